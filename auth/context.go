@@ -29,13 +29,17 @@ type Context struct {
 	err error
 }
 
-// FromContext retrieves the auth.Context from the session.
+// FromContext retrieves the auth.Context from the session. The ID of a new
+// auth.Context defaults to the username of the session's SOCKS5 client, if any.
 func FromContext(ctx *martian.Context) *Context {
 	if v, ok := ctx.Session().Get(key); ok {
 		return v.(*Context)
 	}
 
 	actx := &Context{}
+	if v, ok := ctx.Session().Get(martian.SOCKSUsernameKey); ok {
+		actx.id = v.(string)
+	}
 	ctx.Session().Set(key, actx)
 
 	return actx
@@ -0,0 +1,49 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/google/martian/v3"
+)
+
+func TestFromContextSOCKSUsername(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("NewRequest(): got %v, want no error", err)
+	}
+
+	ctx, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("martian.TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	ctx.Session().Set(martian.SOCKSUsernameKey, "socks-user")
+
+	actx := FromContext(ctx)
+	if got, want := actx.ID(), "socks-user"; got != want {
+		t.Errorf("actx.ID(): got %q, want %q", got, want)
+	}
+
+	// An empty ID, such as from a request without Proxy-Authorization, does not
+	// reset the SOCKS username.
+	actx.SetID("")
+	if got, want := FromContext(ctx).ID(), "socks-user"; got != want {
+		t.Errorf("FromContext(ctx).ID(): got %q, want %q", got, want)
+	}
+}
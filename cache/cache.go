@@ -0,0 +1,949 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cache provides a shared HTTP cache for the proxy that follows
+// RFC 7234.
+//
+// Responses to GET requests are stored when their Cache-Control, Expires and
+// status allow it, keyed by URL and the request headers named by their Vary
+// header. Fresh responses are served without contacting the upstream, and
+// stale responses that carry an ETag or Last-Modified validator are
+// revalidated with a conditional request. Requests with unsafe methods, such
+// as POST, invalidate the stored responses for their URL.
+//
+// The cache is used either as an http.RoundTripper, with NewTransport, or as
+// a request and response modifier of the proxy, with NewModifier.
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/martian/v3/har"
+	"github.com/google/martian/v3/log"
+	"github.com/google/martian/v3/proxyutil"
+)
+
+// DefaultMaxEntrySize is the default size limit of the bodies of stored
+// responses.
+const DefaultMaxEntrySize = 10 << 20
+
+// maxHeuristicLifetime caps the freshness lifetime derived from
+// Last-Modified.
+const maxHeuristicLifetime = 24 * time.Hour
+
+// Status is how the cache handled a request.
+type Status string
+
+const (
+	// Miss is a request sent upstream without a stored response to answer it.
+	Miss Status = "miss"
+	// Hit is a request answered with a fresh stored response, without
+	// contacting the upstream.
+	Hit Status = "hit"
+	// Revalidated is a request answered with a stored response after the
+	// upstream confirmed with 304 Not Modified that it is still valid.
+	Revalidated Status = "revalidated"
+	// Bypass is a request that the cache neither answers nor stores the
+	// response of, such as a POST or a no-store request.
+	Bypass Status = "bypass"
+)
+
+// Entry is a response stored in the cache. Entries are not modified once
+// stored; updates store a copy.
+type Entry struct {
+	// Key is the key of the stored responses for the URL of the request.
+	Key        string      `json:"key"`
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+	// Vary holds the values of the request headers named by the Vary header
+	// of the response, which requests must have to be answered with it.
+	Vary http.Header `json:"vary,omitempty"`
+	// RequestTime is when the request for the response was sent, and
+	// ResponseTime is when the response was received.
+	RequestTime  time.Time `json:"requestTime"`
+	ResponseTime time.Time `json:"responseTime"`
+	// Hits is the number of requests answered with the response, and
+	// LastAccess is when the last of them was answered.
+	Hits       int       `json:"hits"`
+	LastAccess time.Time `json:"lastAccess"`
+}
+
+// size returns the approximate number of bytes held by the response in
+// memory.
+func (e *Entry) size() int64 {
+	n := len(e.Key) + len(e.Body)
+	for _, h := range []http.Header{e.Header, e.Vary} {
+		for k, vs := range h {
+			n += len(k)
+			for _, v := range vs {
+				n += len(v)
+			}
+		}
+	}
+
+	return int64(n)
+}
+
+// Age returns the age of the response at now, as defined by RFC 7234 section
+// 4.2.3.
+func (e *Entry) Age(now time.Time) time.Duration {
+	date, err := http.ParseTime(e.Header.Get("Date"))
+	if err != nil {
+		date = e.ResponseTime
+	}
+
+	apparent := e.ResponseTime.Sub(date)
+	if apparent < 0 {
+		apparent = 0
+	}
+
+	var age time.Duration
+	if secs, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && secs > 0 {
+		age = time.Duration(secs) * time.Second
+	}
+	corrected := age + e.ResponseTime.Sub(e.RequestTime)
+	if corrected < apparent {
+		corrected = apparent
+	}
+
+	return corrected + now.Sub(e.ResponseTime)
+}
+
+// Lifetime returns the freshness lifetime of the response, as defined by RFC
+// 7234 section 4.2.1 for shared caches.
+func (e *Entry) Lifetime() time.Duration {
+	cc := parseCacheControl(e.Header)
+
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+
+	date, err := http.ParseTime(e.Header.Get("Date"))
+	if err != nil {
+		date = e.ResponseTime
+	}
+
+	if exp := e.Header.Get("Expires"); exp != "" {
+		t, err := http.ParseTime(exp)
+		if err != nil || t.Before(date) {
+			return 0
+		}
+		return t.Sub(date)
+	}
+
+	lm, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	if err != nil || !cacheableByDefault[e.StatusCode] || lm.After(date) {
+		return 0
+	}
+
+	d := date.Sub(lm) / 10
+	if d > maxHeuristicLifetime {
+		d = maxHeuristicLifetime
+	}
+	return d
+}
+
+// Expires returns when the response becomes stale.
+func (e *Entry) Expires() time.Time {
+	return e.ResponseTime.Add(e.Lifetime() - e.Age(e.ResponseTime))
+}
+
+// matches returns whether req has the request header values that the stored
+// response was selected with.
+func (e *Entry) matches(req *http.Request) bool {
+	for name, vs := range e.Vary {
+		if strings.Join(req.Header[name], ", ") != strings.Join(vs, ", ") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hasValidators returns whether the response can be revalidated.
+func (e *Entry) hasValidators() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// response returns the stored response as a response to req at now.
+func (e *Entry) response(req *http.Request, now time.Time) *http.Response {
+	res := proxyutil.NewResponse(e.StatusCode, bytes.NewReader(e.Body), req)
+	res.Header = e.Header.Clone()
+	res.ContentLength = int64(len(e.Body))
+	res.Header.Set("Age", strconv.FormatInt(int64(e.Age(now)/time.Second), 10))
+
+	return res
+}
+
+// harEntry returns the state of the stored response for HAR logs.
+func (e *Entry) harEntry() *har.CacheEntry {
+	exp := e.Expires()
+
+	return &har.CacheEntry{
+		Expires:    &exp,
+		LastAccess: e.LastAccess,
+		ETag:       e.Header.Get("ETag"),
+		HitCount:   e.Hits,
+	}
+}
+
+// cacheableByDefault are the status codes of responses that may be stored
+// without explicit freshness information.
+//
+// https://tools.ietf.org/html/rfc7231#section-6.1
+var cacheableByDefault = map[int]bool{
+	200: true,
+	203: true,
+	204: true,
+	300: true,
+	301: true,
+	404: true,
+	405: true,
+	410: true,
+	414: true,
+	501: true,
+}
+
+// Cache is a shared HTTP cache.
+//
+// The hits of stored responses are counted in memory, so that answering a
+// request does not write to the store, and are written to the store with the
+// response when it is next updated.
+type Cache struct {
+	store        Store
+	maxEntrySize int64
+	now          func() time.Time
+
+	// mu serializes updates to the stored responses.
+	mu sync.Mutex
+
+	// hitsMu guards hits, the hits of the stored responses of each key that
+	// are not in the store.
+	hitsMu sync.Mutex
+	hits   map[string][]*hitCount
+}
+
+// hitCount is the hits of a stored response that are not in the store.
+type hitCount struct {
+	responseTime time.Time
+	vary         http.Header
+	hits         int
+	lastAccess   time.Time
+}
+
+// counts returns whether h counts the hits of the stored response e.
+func (h *hitCount) counts(e *Entry) bool {
+	return h.responseTime.Equal(e.ResponseTime) && sameVary(h.vary, e.Vary)
+}
+
+// apply returns a copy of e with the hits of h.
+func (h *hitCount) apply(e *Entry) *Entry {
+	ce := *e
+	ce.Hits += h.hits
+	if h.lastAccess.After(ce.LastAccess) {
+		ce.LastAccess = h.lastAccess
+	}
+
+	return &ce
+}
+
+// New returns a cache that stores responses in s, or in memory if s is nil.
+func New(s Store) *Cache {
+	if s == nil {
+		s = NewMemoryStore()
+	}
+
+	return &Cache{
+		store:        s,
+		maxEntrySize: DefaultMaxEntrySize,
+		now:          time.Now,
+		hits:         make(map[string][]*hitCount),
+	}
+}
+
+// SetMaxEntrySize sets the size limit of the bodies of stored responses;
+// larger responses are not stored. The default is DefaultMaxEntrySize.
+func (c *Cache) SetMaxEntrySize(n int64) {
+	c.maxEntrySize = n
+}
+
+// Entries returns the stored responses.
+func (c *Cache) Entries() ([]*Entry, error) {
+	keys, err := c.store.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*Entry
+	for _, key := range keys {
+		es, err := c.store.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range es {
+			entries = append(entries, c.withHits(e))
+		}
+	}
+
+	return entries, nil
+}
+
+// Purge removes all stored responses.
+func (c *Cache) Purge() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.hitsMu.Lock()
+	c.hits = make(map[string][]*hitCount)
+	c.hitsMu.Unlock()
+
+	return c.store.Purge()
+}
+
+// PurgeURL removes the stored responses for the URL u.
+func (c *Cache) PurgeURL(u *url.URL) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	k := key(u)
+	c.forgetHits(k, nil)
+
+	return c.store.Set(k, nil)
+}
+
+// hit counts a hit at now of the stored response e, and returns e with its
+// hits.
+func (c *Cache) hit(e *Entry, now time.Time) *Entry {
+	c.hitsMu.Lock()
+	defer c.hitsMu.Unlock()
+
+	for _, h := range c.hits[e.Key] {
+		if h.counts(e) {
+			h.hits++
+			h.lastAccess = now
+			return h.apply(e)
+		}
+	}
+
+	h := &hitCount{
+		responseTime: e.ResponseTime,
+		vary:         e.Vary,
+		hits:         1,
+		lastAccess:   now,
+	}
+	c.hits[e.Key] = append(c.hits[e.Key], h)
+
+	return h.apply(e)
+}
+
+// withHits returns the stored response e with its hits.
+func (c *Cache) withHits(e *Entry) *Entry {
+	c.hitsMu.Lock()
+	defer c.hitsMu.Unlock()
+
+	for _, h := range c.hits[e.Key] {
+		if h.counts(e) {
+			return h.apply(e)
+		}
+	}
+
+	return e
+}
+
+// takeHits returns the stored response e with its hits, and stops counting
+// them, so that e is stored with its hits.
+func (c *Cache) takeHits(e *Entry) *Entry {
+	c.hitsMu.Lock()
+	defer c.hitsMu.Unlock()
+
+	hs := c.hits[e.Key]
+	for i, h := range hs {
+		if h.counts(e) {
+			c.hits[e.Key] = append(hs[:i:i], hs[i+1:]...)
+			return h.apply(e)
+		}
+	}
+
+	return e
+}
+
+// forgetHits stops counting the hits of the responses stored under key that
+// are not in entries.
+func (c *Cache) forgetHits(key string, entries []*Entry) {
+	c.hitsMu.Lock()
+	defer c.hitsMu.Unlock()
+
+	var kept []*hitCount
+	for _, h := range c.hits[key] {
+		for _, e := range entries {
+			if h.counts(e) {
+				kept = append(kept, h)
+				break
+			}
+		}
+	}
+
+	if len(kept) == 0 {
+		delete(c.hits, key)
+		return
+	}
+	c.hits[key] = kept
+}
+
+// key returns the key of the stored responses for u.
+func key(u *url.URL) string {
+	ku := *u
+	ku.Fragment = ""
+	ku.RawFragment = ""
+
+	return ku.String()
+}
+
+// lookup is the state of a request handled by the cache.
+type lookup struct {
+	status Status
+	key    string
+	// entry is the stored response that answers the request, or that is
+	// revalidated for it.
+	entry *Entry
+	// before is the state of entry before the request, for HAR logs.
+	before      *har.CacheEntry
+	reqTime     time.Time
+	conditional bool
+	invalidate  bool
+}
+
+// begin looks up the stored response for req.
+func (c *Cache) begin(req *http.Request) *lookup {
+	now := c.now()
+	l := &lookup{
+		status:  Bypass,
+		key:     key(req.URL),
+		reqTime: now,
+	}
+
+	switch req.Method {
+	case "GET":
+	case "HEAD", "OPTIONS", "TRACE":
+		return l
+	default:
+		l.invalidate = true
+		return l
+	}
+
+	reqcc := parseCacheControl(req.Header)
+	if reqcc.has("no-store") || req.Header.Get("Range") != "" {
+		return l
+	}
+	l.status = Miss
+
+	entries, err := c.store.Get(l.key)
+	if err != nil {
+		log.Errorf("cache: failed to read %s: %v", l.key, err)
+		return l
+	}
+	if len(entries) == 0 {
+		// The responses were removed from the store, such as by eviction.
+		c.forgetHits(l.key, nil)
+		return l
+	}
+
+	i := -1
+	for j, e := range entries {
+		if e.matches(req) {
+			i = j
+			break
+		}
+	}
+	if i < 0 {
+		return l
+	}
+	l.entry = c.withHits(entries[i])
+	l.before = l.entry.harEntry()
+
+	if !fresh(l.entry, reqcc, now) {
+		// Requests that carry validators of their own are relayed as is.
+		l.conditional = l.entry.hasValidators() && !isConditional(req)
+		return l
+	}
+
+	l.status = Hit
+	l.entry = c.hit(entries[i], now)
+
+	return l
+}
+
+// fresh returns whether the stored response e may answer a request with the
+// Cache-Control directives reqcc at now without revalidation.
+func fresh(e *Entry, reqcc cacheControl, now time.Time) bool {
+	rescc := parseCacheControl(e.Header)
+	if reqcc.has("no-cache") || rescc.has("no-cache") {
+		return false
+	}
+
+	age := e.Age(now)
+	lifetime := e.Lifetime()
+
+	if d, ok := reqcc.seconds("max-age"); ok && d < lifetime {
+		lifetime = d
+	}
+	if d, ok := reqcc.seconds("min-fresh"); ok {
+		age += d
+	}
+	if age < lifetime {
+		return true
+	}
+
+	if !reqcc.has("max-stale") || rescc.has("must-revalidate") || rescc.has("proxy-revalidate") {
+		return false
+	}
+	if reqcc["max-stale"] == "" {
+		return true
+	}
+	d, ok := reqcc.seconds("max-stale")
+	return ok && age < lifetime+d
+}
+
+// isConditional returns whether req carries validators.
+func isConditional(req *http.Request) bool {
+	return req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != ""
+}
+
+// addValidators adds the validators of the stored response to the request
+// header h.
+func (l *lookup) addValidators(h http.Header) {
+	if etag := l.entry.Header.Get("ETag"); etag != "" {
+		h.Set("If-None-Match", etag)
+	}
+	if lm := l.entry.Header.Get("Last-Modified"); lm != "" {
+		h.Set("If-Modified-Since", lm)
+	}
+}
+
+// errNotRevalidated is returned by finish when the stored response that the
+// cache added validators for is no longer stored once it is revalidated, such
+// as when it was evicted or replaced in the meantime.
+var errNotRevalidated = errors.New("cache: stored response removed while it was revalidated")
+
+// finish handles res, the upstream response to req, and returns the response
+// to send to the client: the stored response if res revalidated it, or res,
+// whose body is stored once read if res is cacheable. The 304 Not Modified
+// response to validators that the client did not send is never returned; if
+// the stored response can not be revalidated, res is closed and
+// errNotRevalidated is returned instead.
+func (c *Cache) finish(l *lookup, req *http.Request, res *http.Response) (*http.Response, error) {
+	now := c.now()
+
+	if l.invalidate {
+		if res.StatusCode < 400 {
+			c.invalidate(req, res)
+		}
+		return res, nil
+	}
+	if l.status == Bypass {
+		return res, nil
+	}
+
+	if l.conditional && res.StatusCode == http.StatusNotModified {
+		res.Body.Close()
+
+		e := c.revalidate(l, res, now)
+		if e == nil {
+			return nil, errNotRevalidated
+		}
+		l.status = Revalidated
+		l.entry = e
+		return e.response(req, now), nil
+	}
+
+	if !storable(req, res) {
+		return res, nil
+	}
+
+	e := &Entry{
+		Key:          l.key,
+		StatusCode:   res.StatusCode,
+		Header:       storedHeader(res.Header),
+		Vary:         varyHeader(req, res),
+		RequestTime:  l.reqTime,
+		ResponseTime: now,
+	}
+	if e.Lifetime() <= 0 && !e.hasValidators() {
+		return res, nil
+	}
+
+	if res.Body == nil || res.Body == http.NoBody || res.ContentLength == 0 {
+		c.put(e)
+		return res, nil
+	}
+	if res.ContentLength > c.maxEntrySize {
+		return res, nil
+	}
+
+	res.Body = &storeBody{
+		ReadCloser: res.Body,
+		limit:      c.maxEntrySize,
+		done: func(body []byte) {
+			e.Body = body
+			c.put(e)
+		},
+	}
+
+	return res, nil
+}
+
+// revalidate updates the stored response of l with the headers of res, a
+// 304 Not Modified response, and returns the updated response, or nil if it
+// is no longer stored.
+//
+// https://tools.ietf.org/html/rfc7234#section-4.3.4
+func (c *Cache) revalidate(l *lookup, res *http.Response, now time.Time) *Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, err := c.store.Get(l.key)
+	if err != nil {
+		log.Errorf("cache: failed to read %s: %v", l.key, err)
+		return nil
+	}
+
+	for i, old := range entries {
+		if !old.ResponseTime.Equal(l.entry.ResponseTime) || !sameVary(old.Vary, l.entry.Vary) {
+			continue
+		}
+
+		e := *c.takeHits(old)
+		e.Header = old.Header.Clone()
+		e.Header.Del("Age")
+		for name, vs := range storedHeader(res.Header) {
+			if name != "Content-Length" {
+				e.Header[name] = vs
+			}
+		}
+		e.RequestTime = l.reqTime
+		e.ResponseTime = now
+		e.Hits++
+		e.LastAccess = now
+
+		entries = append([]*Entry(nil), entries...)
+		entries[i] = &e
+		if err := c.store.Set(l.key, entries); err != nil {
+			log.Errorf("cache: failed to update %s: %v", l.key, err)
+		}
+		return &e
+	}
+
+	return nil
+}
+
+// put stores e, replacing the stored response with the same Vary values.
+func (c *Cache) put(e *Entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, err := c.store.Get(e.Key)
+	if err != nil {
+		log.Errorf("cache: failed to read %s: %v", e.Key, err)
+		return
+	}
+
+	stored := []*Entry{e}
+	for _, old := range entries {
+		if !sameVary(old.Vary, e.Vary) {
+			stored = append(stored, old)
+		}
+	}
+	c.forgetHits(e.Key, stored)
+
+	if err := c.store.Set(e.Key, stored); err != nil {
+		log.Errorf("cache: failed to store %s: %v", e.Key, err)
+	}
+}
+
+// invalidate removes the stored responses for the URL of req, an unsafe
+// request, and for the URLs on the same host in the Location and
+// Content-Location headers of res.
+//
+// https://tools.ietf.org/html/rfc7234#section-4.4
+func (c *Cache) invalidate(req *http.Request, res *http.Response) {
+	keys := []string{key(req.URL)}
+	for _, name := range []string{"Location", "Content-Location"} {
+		v := res.Header.Get(name)
+		if v == "" {
+			continue
+		}
+		u, err := req.URL.Parse(v)
+		if err != nil || u.Host != req.URL.Host {
+			continue
+		}
+		keys = append(keys, key(u))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, k := range keys {
+		c.forgetHits(k, nil)
+		if err := c.store.Set(k, nil); err != nil {
+			log.Errorf("cache: failed to invalidate %s: %v", k, err)
+		}
+	}
+}
+
+// harCache returns the cache state of the request for HAR logs.
+func (l *lookup) harCache() *har.Cache {
+	hc := &har.Cache{
+		Comment: string(l.status),
+	}
+
+	switch l.status {
+	case Hit, Revalidated:
+		hc.BeforeRequest = l.before
+		hc.AfterRequest = l.entry.harEntry()
+	}
+
+	return hc
+}
+
+// storable returns whether res, the response to req, may be stored, as
+// defined by RFC 7234 section 3 for shared caches.
+func storable(req *http.Request, res *http.Response) bool {
+	switch {
+	case res.StatusCode < 200, res.StatusCode == http.StatusPartialContent, res.StatusCode == http.StatusNotModified:
+		return false
+	}
+
+	cc := parseCacheControl(res.Header)
+	if cc.has("no-store") || cc.has("private") {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return false
+	}
+	for _, name := range varyNames(res.Header) {
+		if name == "*" {
+			return false
+		}
+	}
+
+	if cc.has("max-age") || cc.has("s-maxage") || cc.has("public") || res.Header.Get("Expires") != "" {
+		return true
+	}
+	return cacheableByDefault[res.StatusCode]
+}
+
+// varyNames returns the canonical names of the request headers in the Vary
+// header of a response.
+func varyNames(h http.Header) []string {
+	var names []string
+	for _, v := range h["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+
+	return names
+}
+
+// varyHeader returns the values of the request headers of req named by the
+// Vary header of res.
+func varyHeader(req *http.Request, res *http.Response) http.Header {
+	names := varyNames(res.Header)
+	if len(names) == 0 {
+		return nil
+	}
+
+	h := make(http.Header)
+	for _, name := range names {
+		h[name] = append([]string{}, req.Header[name]...)
+	}
+
+	return h
+}
+
+// sameVary returns whether a and b hold the same request header values.
+func sameVary(a, b http.Header) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, vs := range a {
+		if strings.Join(vs, ", ") != strings.Join(b[name], ", ") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hopByHopHeaders are the headers that only apply to a single connection.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Connection",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// storedHeader returns a copy of the response header h without its
+// hop-by-hop headers.
+func storedHeader(h http.Header) http.Header {
+	sh := h.Clone()
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			sh.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		sh.Del(name)
+	}
+
+	return sh
+}
+
+// storeBody is the body of a cacheable response, which is stored once it has
+// been read in full.
+type storeBody struct {
+	io.ReadCloser
+	limit int64
+	done  func([]byte)
+
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	finished bool
+}
+
+func (b *storeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.finished {
+		return n, err
+	}
+	if int64(b.buf.Len()+n) > b.limit {
+		b.finished = true
+		b.buf = bytes.Buffer{}
+		return n, err
+	}
+	b.buf.Write(p[:n])
+
+	switch {
+	case err == io.EOF:
+		b.finished = true
+		b.done(b.buf.Bytes())
+	case err != nil:
+		b.finished = true
+	}
+
+	return n, err
+}
+
+func (b *storeBody) Close() error {
+	b.mu.Lock()
+	b.finished = true
+	b.mu.Unlock()
+
+	return b.ReadCloser.Close()
+}
+
+// cacheControl holds the directives of Cache-Control headers by lowercase
+// name. Directives without an argument have empty values.
+type cacheControl map[string]string
+
+// parseCacheControl returns the Cache-Control directives of h, or the
+// no-cache directive of its Pragma header if it has none.
+func parseCacheControl(h http.Header) cacheControl {
+	cc := make(cacheControl)
+	for _, v := range h["Cache-Control"] {
+		for _, d := range splitDirectives(v) {
+			name, arg := d, ""
+			if i := strings.Index(d, "="); i >= 0 {
+				name, arg = d[:i], strings.Trim(strings.TrimSpace(d[i+1:]), `"`)
+			}
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			if _, ok := cc[name]; !ok {
+				cc[name] = arg
+			}
+		}
+	}
+
+	if len(cc) == 0 && strings.Contains(strings.ToLower(h.Get("Pragma")), "no-cache") {
+		cc["no-cache"] = ""
+	}
+
+	return cc
+}
+
+// splitDirectives splits a Cache-Control header value on the commas that are
+// not in quoted strings.
+func splitDirectives(v string) []string {
+	var ds []string
+	var quoted bool
+	start := 0
+	for i := 0; i < len(v); i++ {
+		switch v[i] {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				ds = append(ds, v[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(ds, v[start:])
+}
+
+// has returns whether the directive is present.
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds returns the delta-seconds argument of the directive.
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	v, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+
+	secs, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || secs < 0 {
+		return 0, false
+	}
+
+	return time.Duration(secs) * time.Second, true
+}
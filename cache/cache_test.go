@@ -0,0 +1,521 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/martian/v3/martiantest"
+	"github.com/google/martian/v3/proxyutil"
+)
+
+// origin is a fake upstream that answers requests with a handler and counts
+// them.
+type origin struct {
+	calls   int
+	handler func(req *http.Request) *http.Response
+}
+
+func (o *origin) transport() *martiantest.Transport {
+	tr := martiantest.NewTransport()
+	tr.Func(func(req *http.Request) (*http.Response, error) {
+		o.calls++
+		return o.handler(req), nil
+	})
+
+	return tr
+}
+
+// newResponse returns a response to req with the status, body and header
+// key/value pairs.
+func newResponse(req *http.Request, status int, body string, kvs ...string) *http.Response {
+	res := proxyutil.NewResponse(status, strings.NewReader(body), req)
+	res.ContentLength = int64(len(body))
+	for i := 0; i < len(kvs); i += 2 {
+		res.Header.Add(kvs[i], kvs[i+1])
+	}
+
+	return res
+}
+
+// fakeClock returns a cache with a clock that only moves when advanced.
+func fakeClock(c *Cache) func(time.Duration) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	return func(d time.Duration) { now = now.Add(d) }
+}
+
+// get sends a GET request for u through tr with the header key/value pairs,
+// and returns the response with its body read.
+func get(t *testing.T, tr http.RoundTripper, u string, kvs ...string) (*http.Response, string) {
+	t.Helper()
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	for i := 0; i < len(kvs); i += 2 {
+		req.Header.Add(kvs[i], kvs[i+1])
+	}
+
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip(): got %v, want no error", err)
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+
+	return res, string(body)
+}
+
+func TestTransportFreshness(t *testing.T) {
+	o := &origin{
+		handler: func(req *http.Request) *http.Response {
+			return newResponse(req, 200, "hello", "Cache-Control", "max-age=60")
+		},
+	}
+	c := New(nil)
+	advance := fakeClock(c)
+	tr := NewTransport(c, o.transport())
+
+	if _, body := get(t, tr, "http://example.com/a"); body != "hello" {
+		t.Fatalf("body: got %q, want %q", body, "hello")
+	}
+
+	advance(30 * time.Second)
+	res, body := get(t, tr, "http://example.com/a")
+	if got, want := o.calls, 1; got != want {
+		t.Errorf("o.calls: got %d, want %d", got, want)
+	}
+	if got, want := body, "hello"; got != want {
+		t.Errorf("body: got %q, want %q", got, want)
+	}
+	if got, want := res.Header.Get("Age"), "30"; got != want {
+		t.Errorf("res.Header.Get(%q): got %q, want %q", "Age", got, want)
+	}
+
+	// The fragment is not part of the key.
+	get(t, tr, "http://example.com/a#fragment")
+	if got, want := o.calls, 1; got != want {
+		t.Errorf("o.calls: got %d, want %d", got, want)
+	}
+
+	// A request may refuse responses older than it allows.
+	get(t, tr, "http://example.com/a", "Cache-Control", "max-age=10")
+	if got, want := o.calls, 2; got != want {
+		t.Errorf("o.calls: got %d, want %d", got, want)
+	}
+
+	advance(61 * time.Second)
+	get(t, tr, "http://example.com/a")
+	if got, want := o.calls, 3; got != want {
+		t.Errorf("o.calls: got %d, want %d after expiry", got, want)
+	}
+}
+
+func TestTransportRevalidation(t *testing.T) {
+	o := &origin{
+		handler: func(req *http.Request) *http.Response {
+			if req.Header.Get("If-None-Match") == `"v1"` {
+				return newResponse(req, 304, "", "ETag", `"v1"`, "X-Revalidated", "true")
+			}
+			return newResponse(req, 200, "hello", "ETag", `"v1"`, "Cache-Control", "no-cache")
+		},
+	}
+	c := New(nil)
+	fakeClock(c)
+	tr := NewTransport(c, o.transport())
+
+	get(t, tr, "http://example.com/a")
+
+	res, body := get(t, tr, "http://example.com/a")
+	if got, want := o.calls, 2; got != want {
+		t.Errorf("o.calls: got %d, want %d", got, want)
+	}
+	if got, want := res.StatusCode, 200; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+	if got, want := body, "hello"; got != want {
+		t.Errorf("body: got %q, want %q", got, want)
+	}
+	if got, want := res.Header.Get("X-Revalidated"), "true"; got != want {
+		t.Errorf("res.Header.Get(%q): got %q, want %q", "X-Revalidated", got, want)
+	}
+
+	// Conditional requests of the client are relayed as is.
+	res, _ = get(t, tr, "http://example.com/a", "If-None-Match", `"v1"`)
+	if got, want := res.StatusCode, 304; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+
+	entries, err := c.Entries()
+	if err != nil {
+		t.Fatalf("c.Entries(): got %v, want no error", err)
+	}
+	if got, want := len(entries), 1; got != want {
+		t.Fatalf("len(entries): got %d, want %d", got, want)
+	}
+	if got, want := entries[0].Hits, 1; got != want {
+		t.Errorf("entries[0].Hits: got %d, want %d", got, want)
+	}
+}
+
+func TestTransportRevalidationEvicted(t *testing.T) {
+	c := New(nil)
+	fakeClock(c)
+
+	// The stored response is evicted while it is revalidated.
+	var conditional []bool
+	o := &origin{
+		handler: func(req *http.Request) *http.Response {
+			conditional = append(conditional, isConditional(req))
+			if req.Header.Get("If-None-Match") == `"v1"` {
+				c.Purge()
+				return newResponse(req, 304, "", "ETag", `"v1"`)
+			}
+			return newResponse(req, 200, "hello", "ETag", `"v1"`, "Cache-Control", "no-cache")
+		},
+	}
+	tr := NewTransport(c, o.transport())
+
+	get(t, tr, "http://example.com/a")
+
+	res, body := get(t, tr, "http://example.com/a")
+	if got, want := conditional, []bool{false, true, false}; !reflect.DeepEqual(got, want) {
+		t.Errorf("conditional requests: got %v, want %v", got, want)
+	}
+	if got, want := res.StatusCode, 200; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+	if got, want := body, "hello"; got != want {
+		t.Errorf("body: got %q, want %q", got, want)
+	}
+}
+
+// setCounter is a store that counts the calls to Set.
+type setCounter struct {
+	Store
+	sets int
+}
+
+func (s *setCounter) Set(key string, entries []*Entry) error {
+	s.sets++
+	return s.Store.Set(key, entries)
+}
+
+func TestTransportHitsNotStored(t *testing.T) {
+	o := &origin{
+		handler: func(req *http.Request) *http.Response {
+			return newResponse(req, 200, "hello", "Cache-Control", "max-age=60", "ETag", `"v1"`)
+		},
+	}
+	store := &setCounter{Store: NewMemoryStore()}
+	c := New(store)
+	advance := fakeClock(c)
+	tr := NewTransport(c, o.transport())
+
+	for i := 0; i < 3; i++ {
+		get(t, tr, "http://example.com/a")
+	}
+	if got, want := store.sets, 1; got != want {
+		t.Errorf("store.sets: got %d, want %d", got, want)
+	}
+
+	entries, err := c.Entries()
+	if err != nil {
+		t.Fatalf("c.Entries(): got %v, want no error", err)
+	}
+	if got, want := entries[0].Hits, 2; got != want {
+		t.Errorf("entries[0].Hits: got %d, want %d", got, want)
+	}
+
+	// The hits are stored with the response when it is revalidated.
+	advance(2 * time.Minute)
+	o.handler = func(req *http.Request) *http.Response {
+		return newResponse(req, 304, "")
+	}
+	get(t, tr, "http://example.com/a")
+
+	stored, err := store.Get("http://example.com/a")
+	if err != nil {
+		t.Fatalf("store.Get(): got %v, want no error", err)
+	}
+	if got, want := stored[0].Hits, 3; got != want {
+		t.Errorf("stored[0].Hits: got %d, want %d", got, want)
+	}
+	entries, _ = c.Entries()
+	if got, want := entries[0].Hits, 3; got != want {
+		t.Errorf("entries[0].Hits: got %d, want %d", got, want)
+	}
+}
+
+func TestTransportVary(t *testing.T) {
+	o := &origin{
+		handler: func(req *http.Request) *http.Response {
+			return newResponse(req, 200, "lang="+req.Header.Get("Accept-Language"),
+				"Cache-Control", "max-age=60", "Vary", "accept-language")
+		},
+	}
+	c := New(nil)
+	fakeClock(c)
+	tr := NewTransport(c, o.transport())
+
+	get(t, tr, "http://example.com/a", "Accept-Language", "en")
+	get(t, tr, "http://example.com/a", "Accept-Language", "fr")
+
+	if _, body := get(t, tr, "http://example.com/a", "Accept-Language", "en"); body != "lang=en" {
+		t.Errorf("body: got %q, want %q", body, "lang=en")
+	}
+	if _, body := get(t, tr, "http://example.com/a", "Accept-Language", "fr"); body != "lang=fr" {
+		t.Errorf("body: got %q, want %q", body, "lang=fr")
+	}
+	if got, want := o.calls, 2; got != want {
+		t.Errorf("o.calls: got %d, want %d", got, want)
+	}
+}
+
+func TestTransportNotStored(t *testing.T) {
+	tt := []struct {
+		name   string
+		reqkvs []string
+		reskvs []string
+		status int
+	}{
+		{
+			name:   "no-store response",
+			reskvs: []string{"Cache-Control", "max-age=60, no-store"},
+		},
+		{
+			name:   "private response",
+			reskvs: []string{"Cache-Control", "private, max-age=60"},
+		},
+		{
+			name:   "no-store request",
+			reqkvs: []string{"Cache-Control", "no-store"},
+			reskvs: []string{"Cache-Control", "max-age=60"},
+		},
+		{
+			name:   "authorized request",
+			reqkvs: []string{"Authorization", "Basic Zm9vOmJhcg=="},
+			reskvs: []string{"Cache-Control", "max-age=60"},
+		},
+		{
+			name:   "vary star",
+			reskvs: []string{"Cache-Control", "max-age=60", "Vary", "*"},
+		},
+		{
+			name:   "no freshness or validators",
+			reskvs: []string{"Content-Type", "text/plain"},
+		},
+		{
+			name:   "uncacheable status",
+			reskvs: []string{"Last-Modified", "Fri, 01 Jan 2021 00:00:00 GMT"},
+			status: 500,
+		},
+		{
+			name:   "invalid expires",
+			reskvs: []string{"Expires", "0"},
+		},
+	}
+
+	for _, tc := range tt {
+		status := tc.status
+		if status == 0 {
+			status = 200
+		}
+		o := &origin{
+			handler: func(req *http.Request) *http.Response {
+				return newResponse(req, status, "hello", tc.reskvs...)
+			},
+		}
+		c := New(nil)
+		fakeClock(c)
+		tr := NewTransport(c, o.transport())
+
+		get(t, tr, "http://example.com/a", tc.reqkvs...)
+		get(t, tr, "http://example.com/a", tc.reqkvs...)
+
+		if got, want := o.calls, 2; got != want {
+			t.Errorf("%s: o.calls: got %d, want %d", tc.name, got, want)
+		}
+	}
+}
+
+func TestTransportInvalidation(t *testing.T) {
+	o := &origin{
+		handler: func(req *http.Request) *http.Response {
+			if req.Method == "POST" {
+				return newResponse(req, 201, "", "Location", "/b")
+			}
+			return newResponse(req, 200, "hello", "Cache-Control", "max-age=60")
+		},
+	}
+	c := New(nil)
+	fakeClock(c)
+	tr := NewTransport(c, o.transport())
+
+	get(t, tr, "http://example.com/a")
+	get(t, tr, "http://example.com/b")
+	get(t, tr, "http://example.com/c")
+
+	req, err := http.NewRequest("POST", "http://example.com/a", strings.NewReader("data"))
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip(): got %v, want no error", err)
+	}
+	res.Body.Close()
+
+	keys, err := c.store.Keys()
+	if err != nil {
+		t.Fatalf("c.store.Keys(): got %v, want no error", err)
+	}
+	if got, want := strings.Join(keys, " "), "http://example.com/c"; got != want {
+		t.Errorf("c.store.Keys(): got %q, want %q", got, want)
+	}
+}
+
+func TestTransportMaxEntrySize(t *testing.T) {
+	o := &origin{
+		handler: func(req *http.Request) *http.Response {
+			res := newResponse(req, 200, strings.TrimPrefix(req.URL.Path, "/"), "Cache-Control", "max-age=60")
+			res.ContentLength = -1
+			return res
+		},
+	}
+	c := New(nil)
+	fakeClock(c)
+	c.SetMaxEntrySize(5)
+	tr := NewTransport(c, o.transport())
+
+	get(t, tr, "http://example.com/small")
+	get(t, tr, "http://example.com/toolarge")
+
+	keys, err := c.store.Keys()
+	if err != nil {
+		t.Fatalf("c.store.Keys(): got %v, want no error", err)
+	}
+	if got, want := strings.Join(keys, " "), "http://example.com/small"; got != want {
+		t.Errorf("c.store.Keys(): got %q, want %q", got, want)
+	}
+}
+
+func TestEntryLifetime(t *testing.T) {
+	date := "Fri, 01 Jan 2021 00:00:00 GMT"
+
+	tt := []struct {
+		name   string
+		status int
+		kvs    []string
+		want   time.Duration
+	}{
+		{
+			name: "s-maxage",
+			kvs:  []string{"Cache-Control", "max-age=10, s-maxage=20"},
+			want: 20 * time.Second,
+		},
+		{
+			name: "max-age",
+			kvs:  []string{"Cache-Control", `max-age="10"`, "Expires", "Fri, 01 Jan 2021 01:00:00 GMT"},
+			want: 10 * time.Second,
+		},
+		{
+			name: "expires",
+			kvs:  []string{"Expires", "Fri, 01 Jan 2021 01:00:00 GMT"},
+			want: time.Hour,
+		},
+		{
+			name: "invalid expires",
+			kvs:  []string{"Expires", "-1"},
+		},
+		{
+			name: "heuristic",
+			kvs:  []string{"Last-Modified", "Thu, 31 Dec 2020 14:00:00 GMT"},
+			want: time.Hour,
+		},
+		{
+			name:   "heuristic for uncacheable status",
+			status: 500,
+			kvs:    []string{"Last-Modified", "Thu, 31 Dec 2020 14:00:00 GMT"},
+		},
+	}
+
+	for _, tc := range tt {
+		e := &Entry{
+			StatusCode: 200,
+			Header:     http.Header{"Date": []string{date}},
+		}
+		if tc.status != 0 {
+			e.StatusCode = tc.status
+		}
+		for i := 0; i < len(tc.kvs); i += 2 {
+			e.Header.Set(tc.kvs[i], tc.kvs[i+1])
+		}
+
+		if got := e.Lifetime(); got != tc.want {
+			t.Errorf("%s: e.Lifetime(): got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestEntryAge(t *testing.T) {
+	sent := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	e := &Entry{
+		Header: http.Header{
+			"Date": []string{"Fri, 01 Jan 2021 00:00:00 GMT"},
+			"Age":  []string{"5"},
+		},
+		RequestTime:  sent,
+		ResponseTime: sent.Add(2 * time.Second),
+	}
+
+	if got, want := e.Age(sent.Add(10*time.Second)), 15*time.Second; got != want {
+		t.Errorf("e.Age(): got %v, want %v", got, want)
+	}
+}
+
+func TestParseCacheControl(t *testing.T) {
+	h := http.Header{
+		"Cache-Control": []string{`No-Cache="Set-Cookie, X-Foo", max-age=60`, "public"},
+	}
+
+	cc := parseCacheControl(h)
+	if got, want := cc["no-cache"], "Set-Cookie, X-Foo"; got != want {
+		t.Errorf("cc[%q]: got %q, want %q", "no-cache", got, want)
+	}
+	if d, ok := cc.seconds("max-age"); !ok || d != time.Minute {
+		t.Errorf("cc.seconds(%q): got %v, %t, want %v, true", "max-age", d, ok, time.Minute)
+	}
+	if !cc.has("public") {
+		t.Errorf("cc.has(%q): got false, want true", "public")
+	}
+
+	cc = parseCacheControl(http.Header{"Pragma": []string{"no-cache"}})
+	if !cc.has("no-cache") {
+		t.Errorf("cc.has(%q): got false, want true for Pragma", "no-cache")
+	}
+}
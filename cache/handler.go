@@ -0,0 +1,127 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/martian/v3/log"
+)
+
+type handler struct {
+	cache *Cache
+}
+
+// NewHandler returns an http.Handler that lists the responses stored in c, as
+// JSON without their bodies, for GET requests, and purges them for DELETE
+// requests. A url query parameter limits the purge to the responses for that
+// URL.
+func NewHandler(c *Cache) http.Handler {
+	return &handler{
+		cache: c,
+	}
+}
+
+// entryJSON describes a stored response.
+type entryJSON struct {
+	URL          string      `json:"url"`
+	StatusCode   int         `json:"statusCode"`
+	Size         int         `json:"size"`
+	Vary         http.Header `json:"vary,omitempty"`
+	ETag         string      `json:"etag,omitempty"`
+	LastModified string      `json:"lastModified,omitempty"`
+	Stored       time.Time   `json:"stored"`
+	Expires      time.Time   `json:"expires"`
+	Fresh        bool        `json:"fresh"`
+	Hits         int         `json:"hits"`
+	LastAccess   *time.Time  `json:"lastAccess,omitempty"`
+}
+
+// ServeHTTP lists or purges the stored responses.
+func (h *handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		h.list(rw)
+	case "DELETE":
+		h.purge(rw, req)
+	default:
+		rw.Header().Set("Allow", "GET, DELETE")
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		log.Errorf("cache: method not allowed: %s", req.Method)
+	}
+}
+
+func (h *handler) list(rw http.ResponseWriter) {
+	entries, err := h.cache.Entries()
+	if err != nil {
+		log.Errorf("cache: failed to list entries: %v", err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	now := h.cache.now()
+	ejs := make([]entryJSON, 0, len(entries))
+	for _, e := range entries {
+		ej := entryJSON{
+			URL:          e.Key,
+			StatusCode:   e.StatusCode,
+			Size:         len(e.Body),
+			Vary:         e.Vary,
+			ETag:         e.Header.Get("ETag"),
+			LastModified: e.Header.Get("Last-Modified"),
+			Stored:       e.ResponseTime,
+			Expires:      e.Expires(),
+			Fresh:        e.Age(now) < e.Lifetime(),
+			Hits:         e.Hits,
+		}
+		if !e.LastAccess.IsZero() {
+			la := e.LastAccess
+			ej.LastAccess = &la
+		}
+		ejs = append(ejs, ej)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(map[string]interface{}{
+		"entries": ejs,
+	}); err != nil {
+		log.Errorf("cache: failed to write entries: %v", err)
+	}
+}
+
+func (h *handler) purge(rw http.ResponseWriter, req *http.Request) {
+	var err error
+	if raw := req.URL.Query().Get("url"); raw != "" {
+		var u *url.URL
+		if u, err = url.Parse(raw); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = h.cache.PurgeURL(u)
+	} else {
+		err = h.cache.Purge()
+	}
+
+	if err != nil {
+		log.Errorf("cache: failed to purge: %v", err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
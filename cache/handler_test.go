@@ -0,0 +1,104 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	o := &origin{
+		handler: func(req *http.Request) *http.Response {
+			return newResponse(req, 200, "hello", "Cache-Control", "max-age=60", "ETag", `"v1"`)
+		},
+	}
+	c := New(nil)
+	fakeClock(c)
+	tr := NewTransport(c, o.transport())
+
+	get(t, tr, "http://example.com/a")
+	get(t, tr, "http://example.com/a")
+	get(t, tr, "http://example.com/b")
+
+	h := NewHandler(c)
+
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, target, nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest(): got %v, want no error", err)
+		}
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw := serve("GET", "/cache")
+	if got, want := rw.Code, 200; got != want {
+		t.Fatalf("rw.Code: got %d, want %d", got, want)
+	}
+
+	var list struct {
+		Entries []entryJSON `json:"entries"`
+	}
+	if err := json.Unmarshal(rw.Body.Bytes(), &list); err != nil {
+		t.Fatalf("json.Unmarshal(): got %v, want no error", err)
+	}
+	if got, want := len(list.Entries), 2; got != want {
+		t.Fatalf("len(list.Entries): got %d, want %d", got, want)
+	}
+	e := list.Entries[0]
+	if got, want := e.URL, "http://example.com/a"; got != want {
+		t.Errorf("e.URL: got %q, want %q", got, want)
+	}
+	if got, want := e.Size, 5; got != want {
+		t.Errorf("e.Size: got %d, want %d", got, want)
+	}
+	if got, want := e.ETag, `"v1"`; got != want {
+		t.Errorf("e.ETag: got %q, want %q", got, want)
+	}
+	if got, want := e.Hits, 1; got != want {
+		t.Errorf("e.Hits: got %d, want %d", got, want)
+	}
+	if !e.Fresh {
+		t.Errorf("e.Fresh: got false, want true")
+	}
+
+	rw = serve("DELETE", "/cache?url="+url.QueryEscape("http://example.com/a"))
+	if got, want := rw.Code, 204; got != want {
+		t.Errorf("rw.Code: got %d, want %d", got, want)
+	}
+	entries, _ := c.Entries()
+	if got, want := len(entries), 1; got != want {
+		t.Errorf("len(c.Entries()): got %d, want %d", got, want)
+	}
+
+	rw = serve("DELETE", "/cache")
+	if got, want := rw.Code, 204; got != want {
+		t.Errorf("rw.Code: got %d, want %d", got, want)
+	}
+	entries, _ = c.Entries()
+	if got := len(entries); got != 0 {
+		t.Errorf("len(c.Entries()): got %d, want 0", got)
+	}
+
+	rw = serve("POST", "/cache")
+	if got, want := rw.Code, 405; got != want {
+		t.Errorf("rw.Code: got %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"net/http"
+
+	"github.com/google/martian/v3"
+	"github.com/google/martian/v3/har"
+	"github.com/google/martian/v3/proxyutil"
+)
+
+// lookupKey is the martian context key of the *lookup of a request.
+const lookupKey = "cache.lookup"
+
+// Modifier answers requests from a cache as a request and response modifier
+// of the proxy. Fresh stored responses skip the round trip, and stale ones
+// are revalidated by adding validators to the request.
+//
+// The request modifier should run after any modifier that changes the URL or
+// headers of the request, and the response modifier before any modifier that
+// reads or changes the response, including loggers, since the response of a
+// hit is only set by it. The cache state of each request is recorded in its
+// context for HAR logs.
+type Modifier struct {
+	cache *Cache
+}
+
+// NewModifier returns a modifier that caches responses in c.
+func NewModifier(c *Cache) *Modifier {
+	return &Modifier{
+		cache: c,
+	}
+}
+
+// ModifyRequest looks up the stored response for req, skipping the round
+// trip if it is fresh.
+func (m *Modifier) ModifyRequest(req *http.Request) error {
+	ctx := martian.NewContext(req)
+	if ctx == nil {
+		return nil
+	}
+
+	l := m.cache.begin(req)
+	ctx.Set(lookupKey, l)
+
+	switch {
+	case l.status == Hit:
+		ctx.SkipRoundTrip()
+	case l.conditional:
+		l.addValidators(req.Header)
+	}
+
+	return nil
+}
+
+// ModifyResponse replaces res with the stored response for hits and
+// successful revalidations, and stores res if it is cacheable. If the stored
+// response was removed while it was revalidated, the 304 Not Modified
+// response to the validators added by the cache is replaced with a 502 Bad
+// Gateway and an error is returned, since the request can not be sent again.
+func (m *Modifier) ModifyResponse(res *http.Response) error {
+	ctx := martian.NewContext(res.Request)
+	if ctx == nil {
+		return nil
+	}
+	v, ok := ctx.Get(lookupKey)
+	if !ok {
+		return nil
+	}
+	l := v.(*lookup)
+
+	var nres *http.Response
+	var err error
+	if l.status == Hit {
+		res.Body.Close()
+		nres = l.entry.response(res.Request, m.cache.now())
+	} else {
+		nres, err = m.cache.finish(l, res.Request, res)
+		if err != nil {
+			nres = proxyutil.NewResponse(http.StatusBadGateway, nil, res.Request)
+		}
+	}
+	if nres != res {
+		*res = *nres
+	}
+
+	if l.status != Bypass {
+		ctx.Set(har.CacheContextKey, l.harCache())
+	}
+
+	return err
+}
@@ -0,0 +1,206 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/google/martian/v3"
+	"github.com/google/martian/v3/har"
+	"github.com/google/martian/v3/proxyutil"
+)
+
+// roundTrip runs req through the cache modifier and the HAR logger as the
+// proxy would, sending it to o unless the round trip is skipped.
+func roundTrip(t *testing.T, m *Modifier, hl *har.Logger, o *origin, req *http.Request) (*http.Response, string) {
+	t.Helper()
+
+	ctx, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("martian.TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	if err := m.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+	if err := hl.ModifyRequest(req); err != nil {
+		t.Fatalf("hl.ModifyRequest(): got %v, want no error", err)
+	}
+
+	var res *http.Response
+	if ctx.SkippingRoundTrip() {
+		res = proxyutil.NewResponse(200, nil, req)
+	} else {
+		o.calls++
+		res = o.handler(req)
+	}
+
+	if err := m.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+	if err := hl.ModifyResponse(res); err != nil {
+		t.Fatalf("hl.ModifyResponse(): got %v, want no error", err)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	res.Body.Close()
+
+	return res, string(body)
+}
+
+func TestModifier(t *testing.T) {
+	o := &origin{
+		handler: func(req *http.Request) *http.Response {
+			if req.Header.Get("If-None-Match") == `"v1"` {
+				return newResponse(req, 304, "", "ETag", `"v1"`)
+			}
+			return newResponse(req, 200, "hello", "Cache-Control", "max-age=60", "ETag", `"v1"`)
+		},
+	}
+	c := New(nil)
+	fakeClock(c)
+	m := NewModifier(c)
+	hl := har.NewLogger()
+
+	newRequest := func(kvs ...string) *http.Request {
+		req, err := http.NewRequest("GET", "http://example.com/a", nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest(): got %v, want no error", err)
+		}
+		for i := 0; i < len(kvs); i += 2 {
+			req.Header.Set(kvs[i], kvs[i+1])
+		}
+		return req
+	}
+
+	if _, body := roundTrip(t, m, hl, o, newRequest()); body != "hello" {
+		t.Errorf("body: got %q, want %q", body, "hello")
+	}
+
+	res, body := roundTrip(t, m, hl, o, newRequest())
+	if got, want := o.calls, 1; got != want {
+		t.Errorf("o.calls: got %d, want %d", got, want)
+	}
+	if got, want := body, "hello"; got != want {
+		t.Errorf("body: got %q, want %q", got, want)
+	}
+	if got, want := res.Header.Get("ETag"), `"v1"`; got != want {
+		t.Errorf("res.Header.Get(%q): got %q, want %q", "ETag", got, want)
+	}
+
+	// The request forces revalidation.
+	res, body = roundTrip(t, m, hl, o, newRequest("Cache-Control", "no-cache"))
+	if got, want := o.calls, 2; got != want {
+		t.Errorf("o.calls: got %d, want %d", got, want)
+	}
+	if got, want := res.StatusCode, 200; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+	if got, want := body, "hello"; got != want {
+		t.Errorf("body: got %q, want %q", got, want)
+	}
+
+	entries := hl.Export().Log.Entries
+	if got, want := len(entries), 3; got != want {
+		t.Fatalf("len(entries): got %d, want %d", got, want)
+	}
+
+	if got, want := entries[0].Cache.Comment, "miss"; got != want {
+		t.Errorf("entries[0].Cache.Comment: got %q, want %q", got, want)
+	}
+	if entries[0].Cache.BeforeRequest != nil {
+		t.Errorf("entries[0].Cache.BeforeRequest: got %+v, want nil", entries[0].Cache.BeforeRequest)
+	}
+
+	hit := entries[1].Cache
+	if got, want := hit.Comment, "hit"; got != want {
+		t.Errorf("entries[1].Cache.Comment: got %q, want %q", got, want)
+	}
+	if hit.BeforeRequest == nil || hit.AfterRequest == nil {
+		t.Fatalf("entries[1].Cache: got %+v, want before and after request states", hit)
+	}
+	if got, want := hit.BeforeRequest.HitCount, 0; got != want {
+		t.Errorf("hit.BeforeRequest.HitCount: got %d, want %d", got, want)
+	}
+	if got, want := hit.AfterRequest.HitCount, 1; got != want {
+		t.Errorf("hit.AfterRequest.HitCount: got %d, want %d", got, want)
+	}
+	if got, want := hit.AfterRequest.ETag, `"v1"`; got != want {
+		t.Errorf("hit.AfterRequest.ETag: got %q, want %q", got, want)
+	}
+	if got, want := entries[1].Response.Content.Text, []byte("hello"); string(got) != string(want) {
+		t.Errorf("entries[1].Response.Content.Text: got %q, want %q", got, want)
+	}
+
+	if got, want := entries[2].Cache.Comment, "revalidated"; got != want {
+		t.Errorf("entries[2].Cache.Comment: got %q, want %q", got, want)
+	}
+}
+
+func TestModifierRevalidationEvicted(t *testing.T) {
+	c := New(nil)
+	fakeClock(c)
+	m := NewModifier(c)
+	hl := har.NewLogger()
+
+	o := &origin{
+		handler: func(req *http.Request) *http.Response {
+			return newResponse(req, 200, "hello", "ETag", `"v1"`, "Cache-Control", "no-cache")
+		},
+	}
+
+	req, err := http.NewRequest("GET", "http://example.com/a", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	roundTrip(t, m, hl, o, req)
+
+	req, err = http.NewRequest("GET", "http://example.com/a", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	_, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("martian.TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	if err := m.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+	if got, want := req.Header.Get("If-None-Match"), `"v1"`; got != want {
+		t.Fatalf("req.Header.Get(%q): got %q, want %q", "If-None-Match", got, want)
+	}
+
+	// The stored response is evicted while it is revalidated, so the 304
+	// answers validators that the client did not send.
+	if err := c.Purge(); err != nil {
+		t.Fatalf("c.Purge(): got %v, want no error", err)
+	}
+	res := newResponse(req, 304, "", "ETag", `"v1"`)
+
+	if err := m.ModifyResponse(res); err != errNotRevalidated {
+		t.Errorf("ModifyResponse(): got %v, want %v", err, errNotRevalidated)
+	}
+	if got, want := res.StatusCode, 502; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+}
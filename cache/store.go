@@ -0,0 +1,311 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Store holds the responses of a cache by key. A key holds the responses for
+// a URL, one for each set of request header values that they vary on.
+type Store interface {
+	// Get returns the responses stored under key, or nil if there are none.
+	Get(key string) ([]*Entry, error)
+	// Set replaces the responses stored under key with entries, removing the
+	// key if entries is empty.
+	Set(key string, entries []*Entry) error
+	// Keys returns the keys that hold responses.
+	Keys() ([]string, error)
+	// Purge removes all responses.
+	Purge() error
+}
+
+// DefaultMemoryStoreMaxSize is the default maximum total size of the
+// responses held by a MemoryStore.
+const DefaultMemoryStoreMaxSize = 256 << 20
+
+// MemoryStore is a Store that holds responses in memory. When the responses
+// exceed the maximum size of the store, the least recently used keys are
+// evicted.
+type MemoryStore struct {
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	// lru holds the *memoryKey of every key, the most recently used first.
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+// memoryKey is the responses stored under a key of a MemoryStore.
+type memoryKey struct {
+	key     string
+	entries []*Entry
+	size    int64
+}
+
+// NewMemoryStore returns an empty in-memory store that holds up to
+// DefaultMemoryStoreMaxSize bytes of responses.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		maxSize: DefaultMemoryStoreMaxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// SetMaxSize sets the maximum total size in bytes of the responses held by
+// the store, evicting the least recently used keys to fit. If n is zero, the
+// size is not limited.
+func (s *MemoryStore) SetMaxSize(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.maxSize = n
+	s.evict()
+}
+
+// Get returns the responses stored under key, marking it recently used.
+func (s *MemoryStore) Get(key string) ([]*Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	s.lru.MoveToFront(el)
+
+	return el.Value.(*memoryKey).entries, nil
+}
+
+// Set replaces the responses stored under key, marking it recently used.
+func (s *MemoryStore) Set(key string, entries []*Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.entries[key]; ok {
+		s.remove(el)
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	mk := &memoryKey{key: key, entries: entries}
+	for _, e := range entries {
+		mk.size += e.size()
+	}
+	// Responses that can never fit do not evict the others.
+	if s.maxSize > 0 && mk.size > s.maxSize {
+		return nil
+	}
+	s.entries[key] = s.lru.PushFront(mk)
+	s.size += mk.size
+	s.evict()
+
+	return nil
+}
+
+// Keys returns the keys that hold responses, sorted.
+func (s *MemoryStore) Keys() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.entries))
+	for k := range s.entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// Purge removes all responses.
+func (s *MemoryStore) Purge() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lru.Init()
+	s.entries = make(map[string]*list.Element)
+	s.size = 0
+
+	return nil
+}
+
+// evict removes the least recently used keys until the responses fit in the
+// maximum size. It must be called with s.mu held.
+func (s *MemoryStore) evict() {
+	for s.maxSize > 0 && s.size > s.maxSize {
+		s.remove(s.lru.Back())
+	}
+}
+
+// remove removes the key of el. It must be called with s.mu held.
+func (s *MemoryStore) remove(el *list.Element) {
+	mk := s.lru.Remove(el).(*memoryKey)
+	delete(s.entries, mk.key)
+	s.size -= mk.size
+}
+
+// diskExt is the extension of the files of a DiskStore.
+const diskExt = ".json"
+
+// DiskStore is a Store that holds the responses of each key in a JSON file in
+// a directory, so that they outlive the proxy.
+type DiskStore struct {
+	dir string
+}
+
+// NewDiskStore returns a store that holds responses in dir, creating it if
+// it does not exist.
+func NewDiskStore(dir string) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &DiskStore{
+		dir: dir,
+	}, nil
+}
+
+// path returns the path of the file of key.
+func (s *DiskStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+diskExt)
+}
+
+// Get returns the responses stored under key.
+func (s *DiskStore) Get(key string) ([]*Entry, error) {
+	entries, err := readDiskEntries(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return entries, err
+}
+
+// Set replaces the responses stored under key. The file is replaced
+// atomically, so that readers never see a partial write.
+func (s *DiskStore) Set(key string, entries []*Entry) error {
+	p := s.path(key)
+	if len(entries) == 0 {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(s.dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), p)
+}
+
+// Keys returns the keys that hold responses, sorted.
+func (s *DiskStore) Keys() ([]string, error) {
+	names, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, name := range names {
+		entries, err := readDiskEntries(filepath.Join(s.dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) > 0 {
+			keys = append(keys, entries[0].Key)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// Purge removes all responses.
+func (s *DiskStore) Purge() error {
+	names, err := s.files()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// files returns the names of the files of the store in its directory.
+func (s *DiskStore) files() ([]string, error) {
+	fis, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, fi := range fis {
+		if !fi.IsDir() && strings.HasSuffix(fi.Name(), diskExt) {
+			names = append(names, fi.Name())
+		}
+	}
+
+	return names, nil
+}
+
+// readDiskEntries reads the responses in the file at p.
+func readDiskEntries(p string) ([]*Entry, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*Entry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "martian-cache")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): got %v, want no error", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ds, err := NewDiskStore(dir)
+	if err != nil {
+		t.Fatalf("NewDiskStore(): got %v, want no error", err)
+	}
+
+	stores := map[string]Store{
+		"memory": NewMemoryStore(),
+		"disk":   ds,
+	}
+
+	for name, s := range stores {
+		entries, err := s.Get("http://example.com/a")
+		if err != nil || entries != nil {
+			t.Errorf("%s: s.Get(): got %v, %v, want nil, no error", name, entries, err)
+		}
+
+		e := &Entry{
+			Key:          "http://example.com/a",
+			StatusCode:   200,
+			Header:       http.Header{"Etag": []string{`"v1"`}},
+			Body:         []byte("hello"),
+			Vary:         http.Header{"Accept-Language": []string{"en"}},
+			ResponseTime: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+		}
+		if err := s.Set(e.Key, []*Entry{e}); err != nil {
+			t.Fatalf("%s: s.Set(): got %v, want no error", name, err)
+		}
+		if err := s.Set("http://example.com/b", []*Entry{{Key: "http://example.com/b"}}); err != nil {
+			t.Fatalf("%s: s.Set(): got %v, want no error", name, err)
+		}
+
+		entries, err = s.Get(e.Key)
+		if err != nil {
+			t.Fatalf("%s: s.Get(): got %v, want no error", name, err)
+		}
+		if got, want := entries, []*Entry{e}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: s.Get(): got %+v, want %+v", name, got[0], want[0])
+		}
+
+		keys, err := s.Keys()
+		if err != nil {
+			t.Fatalf("%s: s.Keys(): got %v, want no error", name, err)
+		}
+		if got, want := keys, []string{"http://example.com/a", "http://example.com/b"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: s.Keys(): got %v, want %v", name, got, want)
+		}
+
+		if err := s.Set(e.Key, nil); err != nil {
+			t.Fatalf("%s: s.Set(nil): got %v, want no error", name, err)
+		}
+		keys, _ = s.Keys()
+		if got, want := keys, []string{"http://example.com/b"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: s.Keys(): got %v, want %v", name, got, want)
+		}
+
+		if err := s.Purge(); err != nil {
+			t.Fatalf("%s: s.Purge(): got %v, want no error", name, err)
+		}
+		keys, _ = s.Keys()
+		if len(keys) != 0 {
+			t.Errorf("%s: s.Keys(): got %v, want none after Purge", name, keys)
+		}
+	}
+}
+
+func TestDiskStorePersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "martian-cache")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): got %v, want no error", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ds, err := NewDiskStore(dir)
+	if err != nil {
+		t.Fatalf("NewDiskStore(): got %v, want no error", err)
+	}
+	if err := ds.Set("http://example.com/a", []*Entry{{Key: "http://example.com/a", Body: []byte("hello")}}); err != nil {
+		t.Fatalf("ds.Set(): got %v, want no error", err)
+	}
+
+	ds, err = NewDiskStore(dir)
+	if err != nil {
+		t.Fatalf("NewDiskStore(): got %v, want no error", err)
+	}
+	entries, err := ds.Get("http://example.com/a")
+	if err != nil {
+		t.Fatalf("ds.Get(): got %v, want no error", err)
+	}
+	if got, want := len(entries), 1; got != want {
+		t.Fatalf("len(entries): got %d, want %d", got, want)
+	}
+	if got, want := string(entries[0].Body), "hello"; got != want {
+		t.Errorf("entries[0].Body: got %q, want %q", got, want)
+	}
+}
+
+func TestMemoryStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	s := NewMemoryStore()
+
+	entry := func(key string) []*Entry {
+		// Each key holds 20 bytes with its 10 byte body.
+		return []*Entry{{Key: key, Body: []byte("0123456789")}}
+	}
+	for _, key := range []string{"http://a.com", "http://b.com"} {
+		if err := s.Set(key, entry(key)); err != nil {
+			t.Fatalf("s.Set(%q): got %v, want no error", key, err)
+		}
+	}
+
+	s.SetMaxSize(50)
+
+	// Using a makes b the least recently used key.
+	if entries, _ := s.Get("http://a.com"); entries == nil {
+		t.Fatal("s.Get(a): got no entries, want entries")
+	}
+	if err := s.Set("http://c.com", entry("http://c.com")); err != nil {
+		t.Fatalf("s.Set(c): got %v, want no error", err)
+	}
+
+	keys, err := s.Keys()
+	if err != nil {
+		t.Fatalf("s.Keys(): got %v, want no error", err)
+	}
+	if got, want := keys, []string{"http://a.com", "http://c.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("s.Keys(): got %v, want %v", got, want)
+	}
+
+	// A key larger than the store is not held, and evicts no other key.
+	if err := s.Set("http://big.com", []*Entry{{Key: "http://big.com", Body: make([]byte, 100)}}); err != nil {
+		t.Fatalf("s.Set(big): got %v, want no error", err)
+	}
+	keys, _ = s.Keys()
+	if got, want := keys, []string{"http://a.com", "http://c.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("s.Keys(): got %v, want %v", got, want)
+	}
+}
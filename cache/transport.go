@@ -0,0 +1,93 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"net/http"
+
+	"github.com/google/martian/v3"
+	"github.com/google/martian/v3/har"
+)
+
+// Transport is an http.RoundTripper that answers requests from a cache when
+// it can, and sends them with another http.RoundTripper otherwise.
+type Transport struct {
+	cache *Cache
+	rt    http.RoundTripper
+}
+
+// NewTransport returns a Transport that caches the responses of rt in c. If rt
+// is nil, http.DefaultTransport is used.
+func NewTransport(c *Cache, rt http.RoundTripper) *Transport {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+
+	return &Transport{
+		cache: c,
+		rt:    rt,
+	}
+}
+
+// RoundTrip answers req with a fresh stored response, or sends it with the
+// underlying http.RoundTripper, revalidating the stored response if it is
+// stale. When req has a martian context, the cache state of req is recorded
+// in it for HAR logs.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	l := t.cache.begin(req)
+
+	var res *http.Response
+	if l.status == Hit {
+		res = l.entry.response(req, t.cache.now())
+	} else {
+		outreq := req
+		if l.conditional {
+			outreq = new(http.Request)
+			*outreq = *req
+			outreq.Header = req.Header.Clone()
+			l.addValidators(outreq.Header)
+		}
+
+		var err error
+		res, err = t.send(l, req, outreq)
+		if err == errNotRevalidated {
+			// The validators were added by the cache, so the request is sent
+			// again as the client made it.
+			l.conditional = false
+			res, err = t.send(l, req, req)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if ctx := martian.NewContext(req); ctx != nil && l.status != Bypass {
+		ctx.Set(har.CacheContextKey, l.harCache())
+	}
+
+	return res, nil
+}
+
+// send sends outreq, the request of the client req with any validators added
+// by the cache, and returns the response to req.
+func (t *Transport) send(l *lookup, req, outreq *http.Request) (*http.Response, error) {
+	res, err := t.rt.RoundTrip(outreq)
+	if err != nil {
+		return nil, err
+	}
+	res.Request = req
+
+	return t.cache.finish(l, req, res)
+}
@@ -140,6 +140,18 @@
 // reset the in-memory HAR log; note that the log will grow unbounded unless it
 // is periodically reset
 //
+//   GET http://martian.proxy/cache
+//
+// lists the responses stored in the cache if the cache flag is enabled; a
+// DELETE request to the same path purges them, or only those for the URL in
+// its url query parameter
+//
+//   GET http://martian.proxy/modifier-errors
+//
+// retrieves the most recent errors returned by the configured modifiers, with
+// the ID of the request, the type of the modifier and the message of each; a
+// DELETE request to the same path clears them
+//
 // passing the -cors flag will enable CORS support for the endpoints so that they
 // may be called via AJAX
 //
@@ -154,6 +166,13 @@
 //     host:port of the proxy API
 //   -tls-addr=":4443"
 //     host:port of the proxy over TLS
+//   -transparent-addr=""
+//     host:port of the transparent proxy; connections redirected to it (e.g.
+//     with iptables REDIRECT) are proxied to their original destination, and
+//     TLS connections are MITM'd if enabled. Linux only
+//   -socks-addr=""
+//     host:port of the SOCKS5 proxy; connections made through it are handled
+//     as if they were tunneled with CONNECT
 //   -api="martian.proxy"
 //     hostname that can be used to reference the configuration API when
 //     configuring through the proxy
@@ -180,20 +199,122 @@
 //   -har=false
 //     enable logging endpoints for retrieving full request/response logs in
 //     HAR format.
+//   -har-max-entries=0
+//     if set, keep at most this many entries in the HAR log, evicting the
+//     oldest first
+//   -har-max-body-bytes=0
+//     if set, keep at most this many bytes of request and response bodies in
+//     the HAR log, evicting the oldest entries first
+//   -har-max-age=0
+//     if set, evict entries from the HAR log once they are older than this
+//   -har-spill-dir=""
+//     directory to write completed HAR entries to as rotating JSON Lines
+//     files, one entry per line, so that long captures outlive the limits;
+//     if none of the -har-max-* limits is set, the HAR log is limited to the
+//     1000 most recent entries
+//   -har-spill-file-size=104857600
+//     size in bytes at which a new HAR spill file is started
+//   -har-spill-files=0
+//     if set, keep at most this many HAR spill files, removing the oldest
+//   -metrics=false
+//     enable the metrics endpoint for retrieving counters and latency
+//     histograms of the proxy in Prometheus text format.
+//   -body-log-limit=0
+//     if set, request and response bodies are streamed through the HAR and
+//     console loggers instead of being read into memory, and at most this
+//     many bytes of each body are logged
 //   -traffic-shaping=false
 //     enable traffic shaping endpoints for simulating latency and constrained
 //     bandwidth conditions (e.g. mobile, exotic network infrastructure, the
 //     90's)
 //   -skip-tls-verify=false
 //     skip TLS server verification; insecure and intended for testing only
+//   -origin-h2=false
+//     negotiate HTTP/2 with origin servers over TLS; requests and responses
+//     are still passed through the configured modifiers
+//   -downstream-proxy-rules=""
+//     filepath to a JSON file of rules for choosing the downstream proxies of
+//     requests by host, port and auth ID, with failover; see the downstream
+//     package for the format
+//   -timeout=5m
+//     time allowed to read each request, including its body, and to handle it
+//   -read-header-timeout=0
+//     time allowed to read the headers of each request; defaults to -timeout
+//   -idle-timeout=0
+//     time to wait for the next request on a keep-alive connection; defaults
+//     to -timeout
+//   -write-timeout=0
+//     time allowed to write each response back to the client; by default
+//     writes are only bounded by -timeout
+//   -response-header-timeout=0
+//     time to wait for the response headers of the upstream server after the
+//     request has been sent; by default only bounded by -timeout
+//   -error-format="html"
+//     format of the error pages sent when requests can not be sent upstream,
+//     "html" or "json"; the pages classify the failure as a DNS, connection
+//     refused, TLS verification, timeout or downstream proxy error
+//   -proxy-protocol=false
+//     read the PROXY protocol header that a load balancer sends at the start
+//     of each connection to -addr, so that the client address is that of the
+//     original client
+//   -proxy-protocol-trusted=""
+//     comma separated CIDRs of the load balancers whose connections have a
+//     PROXY protocol header, such as "10.0.0.0/8"; the header of connections
+//     from other addresses is not read. By default all addresses are trusted
+//   -upstream-proxy-protocol=0
+//     version of the PROXY protocol header, 1 or 2, sent at the start of
+//     CONNECT tunnels to the target or downstream proxy; 0 sends none
+//   -cache=false
+//     cache responses as a shared HTTP cache that follows Cache-Control,
+//     Expires, Vary and revalidates with ETag and Last-Modified, and enable the
+//     cache endpoint; cache hits are marked in the cache object of HAR entries
+//   -cache-dir=""
+//     directory to store the cached responses in so that they outlive the
+//     proxy; by default they are kept in memory
+//   -cache-max-size=268435456
+//     maximum total size in bytes of the responses cached in memory, beyond
+//     which the least recently used are evicted; 0 means no limit
+//   -record=""
+//     filepath of an archive to record every request and response into,
+//     including those of MITM'd HTTPS connections; entries are appended to
+//     the archive as responses complete, and it can be replayed with -replay
+//   -replay=""
+//     filepath of an archive recorded with -record to answer requests from,
+//     without contacting the upstream
+//   -replay-unmatched="notfound"
+//     what to do with requests that match no archived request: "notfound"
+//     answers them with 404 Not Found, "passthrough" sends them upstream, and
+//     "fail" answers them with 404 Not Found and reports them at the verify
+//     endpoint
+//   -replay-match="method,host,path,query"
+//     comma separated attributes that requests must share with archived
+//     requests to be answered with their responses: method, host, path, query
+//     and body, which compares SHA-256 hashes of the bodies
+//   -replay-ignore-params=""
+//     comma separated query parameters left out of the query comparison, such
+//     as cache busters
+//   -modifier-error-policy="continue"
+//     what to do when a modifier returns an error: "continue" adds it to the
+//     request or response as a Warning header, "fail" responds with
+//     -modifier-error-status instead, and "close" closes the connection
+//   -modifier-error-status=500
+//     status of the responses sent by the "fail" modifier error policy
+//   -modifier-error-log=100
+//     number of recent modifier errors kept for the modifier-errors endpoint;
+//     0 disables it
+//   -shutdown-timeout=5s
+//     time to wait for in-flight requests and tunnels to finish on interrupt
+//     before their connections are closed
 //   -v=0
 //     log level for console logs; defaults to error only.
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"flag"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
@@ -207,14 +328,19 @@ import (
 
 	"github.com/google/martian/v3"
 	mapi "github.com/google/martian/v3/api"
+	"github.com/google/martian/v3/cache"
 	"github.com/google/martian/v3/cors"
+	"github.com/google/martian/v3/downstream"
 	"github.com/google/martian/v3/fifo"
 	"github.com/google/martian/v3/har"
 	"github.com/google/martian/v3/httpspec"
 	"github.com/google/martian/v3/marbl"
 	"github.com/google/martian/v3/martianhttp"
 	"github.com/google/martian/v3/martianlog"
+	"github.com/google/martian/v3/metrics"
 	"github.com/google/martian/v3/mitm"
+	"github.com/google/martian/v3/proxyproto"
+	"github.com/google/martian/v3/replay"
 	"github.com/google/martian/v3/servemux"
 	"github.com/google/martian/v3/trafficshape"
 	"github.com/google/martian/v3/verify"
@@ -222,6 +348,7 @@ import (
 	_ "github.com/google/martian/v3/body"
 	_ "github.com/google/martian/v3/cookie"
 	_ "github.com/google/martian/v3/failure"
+	_ "github.com/google/martian/v3/flush"
 	_ "github.com/google/martian/v3/martianurl"
 	_ "github.com/google/martian/v3/method"
 	_ "github.com/google/martian/v3/pingback"
@@ -234,22 +361,58 @@ import (
 	_ "github.com/google/martian/v3/status"
 )
 
+// spillMaxEntries is the limit on the HAR log when spilling without limits.
+const spillMaxEntries = 1000
+
 var (
-	addr           = flag.String("addr", ":8080", "host:port of the proxy")
-	apiAddr        = flag.String("api-addr", ":8181", "host:port of the configuration API")
-	tlsAddr        = flag.String("tls-addr", ":4443", "host:port of the proxy over TLS")
-	api            = flag.String("api", "martian.proxy", "hostname for the API")
-	generateCA     = flag.Bool("generate-ca-cert", false, "generate CA certificate and private key for MITM")
-	cert           = flag.String("cert", "", "filepath to the CA certificate used to sign MITM certificates")
-	key            = flag.String("key", "", "filepath to the private key of the CA used to sign MITM certificates")
-	organization   = flag.String("organization", "Martian Proxy", "organization name for MITM certificates")
-	validity       = flag.Duration("validity", time.Hour, "window of time that MITM certificates are valid")
-	allowCORS      = flag.Bool("cors", false, "allow CORS requests to configure the proxy")
-	harLogging     = flag.Bool("har", false, "enable HAR logging API")
-	marblLogging   = flag.Bool("marbl", false, "enable MARBL logging API")
-	trafficShaping = flag.Bool("traffic-shaping", false, "enable traffic shaping API")
-	skipTLSVerify  = flag.Bool("skip-tls-verify", false, "skip TLS server verification; insecure")
-	dsProxyURL     = flag.String("downstream-proxy-url", "", "URL of downstream proxy")
+	addr            = flag.String("addr", ":8080", "host:port of the proxy")
+	apiAddr         = flag.String("api-addr", ":8181", "host:port of the configuration API")
+	tlsAddr         = flag.String("tls-addr", ":4443", "host:port of the proxy over TLS")
+	transparentAddr = flag.String("transparent-addr", "", "host:port of the transparent proxy for redirected connections (Linux only)")
+	socksAddr       = flag.String("socks-addr", "", "host:port of the SOCKS5 proxy")
+	api             = flag.String("api", "martian.proxy", "hostname for the API")
+	generateCA      = flag.Bool("generate-ca-cert", false, "generate CA certificate and private key for MITM")
+	cert            = flag.String("cert", "", "filepath to the CA certificate used to sign MITM certificates")
+	key             = flag.String("key", "", "filepath to the private key of the CA used to sign MITM certificates")
+	organization    = flag.String("organization", "Martian Proxy", "organization name for MITM certificates")
+	validity        = flag.Duration("validity", time.Hour, "window of time that MITM certificates are valid")
+	allowCORS       = flag.Bool("cors", false, "allow CORS requests to configure the proxy")
+	harLogging      = flag.Bool("har", false, "enable HAR logging API")
+	harMaxEntries   = flag.Int("har-max-entries", 0, "maximum number of entries in the HAR log; 0 means no limit")
+	harMaxBodyBytes = flag.Int64("har-max-body-bytes", 0, "maximum bytes of bodies in the HAR log; 0 means no limit")
+	harMaxAge       = flag.Duration("har-max-age", 0, "maximum age of entries in the HAR log; 0 means no limit")
+	harSpillDir     = flag.String("har-spill-dir", "", "directory to write completed HAR entries to as rotating JSONL files")
+	harSpillSize    = flag.Int64("har-spill-file-size", 100<<20, "size in bytes at which a new HAR spill file is started")
+	harSpillFiles   = flag.Int("har-spill-files", 0, "maximum number of HAR spill files kept; 0 means no limit")
+	metricsAPI      = flag.Bool("metrics", false, "enable metrics API")
+	bodyLogLimit    = flag.Int64("body-log-limit", 0, "stream bodies through the loggers, logging at most this many bytes of each")
+	marblLogging    = flag.Bool("marbl", false, "enable MARBL logging API")
+	trafficShaping  = flag.Bool("traffic-shaping", false, "enable traffic shaping API")
+	skipTLSVerify   = flag.Bool("skip-tls-verify", false, "skip TLS server verification; insecure")
+	dsProxyURL      = flag.String("downstream-proxy-url", "", "URL of downstream proxy")
+	dsProxyRules    = flag.String("downstream-proxy-rules", "", "filepath to the JSON rules for choosing downstream proxies")
+	originH2        = flag.Bool("origin-h2", false, "negotiate HTTP/2 with origin servers")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 5*time.Second, "time to wait for in-flight requests to finish on shutdown")
+	timeout         = flag.Duration("timeout", 5*time.Minute, "time allowed to read and handle each request")
+	readHdrTimeout  = flag.Duration("read-header-timeout", 0, "time allowed to read request headers; defaults to -timeout")
+	idleTimeout     = flag.Duration("idle-timeout", 0, "time to wait for the next request on a keep-alive connection; defaults to -timeout")
+	writeTimeout    = flag.Duration("write-timeout", 0, "time allowed to write each response to the client")
+	resHdrTimeout   = flag.Duration("response-header-timeout", 0, "time to wait for upstream response headers")
+	errorFormat     = flag.String("error-format", "html", "format of error pages for failed requests, html or json")
+	proxyProtocol   = flag.Bool("proxy-protocol", false, "read PROXY protocol headers from connections to the proxy")
+	proxyTrusted    = flag.String("proxy-protocol-trusted", "", "comma separated CIDRs of the load balancers trusted to send PROXY protocol headers; empty trusts all")
+	upstreamProxyV  = flag.Int("upstream-proxy-protocol", 0, "version of the PROXY protocol header sent to upstreams of CONNECT tunnels")
+	modErrPolicy    = flag.String("modifier-error-policy", "continue", "action on modifier errors: continue, fail or close")
+	modErrStatus    = flag.Int("modifier-error-status", 500, "status of the responses sent by the fail modifier error policy")
+	modErrLogSize   = flag.Int("modifier-error-log", 100, "number of recent modifier errors kept for the API; 0 disables")
+	caching         = flag.Bool("cache", false, "cache responses as a shared HTTP cache and enable the cache API")
+	cacheDir        = flag.String("cache-dir", "", "directory to store cached responses in; defaults to memory")
+	cacheMaxSize    = flag.Int64("cache-max-size", cache.DefaultMemoryStoreMaxSize, "maximum total size in bytes of the responses cached in memory; 0 means no limit")
+	recordPath      = flag.String("record", "", "filepath of the archive to record requests and responses into")
+	replayPath      = flag.String("replay", "", "filepath of the archive to answer requests from")
+	replayUnmatched = flag.String("replay-unmatched", "notfound", "action on requests missing from the replay archive: notfound, passthrough or fail")
+	replayMatch     = flag.String("replay-match", "method,host,path,query", "request attributes compared with archived requests: method, host, path, query and body")
+	replayIgnore    = flag.String("replay-ignore-params", "", "comma separated query parameters ignored when comparing with archived requests")
 )
 
 func main() {
@@ -263,6 +426,22 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if *proxyProtocol {
+		pl := proxyproto.NewListener(l)
+		if *proxyTrusted != "" {
+			var nets []*net.IPNet
+			for _, cidr := range strings.Split(*proxyTrusted, ",") {
+				_, n, err := net.ParseCIDR(strings.TrimSpace(cidr))
+				if err != nil {
+					log.Fatalf("martian: invalid -proxy-protocol-trusted: %v", err)
+				}
+				nets = append(nets, n)
+			}
+			pl.SetTrustedSources(nets)
+		}
+		l = pl
+	}
+
 	lAPI, err := net.Listen("tcp", *apiAddr)
 	if err != nil {
 		log.Fatal(err)
@@ -281,8 +460,35 @@ func main() {
 			InsecureSkipVerify: *skipTLSVerify,
 		},
 	}
+	p.SetOriginHTTP2(*originH2)
+	p.SetResponseHeaderTimeout(*resHdrTimeout)
+	p.SetUpstreamProxyProtocol(*upstreamProxyV)
+
+	switch *errorFormat {
+	case "html":
+	case "json":
+		p.SetErrorPages(martian.NewJSONErrorPages())
+	default:
+		log.Fatalf("martian: unknown error page format %q", *errorFormat)
+	}
 	p.SetRoundTripper(tr)
 
+	switch *modErrPolicy {
+	case "continue":
+		p.SetModifierErrorPolicy(martian.ContinueOnModifierError, *modErrStatus)
+	case "fail":
+		p.SetModifierErrorPolicy(martian.FailOnModifierError, *modErrStatus)
+	case "close":
+		p.SetModifierErrorPolicy(martian.CloseOnModifierError, *modErrStatus)
+	default:
+		log.Fatalf("martian: unknown modifier error policy %q", *modErrPolicy)
+	}
+
+	p.SetTimeout(*timeout)
+	p.SetReadHeaderTimeout(*readHdrTimeout)
+	p.SetIdleTimeout(*idleTimeout)
+	p.SetWriteTimeout(*writeTimeout)
+
 	if *dsProxyURL != "" {
 		u, err := url.Parse(*dsProxyURL)
 		if err != nil {
@@ -291,6 +497,18 @@ func main() {
 		p.SetDownstreamProxy(u)
 	}
 
+	if *dsProxyRules != "" {
+		b, err := ioutil.ReadFile(*dsProxyRules)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sel, err := downstream.FromJSON(b)
+		if err != nil {
+			log.Fatal(err)
+		}
+		p.SetDownstreamProxyFunc(sel.Proxies)
+	}
+
 	mux := http.NewServeMux()
 
 	var x509c *x509.Certificate
@@ -340,6 +558,24 @@ func main() {
 		go p.Serve(tls.NewListener(tl, mc.TLS()))
 	}
 
+	if *transparentAddr != "" {
+		tl, err := net.Listen("tcp", *transparentAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		go p.ServeTransparent(tl)
+	}
+
+	if *socksAddr != "" {
+		sl, err := net.Listen("tcp", *socksAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		go p.ServeSOCKS(sl)
+	}
+
 	stack, fg := httpspec.NewStack("martian")
 
 	// wrap stack in a group so that we can forward API requests to the API port
@@ -363,6 +599,89 @@ func main() {
 		topg.AddRequestModifier(apif)
 	}
 	topg.AddRequestModifier(stack)
+
+	// The cache and the replay archive answer requests after the other request
+	// modifiers ran, and set the responses they answer with before the
+	// response modifiers run; the archive is closest to the upstream.
+	var cachef *servemux.Filter
+	if *caching {
+		var store cache.Store
+		if *cacheDir != "" {
+			ds, err := cache.NewDiskStore(*cacheDir)
+			if err != nil {
+				log.Fatal(err)
+			}
+			store = ds
+		} else {
+			ms := cache.NewMemoryStore()
+			ms.SetMaxSize(*cacheMaxSize)
+			store = ms
+		}
+		c := cache.New(store)
+		cm := cache.NewModifier(c)
+
+		cachef = servemux.NewFilter(mux)
+		cachef.RequestWhenFalse(cm)
+		cachef.ResponseWhenFalse(cm)
+		topg.AddRequestModifier(cachef)
+
+		configure("/cache", cache.NewHandler(c), mux)
+	}
+
+	var archiveFile *os.File
+	var archive *replay.Writer
+	var replayer *replay.Replayer
+	switch {
+	case *recordPath != "" && *replayPath != "":
+		log.Fatal("martian: -record and -replay are mutually exclusive")
+	case *recordPath != "":
+		f, err := os.Create(*recordPath)
+		if err != nil {
+			log.Fatalf("martian: failed to create archive: %v", err)
+		}
+		archiveFile = f
+
+		archive, err = replay.NewWriter(f)
+		if err != nil {
+			log.Fatalf("martian: failed to write archive: %v", err)
+		}
+		rec := replay.NewRecorder(archive)
+
+		muxf := servemux.NewFilter(mux)
+		muxf.RequestWhenFalse(rec)
+		muxf.ResponseWhenFalse(rec)
+		topg.AddRequestModifier(muxf)
+		topg.AddResponseModifier(muxf)
+	case *replayPath != "":
+		a, err := replay.LoadArchive(*replayPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		replayer, err = replay.NewReplayer(a, replayMatcher())
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		switch *replayUnmatched {
+		case "notfound":
+		case "passthrough":
+			replayer.SetUnmatchedPolicy(replay.UnmatchedPassthrough)
+		case "fail":
+			replayer.SetUnmatchedPolicy(replay.UnmatchedFail)
+		default:
+			log.Fatalf("martian: unknown replay unmatched policy %q", *replayUnmatched)
+		}
+
+		muxf := servemux.NewFilter(mux)
+		muxf.RequestWhenFalse(replayer)
+		muxf.ResponseWhenFalse(replayer)
+		topg.AddRequestModifier(muxf)
+		topg.AddResponseModifier(muxf)
+	}
+
+	if cachef != nil {
+		topg.AddResponseModifier(cachef)
+	}
 	topg.AddResponseModifier(stack)
 
 	p.SetRequestModifier(topg)
@@ -372,8 +691,26 @@ func main() {
 	fg.AddRequestModifier(m)
 	fg.AddResponseModifier(m)
 
+	var spill *har.Spill
 	if *harLogging {
 		hl := har.NewLogger()
+		if *bodyLogLimit > 0 {
+			hl.SetOption(har.StreamingBodyLogging(*bodyLogLimit))
+		}
+		hl.SetOption(har.MaxEntries(*harMaxEntries), har.MaxBodyBytes(*harMaxBodyBytes), har.MaxEntryAge(*harMaxAge))
+		if *harSpillDir != "" {
+			// Spilled entries are kept in the log as well, so it needs a limit.
+			if *harMaxEntries <= 0 && *harMaxBodyBytes <= 0 && *harMaxAge <= 0 {
+				log.Printf("martian: limiting the HAR log to %d entries while spilling", spillMaxEntries)
+				hl.SetOption(har.MaxEntries(spillMaxEntries))
+			}
+			var err error
+			spill, err = har.NewSpill(*harSpillDir, *harSpillSize, *harSpillFiles)
+			if err != nil {
+				log.Fatal(err)
+			}
+			hl.SetOption(har.SpillEntries(spill))
+		}
 		muxf := servemux.NewFilter(mux)
 		// Only append to HAR logs when the requests are not API requests,
 		// that is, they are not matched in http.DefaultServeMux
@@ -387,8 +724,23 @@ func main() {
 		configure("/logs/reset", har.NewResetHandler(hl), mux)
 	}
 
+	if *modErrLogSize > 0 {
+		el := martian.NewModifierErrorLog(*modErrLogSize)
+		p.SetModifierErrorLog(el)
+
+		configure("/modifier-errors", martianhttp.NewModifierErrorsHandler(el), mux)
+	}
+
+	if *metricsAPI {
+		m := metrics.New()
+		p.SetMetrics(m)
+
+		configure("/metrics", metrics.NewHandler(m), mux)
+	}
+
 	logger := martianlog.NewLogger()
 	logger.SetDecode(true)
+	logger.SetBodyLimit(*bodyLogLimit)
 
 	stack.AddRequestModifier(logger)
 	stack.AddResponseModifier(logger)
@@ -409,16 +761,26 @@ func main() {
 	// Configure modifiers.
 	configure("/configure", m, mux)
 
-	// Verify assertions.
+	// Verify assertions, including the requests missing from the replay
+	// archive.
+	var verifier verify.RequestResponseVerifier = m
+	if replayer != nil {
+		vg := fifo.NewGroup()
+		vg.AddRequestModifier(m)
+		vg.AddResponseModifier(m)
+		vg.AddRequestModifier(replayer)
+		verifier = vg
+	}
+
 	vh := verify.NewHandler()
-	vh.SetRequestVerifier(m)
-	vh.SetResponseVerifier(m)
+	vh.SetRequestVerifier(verifier)
+	vh.SetResponseVerifier(verifier)
 	configure("/verify", vh, mux)
 
 	// Reset verifications.
 	rh := verify.NewResetHandler()
-	rh.SetRequestVerifier(m)
-	rh.SetResponseVerifier(m)
+	rh.SetRequestVerifier(verifier)
+	rh.SetResponseVerifier(verifier)
 	configure("/verify/reset", rh, mux)
 
 	if *trafficShaping {
@@ -439,9 +801,63 @@ func main() {
 	<-sigc
 
 	log.Println("martian: shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	if n, err := p.Shutdown(ctx); err != nil {
+		log.Printf("martian: cut off %d connections after %v", n, *shutdownTimeout)
+	}
+	cancel()
+
+	if spill != nil {
+		if err := spill.Close(); err != nil {
+			log.Printf("martian: failed to close HAR spill: %v", err)
+		}
+	}
+
+	if archive != nil {
+		if err := archiveFile.Close(); err != nil {
+			log.Fatalf("martian: failed to close archive: %v", err)
+		}
+		log.Printf("martian: recorded %d requests to %s", archive.Len(), *recordPath)
+	}
+
 	os.Exit(0)
 }
 
+// replayMatcher returns the matcher of archived requests configured by the
+// replay flags.
+func replayMatcher() *replay.Matcher {
+	m := replay.NewMatcher()
+	m.SetMatchMethod(false)
+	m.SetMatchHost(false)
+	m.SetMatchPath(false)
+	m.SetMatchQuery(false)
+
+	for _, attr := range strings.Split(*replayMatch, ",") {
+		switch strings.TrimSpace(attr) {
+		case "method":
+			m.SetMatchMethod(true)
+		case "host":
+			m.SetMatchHost(true)
+		case "path":
+			m.SetMatchPath(true)
+		case "query":
+			m.SetMatchQuery(true)
+		case "body":
+			m.SetMatchBody(true)
+		case "":
+		default:
+			log.Fatalf("martian: unknown replay match attribute %q", attr)
+		}
+	}
+
+	if *replayIgnore != "" {
+		m.IgnoreQueryParams(strings.Split(*replayIgnore, ",")...)
+	}
+
+	return m
+}
+
 // configure installs a configuration handler at path.
 func configure(pattern string, handler http.Handler, mux *http.ServeMux) {
 	if *allowCORS {
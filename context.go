@@ -21,7 +21,9 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"reflect"
 	"sync"
+	"time"
 )
 
 // Context provides information and storage for a single request/response pair.
@@ -36,6 +38,19 @@ type Context struct {
 	skipRoundTrip bool
 	skipLogging   bool
 	apiRequest    bool
+	flushInterval time.Duration
+	trace         RoundTripTrace
+	traced        bool
+
+	// modErrs are the modifiers that returned errors for the request, innermost
+	// first.
+	modErrs []modifierErrorSource
+}
+
+// modifierErrorSource is the modifier that returned an error.
+type modifierErrorSource struct {
+	err      error
+	modifier string
 }
 
 // Session provides information and storage about a connection.
@@ -46,7 +61,20 @@ type Session struct {
 	hijacked bool
 	conn     net.Conn
 	brw      *bufio.ReadWriter
+	dst      string
 	vals     map[string]interface{}
+
+	// onHijack is called before the connection is handed to a hijacker.
+	onHijack func()
+	// keepAlive is set once a request has been handled on the connection. It
+	// is only accessed by the goroutine handling the connection.
+	keepAlive bool
+	// handshakeStart and handshakeDone bound the MITM handshake with the
+	// client, until they are reported in the trace of the first request read
+	// from the connection. They are only accessed by the goroutine handling
+	// the connection.
+	handshakeStart time.Time
+	handshakeDone  time.Time
 }
 
 var (
@@ -128,12 +156,17 @@ func (s *Session) MarkInsecure() {
 // return of the hijacker.
 func (s *Session) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
 	if s.hijacked {
+		s.mu.Unlock()
 		return nil, nil, fmt.Errorf("martian: session has already been hijacked")
 	}
 	s.hijacked = true
+	onHijack := s.onHijack
+	s.mu.Unlock()
+
+	if onHijack != nil {
+		onHijack()
+	}
 
 	return s.conn, s.brw, nil
 }
@@ -146,6 +179,34 @@ func (s *Session) Hijacked() bool {
 	return s.hijacked
 }
 
+// setHijackHook sets the function called before the connection is handed to
+// a hijacker.
+func (s *Session) setHijackHook(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.onHijack = f
+}
+
+// OriginalDestination returns the host:port the client connected to before
+// its traffic was intercepted, such as the SO_ORIGINAL_DST of a transparently
+// proxied connection. It returns the empty string when the destination is
+// only known from the requests themselves.
+func (s *Session) OriginalDestination() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.dst
+}
+
+// setOriginalDestination sets the host:port the client connected to.
+func (s *Session) setOriginalDestination(dst string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dst = dst
+}
+
 // setConn resets the underlying connection and bufio.ReadWriter of the
 // session. Used by the proxy when the connection is upgraded to TLS.
 func (s *Session) setConn(conn net.Conn, brw *bufio.ReadWriter) {
@@ -221,6 +282,69 @@ func (ctx *Context) SkippingRoundTrip() bool {
 	return ctx.skipRoundTrip
 }
 
+// SetFlushInterval sets how often the response body for the current request
+// is flushed to the client while it is written. A negative interval, such as
+// FlushImmediately, flushes after every write. An interval of zero leaves the
+// decision to the flush policy of the proxy.
+func (ctx *Context) SetFlushInterval(interval time.Duration) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	ctx.flushInterval = interval
+}
+
+// FlushInterval returns the flush interval set for the current request.
+func (ctx *Context) FlushInterval() time.Duration {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+
+	return ctx.flushInterval
+}
+
+// noteModifierError records that mod returned err, unless err was already
+// returned by a modifier that mod ran.
+func (ctx *Context) noteModifierError(mod interface{}, err error) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	for _, src := range ctx.modErrs {
+		if sameError(src.err, err) {
+			return
+		}
+	}
+
+	ctx.modErrs = append(ctx.modErrs, modifierErrorSource{
+		err:      err,
+		modifier: fmt.Sprintf("%T", mod),
+	})
+}
+
+// modifierOf returns the type of the innermost modifier that returned err, or
+// the empty string if unknown.
+func (ctx *Context) modifierOf(err error) string {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+
+	for _, src := range ctx.modErrs {
+		if sameError(src.err, err) {
+			return src.modifier
+		}
+	}
+
+	return ""
+}
+
+// sameError returns whether a and b are the same error value, without
+// panicking on errors of types that are not comparable.
+func sameError(a, b error) bool {
+	ta := reflect.TypeOf(a)
+	if ta != reflect.TypeOf(b) || !ta.Comparable() {
+		return false
+	}
+
+	return a == b
+}
+
 // SkipLogging skips logging by Martian loggers for the current request.
 func (ctx *Context) SkipLogging() {
 	ctx.mu.Lock()
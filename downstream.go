@@ -0,0 +1,250 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+
+	"github.com/google/martian/v3/log"
+)
+
+// SetDownstreamProxyFunc sets the function that chooses the downstream proxies
+// for each request, overriding the proxy set with SetDownstreamProxy. The
+// proxies are tried in order until a connection to one of them is made, and a
+// nil URL in the list connects to the target directly. Proxy URLs with the
+// http, https, socks5 and socks5h schemes are supported. When nil, the proxy
+// set with SetDownstreamProxy is used.
+//
+// Requests are only sent through the proxies chosen by f when the round
+// tripper of the proxy is an *http.Transport. Requests are retried through the
+// next proxy only if none of their body has been sent.
+func (p *Proxy) SetDownstreamProxyFunc(f func(*http.Request) ([]*url.URL, error)) {
+	p.proxyFunc = f
+
+	if tr, ok := p.roundTripper.(*http.Transport); ok {
+		tr.Proxy = p.transportProxy
+	}
+}
+
+// downstreamProxies returns the proxies to try in order for req, where nil
+// connects directly.
+func (p *Proxy) downstreamProxies(req *http.Request) ([]*url.URL, error) {
+	if p.proxyFunc != nil {
+		proxies, err := p.proxyFunc(req)
+		if err != nil {
+			return nil, err
+		}
+		if len(proxies) == 0 {
+			return []*url.URL{nil}, nil
+		}
+		return proxies, nil
+	}
+
+	return []*url.URL{p.proxyURL}, nil
+}
+
+// downstreamProxyKey is the context key of the *downstreamProxy chosen for a
+// request sent through the round tripper.
+type downstreamProxyKey struct{}
+
+type downstreamProxy struct {
+	url *url.URL
+}
+
+// transportProxy is the Proxy function of the *http.Transport of the proxy.
+func (p *Proxy) transportProxy(req *http.Request) (*url.URL, error) {
+	if dp, ok := req.Context().Value(downstreamProxyKey{}).(*downstreamProxy); ok {
+		return dp.url, nil
+	}
+
+	return p.proxyURL, nil
+}
+
+// roundTripDownstream sends req through the round tripper, failing over to the
+// next downstream proxy while the chosen ones are unreachable or refuse the
+// request.
+func (p *Proxy) roundTripDownstream(req *http.Request) (*http.Response, error) {
+	if _, ok := p.roundTripper.(*http.Transport); !ok {
+		return p.roundTripper.RoundTrip(req)
+	}
+
+	proxies, err := p.downstreamProxies(req)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, proxyURL := range proxies {
+		ctx := context.WithValue(req.Context(), downstreamProxyKey{}, &downstreamProxy{url: proxyURL})
+		preq := req.WithContext(ctx)
+
+		last := i == len(proxies)-1
+		var body *retryBody
+		if !last && req.Body != nil && req.Body != http.NoBody {
+			body = &retryBody{ReadCloser: req.Body}
+			preq.Body = body
+		}
+
+		var res *http.Response
+		res, err = p.roundTripper.RoundTrip(preq)
+		if proxyURL != nil {
+			err = downstreamErr(proxyURL, res, err)
+		}
+		if err == nil || last || !canFailOver(err) || (body != nil && body.wasRead()) {
+			return res, err
+		}
+
+		log.Infof("martian: failed to reach %s, trying next: %v", proxyName(proxyURL), err)
+	}
+
+	return nil, err
+}
+
+// retryBody is a request body that can be sent again if the round trip fails
+// before any of it is read. Closing it is left to the owner of the request.
+type retryBody struct {
+	io.ReadCloser
+	read int32
+}
+
+func (b *retryBody) Read(p []byte) (int, error) {
+	atomic.StoreInt32(&b.read, 1)
+	return b.ReadCloser.Read(p)
+}
+
+func (b *retryBody) Close() error {
+	return nil
+}
+
+func (b *retryBody) wasRead() bool {
+	return atomic.LoadInt32(&b.read) == 1
+}
+
+// downstreamErr returns a *downstreamProxyError if the downstream proxy
+// refused the round trip, and err otherwise. Error responses to the CONNECT
+// requests of the *http.Transport are reported as such by
+// proxyConnectResponse, and responses to absolute-form requests are returned
+// as is, so only 407 Proxy Authentication Required is known to come from the
+// downstream proxy in that case.
+func downstreamErr(proxyURL *url.URL, res *http.Response, err error) error {
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != http.StatusProxyAuthRequired {
+		return nil
+	}
+	res.Body.Close()
+
+	return &downstreamProxyError{proxyURL: proxyURL, statusCode: res.StatusCode}
+}
+
+// proxyConnectResponse returns the OnProxyConnectResponse func of the
+// *http.Transport of the proxy, which calls next, if not nil, and reports an
+// error response of the downstream proxy to CONNECT as a
+// *downstreamProxyError, whatever its reason phrase.
+func proxyConnectResponse(next func(context.Context, *url.URL, *http.Request, *http.Response) error) func(context.Context, *url.URL, *http.Request, *http.Response) error {
+	return func(ctx context.Context, proxyURL *url.URL, creq *http.Request, res *http.Response) error {
+		if next != nil {
+			if err := next(ctx, proxyURL, creq, res); err != nil {
+				return err
+			}
+		}
+		if res.StatusCode != http.StatusOK {
+			return &downstreamProxyError{proxyURL: proxyURL, statusCode: res.StatusCode}
+		}
+
+		return nil
+	}
+}
+
+// downstreamProxyError is the error returned when a downstream proxy refuses
+// to forward a request with an error response.
+type downstreamProxyError struct {
+	proxyURL   *url.URL
+	statusCode int
+}
+
+func (e *downstreamProxyError) Error() string {
+	switch {
+	case e.statusCode != http.StatusProxyAuthRequired:
+		return fmt.Sprintf("downstream proxy %s refused the request: %d %s", e.proxyURL.Host, e.statusCode, http.StatusText(e.statusCode))
+	case e.proxyURL.User == nil:
+		return fmt.Sprintf("downstream proxy %s requires authentication", e.proxyURL.Host)
+	default:
+		return fmt.Sprintf("downstream proxy %s rejected the credentials of user %q", e.proxyURL.Host, e.proxyURL.User.Username())
+	}
+}
+
+// canFailOver returns whether the request may be sent through the next
+// downstream proxy after failing with err.
+func canFailOver(err error) bool {
+	var derr *downstreamProxyError
+	return isUnreachable(err) || errors.As(err, &derr)
+}
+
+// isUnreachable returns whether err is the failure to connect to a downstream
+// proxy or to the target of a request.
+func isUnreachable(err error) bool {
+	var oerr *net.OpError
+	if !errors.As(err, &oerr) {
+		return false
+	}
+
+	return oerr.Op == "dial" || oerr.Op == "proxyconnect"
+}
+
+// proxyAddr returns the host:port of the downstream proxy, defaulting the port
+// by scheme.
+func proxyAddr(proxyURL *url.URL) string {
+	if proxyURL.Port() != "" {
+		return proxyURL.Host
+	}
+
+	port := "80"
+	switch proxyURL.Scheme {
+	case "https":
+		port = "443"
+	case "socks5", "socks5h":
+		port = "1080"
+	}
+
+	return net.JoinHostPort(proxyURL.Hostname(), port)
+}
+
+// proxyAuthorization returns the value of the Proxy-Authorization header that
+// authenticates user with the Basic scheme.
+func proxyAuthorization(user *url.Userinfo) string {
+	password, _ := user.Password()
+	creds := user.Username() + ":" + password
+
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(creds))
+}
+
+// proxyName returns the name of the downstream proxy for logging.
+func proxyName(proxyURL *url.URL) string {
+	if proxyURL == nil {
+		return "DIRECT"
+	}
+
+	return proxyURL.Host
+}
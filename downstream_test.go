@@ -0,0 +1,514 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/martian/v3/martiantest"
+)
+
+// unreachableAddr returns the address of a closed listener.
+func unreachableAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	return addr
+}
+
+// serveDownstream starts a proxy that responds to all requests with a 299 and
+// returns its address.
+func serveDownstream(t *testing.T, serve func(*Proxy, net.Listener) error) (*Proxy, string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	p.SetTimeout(500 * time.Millisecond)
+
+	tr := martiantest.NewTransport()
+	tr.Respond(299)
+	p.SetRoundTripper(tr)
+
+	go serve(p, l)
+
+	return p, l.Addr().String()
+}
+
+func TestIntegrationDownstreamProxyFailover(t *testing.T) {
+	t.Parallel()
+
+	downstream, addr := serveDownstream(t, (*Proxy).Serve)
+	defer downstream.Close()
+
+	var body []byte
+	tm := martiantest.NewModifier()
+	tm.RequestFunc(func(req *http.Request) {
+		if req.Method == "POST" {
+			body, _ = ioutil.ReadAll(req.Body)
+		}
+	})
+	downstream.SetRequestModifier(tm)
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	p.SetRoundTripper(&http.Transport{})
+	p.SetTimeout(500 * time.Millisecond)
+
+	dead := &url.URL{Scheme: "http", Host: unreachableAddr(t)}
+	live := &url.URL{Scheme: "http", Host: addr}
+	p.SetDownstreamProxyFunc(func(req *http.Request) ([]*url.URL, error) {
+		return []*url.URL{dead, live}, nil
+	})
+
+	go p.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+
+	// The body of the request is sent to the live proxy after the dead proxy
+	// was unreachable.
+	req, err := http.NewRequest("POST", "http://example.com", strings.NewReader("body"))
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.WriteProxy(conn); err != nil {
+		t.Fatalf("req.WriteProxy(): got %v, want no error", err)
+	}
+
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	res.Body.Close()
+
+	if got, want := res.StatusCode, 299; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+	if got, want := string(body), "body"; got != want {
+		t.Errorf("body: got %q, want %q", got, want)
+	}
+
+	// The live proxy tunnels the connection to itself.
+	req, err = http.NewRequest("CONNECT", "//"+addr, nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("req.Write(): got %v, want no error", err)
+	}
+
+	res, err = http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	res.Body.Close()
+
+	if got, want := res.StatusCode, 200; got != want {
+		t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+	}
+
+	req, err = http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("req.Write(): got %v, want no error", err)
+	}
+
+	res, err = http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	res.Body.Close()
+
+	if got, want := res.StatusCode, 299; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+}
+
+func TestIntegrationSOCKSDownstreamProxy(t *testing.T) {
+	t.Parallel()
+
+	downstream, addr := serveDownstream(t, (*Proxy).ServeSOCKS)
+	defer downstream.Close()
+
+	downstream.SetSOCKSAuthenticator(func(username, password string) bool {
+		return username == "user" && password == "secret"
+	})
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	p.SetRoundTripper(&http.Transport{})
+	p.SetTimeout(500 * time.Millisecond)
+	p.SetDownstreamProxyFunc(func(req *http.Request) ([]*url.URL, error) {
+		return []*url.URL{{
+			Scheme: "socks5",
+			User:   url.UserPassword("user", "secret"),
+			Host:   addr,
+		}}, nil
+	})
+
+	go p.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.WriteProxy(conn); err != nil {
+		t.Fatalf("req.WriteProxy(): got %v, want no error", err)
+	}
+
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	res.Body.Close()
+
+	if got, want := res.StatusCode, 299; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+
+	req, err = http.NewRequest("CONNECT", "//example.com:80", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("req.Write(): got %v, want no error", err)
+	}
+
+	res, err = http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	res.Body.Close()
+
+	if got, want := res.StatusCode, 200; got != want {
+		t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+	}
+
+	req, err = http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("req.Write(): got %v, want no error", err)
+	}
+
+	res, err = http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	res.Body.Close()
+
+	if got, want := res.StatusCode, 299; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+}
+
+func TestIntegrationDownstreamProxyAuthorization(t *testing.T) {
+	t.Parallel()
+
+	downstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Proxy-Authorization") != "Basic dXNlcjpzZWNyZXQ=" {
+			rw.Header().Set("Proxy-Authenticate", `Basic realm="corp"`)
+			rw.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		if req.Method != "CONNECT" {
+			rw.WriteHeader(299)
+			return
+		}
+
+		// Close the tunnel right away.
+		conn, brw, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		brw.WriteString("HTTP/1.1 200 OK\r\n\r\n")
+		brw.Flush()
+	}))
+	defer downstream.Close()
+
+	tt := []struct {
+		user       *url.Userinfo
+		wantStatus int
+	}{
+		{url.UserPassword("user", "secret"), 299},
+		{url.UserPassword("user", "wrong"), 502},
+		{nil, 502},
+	}
+
+	for i, tc := range tt {
+		l, err := net.Listen("tcp", "[::]:0")
+		if err != nil {
+			t.Fatalf("%d. net.Listen(): got %v, want no error", i, err)
+		}
+
+		p := NewProxy()
+		defer p.Close()
+
+		p.SetRoundTripper(&http.Transport{})
+		p.SetTimeout(500 * time.Millisecond)
+		p.SetDownstreamProxy(&url.URL{
+			Scheme: "http",
+			User:   tc.user,
+			Host:   strings.TrimPrefix(downstream.URL, "http://"),
+		})
+
+		go p.Serve(l)
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("%d. net.Dial(): got %v, want no error", i, err)
+		}
+		defer conn.Close()
+
+		br := bufio.NewReader(conn)
+
+		req, err := http.NewRequest("GET", "http://example.com", nil)
+		if err != nil {
+			t.Fatalf("%d. http.NewRequest(): got %v, want no error", i, err)
+		}
+		if err := req.WriteProxy(conn); err != nil {
+			t.Fatalf("%d. req.WriteProxy(): got %v, want no error", i, err)
+		}
+
+		res, err := http.ReadResponse(br, req)
+		if err != nil {
+			t.Fatalf("%d. http.ReadResponse(): got %v, want no error", i, err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if got, want := res.StatusCode, tc.wantStatus; got != want {
+			t.Errorf("%d. res.StatusCode: got %d, want %d", i, got, want)
+		}
+		if tc.wantStatus == 502 {
+			if got, want := res.Header.Get("Content-Type"), "text/html; charset=utf-8"; got != want {
+				t.Errorf("%d. res.Header.Get(%q): got %q, want %q", i, "Content-Type", got, want)
+			}
+			if got, want := string(body), "Downstream proxy authentication failed"; !strings.Contains(got, want) {
+				t.Errorf("%d. res.Body: got %q, want to contain %q", i, got, want)
+			}
+		}
+
+		req, err = http.NewRequest("CONNECT", "//example.com:443", nil)
+		if err != nil {
+			t.Fatalf("%d. http.NewRequest(): got %v, want no error", i, err)
+		}
+		if err := req.Write(conn); err != nil {
+			t.Fatalf("%d. req.Write(): got %v, want no error", i, err)
+		}
+
+		res, err = http.ReadResponse(br, req)
+		if err != nil {
+			t.Fatalf("%d. http.ReadResponse(): got %v, want no error", i, err)
+		}
+
+		if tc.wantStatus != 502 {
+			if got, want := res.StatusCode, 200; got != want {
+				t.Errorf("%d. CONNECT res.StatusCode: got %d, want %d", i, got, want)
+			}
+			continue
+		}
+
+		body, _ = ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if got, want := res.StatusCode, 502; got != want {
+			t.Errorf("%d. CONNECT res.StatusCode: got %d, want %d", i, got, want)
+		}
+		if got, want := string(body), "Downstream proxy authentication failed"; !strings.Contains(got, want) {
+			t.Errorf("%d. CONNECT res.Body: got %q, want to contain %q", i, got, want)
+		}
+	}
+}
+
+func TestDownstreamProxyConnectRefused(t *testing.T) {
+	t.Parallel()
+
+	var tried []string
+	refuse := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			tried = append(tried, name)
+
+			conn, brw, err := rw.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			// The reason phrase is not the status text of the code.
+			brw.WriteString("HTTP/1.1 403 Blocked by policy\r\nContent-Length: 0\r\n\r\n")
+			brw.Flush()
+		}))
+	}
+	first := refuse("first")
+	defer first.Close()
+	second := refuse("second")
+	defer second.Close()
+
+	p := NewProxy()
+	defer p.Close()
+
+	p.SetRoundTripper(&http.Transport{})
+	p.SetDownstreamProxyFunc(func(req *http.Request) ([]*url.URL, error) {
+		return []*url.URL{
+			{Scheme: "http", Host: strings.TrimPrefix(first.URL, "http://")},
+			{Scheme: "http", Host: strings.TrimPrefix(second.URL, "http://")},
+		}, nil
+	})
+
+	req, err := http.NewRequest("GET", "https://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	_, err = p.roundTripDownstream(req)
+
+	var derr *downstreamProxyError
+	if !errors.As(err, &derr) {
+		t.Fatalf("p.roundTripDownstream(): got %v, want *downstreamProxyError", err)
+	}
+	if got, want := derr.statusCode, http.StatusForbidden; got != want {
+		t.Errorf("derr.statusCode: got %d, want %d", got, want)
+	}
+	if got, want := ClassifyError(err), ErrorDownstreamProxy; got != want {
+		t.Errorf("ClassifyError(): got %q, want %q", got, want)
+	}
+	if got, want := strings.Join(tried, ","), "first,second"; got != want {
+		t.Errorf("tried: got %q, want %q", got, want)
+	}
+}
+
+func TestIntegrationTLSDownstreamProxyConnect(t *testing.T) {
+	t.Parallel()
+
+	downstream := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		conn, brw, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		brw.WriteString("HTTP/1.1 200 OK\r\n\r\n")
+		brw.Flush()
+	}))
+	defer downstream.Close()
+
+	p := NewProxy()
+	defer p.Close()
+
+	// The downstream proxy is verified with the roots of the transport.
+	roots := x509.NewCertPool()
+	roots.AddCert(downstream.Certificate())
+	p.SetRoundTripper(&http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	})
+	p.SetDownstreamProxy(&url.URL{
+		Scheme: "https",
+		Host:   strings.TrimPrefix(downstream.URL, "https://"),
+	})
+
+	req, err := http.NewRequest("CONNECT", "//example.com:443", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	res, conn, err := p.connect(req)
+	if err != nil {
+		t.Fatalf("p.connect(): got %v, want no error", err)
+	}
+	conn.Close()
+
+	if got, want := res.StatusCode, 200; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+
+	// The handshake is bounded by the TLS handshake timeout of the transport.
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		ioutil.ReadAll(conn)
+	}()
+
+	p.SetRoundTripper(&http.Transport{TLSHandshakeTimeout: 50 * time.Millisecond})
+	p.SetDownstreamProxy(&url.URL{Scheme: "https", Host: l.Addr().String()})
+
+	_, _, err = p.connect(req)
+
+	var nerr net.Error
+	if !errors.As(err, &nerr) || !nerr.Timeout() {
+		t.Fatalf("p.connect(): got %v, want timeout", err)
+	}
+}
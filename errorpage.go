@@ -0,0 +1,310 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"text/template"
+
+	"github.com/google/martian/v3/log"
+	"github.com/google/martian/v3/proxyutil"
+)
+
+// ErrorClass is the class of a failure to send a request upstream.
+type ErrorClass string
+
+// Classes of failures to send a request upstream.
+const (
+	// ErrorDNS is the failure to resolve the host name of the upstream server.
+	ErrorDNS ErrorClass = "dns"
+	// ErrorConnectionRefused is the refusal of the connection to the upstream
+	// server.
+	ErrorConnectionRefused ErrorClass = "connection_refused"
+	// ErrorTLSVerify is the failure to verify the certificate of the upstream
+	// server.
+	ErrorTLSVerify ErrorClass = "tls_verify"
+	// ErrorTimeout is a timeout connecting to or waiting on the upstream server.
+	ErrorTimeout ErrorClass = "timeout"
+	// ErrorDownstreamProxy is the refusal of the downstream proxy to forward
+	// the request.
+	ErrorDownstreamProxy ErrorClass = "downstream_proxy"
+	// ErrorUnknown is any other failure.
+	ErrorUnknown ErrorClass = "unknown"
+)
+
+// ClassifyError returns the class of err, the failure to send a request
+// upstream.
+func ClassifyError(err error) ErrorClass {
+	var derr *downstreamProxyError
+	var dnserr *net.DNSError
+	var uaerr x509.UnknownAuthorityError
+	var hnerr x509.HostnameError
+	var cierr x509.CertificateInvalidError
+	var nerr net.Error
+
+	switch {
+	case errors.As(err, &derr):
+		return ErrorDownstreamProxy
+	case errors.As(err, &dnserr):
+		return ErrorDNS
+	case errors.As(err, &uaerr), errors.As(err, &hnerr), errors.As(err, &cierr):
+		return ErrorTLSVerify
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorConnectionRefused
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &nerr) && nerr.Timeout():
+		return ErrorTimeout
+	}
+
+	return ErrorUnknown
+}
+
+// ErrorInfo describes the failure to send a request upstream to the template
+// of an error page.
+type ErrorInfo struct {
+	Class      ErrorClass
+	StatusCode int
+	// Status is the status line of the response, such as "502 Bad Gateway".
+	Status string
+	// Title and Message describe the class of the failure for humans.
+	Title   string
+	Message string
+	// Error is the text of the error itself.
+	Error string
+
+	Method string
+	URL    string
+	Host   string
+}
+
+// ErrorPage is the response sent to the client for a class of failures.
+type ErrorPage struct {
+	StatusCode  int
+	ContentType string
+	// Template renders the body of the response from an *ErrorInfo. When nil,
+	// the response has an empty body.
+	Template *template.Template
+}
+
+// ErrorTemplateFuncs are the functions available to error page templates in
+// addition to the predefined functions of text/template, such as html.
+var ErrorTemplateFuncs = template.FuncMap{
+	// json encodes its argument as JSON.
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// NewErrorPage returns an error page with the status code and content type
+// that renders the template text.
+func NewErrorPage(statusCode int, contentType, text string) (*ErrorPage, error) {
+	tmpl, err := template.New("errorpage").Funcs(ErrorTemplateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ErrorPage{
+		StatusCode:  statusCode,
+		ContentType: contentType,
+		Template:    tmpl,
+	}, nil
+}
+
+// DefaultHTMLErrorTemplate is the template of the default HTML error pages.
+const DefaultHTMLErrorTemplate = `<!DOCTYPE html>
+<html>
+<head><title>{{html .Status}}</title></head>
+<body>
+<h1>{{html .Title}}</h1>
+<p>{{html .Message}}</p>
+<pre>{{html .Error}}</pre>
+</body>
+</html>
+`
+
+// DefaultJSONErrorTemplate is the template of the default JSON error pages.
+const DefaultJSONErrorTemplate = `{"status":{{.StatusCode}},"class":{{json .Class}},"title":{{json .Title}},"message":{{json .Message}},"error":{{json .Error}},"url":{{json .URL}}}
+`
+
+// errorDescriptions are the titles and messages of each class of failure. The
+// messages are formatted with the host of the request.
+var errorDescriptions = map[ErrorClass][2]string{
+	ErrorDNS:               {"Host not found", "The host name %s could not be resolved."},
+	ErrorConnectionRefused: {"Connection refused", "The connection to %s was refused."},
+	ErrorTLSVerify:         {"Certificate verification failed", "The certificate of %s could not be verified."},
+	ErrorTimeout:           {"Gateway timeout", "The request to %s timed out."},
+	ErrorDownstreamProxy:   {"Downstream proxy refused the request", "The downstream proxy refused to forward the request to %s."},
+	ErrorUnknown:           {"Bad gateway", "The request to %s failed."},
+}
+
+// defaultErrorStatus returns the default status code of the error page for
+// class.
+func defaultErrorStatus(class ErrorClass) int {
+	if class == ErrorTimeout {
+		return http.StatusGatewayTimeout
+	}
+
+	return http.StatusBadGateway
+}
+
+// ErrorPages maps the classes of failures to send requests upstream to the
+// error pages sent to the client.
+type ErrorPages struct {
+	mu    sync.RWMutex
+	pages map[ErrorClass]*ErrorPage
+}
+
+// NewErrorPages returns the default error pages, which render
+// DefaultHTMLErrorTemplate with 504 Gateway Timeout for timeouts and 502 Bad
+// Gateway for all other failures.
+func NewErrorPages() *ErrorPages {
+	return newErrorPages("text/html; charset=utf-8", DefaultHTMLErrorTemplate)
+}
+
+// NewJSONErrorPages returns error pages like NewErrorPages that render
+// DefaultJSONErrorTemplate.
+func NewJSONErrorPages() *ErrorPages {
+	return newErrorPages("application/json", DefaultJSONErrorTemplate)
+}
+
+func newErrorPages(contentType, text string) *ErrorPages {
+	ep := &ErrorPages{
+		pages: make(map[ErrorClass]*ErrorPage),
+	}
+
+	for class := range errorDescriptions {
+		page, err := NewErrorPage(defaultErrorStatus(class), contentType, text)
+		if err != nil {
+			panic(err)
+		}
+		ep.pages[class] = page
+	}
+
+	return ep
+}
+
+// SetPage sets the error page for class. A nil page restores the empty 502 Bad
+// Gateway response.
+func (ep *ErrorPages) SetPage(class ErrorClass, page *ErrorPage) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	ep.pages[class] = page
+}
+
+// Page returns the error page for class.
+func (ep *ErrorPages) Page(class ErrorClass) *ErrorPage {
+	ep.mu.RLock()
+	defer ep.mu.RUnlock()
+
+	return ep.pages[class]
+}
+
+// Response returns the response to req for the failure err to send it
+// upstream. The error is also added to the response as a Warning header.
+func (ep *ErrorPages) Response(req *http.Request, err error) *http.Response {
+	class := ClassifyError(err)
+
+	page := ep.Page(class)
+	if page == nil {
+		page = &ErrorPage{StatusCode: http.StatusBadGateway}
+	}
+
+	var body []byte
+	if page.Template != nil {
+		info := newErrorInfo(req, class, page.StatusCode, err)
+
+		buf := &bytes.Buffer{}
+		if terr := page.Template.Execute(buf, info); terr != nil {
+			log.Errorf("martian: failed to render error page for %s: %v", class, terr)
+		} else {
+			body = buf.Bytes()
+		}
+	}
+
+	res := proxyutil.NewResponse(page.StatusCode, bytes.NewReader(body), req)
+	res.ContentLength = int64(len(body))
+	if len(body) > 0 && page.ContentType != "" {
+		res.Header.Set("Content-Type", page.ContentType)
+	}
+	proxyutil.Warning(res.Header, err)
+
+	return res
+}
+
+func newErrorInfo(req *http.Request, class ErrorClass, statusCode int, err error) *ErrorInfo {
+	desc, ok := errorDescriptions[class]
+	if !ok {
+		desc = errorDescriptions[ErrorUnknown]
+	}
+
+	info := &ErrorInfo{
+		Class:      class,
+		StatusCode: statusCode,
+		Status:     fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		Title:      desc[0],
+		Message:    fmt.Sprintf(desc[1], req.URL.Host),
+		Error:      err.Error(),
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		Host:       req.URL.Host,
+	}
+
+	// Passing the 407 of a downstream proxy on would prompt the client for the
+	// credentials of the wrong proxy, so explain how to configure them instead.
+	var derr *downstreamProxyError
+	if errors.As(err, &derr) && derr.statusCode == http.StatusProxyAuthRequired {
+		host := derr.proxyURL.Host
+
+		info.Title = "Downstream proxy authentication failed"
+		info.Message = fmt.Sprintf("The downstream proxy %s requires authentication. Set the credentials as "+
+			"the user information of the downstream proxy URL, as in http://user:password@%s.", host, host)
+		if derr.proxyURL.User != nil {
+			info.Message = fmt.Sprintf("The downstream proxy %s rejected the credentials of user %q. Check the "+
+				"user information of the downstream proxy URL.", host, derr.proxyURL.User.Username())
+		}
+	}
+
+	return info
+}
+
+// SetErrorPages sets the error pages sent to clients when requests can not be
+// sent upstream, for plain, CONNECT and MITM requests alike. When nil, the
+// default pages of NewErrorPages are sent.
+func (p *Proxy) SetErrorPages(ep *ErrorPages) {
+	p.errorPages = ep
+}
+
+// errorResponse returns the response to req for the failure err to send it
+// upstream.
+func (p *Proxy) errorResponse(req *http.Request, err error) *http.Response {
+	ep := p.errorPages
+	if ep == nil {
+		ep = defaultErrorPages
+	}
+
+	return ep.Response(req, err)
+}
+
+var defaultErrorPages = NewErrorPages()
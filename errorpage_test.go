@@ -0,0 +1,309 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/martian/v3/martiantest"
+	"github.com/google/martian/v3/mitm"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyError(t *testing.T) {
+	tt := []struct {
+		err  error
+		want ErrorClass
+	}{
+		{
+			err: &url.Error{Op: "Get", URL: "http://example.com", Err: &net.OpError{
+				Op:  "dial",
+				Net: "tcp",
+				Err: &net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true},
+			}},
+			want: ErrorDNS,
+		},
+		{
+			err: &net.OpError{
+				Op:  "dial",
+				Net: "tcp",
+				Err: os.NewSyscallError("connect", syscall.ECONNREFUSED),
+			},
+			want: ErrorConnectionRefused,
+		},
+		{
+			err:  fmt.Errorf("tls: %w", x509.UnknownAuthorityError{}),
+			want: ErrorTLSVerify,
+		},
+		{
+			err:  x509.HostnameError{Certificate: &x509.Certificate{}, Host: "example.com"},
+			want: ErrorTLSVerify,
+		},
+		{
+			err:  &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}},
+			want: ErrorTimeout,
+		},
+		{
+			err:  fmt.Errorf("round trip: %w", context.DeadlineExceeded),
+			want: ErrorTimeout,
+		},
+		{
+			err:  &downstreamProxyError{proxyURL: &url.URL{Host: "proxy.corp:3128"}, statusCode: 403},
+			want: ErrorDownstreamProxy,
+		},
+		{
+			err:  errors.New("something else"),
+			want: ErrorUnknown,
+		},
+	}
+
+	for i, tc := range tt {
+		if got := ClassifyError(tc.err); got != tc.want {
+			t.Errorf("%d. ClassifyError(%v): got %q, want %q", i, tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestErrorPagesResponse(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://example.com/path", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	ep := NewJSONErrorPages()
+
+	res := ep.Response(req, &net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true})
+	if got, want := res.StatusCode, 502; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+	if got, want := res.Header.Get("Content-Type"), "application/json"; got != want {
+		t.Errorf("res.Header.Get(%q): got %q, want %q", "Content-Type", got, want)
+	}
+	if got, want := res.Header.Get("Warning"), "no such host"; !strings.Contains(got, want) {
+		t.Errorf("res.Header.Get(%q): got %q, want to contain %q", "Warning", got, want)
+	}
+
+	var body struct {
+		Status  int
+		Class   string
+		Message string
+		URL     string
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatalf("json.Decode(): got %v, want no error", err)
+	}
+	if got, want := body.Status, 502; got != want {
+		t.Errorf("body.Status: got %d, want %d", got, want)
+	}
+	if got, want := body.Class, "dns"; got != want {
+		t.Errorf("body.Class: got %q, want %q", got, want)
+	}
+	if got, want := body.Message, "The host name example.com could not be resolved."; got != want {
+		t.Errorf("body.Message: got %q, want %q", got, want)
+	}
+	if got, want := body.URL, "http://example.com/path"; got != want {
+		t.Errorf("body.URL: got %q, want %q", got, want)
+	}
+
+	page, err := NewErrorPage(599, "text/plain", "{{.Class}} {{.Method}} {{.Host}}")
+	if err != nil {
+		t.Fatalf("NewErrorPage(): got %v, want no error", err)
+	}
+	ep.SetPage(ErrorTimeout, page)
+
+	res = ep.Response(req, context.DeadlineExceeded)
+	if got, want := res.StatusCode, 599; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+	got, _ := ioutil.ReadAll(res.Body)
+	if want := "timeout GET example.com"; string(got) != want {
+		t.Errorf("res.Body: got %q, want %q", got, want)
+	}
+
+	ep.SetPage(ErrorUnknown, nil)
+
+	res = ep.Response(req, errors.New("something else"))
+	if got, want := res.StatusCode, 502; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+	if got, want := res.ContentLength, int64(0); got != want {
+		t.Errorf("res.ContentLength: got %d, want %d", got, want)
+	}
+}
+
+func TestIntegrationErrorPages(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	p.SetTimeout(500 * time.Millisecond)
+	p.SetErrorPages(NewJSONErrorPages())
+
+	tr := martiantest.NewTransport()
+	tr.Func(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Scheme == "https" {
+			return nil, &url.Error{Op: "Get", URL: req.URL.String(), Err: x509.UnknownAuthorityError{}}
+		}
+		return nil, &url.Error{Op: "Get", URL: req.URL.String(), Err: timeoutError{}}
+	})
+	p.SetRoundTripper(tr)
+
+	ca, priv, err := mitm.NewAuthority("martian.proxy", "Martian Authority", 2*time.Hour)
+	if err != nil {
+		t.Fatalf("mitm.NewAuthority(): got %v, want no error", err)
+	}
+	mc, err := mitm.NewConfig(ca, priv)
+	if err != nil {
+		t.Fatalf("mitm.NewConfig(): got %v, want no error", err)
+	}
+
+	go p.Serve(l)
+
+	readClass := func(t *testing.T, res *http.Response) string {
+		t.Helper()
+
+		var body struct{ Class string }
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			t.Fatalf("json.Decode(): got %v, want no error", err)
+		}
+		return body.Class
+	}
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+
+	// Plain requests.
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.WriteProxy(conn); err != nil {
+		t.Fatalf("req.WriteProxy(): got %v, want no error", err)
+	}
+
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	if got, want := res.StatusCode, 504; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+	if got, want := readClass(t, res), "timeout"; got != want {
+		t.Errorf("class: got %q, want %q", got, want)
+	}
+	res.Body.Close()
+
+	// CONNECT requests.
+	req, err = http.NewRequest("CONNECT", "//"+unreachableAddr(t), nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("req.Write(): got %v, want no error", err)
+	}
+
+	res, err = http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	if got, want := res.StatusCode, 502; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+	if got, want := readClass(t, res), "connection_refused"; got != want {
+		t.Errorf("class: got %q, want %q", got, want)
+	}
+	res.Body.Close()
+
+	// MITM requests.
+	p.SetMITM(mc)
+
+	req, err = http.NewRequest("CONNECT", "//example.com:443", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("req.Write(): got %v, want no error", err)
+	}
+
+	res, err = http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	res.Body.Close()
+	if got, want := res.StatusCode, 200; got != want {
+		t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	tlsconn := tls.Client(conn, &tls.Config{
+		ServerName: "example.com",
+		RootCAs:    roots,
+	})
+	defer tlsconn.Close()
+
+	req, err = http.NewRequest("GET", "https://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.Write(tlsconn); err != nil {
+		t.Fatalf("req.Write(): got %v, want no error", err)
+	}
+
+	res, err = http.ReadResponse(bufio.NewReader(tlsconn), req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	defer res.Body.Close()
+
+	if got, want := res.StatusCode, 502; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+	if got, want := readClass(t, res), "tls_verify"; got != want {
+		t.Errorf("class: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// errExpectationDone is returned when the body of a request with Expect:
+// 100-continue is read after the final response has started, since the client
+// was never asked to send it.
+var errExpectationDone = errors.New("martian: request body read after the final response started")
+
+// expectsContinue returns whether the client waits for a 100 Continue response
+// before sending the body of req.
+func expectsContinue(req *http.Request) bool {
+	return req.Body != nil && req.Body != http.NoBody && req.ProtoAtLeast(1, 1) &&
+		strings.EqualFold(req.Header.Get("Expect"), "100-continue")
+}
+
+// expectContinueBody is the body of a request with Expect: 100-continue. The
+// client is only asked to send the body, with a 100 Continue response, once the
+// body is first read. Request modifiers that skip the round trip without
+// reading the body, and upstream servers that reply with a final response
+// before asking for the body, reject the request before it is sent.
+type expectContinueBody struct {
+	io.ReadCloser
+	w *bufio.Writer
+
+	mu       sync.Mutex
+	sent     bool
+	finished bool
+	err      error
+}
+
+func (b *expectContinueBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	if !b.sent {
+		if b.finished {
+			b.mu.Unlock()
+			return 0, errExpectationDone
+		}
+
+		b.sent = true
+		b.w.WriteString("HTTP/1.1 100 Continue\r\n\r\n")
+		b.err = b.w.Flush()
+	}
+	err := b.err
+	b.mu.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return b.ReadCloser.Read(p)
+}
+
+// Close closes the body. A body that the client was not asked to send is not
+// read to its end, since the client may never send it.
+func (b *expectContinueBody) Close() error {
+	b.mu.Lock()
+	sent := b.sent
+	b.mu.Unlock()
+
+	if !sent {
+		return nil
+	}
+
+	return b.ReadCloser.Close()
+}
+
+// finish is called before the final response is written, and returns whether
+// the client was asked to send the body. The connection must be closed after
+// responding to a request whose body was not asked for, since the client may
+// or may not send it anyway.
+func (b *expectContinueBody) finish() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.finished = true
+	return b.sent
+}
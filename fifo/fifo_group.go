@@ -21,6 +21,7 @@
 package fifo
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"sync"
@@ -89,6 +90,12 @@ func (g *Group) AddResponseModifier(resmod martian.ResponseModifier) {
 // aggregateErrors is set to true, the errors returned by each modifier in the group are
 // aggregated.
 func (g *Group) ModifyRequest(req *http.Request) error {
+	return g.ModifyRequestContext(context.Background(), req)
+}
+
+// ModifyRequestContext modifies the request like ModifyRequest, passing ctx to
+// each modifier in the group that accepts a context.
+func (g *Group) ModifyRequestContext(ctx context.Context, req *http.Request) error {
 	log.Debugf("fifo.ModifyRequest: %s", req.URL)
 	g.reqmu.RLock()
 	defer g.reqmu.RUnlock()
@@ -96,7 +103,7 @@ func (g *Group) ModifyRequest(req *http.Request) error {
 	merr := martian.NewMultiError()
 
 	for _, reqmod := range g.reqmods {
-		if err := reqmod.ModifyRequest(req); err != nil {
+		if err := martian.ModifyRequestWithContext(ctx, reqmod, req); err != nil {
 			if g.aggregateErrors {
 				merr.Add(err)
 				continue
@@ -118,6 +125,12 @@ func (g *Group) ModifyRequest(req *http.Request) error {
 // aggregateErrors is set to true, the errors returned by each modifier in the group are
 // aggregated.
 func (g *Group) ModifyResponse(res *http.Response) error {
+	return g.ModifyResponseContext(context.Background(), res)
+}
+
+// ModifyResponseContext modifies the response like ModifyResponse, passing ctx
+// to each modifier in the group that accepts a context.
+func (g *Group) ModifyResponseContext(ctx context.Context, res *http.Response) error {
 	requ := ""
 	if res.Request != nil {
 		requ = res.Request.URL.String()
@@ -129,7 +142,7 @@ func (g *Group) ModifyResponse(res *http.Response) error {
 	merr := martian.NewMultiError()
 
 	for _, resmod := range g.resmods {
-		if err := resmod.ModifyResponse(res); err != nil {
+		if err := martian.ModifyResponseWithContext(ctx, resmod, res); err != nil {
 			if g.aggregateErrors {
 				merr.Add(err)
 				continue
@@ -15,6 +15,7 @@
 package fifo
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -245,6 +246,36 @@ func TestModifyResponseAggregatesErrors(t *testing.T) {
 	}
 }
 
+func TestModifyContext(t *testing.T) {
+	fg := NewGroup()
+	tm := martiantest.NewModifier()
+
+	fg.AddRequestModifier(tm)
+	fg.AddResponseModifier(tm)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := fg.ModifyRequestContext(ctx, req); err != nil {
+		t.Fatalf("fg.ModifyRequestContext(): got %v, want no error", err)
+	}
+	if got := tm.RequestContext(); got != ctx {
+		t.Errorf("tm.RequestContext(): got %v, want %v", got, ctx)
+	}
+
+	res := proxyutil.NewResponse(200, nil, req)
+	if err := fg.ModifyResponseContext(ctx, res); err != nil {
+		t.Fatalf("fg.ModifyResponseContext(): got %v, want no error", err)
+	}
+	if got := tm.ResponseContext(); got != ctx {
+		t.Errorf("tm.ResponseContext(): got %v, want %v", got, ctx)
+	}
+}
+
 func TestVerifyRequests(t *testing.T) {
 	fg := NewGroup()
 
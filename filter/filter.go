@@ -17,6 +17,7 @@
 package filter
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 
@@ -122,6 +123,12 @@ func (f *Filter) ResponseWhenFalse(mod martian.ResponseModifier) {
 // ModifyRequest evaluates reqcond and executes treqmod iff reqcond evaluates
 // to true; otherwise, freqmod is executed.
 func (f *Filter) ModifyRequest(req *http.Request) error {
+	return f.ModifyRequestContext(context.Background(), req)
+}
+
+// ModifyRequestContext modifies the request like ModifyRequest, passing ctx to
+// the executed modifier if it accepts a context.
+func (f *Filter) ModifyRequestContext(ctx context.Context, req *http.Request) error {
 	if f.reqcond == nil {
 		return fmt.Errorf("filter.ModifyRequest: no request condition set. Set condition with SetRequestCondition")
 	}
@@ -129,15 +136,21 @@ func (f *Filter) ModifyRequest(req *http.Request) error {
 	match := f.reqcond.MatchRequest(req)
 	if match {
 		log.Debugf("filter.ModifyRequest: matched %s", req.URL)
-		return f.treqmod.ModifyRequest(req)
+		return martian.ModifyRequestWithContext(ctx, f.treqmod, req)
 	}
 
-	return f.freqmod.ModifyRequest(req)
+	return martian.ModifyRequestWithContext(ctx, f.freqmod, req)
 }
 
 // ModifyResponse evaluates rescond and executes tresmod iff rescond evaluates
 // to true; otherwise, fresmod is executed.
 func (f *Filter) ModifyResponse(res *http.Response) error {
+	return f.ModifyResponseContext(context.Background(), res)
+}
+
+// ModifyResponseContext modifies the response like ModifyResponse, passing ctx
+// to the executed modifier if it accepts a context.
+func (f *Filter) ModifyResponseContext(ctx context.Context, res *http.Response) error {
 	if f.rescond == nil {
 		return fmt.Errorf("filter.ModifyResponse: no response condition set. Set condition with SetResponseCondition")
 	}
@@ -149,10 +162,10 @@ func (f *Filter) ModifyResponse(res *http.Response) error {
 			requ = res.Request.URL.String()
 		}
 		log.Debugf("filter.ModifyResponse: %s", requ)
-		return f.tresmod.ModifyResponse(res)
+		return martian.ModifyResponseWithContext(ctx, f.tresmod, res)
 	}
 
-	return f.fresmod.ModifyResponse(res)
+	return martian.ModifyResponseWithContext(ctx, f.fresmod, res)
 }
 
 // VerifyRequests returns an error containing all the verification errors
@@ -15,6 +15,7 @@
 package filter
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"testing"
@@ -146,6 +147,38 @@ func TestResponseWhenFalseCondition(t *testing.T) {
 	}
 }
 
+func TestModifyContext(t *testing.T) {
+	f := New()
+	f.SetRequestCondition(martiantest.NewMatcher())
+	f.SetResponseCondition(martiantest.NewMatcher())
+
+	tm := martiantest.NewModifier()
+	f.RequestWhenTrue(tm)
+	f.ResponseWhenTrue(tm)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := f.ModifyRequestContext(ctx, req); err != nil {
+		t.Fatalf("f.ModifyRequestContext(): got %v, want no error", err)
+	}
+	if got := tm.RequestContext(); got != ctx {
+		t.Errorf("tm.RequestContext(): got %v, want %v", got, ctx)
+	}
+
+	res := proxyutil.NewResponse(200, nil, req)
+	if err := f.ModifyResponseContext(ctx, res); err != nil {
+		t.Fatalf("f.ModifyResponseContext(): got %v, want no error", err)
+	}
+	if got := tm.ResponseContext(); got != ctx {
+		t.Errorf("tm.ResponseContext(): got %v, want %v", got, ctx)
+	}
+}
+
 func TestResetVerifications(t *testing.T) {
 	filter := New()
 
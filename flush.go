@@ -0,0 +1,151 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FlushImmediately is a flush interval that flushes the response to the client
+// after every write.
+const FlushImmediately time.Duration = -1
+
+// FlushPolicy returns how often the body of res is flushed to the client while
+// it is written: after every write when negative, at most once per interval
+// when positive, and only once the full response is written when zero.
+//
+// The policy is consulted after the response modifiers have run, and only for
+// responses whose context does not set a flush interval.
+type FlushPolicy func(res *http.Response) time.Duration
+
+// FlushContentTypes returns a FlushPolicy that flushes responses with one of
+// the given content types every interval.
+func FlushContentTypes(interval time.Duration, cts ...string) FlushPolicy {
+	return func(res *http.Response) time.Duration {
+		rct := strings.ToLower(res.Header.Get("Content-Type"))
+
+		for _, ct := range cts {
+			if strings.HasPrefix(rct, strings.ToLower(ct)) {
+				return interval
+			}
+		}
+
+		return 0
+	}
+}
+
+// defaultFlushPolicy flushes Server-Sent Events as soon as they are written.
+var defaultFlushPolicy = FlushContentTypes(FlushImmediately, "text/event-stream")
+
+// SetFlushPolicy sets the policy that decides how often response bodies are
+// flushed to the client. By default, text/event-stream responses are flushed
+// after every write and all other responses are flushed once written in full.
+// A nil policy never flushes before the full response is written.
+func (p *Proxy) SetFlushPolicy(policy FlushPolicy) {
+	p.flushPolicy = policy
+}
+
+// flushInterval returns the flush interval for res.
+func (p *Proxy) flushInterval(ctx *Context, res *http.Response) time.Duration {
+	if interval := ctx.FlushInterval(); interval != 0 {
+		return interval
+	}
+	if p.flushPolicy == nil {
+		return 0
+	}
+
+	return p.flushPolicy(res)
+}
+
+// maxLatencyWriter flushes writes to the underlying writer after every write
+// when latency is negative, or at most latency after a write otherwise.
+type maxLatencyWriter struct {
+	dst     *bufio.Writer
+	latency time.Duration
+
+	mu           sync.Mutex // protects dst, t and flushPending
+	t            *time.Timer
+	flushPending bool
+}
+
+// newFlushWriter returns w unchanged when interval is zero, or a writer that
+// flushes w according to interval otherwise. The returned function stops any
+// pending flush and must be called before w is used directly again.
+func newFlushWriter(w *bufio.Writer, interval time.Duration) (io.Writer, func()) {
+	if interval == 0 {
+		return w, func() {}
+	}
+
+	mlw := &maxLatencyWriter{
+		dst:     w,
+		latency: interval,
+	}
+
+	return mlw, mlw.stop
+}
+
+func (m *maxLatencyWriter) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n, err := m.dst.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	if m.latency < 0 {
+		return n, m.dst.Flush()
+	}
+	if m.flushPending {
+		return n, nil
+	}
+
+	if m.t == nil {
+		m.t = time.AfterFunc(m.latency, m.delayedFlush)
+	} else {
+		m.t.Reset(m.latency)
+	}
+	m.flushPending = true
+
+	return n, nil
+}
+
+func (m *maxLatencyWriter) delayedFlush() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// stop may have been called, or the write that scheduled the flush failed.
+	if !m.flushPending {
+		return
+	}
+
+	m.dst.Flush()
+	m.flushPending = false
+}
+
+func (m *maxLatencyWriter) stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.flushPending = false
+	if m.t != nil {
+		m.t.Stop()
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package flush provides a modifier that sets how often the response body is
+// flushed to the client, such as for Server-Sent Events or other streamed
+// responses matched by a filter.
+package flush
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/martian/v3"
+	"github.com/google/martian/v3/parse"
+)
+
+// Modifier sets the flush interval of the response on the context of the
+// request. It can be used as a request or response modifier.
+type Modifier struct {
+	interval time.Duration
+}
+
+type modifierJSON struct {
+	Interval string               `json:"interval"`
+	Scope    []parse.ModifierType `json:"scope"`
+}
+
+func init() {
+	parse.Register("flush.Modifier", modifierFromJSON)
+}
+
+// NewModifier returns a modifier that sets the flush interval to interval. A
+// negative interval, such as martian.FlushImmediately, flushes the response
+// after every write.
+func NewModifier(interval time.Duration) *Modifier {
+	return &Modifier{
+		interval: interval,
+	}
+}
+
+// ModifyRequest sets the flush interval for the response to the request.
+func (m *Modifier) ModifyRequest(req *http.Request) error {
+	ctx := martian.NewContext(req)
+	ctx.SetFlushInterval(m.interval)
+
+	return nil
+}
+
+// ModifyResponse sets the flush interval for the response.
+func (m *Modifier) ModifyResponse(res *http.Response) error {
+	ctx := martian.NewContext(res.Request)
+	ctx.SetFlushInterval(m.interval)
+
+	return nil
+}
+
+// modifierFromJSON builds a flush.Modifier from JSON. The interval is either
+// "immediate", to flush after every write, or a duration such as "100ms".
+//
+// Example JSON:
+// {
+//   "flush.Modifier": {
+//     "scope": ["response"],
+//     "interval": "immediate"
+//   }
+// }
+func modifierFromJSON(b []byte) (*parse.Result, error) {
+	msg := &modifierJSON{}
+	if err := json.Unmarshal(b, msg); err != nil {
+		return nil, err
+	}
+
+	interval := martian.FlushImmediately
+	if msg.Interval != "immediate" {
+		var err error
+		if interval, err = time.ParseDuration(msg.Interval); err != nil {
+			return nil, err
+		}
+		if interval <= 0 {
+			return nil, fmt.Errorf("flush.Modifier: interval must be positive, got %q", msg.Interval)
+		}
+	}
+
+	return parse.NewResult(NewModifier(interval), msg.Scope)
+}
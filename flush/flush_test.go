@@ -0,0 +1,89 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flush
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/martian/v3"
+	"github.com/google/martian/v3/parse"
+	"github.com/google/martian/v3/proxyutil"
+)
+
+func TestModifyResponse(t *testing.T) {
+	m := NewModifier(martian.FlushImmediately)
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	ctx, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("martian.TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	if got, want := ctx.FlushInterval(), time.Duration(0); got != want {
+		t.Fatalf("ctx.FlushInterval(): got %v, want %v", got, want)
+	}
+
+	res := proxyutil.NewResponse(200, nil, req)
+	if err := m.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+
+	if got, want := ctx.FlushInterval(), martian.FlushImmediately; got != want {
+		t.Errorf("ctx.FlushInterval(): got %v, want %v", got, want)
+	}
+}
+
+func TestFromJSON(t *testing.T) {
+	tt := []struct {
+		interval string
+		want     time.Duration
+	}{
+		{interval: "immediate", want: martian.FlushImmediately},
+		{interval: "250ms", want: 250 * time.Millisecond},
+	}
+
+	for _, tc := range tt {
+		msg := []byte(`{
+			"flush.Modifier": {
+				"scope": ["response"],
+				"interval": "` + tc.interval + `"
+			}
+		}`)
+
+		r, err := parse.FromJSON(msg)
+		if err != nil {
+			t.Fatalf("parse.FromJSON(%q): got %v, want no error", tc.interval, err)
+		}
+
+		m, ok := r.ResponseModifier().(*Modifier)
+		if !ok {
+			t.Fatalf("r.ResponseModifier().(*Modifier): got !ok, want ok")
+		}
+		if got := m.interval; got != tc.want {
+			t.Errorf("m.interval: got %v, want %v", got, tc.want)
+		}
+	}
+
+	if _, err := parse.FromJSON([]byte(`{"flush.Modifier": {"interval": "0s"}}`)); err == nil {
+		t.Error("parse.FromJSON(0s): got no error, want error")
+	}
+}
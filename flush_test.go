@@ -0,0 +1,139 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/martian/v3/martiantest"
+	"github.com/google/martian/v3/proxyutil"
+)
+
+func TestFlushContentTypes(t *testing.T) {
+	policy := FlushContentTypes(FlushImmediately, "text/event-stream")
+
+	tt := []struct {
+		ct   string
+		want time.Duration
+	}{
+		{ct: "text/event-stream", want: FlushImmediately},
+		{ct: "Text/Event-Stream; charset=utf-8", want: FlushImmediately},
+		{ct: "text/html", want: 0},
+		{ct: "", want: 0},
+	}
+
+	for _, tc := range tt {
+		res := proxyutil.NewResponse(200, nil, nil)
+		res.Header.Set("Content-Type", tc.ct)
+
+		if got := policy(res); got != tc.want {
+			t.Errorf("policy(%q): got %v, want %v", tc.ct, got, tc.want)
+		}
+	}
+}
+
+func TestIntegrationFlush(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		name string
+		ct   string
+		mod  func(res *http.Response)
+	}{
+		{
+			name: "default policy",
+			ct:   "text/event-stream",
+		},
+		{
+			name: "context interval",
+			ct:   "text/plain",
+			mod: func(res *http.Response) {
+				NewContext(res.Request).SetFlushInterval(10 * time.Millisecond)
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "[::]:0")
+			if err != nil {
+				t.Fatalf("net.Listen(): got %v, want no error", err)
+			}
+
+			p := NewProxy()
+			defer p.Close()
+
+			p.SetTimeout(5 * time.Second)
+
+			pr, pw := io.Pipe()
+			defer pw.Close()
+
+			tr := martiantest.NewTransport()
+			tr.Func(func(req *http.Request) (*http.Response, error) {
+				res := proxyutil.NewResponse(200, pr, req)
+				res.Header.Set("Content-Type", tc.ct)
+				res.ContentLength = -1
+				res.TransferEncoding = []string{"chunked"}
+
+				return res, nil
+			})
+			p.SetRoundTripper(tr)
+
+			if tc.mod != nil {
+				tm := martiantest.NewModifier()
+				tm.ResponseFunc(tc.mod)
+				p.SetResponseModifier(tm)
+			}
+
+			go p.Serve(l)
+
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatalf("net.Dial(): got %v, want no error", err)
+			}
+			defer conn.Close()
+
+			req, err := http.NewRequest("GET", "http://example.com/events", nil)
+			if err != nil {
+				t.Fatalf("http.NewRequest(): got %v, want no error", err)
+			}
+			if err := req.WriteProxy(conn); err != nil {
+				t.Fatalf("req.WriteProxy(): got %v, want no error", err)
+			}
+
+			go io.WriteString(pw, "data: event\n\n")
+
+			// The event must reach the client while the upstream body is still open.
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			res, err := http.ReadResponse(bufio.NewReader(conn), req)
+			if err != nil {
+				t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+			}
+
+			got := make([]byte, len("data: event\n\n"))
+			if _, err := io.ReadFull(res.Body, got); err != nil {
+				t.Fatalf("io.ReadFull(): got %v, want no error", err)
+			}
+			if want := "data: event\n\n"; string(got) != want {
+				t.Errorf("res.Body: got %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,700 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/martian/v3/h2"
+	"github.com/google/martian/v3/log"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// h2ConnectionHeaders are the connection-specific header fields that are not
+// allowed in HTTP/2.
+// https://tools.ietf.org/html/rfc7540#section-8.1.2.2
+var h2ConnectionHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+// H2StreamProcessorFactory returns an h2.StreamProcessorFactory that passes
+// the HTTP/2 streams relayed by the h2 package through the request and
+// response modifiers of the proxy, so that MITM'd HTTP/2 clients are handled
+// like HTTP/1.1 clients.
+//
+// The HEADERS and DATA frames of each message are buffered until the end of
+// the stream, assembled into an *http.Request or *http.Response, modified and
+// re-encoded as frames. Each stream is given its own session, which is marked
+// secure for https streams. Streams that can not be buffered, such as gRPC and
+// server-sent events, are relayed without being modified; gRPC traffic can be
+// processed with the h2/grpc package instead. The round trip can not be
+// skipped by modifiers and sessions can not be hijacked. Messages with a body
+// larger than the limit set with SetH2MaxBodySize are relayed unmodified once
+// the limit is exceeded. The context passed to the modifiers is cancelled when
+// the stream ends, is reset, or its connection is closed.
+//
+// The factory should be the first in h2.Config.StreamProcessorFactories so
+// that processors later in the chain observe the modified frames.
+func (p *Proxy) H2StreamProcessorFactory() h2.StreamProcessorFactory {
+	return func(u *url.URL, sinks *h2.Processors) (h2.Processor, h2.Processor) {
+		s := &h2Stream{proxy: p, url: u, client: sinks.ForDirection(h2.ServerToClient)}
+		s.ctx, s.cancel = context.WithCancel(p.ctx)
+		s.stop = context.AfterFunc(sinks.Context(), s.cancel)
+
+		cToS := &h2Processor{stream: s, dir: h2.ClientToServer, sink: sinks.ForDirection(h2.ClientToServer)}
+		sToC := &h2Processor{stream: s, dir: h2.ServerToClient, sink: sinks.ForDirection(h2.ServerToClient)}
+
+		return cToS, sToC
+	}
+}
+
+// DefaultH2MaxBodySize is the default maximum size of a message body buffered
+// by the processors of H2StreamProcessorFactory.
+const DefaultH2MaxBodySize = 16 << 20
+
+// SetH2MaxBodySize sets the maximum size in bytes of the body of an HTTP/2
+// message buffered to be passed through the modifiers by the processors of
+// H2StreamProcessorFactory. The stream of a message with a larger body is
+// relayed without being modified.
+func (p *Proxy) SetH2MaxBodySize(n int64) {
+	p.h2MaxBody = n
+}
+
+// proxyH2 relays HTTP/2 traffic between the MITM'd client connection, cc, and
+// the target of the CONNECT request. The server connection follows the same
+// egress path as HTTP/1.1 traffic.
+func (p *Proxy) proxyH2(cc net.Conn, req *http.Request) error {
+	sc, err := p.dialH2(req)
+	if err != nil {
+		return fmt.Errorf("connecting h2 to %v: %w", req.URL, err)
+	}
+	defer sc.Close()
+
+	return p.mitm.H2Config().Relay(p.closing, cc, sc, req.URL)
+}
+
+// dialH2 connects to the target of the CONNECT request with the dial function
+// of the proxy, through the downstream proxy if one is set, and negotiates h2
+// over TLS. The TLS client configuration and handshake timeout of the round
+// tripper apply when it is an *http.Transport.
+func (p *Proxy) dialH2(req *http.Request) (*tls.Conn, error) {
+	res, conn, err := p.connect(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.Body != nil {
+		res.Body.Close()
+	}
+	if res.StatusCode != 200 {
+		conn.Close()
+		return nil, fmt.Errorf("downstream proxy responded to CONNECT with %q", res.Status)
+	}
+
+	config := &tls.Config{}
+	timeout := p.timeout
+	if tr, ok := p.roundTripper.(*http.Transport); ok {
+		if tr.TLSClientConfig != nil {
+			config = tr.TLSClientConfig.Clone()
+		}
+		if tr.TLSHandshakeTimeout > 0 {
+			timeout = tr.TLSHandshakeTimeout
+		}
+	}
+	if config.ServerName == "" {
+		config.ServerName = req.URL.Hostname()
+	}
+	if rootCAs := p.mitm.H2Config().RootCAs; rootCAs != nil {
+		config.RootCAs = rootCAs
+	}
+	if p.mitm.SkippingTLSVerify() {
+		config.InsecureSkipVerify = true
+	}
+	config.NextProtos = []string{"h2"}
+
+	tlsconn := tls.Client(conn, config)
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := tlsconn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	if proto := tlsconn.ConnectionState().NegotiatedProtocol; proto != "h2" {
+		tlsconn.Close()
+		return nil, fmt.Errorf("server negotiated %q instead of h2", proto)
+	}
+
+	return tlsconn, nil
+}
+
+// isH2CPreface returns whether req is the start of the HTTP/2 connection
+// preface, which parses as a request with the PRI method.
+// https://tools.ietf.org/html/rfc7540#section-3.5
+func isH2CPreface(req *http.Request) bool {
+	return req.Method == "PRI" && req.RequestURI == "*" && req.ProtoMajor == 2
+}
+
+// h2cAllowedHost returns whether h2c connections to host are relayed through
+// the h2 package.
+func (p *Proxy) h2cAllowedHost(host string) bool {
+	return p.h2c != nil &&
+		p.h2c.AllowedHostsFilter != nil &&
+		p.h2c.AllowedHostsFilter(host)
+}
+
+// handleH2CPriorKnowledge relays a connection on which the client started
+// HTTP/2 without an upgrade, after the first line of the connection preface
+// was read as a request. The connection is relayed to the original
+// destination of the session through the h2 package, or tunneled if h2c is
+// not enabled for it.
+func (p *Proxy) handleH2CPriorKnowledge(session *Session, conn net.Conn, brw *bufio.ReadWriter) error {
+	dst := session.OriginalDestination()
+	if dst == "" {
+		log.Errorf("martian: received HTTP/2 connection preface without a known destination from %s", conn.RemoteAddr())
+		return errClose
+	}
+
+	// The remainder of the preface follows the PRI request.
+	rest := make([]byte, len(http2.ClientPreface)-len("PRI * HTTP/2.0\r\n\r\n"))
+	if _, err := io.ReadFull(brw, rest); err != nil {
+		return err
+	}
+	if !bytes.HasSuffix([]byte(http2.ClientPreface), rest) {
+		log.Errorf("martian: received invalid HTTP/2 connection preface from %s", conn.RemoteAddr())
+		return errClose
+	}
+
+	// HTTP/2 connections are long-lived and are not subject to the request
+	// timeout.
+	conn.SetDeadline(time.Time{})
+
+	preface := io.MultiReader(strings.NewReader(http2.ClientPreface), brw.Reader)
+	if !p.h2cAllowedHost(dst) {
+		p.tunnel(session, conn, bufio.NewReadWriter(bufio.NewReader(preface), brw.Writer), dst)
+		return errClose
+	}
+
+	res, sc, err := p.connect(connectRequest(dst))
+	if err != nil {
+		log.Errorf("martian: failed to connect h2c to %s: %v", dst, err)
+		return errClose
+	}
+	defer res.Body.Close()
+	defer sc.Close()
+
+	if res.StatusCode != 200 {
+		log.Errorf("martian: failed to connect h2c to %s: %s", dst, res.Status)
+		return errClose
+	}
+
+	p.hooks.h2Negotiated(session, dst)
+
+	cc := struct {
+		io.Reader
+		io.Writer
+	}{preface, conn}
+	if err := p.h2c.Relay(p.closing, cc, sc, &url.URL{Scheme: "http", Host: dst}); err != nil {
+		log.Errorf("martian: failed to proxy h2c for %s: %v", dst, err)
+	}
+
+	return errClose
+}
+
+// h2Stream holds the state of a stream that is shared by the processors for
+// both directions.
+type h2Stream struct {
+	proxy *Proxy
+	url   *url.URL
+	// client is the sink of the frames sent to the client, used to answer the
+	// stream when its request fails.
+	client h2.Processor
+	// ctx is passed to the modifiers, and cancelled by cancel once the stream
+	// is closed. stop stops cancelling it when the connection is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+	stop   func() bool
+
+	mu          sync.Mutex
+	passthrough bool
+	req         *http.Request
+}
+
+// bypass returns whether the stream is relayed without being modified.
+func (s *h2Stream) bypass() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.passthrough
+}
+
+// setBypass marks the stream to be relayed without being modified.
+func (s *h2Stream) setBypass() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.passthrough = true
+}
+
+// request returns the modified request of the stream, or nil if the request
+// has not been completely received.
+func (s *h2Stream) request() *http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.req
+}
+
+func (s *h2Stream) setRequest(req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.req = req
+}
+
+// close cancels the context of the stream and removes the context of the
+// request, if any.
+func (s *h2Stream) close() {
+	s.stop()
+	s.cancel()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.req != nil {
+		unlink(s.req)
+	}
+}
+
+// h2Processor buffers the message in one direction of a stream.
+type h2Processor struct {
+	stream *h2Stream
+	dir    h2.Direction
+	sink   h2.Processor
+
+	header   []hpack.HeaderField
+	priority http2.PriorityParam
+	body     bytes.Buffer
+	trailer  []hpack.HeaderField
+	done     bool
+}
+
+func (hp *h2Processor) Header(headers []hpack.HeaderField, streamEnded bool, priority http2.PriorityParam) error {
+	if hp.done || hp.stream.bypass() {
+		return hp.sink.Header(headers, streamEnded, priority)
+	}
+
+	if hp.header == nil {
+		// Informational responses precede the final response headers.
+		if hp.dir == h2.ServerToClient && strings.HasPrefix(h2FieldValue(headers, ":status"), "1") {
+			return hp.sink.Header(headers, streamEnded, priority)
+		}
+
+		if !h2Bufferable(headers) || (hp.dir == h2.ServerToClient && hp.stream.request() == nil) {
+			hp.stream.setBypass()
+			return hp.sink.Header(headers, streamEnded, priority)
+		}
+
+		hp.header = headers
+		hp.priority = priority
+	} else {
+		hp.trailer = headers
+	}
+
+	if streamEnded {
+		return hp.finish()
+	}
+
+	return nil
+}
+
+func (hp *h2Processor) Data(data []byte, streamEnded bool) error {
+	if hp.done || hp.stream.bypass() {
+		return hp.sink.Data(data, streamEnded)
+	}
+
+	if int64(hp.body.Len()+len(data)) > hp.stream.proxy.h2MaxBody {
+		return hp.passthrough(data, streamEnded)
+	}
+	hp.body.Write(data)
+
+	if streamEnded {
+		return hp.finish()
+	}
+
+	return nil
+}
+
+// passthrough forwards the buffered message followed by data, and relays the
+// rest of the stream without modifying it.
+func (hp *h2Processor) passthrough(data []byte, streamEnded bool) error {
+	log.Infof("martian: HTTP/2 message body for %s exceeds %d bytes, relaying stream unmodified", hp.stream.url, hp.stream.proxy.h2MaxBody)
+
+	hp.done = true
+	hp.stream.setBypass()
+	if hp.dir == h2.ServerToClient {
+		hp.stream.close()
+	}
+
+	if err := hp.sink.Header(hp.header, false, hp.priority); err != nil {
+		return err
+	}
+	if hp.body.Len() > 0 {
+		if err := hp.sink.Data(hp.body.Bytes(), false); err != nil {
+			return err
+		}
+	}
+	hp.body.Reset()
+
+	return hp.sink.Data(data, streamEnded)
+}
+
+func (hp *h2Processor) Priority(priority http2.PriorityParam) error {
+	return hp.sink.Priority(priority)
+}
+
+func (hp *h2Processor) RSTStream(errCode http2.ErrCode) error {
+	hp.done = true
+	hp.stream.close()
+
+	return hp.sink.RSTStream(errCode)
+}
+
+func (hp *h2Processor) PushPromise(promiseID uint32, headers []hpack.HeaderField) error {
+	return hp.sink.PushPromise(promiseID, headers)
+}
+
+// finish runs the buffered message through the modifiers and forwards it.
+func (hp *h2Processor) finish() error {
+	hp.done = true
+
+	if hp.dir == h2.ClientToServer {
+		return hp.finishRequest()
+	}
+
+	return hp.finishResponse()
+}
+
+func (hp *h2Processor) finishRequest() error {
+	p := hp.stream.proxy
+
+	req, err := h2Request(hp.stream.url, hp.header, hp.body.Bytes(), hp.trailer)
+	if err != nil {
+		log.Errorf("martian: failed to build HTTP/2 request: %v", err)
+		hp.stream.setBypass()
+		return hp.write(hp.header, hp.body.Bytes(), hp.trailer)
+	}
+
+	session, err := newSession(nil, nil)
+	if err != nil {
+		log.Errorf("martian: failed to build new session: %v", err)
+		hp.stream.setBypass()
+		return hp.write(hp.header, hp.body.Bytes(), hp.trailer)
+	}
+	if req.URL.Scheme == "https" {
+		session.MarkSecure()
+	}
+
+	ctx, err := withSession(session)
+	if err != nil {
+		log.Errorf("martian: failed to build new context: %v", err)
+		hp.stream.setBypass()
+		return hp.write(hp.header, hp.body.Bytes(), hp.trailer)
+	}
+
+	link(req, ctx)
+	hp.stream.setRequest(req)
+
+	reqerr := ModifyRequestWithContext(hp.stream.ctx, p.reqmod, req)
+	if reqerr != nil {
+		log.Errorf("martian: error modifying request: %v", reqerr)
+	}
+	switch p.modifierError("request", req, req.Header, reqerr) {
+	case CloseOnModifierError:
+		return fmt.Errorf("modifying request: %w", reqerr)
+	case FailOnModifierError:
+		// The stream is answered without being opened with the server, so
+		// none of its frames are received from the server and the response
+		// is written to the client on this thread.
+		return hp.stream.respond(p.modifierErrorResponse(req, reqerr), http2.PriorityParam{})
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return fmt.Errorf("reading modified request body: %w", err)
+	}
+	if req.Header.Get("Content-Length") != "" {
+		req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	header := []hpack.HeaderField{
+		{Name: ":method", Value: req.Method},
+		{Name: ":scheme", Value: req.URL.Scheme},
+		{Name: ":authority", Value: host},
+		{Name: ":path", Value: req.URL.RequestURI()},
+	}
+
+	return hp.write(h2HeaderFields(header, req.Header), body, h2HeaderFields(nil, req.Trailer))
+}
+
+func (hp *h2Processor) finishResponse() error {
+	req := hp.stream.request()
+	res, err := h2Response(req, hp.header, hp.body.Bytes(), hp.trailer)
+	if err != nil {
+		defer hp.stream.close()
+
+		log.Errorf("martian: failed to build HTTP/2 response: %v", err)
+		return hp.write(hp.header, hp.body.Bytes(), hp.trailer)
+	}
+
+	return hp.stream.respond(res, hp.priority)
+}
+
+// write forwards the message as HEADERS, DATA and trailing HEADERS frames.
+func (hp *h2Processor) write(header []hpack.HeaderField, body []byte, trailer []hpack.HeaderField) error {
+	return h2Write(hp.sink, header, body, trailer, hp.priority)
+}
+
+// respond runs res, the response to the request of the stream, through the
+// response modifiers, writes it to the client and closes the stream.
+func (s *h2Stream) respond(res *http.Response, priority http2.PriorityParam) error {
+	p := s.proxy
+	defer s.close()
+
+	req := s.request()
+	reserr := ModifyResponseWithContext(s.ctx, p.resmod, res)
+	if reserr != nil {
+		log.Errorf("martian: error modifying response: %v", reserr)
+	}
+	switch p.modifierError("response", req, res.Header, reserr) {
+	case CloseOnModifierError:
+		return fmt.Errorf("modifying response: %w", reserr)
+	case FailOnModifierError:
+		res = p.modifierErrorResponse(req, reserr)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return fmt.Errorf("reading modified response body: %w", err)
+	}
+	if res.Header.Get("Content-Length") != "" && req.Method != "HEAD" {
+		res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	header := []hpack.HeaderField{
+		{Name: ":status", Value: strconv.Itoa(res.StatusCode)},
+	}
+
+	return h2Write(s.client, h2HeaderFields(header, res.Header), body, h2HeaderFields(nil, res.Trailer), priority)
+}
+
+// h2Write writes a message to sink as HEADERS, DATA and trailing HEADERS
+// frames.
+func h2Write(sink h2.Processor, header []hpack.HeaderField, body []byte, trailer []hpack.HeaderField, priority http2.PriorityParam) error {
+	if err := sink.Header(header, len(body) == 0 && len(trailer) == 0, priority); err != nil {
+		return err
+	}
+
+	if len(body) > 0 {
+		if err := sink.Data(body, len(trailer) == 0); err != nil {
+			return err
+		}
+	}
+
+	if len(trailer) > 0 {
+		return sink.Header(trailer, true, http2.PriorityParam{})
+	}
+
+	return nil
+}
+
+// h2Request builds a request from the header fields, body and trailer fields
+// of a stream sent to u.
+func h2Request(u *url.URL, fields []hpack.HeaderField, body []byte, trailer []hpack.HeaderField) (*http.Request, error) {
+	header := h2Header(fields)
+
+	method := h2FieldValue(fields, ":method")
+	path := h2FieldValue(fields, ":path")
+	if method == "" || path == "" {
+		return nil, fmt.Errorf("missing :method or :path in %v", fields)
+	}
+
+	ru, err := url.ParseRequestURI(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ru.Scheme = h2FieldValue(fields, ":scheme")
+	if ru.Scheme == "" {
+		ru.Scheme = "https"
+	}
+	ru.Host = h2FieldValue(fields, ":authority")
+	if ru.Host == "" {
+		ru.Host = header.Get("Host")
+	}
+	if ru.Host == "" {
+		ru.Host = u.Host
+	}
+	header.Del("Host")
+
+	return &http.Request{
+		Method:        method,
+		URL:           ru,
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		ProtoMinor:    0,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Host:          ru.Host,
+		Trailer:       h2Trailer(trailer),
+	}, nil
+}
+
+// h2Response builds a response to req from the header fields, body and
+// trailer fields of a stream.
+func h2Response(req *http.Request, fields []hpack.HeaderField, body []byte, trailer []hpack.HeaderField) (*http.Response, error) {
+	code, err := strconv.Atoi(h2FieldValue(fields, ":status"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid :status in %v", fields)
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		ProtoMinor:    0,
+		Header:        h2Header(fields),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Trailer:       h2Trailer(trailer),
+		Request:       req,
+	}, nil
+}
+
+// h2Bufferable returns whether the message with the header fields can be
+// buffered until the end of the stream.
+func h2Bufferable(fields []hpack.HeaderField) bool {
+	if h2FieldValue(fields, ":method") == "CONNECT" {
+		return false
+	}
+
+	for _, f := range fields {
+		if f.Name != "content-type" {
+			continue
+		}
+
+		ct := strings.ToLower(f.Value)
+		if strings.HasPrefix(ct, "application/grpc") || strings.HasPrefix(ct, "text/event-stream") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// h2FieldValue returns the value of the first header field with name.
+func h2FieldValue(fields []hpack.HeaderField, name string) string {
+	for _, f := range fields {
+		if f.Name == name {
+			return f.Value
+		}
+	}
+
+	return ""
+}
+
+// h2Header converts the regular header fields to an http.Header. Cookie fields
+// are joined into a single header as they would be in HTTP/1.1.
+// https://tools.ietf.org/html/rfc7540#section-8.1.2.5
+func h2Header(fields []hpack.HeaderField) http.Header {
+	header := make(http.Header)
+	for _, f := range fields {
+		if f.IsPseudo() {
+			continue
+		}
+
+		header.Add(http.CanonicalHeaderKey(f.Name), f.Value)
+	}
+
+	if cookies := header["Cookie"]; len(cookies) > 1 {
+		header.Set("Cookie", strings.Join(cookies, "; "))
+	}
+
+	return header
+}
+
+// h2Trailer converts the trailer fields to an http.Header, returning nil if
+// there are none.
+func h2Trailer(fields []hpack.HeaderField) http.Header {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	return h2Header(fields)
+}
+
+// h2HeaderFields appends the fields of header to fields in a stable order,
+// omitting connection-specific fields.
+func h2HeaderFields(fields []hpack.HeaderField, header http.Header) []hpack.HeaderField {
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		name := strings.ToLower(k)
+		if h2ConnectionHeaders[name] {
+			continue
+		}
+
+		for _, v := range header[k] {
+			if name == "te" && v != "trailers" {
+				continue
+			}
+
+			fields = append(fields, hpack.HeaderField{Name: name, Value: v})
+		}
+	}
+
+	return fields
+}
@@ -17,6 +17,7 @@ package h2
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/hex"
@@ -54,10 +55,10 @@ type Config struct {
 
 // Proxy proxies HTTP/2 traffic between a client connection, `cc`, and the HTTP/2 `url` assuming
 // h2 is being used. Since no browsers use h2c, it's safe to assume all traffic uses TLS.
+//
+// The server connection is dialed directly. Use Relay to proxy over a connection that was
+// established by other means, such as through a downstream proxy.
 func (c *Config) Proxy(closing chan bool, cc io.ReadWriter, url *url.URL) error {
-	if c.EnableDebugLogs {
-		log.Infof("\u001b[1;35mProxying %v with HTTP/2\u001b[0m", url)
-	}
 	sc, err := tls.Dial("tcp", url.Host, &tls.Config{
 		RootCAs:    c.RootCAs,
 		NextProtos: []string{"h2"},
@@ -65,6 +66,15 @@ func (c *Config) Proxy(closing chan bool, cc io.ReadWriter, url *url.URL) error
 	if err != nil {
 		return fmt.Errorf("connecting h2 to %v: %w", url, err)
 	}
+	return c.Relay(closing, cc, sc, url)
+}
+
+// Relay proxies HTTP/2 traffic between a client connection, `cc`, and a server connection, `sc`,
+// to the HTTP/2 `url`. The server connection must already have negotiated h2 with the server.
+func (c *Config) Relay(closing chan bool, cc, sc io.ReadWriter, url *url.URL) error {
+	if c.EnableDebugLogs {
+		log.Infof("\u001b[1;35mProxying %v with HTTP/2\u001b[0m", url)
+	}
 	if err := forwardPreface(sc, cc); err != nil {
 		return fmt.Errorf("initializing h2 with %v: %w", url, err)
 	}
@@ -78,11 +88,15 @@ func (c *Config) Proxy(closing chan bool, cc io.ReadWriter, url *url.URL) error
 	// The client-to-server relay depends on the server-to-client relay and vice versa.
 	cToS.peer, sToC.peer = sToC, cToS
 
+	// The context of the connection is cancelled once either direction stops being relayed.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	// Creating processors is circular because the create function references the relays and the
 	// relays need to call create.
 	cToS.processors = &streamProcessors{
 		create: func(id uint32) *Processors {
-			p := &Processors{cToS: &relayAdapter{id, cToS}, sToC: &relayAdapter{id, sToC}}
+			p := &Processors{cToS: &relayAdapter{id, cToS}, sToC: &relayAdapter{id, sToC}, ctx: ctx}
 			// Chains the pipeline of processors together.
 			for i := len(c.StreamProcessorFactories) - 1; i >= 0; i-- {
 				cToS, sToC := c.StreamProcessorFactories[i](url, p)
@@ -93,7 +107,7 @@ func (c *Config) Proxy(closing chan bool, cc io.ReadWriter, url *url.URL) error
 				if sToC == nil {
 					sToC = p.ForDirection(ServerToClient)
 				}
-				p = &Processors{cToS: cToS, sToC: sToC}
+				p = &Processors{cToS: cToS, sToC: sToC, ctx: ctx}
 			}
 			return p
 		},
@@ -104,12 +118,14 @@ func (c *Config) Proxy(closing chan bool, cc io.ReadWriter, url *url.URL) error
 	wg.Add(2)
 	go func() { // Forwards frames from client to server.
 		defer wg.Done()
+		defer cancel()
 		if err := cToS.relayFrames(closing); err != nil {
 			log.Errorf("relaying frame from client to %v: %v", url, err)
 		}
 	}()
 	go func() { // Forwards frames from server to client.
 		defer wg.Done()
+		defer cancel()
 		if err := sToC.relayFrames(closing); err != nil {
 			log.Errorf("relaying frame from %v to client: %v", url, err)
 		}
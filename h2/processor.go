@@ -15,6 +15,7 @@
 package h2
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 
@@ -44,12 +45,24 @@ const (
 // Concurrency: there is a separate client-to-server and server-to-client thread. Calls against
 // the `ClientToServer` sink must be made on the client-to-server thread and calls against
 // the `ServerToClient` sink must be made on the server-to-client thread. Implementors should
-// guard interactions across threads.
+// guard interactions across threads. A stream that the client-to-server processor answers
+// without forwarding it to the server is the exception: as none of its frames are received from
+// the server, its `ServerToClient` sink may be called on the client-to-server thread.
 type StreamProcessorFactory func(url *url.URL, sinks *Processors) (Processor, Processor)
 
 // Processors encapsulates the two traffic receiving endpoints.
 type Processors struct {
 	cToS, sToC Processor
+	ctx        context.Context
+}
+
+// Context returns the context of the connection of the stream, which is
+// cancelled once the connection is no longer relayed.
+func (s *Processors) Context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
 }
 
 // ForDirection returns the processor receiving traffic in the given direction.
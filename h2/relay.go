@@ -70,6 +70,12 @@ type relay struct {
 	destMu sync.Mutex
 	dest   *http2.Framer
 
+	// settingsSent indicates whether a SETTINGS frame has been written to dest. HTTP/2 requires
+	// SETTINGS to be the first frame of a connection, so WINDOW_UPDATE frames written by `peer` before
+	// then are accumulated in pendingWindowUpdates, keyed by stream ID. Both are guarded by destMu.
+	settingsSent         bool
+	pendingWindowUpdates map[uint32]uint32
+
 	// maxFrameSize is set by the peer relay and is accessed atomically.
 	maxFrameSize uint32
 
@@ -82,6 +88,10 @@ type relay struct {
 	encoder   *hpack.Encoder
 	reencoded bytes.Buffer // handle to the output buffer of `encoder`
 
+	// headerMu keeps header blocks queued in the order they are encoded in, since they may be
+	// sent from either thread. See StreamProcessorFactory.
+	headerMu sync.Mutex
+
 	// headerBuffer collects header fragments that are received across multiple frames, i.e.,
 	// when there are continuation frames.
 	headerBuffer      bytes.Buffer
@@ -127,6 +137,7 @@ func newRelay(
 		initialWindowSize:    defaultInitialWindowSize,
 		connectionWindowSize: defaultInitialWindowSize,
 		outputBuffers:        make(map[uint32]*outputBuffer),
+		pendingWindowUpdates: make(map[uint32]uint32),
 		output:               make(chan queuedFrame, outputChannelSize),
 		enableDebugLogs:      enableDebugLogs,
 	}
@@ -230,7 +241,7 @@ func (r *relay) processFrame(f http2.Frame) error {
 		if !f.HeadersEnded() {
 			r.headerBuffer.Reset()
 			r.headerBuffer.Write(f.HeaderBlockFragment())
-			r.continuationState = &headerContinuation{f.Priority}
+			r.continuationState = &headerContinuation{f.Priority, f.StreamEnded()}
 		} else {
 			var headers []hpack.HeaderField
 			headers, err = r.decodeFull(f.HeaderBlockFragment())
@@ -263,7 +274,7 @@ func (r *relay) processFrame(f http2.Frame) error {
 				return nil
 			}); err == nil {
 				r.destMu.Lock()
-				err = r.dest.WriteSettings(settings...)
+				err = r.writeSettings(settings)
 				r.destMu.Unlock()
 			}
 		}
@@ -403,6 +414,9 @@ func (r *relay) header(
 	streamEnded bool,
 	priority http2.PriorityParam,
 ) error {
+	r.headerMu.Lock()
+	defer r.headerMu.Unlock()
+
 	encoded, err := r.encodeFull(headers)
 	if err != nil {
 		return fmt.Errorf("encoding headers %v: %w", headers, err)
@@ -442,6 +456,9 @@ func (r *relay) rstStream(id uint32, errCode http2.ErrCode) {
 }
 
 func (r *relay) pushPromise(id, promiseID uint32, headers []hpack.HeaderField) error {
+	r.headerMu.Lock()
+	defer r.headerMu.Unlock()
+
 	encoded, err := r.encodeFull(headers)
 	if err != nil {
 		return fmt.Errorf("encoding push promise headers %v: %w", headers, err)
@@ -498,6 +515,11 @@ func (r *relay) sendWindowUpdates(f *http2.DataFrame) error {
 	}
 	r.destMu.Lock()
 	defer r.destMu.Unlock()
+	if !r.settingsSent {
+		r.pendingWindowUpdates[0] += uint32(len(f.Data()))
+		r.pendingWindowUpdates[f.StreamID] += uint32(len(f.Data()))
+		return nil
+	}
 	// First updates the connection level window.
 	if err := r.dest.WriteWindowUpdate(0, uint32(len(f.Data()))); err != nil {
 		return err
@@ -506,6 +528,32 @@ func (r *relay) sendWindowUpdates(f *http2.DataFrame) error {
 	return r.dest.WriteWindowUpdate(f.StreamID, uint32(len(f.Data())))
 }
 
+// writeSettings writes a SETTINGS frame to dest followed by any WINDOW_UPDATE frames that were
+// waiting for it.
+//
+// The caller must hold `destMu`.
+func (r *relay) writeSettings(settings []http2.Setting) error {
+	if err := r.dest.WriteSettings(settings...); err != nil {
+		return err
+	}
+	r.settingsSent = true
+
+	// The connection level window is updated first.
+	if incr, ok := r.pendingWindowUpdates[0]; ok {
+		if err := r.dest.WriteWindowUpdate(0, incr); err != nil {
+			return err
+		}
+		delete(r.pendingWindowUpdates, 0)
+	}
+	for id, incr := range r.pendingWindowUpdates {
+		if err := r.dest.WriteWindowUpdate(id, incr); err != nil {
+			return err
+		}
+		delete(r.pendingWindowUpdates, id)
+	}
+	return nil
+}
+
 func (r *relay) decodeFull(data []byte) ([]hpack.HeaderField, error) {
 	r.decoderMu.Lock()
 	defer r.decoderMu.Unlock()
@@ -577,11 +625,12 @@ type continuationState interface {
 }
 
 type headerContinuation struct {
-	priority http2.PriorityParam
+	priority  http2.PriorityParam
+	endStream bool
 }
 
 func (h *headerContinuation) complete(s Processor, headers []hpack.HeaderField) error {
-	return s.Header(headers, true, h.priority)
+	return s.Header(headers, h.endStream, h.priority)
 }
 
 type pushPromiseContinuation struct {
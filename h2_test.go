@@ -0,0 +1,1054 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/martian/v3/h2"
+	"github.com/google/martian/v3/martiantest"
+	"github.com/google/martian/v3/mitm"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/http2/hpack"
+)
+
+func TestH2HeaderFields(t *testing.T) {
+	header := http.Header{
+		"Connection":   []string{"close"},
+		"Content-Type": []string{"text/plain"},
+		"Te":           []string{"gzip", "trailers"},
+		"X-Multi":      []string{"a", "b"},
+	}
+
+	got := h2HeaderFields([]hpack.HeaderField{{Name: ":status", Value: "200"}}, header)
+	want := []hpack.HeaderField{
+		{Name: ":status", Value: "200"},
+		{Name: "content-type", Value: "text/plain"},
+		{Name: "te", Value: "trailers"},
+		{Name: "x-multi", Value: "a"},
+		{Name: "x-multi", Value: "b"},
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("h2HeaderFields(): got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("h2HeaderFields()[%d]: got %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestH2Request(t *testing.T) {
+	fields := []hpack.HeaderField{
+		{Name: ":method", Value: "POST"},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":authority", Value: "example.com"},
+		{Name: ":path", Value: "/path?q=1"},
+		{Name: "cookie", Value: "a=1"},
+		{Name: "cookie", Value: "b=2"},
+	}
+
+	req, err := h2Request(&url.URL{Host: "example.com:443"}, fields, []byte("body"), nil)
+	if err != nil {
+		t.Fatalf("h2Request(): got %v, want no error", err)
+	}
+
+	if got, want := req.Method, "POST"; got != want {
+		t.Errorf("req.Method: got %q, want %q", got, want)
+	}
+	if got, want := req.URL.String(), "https://example.com/path?q=1"; got != want {
+		t.Errorf("req.URL: got %q, want %q", got, want)
+	}
+	if got, want := req.Header.Get("Cookie"), "a=1; b=2"; got != want {
+		t.Errorf("req.Header.Get(%q): got %q, want %q", "Cookie", got, want)
+	}
+	if got, want := req.ContentLength, int64(4); got != want {
+		t.Errorf("req.ContentLength: got %d, want %d", got, want)
+	}
+
+	if _, err := h2Request(&url.URL{}, fields[1:], nil, nil); err == nil {
+		t.Error("h2Request(): got nil, want error for missing :method")
+	}
+}
+
+func TestIntegrationH2Modifiers(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+
+		rw.Header().Set("Origin-Header", req.Header.Get("Martian-Request"))
+		rw.Header().Set("Origin-Proto", req.Proto)
+		rw.Write(bytes.ToUpper(body))
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	origins := x509.NewCertPool()
+	origins.AddCert(ts.Certificate())
+
+	ca, priv, err := mitm.NewAuthority("martian.proxy", "Martian Authority", 2*time.Hour)
+	if err != nil {
+		t.Fatalf("mitm.NewAuthority(): got %v, want no error", err)
+	}
+
+	mc, err := mitm.NewConfig(ca, priv)
+	if err != nil {
+		t.Fatalf("mitm.NewConfig(): got %v, want no error", err)
+	}
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	mc.SetH2Config(&h2.Config{
+		AllowedHostsFilter:       func(string) bool { return true },
+		RootCAs:                  origins,
+		StreamProcessorFactories: []h2.StreamProcessorFactory{p.H2StreamProcessorFactory()},
+	})
+	p.SetMITM(mc)
+	p.SetTimeout(2 * time.Second)
+
+	var secure bool
+	tm := martiantest.NewModifier()
+	tm.RequestFunc(func(req *http.Request) {
+		if req.Method == "CONNECT" {
+			return
+		}
+		secure = NewContext(req).Session().IsSecure()
+
+		req.Header.Set("Martian-Request", "true")
+		req.Body = ioutil.NopCloser(strings.NewReader("modified request"))
+	})
+	tm.ResponseFunc(func(res *http.Response) {
+		if res.Request.Method == "CONNECT" {
+			return
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+
+		res.StatusCode = 201
+		res.Header.Set("Martian-Response", "true")
+		res.Body = ioutil.NopCloser(bytes.NewReader(append(body, "!"...)))
+	})
+	p.SetRequestModifier(tm)
+	p.SetResponseModifier(tm)
+
+	go p.Serve(l)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	proxyURL := &url.URL{Scheme: "http", Host: l.Addr().String()}
+	tr := &http.Transport{
+		Proxy:             http.ProxyURL(proxyURL),
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		ForceAttemptHTTP2: true,
+	}
+	defer tr.CloseIdleConnections()
+
+	req, err := http.NewRequest("POST", ts.URL+"/path", strings.NewReader("request"))
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("tr.RoundTrip(): got %v, want no error", err)
+	}
+	defer res.Body.Close()
+
+	if got, want := res.ProtoMajor, 2; got != want {
+		t.Errorf("res.ProtoMajor: got %d, want %d", got, want)
+	}
+	if got, want := res.StatusCode, 201; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+	if got, want := res.Header.Get("Origin-Header"), "true"; got != want {
+		t.Errorf("res.Header.Get(%q): got %q, want %q", "Origin-Header", got, want)
+	}
+	if got, want := res.Header.Get("Origin-Proto"), "HTTP/2.0"; got != want {
+		t.Errorf("res.Header.Get(%q): got %q, want %q", "Origin-Proto", got, want)
+	}
+	if got, want := res.Header.Get("Martian-Response"), "true"; got != want {
+		t.Errorf("res.Header.Get(%q): got %q, want %q", "Martian-Response", got, want)
+	}
+
+	got, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	if want := "MODIFIED REQUEST!"; string(got) != want {
+		t.Errorf("res.Body: got %q, want %q", got, want)
+	}
+
+	if !secure {
+		t.Error("session.IsSecure(): got false, want true")
+	}
+}
+
+func TestIntegrationH2FailOnModifierError(t *testing.T) {
+	t.Parallel()
+
+	var requests int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		rw.Write([]byte("origin"))
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	origins := x509.NewCertPool()
+	origins.AddCert(ts.Certificate())
+
+	ca, priv, err := mitm.NewAuthority("martian.proxy", "Martian Authority", 2*time.Hour)
+	if err != nil {
+		t.Fatalf("mitm.NewAuthority(): got %v, want no error", err)
+	}
+
+	mc, err := mitm.NewConfig(ca, priv)
+	if err != nil {
+		t.Fatalf("mitm.NewConfig(): got %v, want no error", err)
+	}
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	mc.SetH2Config(&h2.Config{
+		AllowedHostsFilter:       func(string) bool { return true },
+		RootCAs:                  origins,
+		StreamProcessorFactories: []h2.StreamProcessorFactory{p.H2StreamProcessorFactory()},
+	})
+	p.SetMITM(mc)
+	p.SetTimeout(2 * time.Second)
+	p.SetModifierErrorPolicy(FailOnModifierError, http.StatusTeapot)
+
+	p.SetRequestModifier(RequestModifierFunc(func(req *http.Request) error {
+		if req.URL.Path == "/request" {
+			return fmt.Errorf("request failed")
+		}
+		return nil
+	}))
+	p.SetResponseModifier(ResponseModifierFunc(func(res *http.Response) error {
+		if res.Request.URL.Path == "/response" {
+			return fmt.Errorf("response failed")
+		}
+		return nil
+	}))
+
+	go p.Serve(l)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	var conns int32
+	proxyURL := &url.URL{Scheme: "http", Host: l.Addr().String()}
+	tr := &http.Transport{
+		Proxy:             http.ProxyURL(proxyURL),
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		ForceAttemptHTTP2: true,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&conns, 1)
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+	defer tr.CloseIdleConnections()
+
+	get := func(path string) (*http.Response, error) {
+		req, err := http.NewRequest("GET", ts.URL+path, nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest(): got %v, want no error", err)
+		}
+
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		return res, nil
+	}
+
+	res, err := get("/response")
+	if err != nil {
+		t.Fatalf("get(%q): got %v, want no error", "/response", err)
+	}
+	if got, want := res.StatusCode, http.StatusTeapot; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+
+	// The failed request is answered without being sent to the origin.
+	res, err = get("/request")
+	if err != nil {
+		t.Fatalf("get(%q): got %v, want no error", "/request", err)
+	}
+	if got, want := res.StatusCode, http.StatusTeapot; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Errorf("origin requests: got %d, want 1", got)
+	}
+
+	res, err = get("/ok")
+	if err != nil {
+		t.Fatalf("get(%q): got %v, want no error", "/ok", err)
+	}
+	if got, want := res.StatusCode, 200; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+	if got, want := res.ProtoMajor, 2; got != want {
+		t.Errorf("res.ProtoMajor: got %d, want %d", got, want)
+	}
+	if got, want := atomic.LoadInt32(&conns), int32(1); got != want {
+		t.Errorf("connections: got %d, want %d", got, want)
+	}
+}
+
+// h2ContextModifier is a ContextResponseModifier that waits for the context
+// of responses to /wait to be done.
+type h2ContextModifier struct {
+	started chan struct{}
+	errc    chan error
+}
+
+func (m *h2ContextModifier) ModifyResponse(res *http.Response) error {
+	return fmt.Errorf("h2ContextModifier: ModifyResponse called instead of ModifyResponseContext")
+}
+
+func (m *h2ContextModifier) ModifyResponseContext(ctx context.Context, res *http.Response) error {
+	if res.Request.URL.Path != "/wait" {
+		go func() {
+			<-ctx.Done()
+			m.errc <- ctx.Err()
+		}()
+		return nil
+	}
+	close(m.started)
+
+	select {
+	case <-ctx.Done():
+		m.errc <- ctx.Err()
+	case <-time.After(5 * time.Second):
+		m.errc <- nil
+	}
+
+	return nil
+}
+
+func TestIntegrationH2StreamContext(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("origin"))
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	origins := x509.NewCertPool()
+	origins.AddCert(ts.Certificate())
+
+	ca, priv, err := mitm.NewAuthority("martian.proxy", "Martian Authority", 2*time.Hour)
+	if err != nil {
+		t.Fatalf("mitm.NewAuthority(): got %v, want no error", err)
+	}
+
+	mc, err := mitm.NewConfig(ca, priv)
+	if err != nil {
+		t.Fatalf("mitm.NewConfig(): got %v, want no error", err)
+	}
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	mc.SetH2Config(&h2.Config{
+		AllowedHostsFilter:       func(string) bool { return true },
+		RootCAs:                  origins,
+		StreamProcessorFactories: []h2.StreamProcessorFactory{p.H2StreamProcessorFactory()},
+	})
+	p.SetMITM(mc)
+	p.SetTimeout(10 * time.Second)
+
+	cm := &h2ContextModifier{
+		started: make(chan struct{}),
+		errc:    make(chan error, 2),
+	}
+	p.SetResponseModifier(cm)
+
+	go p.Serve(l)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	tr := &http.Transport{
+		Proxy:             http.ProxyURL(&url.URL{Scheme: "http", Host: l.Addr().String()}),
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		ForceAttemptHTTP2: true,
+	}
+	defer tr.CloseIdleConnections()
+
+	// The context is cancelled once the stream ends.
+	req, err := http.NewRequest("GET", ts.URL+"/ok", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("tr.RoundTrip(): got %v, want no error", err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if got, want := res.ProtoMajor, 2; got != want {
+		t.Fatalf("res.ProtoMajor: got %d, want %d", got, want)
+	}
+	select {
+	case err := <-cm.errc:
+		if got, want := err, context.Canceled; got != want {
+			t.Errorf("ctx.Err(): got %v, want %v", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("context was not cancelled after the stream ended")
+	}
+
+	// The context is cancelled when the client resets the stream.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err = http.NewRequest("GET", ts.URL+"/wait", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := tr.RoundTrip(req.WithContext(ctx))
+		errc <- err
+	}()
+
+	select {
+	case <-cm.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("modifier was not called")
+	}
+	cancel()
+	<-errc
+
+	if got, want := <-cm.errc, context.Canceled; got != want {
+		t.Errorf("ctx.Err(): got %v, want %v", got, want)
+	}
+}
+
+func TestIntegrationH2MaxBodySize(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		rw.Write(bytes.Repeat(bytes.ToUpper(body), 2))
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	origins := x509.NewCertPool()
+	origins.AddCert(ts.Certificate())
+
+	ca, priv, err := mitm.NewAuthority("martian.proxy", "Martian Authority", 2*time.Hour)
+	if err != nil {
+		t.Fatalf("mitm.NewAuthority(): got %v, want no error", err)
+	}
+
+	mc, err := mitm.NewConfig(ca, priv)
+	if err != nil {
+		t.Fatalf("mitm.NewConfig(): got %v, want no error", err)
+	}
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	mc.SetH2Config(&h2.Config{
+		AllowedHostsFilter:       func(string) bool { return true },
+		RootCAs:                  origins,
+		StreamProcessorFactories: []h2.StreamProcessorFactory{p.H2StreamProcessorFactory()},
+	})
+	p.SetMITM(mc)
+	p.SetTimeout(2 * time.Second)
+	p.SetH2MaxBodySize(8)
+
+	p.SetResponseModifier(ResponseModifierFunc(func(res *http.Response) error {
+		if res.Request.Method != "CONNECT" {
+			res.Header.Set("Martian-Response", "true")
+		}
+		return nil
+	}))
+
+	go p.Serve(l)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	proxyURL := &url.URL{Scheme: "http", Host: l.Addr().String()}
+	tr := &http.Transport{
+		Proxy:             http.ProxyURL(proxyURL),
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		ForceAttemptHTTP2: true,
+	}
+	defer tr.CloseIdleConnections()
+
+	// The response body is the request body in upper case, twice.
+	tt := []struct {
+		body     string
+		modified string
+	}{
+		{"abc", "true"},
+		{"small", ""},
+		{"larger than the limit", ""},
+	}
+
+	for i, tc := range tt {
+		req, err := http.NewRequest("POST", ts.URL, strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatalf("%d. http.NewRequest(): got %v, want no error", i, err)
+		}
+
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%d. tr.RoundTrip(): got %v, want no error", i, err)
+		}
+
+		got, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("%d. ioutil.ReadAll(): got %v, want no error", i, err)
+		}
+		if want := strings.Repeat(strings.ToUpper(tc.body), 2); string(got) != want {
+			t.Errorf("%d. res.Body: got %q, want %q", i, got, want)
+		}
+		if got, want := res.Header.Get("Martian-Response"), tc.modified; got != want {
+			t.Errorf("%d. res.Header.Get(%q): got %q, want %q", i, "Martian-Response", got, want)
+		}
+	}
+}
+
+func TestIntegrationH2DownstreamProxy(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Origin-Proto", req.Proto)
+		rw.Write([]byte("origin"))
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	// The downstream proxy tunnels CONNECT requests to the origin.
+	dl, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	downstream := NewProxy()
+	defer downstream.Close()
+
+	downstream.SetTimeout(2 * time.Second)
+
+	connects := make(chan string, 1)
+	dm := martiantest.NewModifier()
+	dm.RequestFunc(func(req *http.Request) {
+		if req.Method == "CONNECT" {
+			connects <- req.URL.Host
+		}
+	})
+	downstream.SetRequestModifier(dm)
+
+	go downstream.Serve(dl)
+
+	ca, priv, err := mitm.NewAuthority("martian.proxy", "Martian Authority", 2*time.Hour)
+	if err != nil {
+		t.Fatalf("mitm.NewAuthority(): got %v, want no error", err)
+	}
+
+	mc, err := mitm.NewConfig(ca, priv)
+	if err != nil {
+		t.Fatalf("mitm.NewConfig(): got %v, want no error", err)
+	}
+	// The origin uses a self-signed certificate that is not in RootCAs.
+	mc.SkipTLSVerify(true)
+	mc.SetH2Config(&h2.Config{
+		AllowedHostsFilter: func(string) bool { return true },
+	})
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	p.SetMITM(mc)
+	p.SetTimeout(2 * time.Second)
+	p.SetDownstreamProxy(&url.URL{Scheme: "http", Host: dl.Addr().String()})
+
+	dials := make(chan string, 1)
+	p.SetDial(func(network, addr string) (net.Conn, error) {
+		select {
+		case dials <- addr:
+		default:
+		}
+		return net.Dial(network, addr)
+	})
+
+	go p.Serve(l)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	tr := &http.Transport{
+		Proxy:             http.ProxyURL(&url.URL{Scheme: "http", Host: l.Addr().String()}),
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		ForceAttemptHTTP2: true,
+	}
+	defer tr.CloseIdleConnections()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("tr.RoundTrip(): got %v, want no error", err)
+	}
+	defer res.Body.Close()
+
+	if got, want := res.ProtoMajor, 2; got != want {
+		t.Errorf("res.ProtoMajor: got %d, want %d", got, want)
+	}
+	if got, want := res.Header.Get("Origin-Proto"), "HTTP/2.0"; got != want {
+		t.Errorf("res.Header.Get(%q): got %q, want %q", "Origin-Proto", got, want)
+	}
+
+	if got, want := <-dials, dl.Addr().String(); got != want {
+		t.Errorf("dial address: got %q, want %q", got, want)
+	}
+	if got, want := <-connects, req.URL.Host; got != want {
+		t.Errorf("downstream CONNECT host: got %q, want %q", got, want)
+	}
+}
+
+func TestIntegrationH2HandshakeTimeout(t *testing.T) {
+	t.Parallel()
+
+	// The origin accepts connections but never completes a TLS handshake.
+	ol, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+	defer ol.Close()
+
+	go func() {
+		for {
+			conn, err := ol.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ca, priv, err := mitm.NewAuthority("martian.proxy", "Martian Authority", 2*time.Hour)
+	if err != nil {
+		t.Fatalf("mitm.NewAuthority(): got %v, want no error", err)
+	}
+
+	mc, err := mitm.NewConfig(ca, priv)
+	if err != nil {
+		t.Fatalf("mitm.NewConfig(): got %v, want no error", err)
+	}
+	mc.SetH2Config(&h2.Config{
+		AllowedHostsFilter: func(string) bool { return true },
+	})
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	p.SetMITM(mc)
+	p.SetTimeout(time.Minute)
+	p.SetRoundTripper(&http.Transport{
+		TLSHandshakeTimeout: 200 * time.Millisecond,
+	})
+
+	closed := make(chan struct{})
+	p.SetDial(func(network, addr string) (net.Conn, error) {
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &closeNotifyConn{Conn: conn, closed: closed}, nil
+	})
+
+	go p.Serve(l)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	tr := &http.Transport{
+		Proxy:             http.ProxyURL(&url.URL{Scheme: "http", Host: l.Addr().String()}),
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		ForceAttemptHTTP2: true,
+	}
+	defer tr.CloseIdleConnections()
+
+	req, err := http.NewRequest("GET", "https://"+ol.Addr().String(), nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	go func() {
+		res, err := tr.RoundTrip(req)
+		if err == nil {
+			res.Body.Close()
+		}
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("handshake with the origin was not timed out")
+	}
+}
+
+// closeNotifyConn is a net.Conn that closes closed when it is closed.
+type closeNotifyConn struct {
+	net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *closeNotifyConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func TestIntegrationH2CPriorKnowledge(t *testing.T) {
+	ts := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Origin-Proto", req.Proto)
+		rw.Write([]byte("origin"))
+	}), &http2.Server{}))
+	defer ts.Close()
+
+	defer fakeOriginalDestination(ts.Listener.Addr().String())()
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	p.SetTimeout(2 * time.Second)
+	p.SetH2CConfig(&h2.Config{
+		AllowedHostsFilter:       func(string) bool { return true },
+		StreamProcessorFactories: []h2.StreamProcessorFactory{p.H2StreamProcessorFactory()},
+	})
+
+	var secure bool
+	tm := martiantest.NewModifier()
+	tm.RequestFunc(func(req *http.Request) {
+		secure = NewContext(req).Session().IsSecure()
+	})
+	tm.ResponseFunc(func(res *http.Response) {
+		res.Header.Set("Martian-Response", "true")
+	})
+	p.SetRequestModifier(tm)
+	p.SetResponseModifier(tm)
+
+	go p.ServeTransparent(l)
+
+	tr := &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, _ string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, l.Addr().String())
+		},
+	}
+	defer tr.CloseIdleConnections()
+
+	req, err := http.NewRequest("GET", "http://example.com/path", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("tr.RoundTrip(): got %v, want no error", err)
+	}
+	defer res.Body.Close()
+
+	if got, want := res.Header.Get("Origin-Proto"), "HTTP/2.0"; got != want {
+		t.Errorf("res.Header.Get(%q): got %q, want %q", "Origin-Proto", got, want)
+	}
+	if got, want := res.Header.Get("Martian-Response"), "true"; got != want {
+		t.Errorf("res.Header.Get(%q): got %q, want %q", "Martian-Response", got, want)
+	}
+
+	got, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	if want := "origin"; string(got) != want {
+		t.Errorf("res.Body: got %q, want %q", got, want)
+	}
+
+	if secure {
+		t.Error("session.IsSecure(): got true, want false")
+	}
+}
+
+func TestIntegrationH2CPriorKnowledgeConnect(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Origin-Proto", req.Proto)
+		rw.Write([]byte("origin"))
+	}), &http2.Server{}))
+	defer ts.Close()
+
+	ca, priv, err := mitm.NewAuthority("martian.proxy", "Martian Authority", 2*time.Hour)
+	if err != nil {
+		t.Fatalf("mitm.NewAuthority(): got %v, want no error", err)
+	}
+	mc, err := mitm.NewConfig(ca, priv)
+	if err != nil {
+		t.Fatalf("mitm.NewConfig(): got %v, want no error", err)
+	}
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	p.SetMITM(mc)
+	p.SetTimeout(2 * time.Second)
+	p.SetH2CConfig(&h2.Config{
+		AllowedHostsFilter:       func(string) bool { return true },
+		StreamProcessorFactories: []h2.StreamProcessorFactory{p.H2StreamProcessorFactory()},
+	})
+
+	go p.Serve(l)
+
+	host := ts.Listener.Addr().String()
+	tr := &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, _ string, _ *tls.Config) (net.Conn, error) {
+			conn, err := net.Dial(network, l.Addr().String())
+			if err != nil {
+				return nil, err
+			}
+
+			fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+			res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			if res.StatusCode != 200 {
+				conn.Close()
+				return nil, fmt.Errorf("CONNECT: got status %d, want 200", res.StatusCode)
+			}
+
+			return conn, nil
+		},
+	}
+	defer tr.CloseIdleConnections()
+
+	req, err := http.NewRequest("GET", "http://"+host+"/path", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("tr.RoundTrip(): got %v, want no error", err)
+	}
+	defer res.Body.Close()
+
+	if got, want := res.Header.Get("Origin-Proto"), "HTTP/2.0"; got != want {
+		t.Errorf("res.Header.Get(%q): got %q, want %q", "Origin-Proto", got, want)
+	}
+
+	got, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	if want := "origin"; string(got) != want {
+		t.Errorf("res.Body: got %q, want %q", got, want)
+	}
+}
+
+// headerCounter counts the HEADERS forwarded to the wrapped processor.
+type headerCounter struct {
+	h2.Processor
+	count *int32
+}
+
+func (h *headerCounter) Header(headers []hpack.HeaderField, streamEnded bool, priority http2.PriorityParam) error {
+	atomic.AddInt32(h.count, 1)
+	return h.Processor.Header(headers, streamEnded, priority)
+}
+
+func TestIntegrationH2CUpgrade(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Origin-Proto", req.Proto)
+		rw.Write([]byte("origin"))
+	}), &http2.Server{}))
+	defer ts.Close()
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	var headers int32
+	p.SetTimeout(2 * time.Second)
+	p.SetH2CConfig(&h2.Config{
+		AllowedHostsFilter: func(string) bool { return true },
+		StreamProcessorFactories: []h2.StreamProcessorFactory{
+			func(_ *url.URL, sinks *h2.Processors) (h2.Processor, h2.Processor) {
+				return nil, &headerCounter{sinks.ForDirection(h2.ServerToClient), &headers}
+			},
+		},
+	})
+
+	go p.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	host := ts.Listener.Addr().String()
+	raw := fmt.Sprintf("GET http://%s/ HTTP/1.1\r\n"+
+		"Host: %s\r\n"+
+		"Connection: Upgrade, HTTP2-Settings\r\n"+
+		"Upgrade: h2c\r\n"+
+		"HTTP2-Settings: \r\n\r\n", host, host)
+
+	if _, err := conn.Write([]byte(raw)); err != nil {
+		t.Fatalf("conn.Write(headers): got %v, want no error", err)
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	if got, want := res.StatusCode, 101; got != want {
+		t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+	}
+
+	if _, err := conn.Write([]byte(http2.ClientPreface)); err != nil {
+		t.Fatalf("conn.Write(preface): got %v, want no error", err)
+	}
+	framer := http2.NewFramer(conn, br)
+	if err := framer.WriteSettings(); err != nil {
+		t.Fatalf("framer.WriteSettings(): got %v, want no error", err)
+	}
+
+	// The response to the upgraded request is sent on stream 1.
+	var fields []hpack.HeaderField
+	var body []byte
+	decoder := hpack.NewDecoder(4096, func(f hpack.HeaderField) { fields = append(fields, f) })
+	for done := false; !done; {
+		f, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatalf("framer.ReadFrame(): got %v, want no error", err)
+		}
+
+		switch f := f.(type) {
+		case *http2.HeadersFrame:
+			if _, err := decoder.Write(f.HeaderBlockFragment()); err != nil {
+				t.Fatalf("decoder.Write(): got %v, want no error", err)
+			}
+			done = f.StreamEnded()
+		case *http2.DataFrame:
+			body = append(body, f.Data()...)
+			done = f.StreamEnded()
+		}
+	}
+
+	if got, want := h2FieldValue(fields, "origin-proto"), "HTTP/2.0"; got != want {
+		t.Errorf("origin-proto: got %q, want %q", got, want)
+	}
+	if got, want := string(body), "origin"; got != want {
+		t.Errorf("body: got %q, want %q", got, want)
+	}
+	if atomic.LoadInt32(&headers) == 0 {
+		t.Error("headers processed: got 0, want at least 1")
+	}
+}
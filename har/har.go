@@ -44,12 +44,18 @@ import (
 type Logger struct {
 	bodyLogging     func(*http.Response) bool
 	postDataLogging func(*http.Request) bool
+	bodyLimit       int64
+	maxEntries      int
+	maxBodyBytes    int64
+	maxAge          time.Duration
+	spill           *Spill
 
 	creator *Creator
 
-	mu      sync.Mutex
-	entries map[string]*Entry
-	tail    *Entry
+	mu        sync.Mutex
+	entries   map[string]*Entry
+	tail      *Entry
+	bodyBytes int64
 }
 
 // HAR is the top level object of a HAR log.
@@ -92,7 +98,14 @@ type Entry struct {
 	// Timings describes various phases within request-response round trip. All
 	// times are specified in milliseconds.
 	Timings *Timings `json:"timings"`
-	next    *Entry
+	// ServerIPAddress is the IP address of the server that the request was
+	// sent to, which is that of the downstream proxy when there is one.
+	ServerIPAddress string `json:"serverIPAddress,omitempty"`
+	// Connection identifies the upstream connection by its local port.
+	Connection string `json:"connection,omitempty"`
+	next       *Entry
+	// size is the number of body bytes of the entry counted by the logger.
+	size int64
 }
 
 // Request holds data about an individual HTTP request.
@@ -145,21 +158,58 @@ type Response struct {
 	BodySize int64 `json:"bodySize"`
 }
 
-// Cache contains information about a request coming from browser cache.
+// CacheContextKey is the key of the *Cache in the martian context of a
+// request that a cache in front of the upstream, such as the cache package,
+// sets to record how it handled the request.
+const CacheContextKey = "har.Cache"
+
+// Cache contains information about a request coming from a cache. It is
+// empty unless a cache recorded its state in the request context under
+// CacheContextKey, but HAR requires the "cache" object to exist.
 type Cache struct {
-	// Has no fields as they are not supported, but HAR requires the "cache"
-	// object to exist.
+	// BeforeRequest is the state of the cache entry before the request. Leave
+	// out this field if the information is not available.
+	BeforeRequest *CacheEntry `json:"beforeRequest,omitempty"`
+	// AfterRequest is the state of the cache entry after the request. Leave
+	// out this field if the information is not available.
+	AfterRequest *CacheEntry `json:"afterRequest,omitempty"`
+	// Comment is how the cache handled the request, such as "hit" or "miss".
+	Comment string `json:"comment,omitempty"`
+}
+
+// CacheEntry is the state of a cache entry.
+type CacheEntry struct {
+	// Expires is when the cache entry expires.
+	Expires *time.Time `json:"expires,omitempty"`
+	// LastAccess is the last time the cache entry was opened.
+	LastAccess time.Time `json:"lastAccess"`
+	// ETag is the ETag of the cached response.
+	ETag string `json:"eTag"`
+	// HitCount is the number of times the cache entry was opened.
+	HitCount int `json:"hitCount"`
 }
 
 // Timings describes various phases within request-response round trip. All
 // times are specified in milliseconds
 type Timings struct {
+	// Blocked is the time spent waiting for a network connection, or -1 if it
+	// does not apply.
+	Blocked int64 `json:"blocked"`
+	// DNS is the time required to resolve the host name, or -1 if it does not
+	// apply.
+	DNS int64 `json:"dns"`
+	// Connect is the time required to create the TCP connection, including
+	// SSL, or -1 if it does not apply.
+	Connect int64 `json:"connect"`
 	// Send is the time required to send HTTP request to the server.
 	Send int64 `json:"send"`
 	// Wait is the time spent waiting for a response from the server.
 	Wait int64 `json:"wait"`
 	// Receive is the time required to read entire response from server or cache.
 	Receive int64 `json:"receive"`
+	// SSL is the time required for the SSL/TLS negotiation, or -1 if it does
+	// not apply. The time is also included in Connect.
+	SSL int64 `json:"ssl"`
 }
 
 // Cookie is the data about a cookie on a request or response.
@@ -449,6 +499,53 @@ func SkipBodyLoggingForContentTypes(cts ...string) Option {
 	}
 }
 
+// StreamingBodyLogging returns an option that captures request post data and
+// response bodies as they stream through the proxy, instead of reading them
+// into memory before they are sent. At most limit bytes of each body are
+// logged, and entries are updated once their bodies have been read. Post data
+// is logged as text only; form parameters are not parsed. Whether a body is
+// logged is still decided by the other options.
+func StreamingBodyLogging(limit int64) Option {
+	return func(l *Logger) {
+		l.bodyLimit = limit
+	}
+}
+
+// MaxEntries returns an option that limits the log to the n most recent
+// entries, evicting the oldest entries first. Zero means no limit.
+func MaxEntries(n int) Option {
+	return func(l *Logger) {
+		l.maxEntries = n
+	}
+}
+
+// MaxBodyBytes returns an option that limits the total size of the request
+// post data and response bodies in the log to n bytes, evicting the oldest
+// entries first. Zero means no limit.
+func MaxBodyBytes(n int64) Option {
+	return func(l *Logger) {
+		l.maxBodyBytes = n
+	}
+}
+
+// MaxEntryAge returns an option that evicts entries from the log once their
+// requests started more than d ago. Zero means no limit.
+func MaxEntryAge(d time.Duration) Option {
+	return func(l *Logger) {
+		l.maxAge = d
+	}
+}
+
+// SpillEntries returns an option that writes each entry to s once its
+// response, including any streamed body, has been logged. Spilled entries stay
+// in the log until they are evicted or reset, so the spill should be combined
+// with limits on the log to bound its memory.
+func SpillEntries(s *Spill) Option {
+	return func(l *Logger) {
+		l.spill = s
+	}
+}
+
 // NewLogger returns a HAR logger. The returned
 // logger logs all request post data and response bodies by default.
 func NewLogger() *Logger {
@@ -486,17 +583,49 @@ func (l *Logger) ModifyRequest(req *http.Request) error {
 // RecordRequest logs the HTTP request with the given ID. The ID should be unique
 // per request/response pair.
 func (l *Logger) RecordRequest(id string, req *http.Request) error {
-	hreq, err := NewRequest(req, l.postDataLogging(req))
+	logBody := l.postDataLogging(req)
+	stream := logBody && l.bodyLimit > 0
+
+	hreq, err := NewRequest(req, logBody && !stream)
 	if err != nil {
 		return err
 	}
+	if stream && hreq.PostData != nil {
+		mv := messageview.New()
+		if err := mv.StreamRequest(req, l.bodyLimit, func() {
+			br, err := mv.BodyReader()
+			if err != nil {
+				log.Errorf("har: failed to read post data: %v", err)
+				return
+			}
+			body, _ := ioutil.ReadAll(br)
+
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			hreq.PostData.Text = string(body)
+			if e, ok := l.entries[id]; ok && e.Request == hreq {
+				l.resize(e)
+				l.evict()
+			}
+		}); err != nil {
+			return err
+		}
+	}
 
 	entry := &Entry{
 		ID:              id,
 		StartedDateTime: time.Now().UTC(),
 		Request:         hreq,
 		Cache:           &Cache{},
-		Timings:         &Timings{},
+		Timings:         newTimings(time.Time{}, martian.RoundTripTrace{}, time.Time{}),
+	}
+	// The client of a MITM'd connection waited for the handshake before it
+	// sent its first request.
+	if ctx := martian.NewContext(req); ctx != nil {
+		if rt, ok := ctx.RoundTripTrace(); ok && !rt.HandshakeStart.IsZero() {
+			entry.StartedDateTime = rt.HandshakeStart.UTC()
+		}
 	}
 
 	l.mu.Lock()
@@ -512,6 +641,8 @@ func (l *Logger) RecordRequest(id string, req *http.Request) error {
 	entry.next = l.tail.next
 	l.tail.next = entry
 	l.tail = entry
+	l.resize(entry)
+	l.evict()
 
 	return nil
 }
@@ -558,28 +689,292 @@ func (l *Logger) ModifyResponse(res *http.Response) error {
 	}
 	id := ctx.ID()
 
+	// The cache is recorded first so that it is in the entry when spilled.
+	if v, ok := ctx.Get(CacheContextKey); ok {
+		if c, ok := v.(*Cache); ok {
+			l.mu.Lock()
+			if e, ok := l.entries[id]; ok {
+				e.Cache = c
+			}
+			l.mu.Unlock()
+		}
+	}
+
 	return l.RecordResponse(id, res)
 }
 
 // RecordResponse logs an HTTP response, associating it with the previously-logged
 // HTTP request with the same ID.
 func (l *Logger) RecordResponse(id string, res *http.Response) error {
-	hres, err := NewResponse(res, l.bodyLogging(res))
+	logBody := l.bodyLogging(res)
+	stream := logBody && l.bodyLimit > 0
+
+	var rt martian.RoundTripTrace
+	if ctx := martian.NewContext(res.Request); ctx != nil {
+		rt, _ = ctx.RoundTripTrace()
+	}
+
+	// The entry is complete once the response has been added to it and its
+	// body has been received and, when streaming, logged. The body may be
+	// received while the response is read, before it is added. pending counts
+	// the bodies it waits for, added is whether the response has been added
+	// and received is when the body was received, all guarded by l.mu.
+	var hres *Response
+	var received time.Time
+	var added bool
+	pending := 1
+	if stream {
+		pending++
+	}
+	finish := func() *Entry {
+		pending--
+		if pending > 0 || !added {
+			return nil
+		}
+		if e, ok := l.entries[id]; ok && e.Response == hres {
+			return l.complete(e, rt, received)
+		}
+		return nil
+	}
+
+	// The body of an upgraded connection is left as is, so that the proxy can
+	// still relay it.
+	if res.Body == nil || res.Body == http.NoBody || res.StatusCode == http.StatusSwitchingProtocols {
+		received = time.Now()
+		pending--
+	} else {
+		res.Body = &receiveBody{ReadCloser: res.Body, done: func() {
+			l.mu.Lock()
+			received = time.Now()
+			se := finish()
+			l.mu.Unlock()
+
+			l.writeSpill(se)
+		}}
+	}
+
+	hres, err := NewResponse(res, logBody && !stream)
 	if err != nil {
 		return err
 	}
+	if stream {
+		mv := messageview.New()
+		if err := mv.StreamResponse(res, l.bodyLimit, func() {
+			// A truncated body may fail to decode in full; keep what was decoded.
+			var body []byte
+			br, err := mv.BodyReader(messageview.Decode())
+			if err != nil {
+				log.Errorf("har: failed to decode response body: %v", err)
+			} else {
+				body, _ = ioutil.ReadAll(br)
+			}
 
-	l.mu.Lock()
-	defer l.mu.Unlock()
+			l.mu.Lock()
+			hres.Content = &Content{
+				Encoding: "base64",
+				MimeType: hres.Content.MimeType,
+				Text:     body,
+				Size:     int64(len(body)),
+			}
+			se := finish()
+			l.mu.Unlock()
+
+			l.writeSpill(se)
+		}); err != nil {
+			return err
+		}
+	}
 
+	var se *Entry
+	l.mu.Lock()
 	if e, ok := l.entries[id]; ok {
 		e.Response = hres
 		e.Time = time.Since(e.StartedDateTime).Nanoseconds() / 1000000
+		e.Timings = newTimings(e.StartedDateTime, rt, received)
+		e.ServerIPAddress = rt.ServerIP
+		e.Connection = rt.Connection
+		added = true
+		if pending == 0 {
+			se = l.complete(e, rt, received)
+		}
 	}
+	l.mu.Unlock()
+
+	l.writeSpill(se)
 
 	return nil
 }
 
+// complete records the timings of e, whose response body was received at
+// received, and counts its bodies. It returns a copy of e to write to the
+// spill once l.mu is released, or nil if there is no spill. l.mu must be held.
+func (l *Logger) complete(e *Entry, rt martian.RoundTripTrace, received time.Time) *Entry {
+	e.Time = received.Sub(e.StartedDateTime).Nanoseconds() / 1000000
+	e.Timings = newTimings(e.StartedDateTime, rt, received)
+
+	l.resize(e)
+	l.evict()
+
+	if l.spill == nil {
+		return nil
+	}
+	se := *e
+	se.next = nil
+
+	return &se
+}
+
+// writeSpill writes e to the spill, if e is not nil. Encoding and writing the
+// entry can be slow, so l.mu must not be held.
+func (l *Logger) writeSpill(e *Entry) {
+	if e == nil {
+		return
+	}
+	if err := l.spill.Write(e); err != nil {
+		log.Errorf("har: failed to spill entry %s: %v", e.ID, err)
+	}
+}
+
+// receiveBody is a response body that calls done once it has been read to EOF
+// or closed.
+type receiveBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *receiveBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.once.Do(b.done)
+	}
+
+	return n, err
+}
+
+func (b *receiveBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+
+	return err
+}
+
+// newTimings returns the timings of the request that started at start and
+// was traced by rt, whose response body was received at received. Phases that
+// did not happen are -1 if they are optional and 0 otherwise.
+func newTimings(start time.Time, rt martian.RoundTripTrace, received time.Time) *Timings {
+	t := &Timings{
+		Blocked: -1,
+		DNS:     -1,
+		Connect: -1,
+		SSL:     -1,
+	}
+
+	// The handshake with the client of a MITM'd connection is reported as
+	// the setup of the connection the request was sent on, along with that
+	// of the upstream connection.
+	if !rt.HandshakeStart.IsZero() {
+		t.Connect = millis(rt.HandshakeStart, rt.HandshakeDone)
+		t.SSL = t.Connect
+		start = rt.HandshakeDone
+	}
+	if rt.Start.IsZero() {
+		return t
+	}
+
+	// The request is blocked until it starts to set up a connection, or gets
+	// an idle one.
+	var setup time.Time
+	for _, ts := range []time.Time{rt.DNSStart, rt.ConnectStart, rt.TLSHandshakeStart, rt.GotConn} {
+		if !ts.IsZero() && (setup.IsZero() || ts.Before(setup)) {
+			setup = ts
+		}
+	}
+	if !setup.IsZero() {
+		t.Blocked = millis(start, setup)
+	}
+
+	if !rt.DNSStart.IsZero() {
+		t.DNS = millis(rt.DNSStart, rt.DNSDone)
+	}
+	if !rt.ConnectStart.IsZero() {
+		done := rt.ConnectDone
+		if rt.TLSHandshakeDone.After(done) {
+			done = rt.TLSHandshakeDone
+		}
+		t.Connect = addMillis(t.Connect, millis(rt.ConnectStart, done))
+	}
+	if !rt.TLSHandshakeStart.IsZero() {
+		t.SSL = addMillis(t.SSL, millis(rt.TLSHandshakeStart, rt.TLSHandshakeDone))
+	}
+
+	if !rt.GotConn.IsZero() && !rt.WroteRequest.IsZero() {
+		t.Send = millis(rt.GotConn, rt.WroteRequest)
+	}
+	if !rt.WroteRequest.IsZero() && !rt.GotFirstResponseByte.IsZero() {
+		t.Wait = millis(rt.WroteRequest, rt.GotFirstResponseByte)
+	}
+	if !rt.GotFirstResponseByte.IsZero() && !received.IsZero() {
+		t.Receive = millis(rt.GotFirstResponseByte, received)
+	}
+
+	return t
+}
+
+// millis returns the milliseconds from start to end, or 0 if end is not after
+// start.
+func millis(start, end time.Time) int64 {
+	if !end.After(start) {
+		return 0
+	}
+
+	return end.Sub(start).Nanoseconds() / 1000000
+}
+
+// addMillis adds ms to the optional timing t, which is -1 if unset.
+func addMillis(t, ms int64) int64 {
+	if t < 0 {
+		return ms
+	}
+
+	return t + ms
+}
+
+// resize updates the number of body bytes of e in the log. l.mu must be held.
+func (l *Logger) resize(e *Entry) {
+	var size int64
+	if e.Request != nil && e.Request.PostData != nil {
+		size += int64(len(e.Request.PostData.Text))
+	}
+	if e.Response != nil && e.Response.Content != nil {
+		size += int64(len(e.Response.Content.Text))
+	}
+
+	l.bodyBytes += size - e.size
+	e.size = size
+}
+
+// evict removes the oldest entries from the log while it exceeds its limits.
+// l.mu must be held.
+func (l *Logger) evict() {
+	for l.tail != nil {
+		head := l.tail.next
+		if (l.maxEntries <= 0 || len(l.entries) <= l.maxEntries) &&
+			(l.maxBodyBytes <= 0 || l.bodyBytes <= l.maxBodyBytes) &&
+			(l.maxAge <= 0 || time.Since(head.StartedDateTime) <= l.maxAge) {
+			return
+		}
+
+		delete(l.entries, head.ID)
+		l.bodyBytes -= head.size
+		if head == l.tail {
+			l.tail = nil
+		} else {
+			l.tail.next = head.next
+		}
+	}
+}
+
 // NewResponse constructs and returns a Response from resp. If withBody is true,
 // resp.Body is read to EOF and replaced with a copy in a bytes.Buffer. An error
 // is returned (and resp.Body may be in an intermediate state) if an error is
@@ -631,6 +1026,8 @@ func (l *Logger) Export() *HAR {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	l.evict()
+
 	es := make([]*Entry, 0, len(l.entries))
 	curr := l.tail
 	for curr != nil {
@@ -649,6 +1046,8 @@ func (l *Logger) ExportAndReset() *HAR {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	l.evict()
+
 	es := make([]*Entry, 0, len(l.entries))
 	curr := l.tail
 	prev := l.tail
@@ -658,6 +1057,7 @@ func (l *Logger) ExportAndReset() *HAR {
 		if curr.Response != nil {
 			es = append(es, curr)
 			delete(l.entries, curr.ID)
+			l.bodyBytes -= curr.size
 		} else {
 			if first == nil {
 				first = curr
@@ -696,6 +1096,7 @@ func (l *Logger) Reset() {
 
 	l.entries = make(map[string]*Entry)
 	l.tail = nil
+	l.bodyBytes = 0
 }
 
 func cookies(cs []*http.Cookie) []Cookie {
@@ -17,8 +17,15 @@ package har
 import (
 	"bytes"
 	"encoding/json"
+	"io"
+	"io/ioutil"
 	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -230,6 +237,48 @@ func TestModifyResponse(t *testing.T) {
 	}
 }
 
+func TestModifyResponseRecordsCache(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("NewRequest(): got %v, want no error", err)
+	}
+
+	ctx, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("martian.TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	logger := NewLogger()
+	if err := logger.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+
+	expires := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	ctx.Set(CacheContextKey, &Cache{
+		BeforeRequest: &CacheEntry{
+			Expires:  &expires,
+			ETag:     `"v1"`,
+			HitCount: 1,
+		},
+		Comment: "hit",
+	})
+
+	res := proxyutil.NewResponse(200, nil, req)
+	if err := logger.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+
+	b, err := json.Marshal(logger.Export().Log.Entries[0].Cache)
+	if err != nil {
+		t.Fatalf("json.Marshal(): got %v, want no error", err)
+	}
+	want := `{"beforeRequest":{"expires":"2021-01-01T00:00:00Z","lastAccess":"0001-01-01T00:00:00Z","eTag":"\"v1\"","hitCount":1},"comment":"hit"}`
+	if got := string(b); got != want {
+		t.Errorf("json.Marshal(Cache): got %s, want %s", got, want)
+	}
+}
+
 func TestModifyRequestBodyURLEncoded(t *testing.T) {
 	logger := NewLogger()
 
@@ -826,6 +875,365 @@ func TestOptionResponseBodyLogging(t *testing.T) {
 	}
 }
 
+func TestOptionStreamingBodyLogging(t *testing.T) {
+	req, err := http.NewRequest("POST", "http://example.com", strings.NewReader("post data"))
+	if err != nil {
+		t.Fatalf("NewRequest(): got %v, want no error", err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+
+	_, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("martian.TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	res := proxyutil.NewResponse(200, strings.NewReader("response body"), req)
+	res.TransferEncoding = []string{"chunked"}
+	res.Header.Set("Content-Type", "text/plain")
+
+	logger := NewLogger()
+	logger.SetOption(StreamingBodyLogging(8))
+
+	if err := logger.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+	if err := logger.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+
+	log := logger.Export().Log
+	if got, want := len(log.Entries), 1; got != want {
+		t.Fatalf("len(log.Entries): got %d, want %d", got, want)
+	}
+	if got, want := log.Entries[0].Request.PostData.Text, ""; got != want {
+		t.Errorf("PostData.Text: got %q before the body was read, want %q", got, want)
+	}
+	if got, want := string(log.Entries[0].Response.Content.Text), ""; got != want {
+		t.Errorf("Content.Text: got %q before the body was read, want %q", got, want)
+	}
+
+	for _, body := range []io.ReadCloser{req.Body, res.Body} {
+		if _, err := ioutil.ReadAll(body); err != nil {
+			t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+		}
+		body.Close()
+	}
+
+	log = logger.Export().Log
+	if got, want := log.Entries[0].Request.PostData.Text, "post dat"; got != want {
+		t.Errorf("PostData.Text: got %q, want %q", got, want)
+	}
+	if got, want := string(log.Entries[0].Response.Content.Text), "response"; got != want {
+		t.Errorf("Content.Text: got %q, want %q", got, want)
+	}
+	if got, want := log.Entries[0].Response.Content.Size, int64(8); got != want {
+		t.Errorf("Content.Size: got %d, want %d", got, want)
+	}
+}
+
+// recordRoundTrip logs a request with id and its response with body.
+func recordRoundTrip(t *testing.T, logger *Logger, id, body string) {
+	t.Helper()
+
+	req, err := http.NewRequest("GET", "http://example.com/"+id, nil)
+	if err != nil {
+		t.Fatalf("NewRequest(): got %v, want no error", err)
+	}
+	if err := logger.RecordRequest(id, req); err != nil {
+		t.Fatalf("RecordRequest(%q): got %v, want no error", id, err)
+	}
+
+	res := proxyutil.NewResponse(200, strings.NewReader(body), req)
+	if err := logger.RecordResponse(id, res); err != nil {
+		t.Fatalf("RecordResponse(%q): got %v, want no error", id, err)
+	}
+	// Streamed bodies are logged once read.
+	if _, err := ioutil.ReadAll(res.Body); err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	res.Body.Close()
+}
+
+func entryIDs(h *HAR) []string {
+	var ids []string
+	for _, e := range h.Log.Entries {
+		ids = append(ids, e.ID)
+	}
+	return ids
+}
+
+func TestOptionMaxEntries(t *testing.T) {
+	logger := NewLogger()
+	logger.SetOption(MaxEntries(2))
+
+	for _, id := range []string{"a", "b", "c"} {
+		recordRoundTrip(t, logger, id, "body")
+	}
+
+	if got, want := entryIDs(logger.Export()), []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("entry IDs: got %v, want %v", got, want)
+	}
+}
+
+func TestOptionMaxBodyBytes(t *testing.T) {
+	logger := NewLogger()
+	logger.SetOption(MaxBodyBytes(10))
+
+	recordRoundTrip(t, logger, "a", "12345")
+	recordRoundTrip(t, logger, "b", "12345")
+	if got, want := entryIDs(logger.Export()), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("entry IDs: got %v, want %v", got, want)
+	}
+
+	recordRoundTrip(t, logger, "c", "1")
+	if got, want := entryIDs(logger.Export()), []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("entry IDs: got %v, want %v", got, want)
+	}
+
+	logger.ExportAndReset()
+	recordRoundTrip(t, logger, "d", "1234567890")
+	if got, want := entryIDs(logger.Export()), []string{"d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("entry IDs after ExportAndReset(): got %v, want %v", got, want)
+	}
+}
+
+func TestOptionMaxEntryAge(t *testing.T) {
+	logger := NewLogger()
+	logger.SetOption(MaxEntryAge(time.Minute))
+
+	recordRoundTrip(t, logger, "a", "body")
+	recordRoundTrip(t, logger, "b", "body")
+
+	logger.mu.Lock()
+	logger.entries["a"].StartedDateTime = time.Now().Add(-2 * time.Minute)
+	logger.mu.Unlock()
+
+	if got, want := entryIDs(logger.Export()), []string{"b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("entry IDs: got %v, want %v", got, want)
+	}
+}
+
+func TestOptionSpillEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "har")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): got %v, want no error", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewSpill(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("NewSpill(): got %v, want no error", err)
+	}
+
+	logger := NewLogger()
+	logger.SetOption(MaxEntries(1), SpillEntries(s), StreamingBodyLogging(100))
+
+	recordRoundTrip(t, logger, "a", "body")
+	recordRoundTrip(t, logger, "b", "streamed")
+	recordRoundTrip(t, logger, "c", "body")
+
+	// A pending entry is not spilled.
+	req, err := http.NewRequest("GET", "http://example.com/d", nil)
+	if err != nil {
+		t.Fatalf("NewRequest(): got %v, want no error", err)
+	}
+	if err := logger.RecordRequest("d", req); err != nil {
+		t.Fatalf("RecordRequest(): got %v, want no error", err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("s.Close(): got %v, want no error", err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "har-000001.jsonl"))
+	if err != nil {
+		t.Fatalf("ioutil.ReadFile(): got %v, want no error", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+
+	var ids []string
+	for _, line := range lines {
+		var e Entry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("json.Unmarshal(): got %v, want no error", err)
+		}
+		ids = append(ids, e.ID)
+		if e.ID == "b" {
+			if got, want := string(e.Response.Content.Text), "streamed"; got != want {
+				t.Errorf("Content.Text: got %q, want %q", got, want)
+			}
+		}
+	}
+	if got, want := ids, []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("spilled entry IDs: got %v, want %v", got, want)
+	}
+
+	if got, want := entryIDs(logger.Export()), []string{"d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("entry IDs: got %v, want %v", got, want)
+	}
+}
+
+func TestOptionSpillEntriesBodyLogging(t *testing.T) {
+	dir, err := ioutil.TempDir("", "har")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): got %v, want no error", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewSpill(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("NewSpill(): got %v, want no error", err)
+	}
+
+	// The body is read while the response is logged, before it is added to
+	// the entry; the entry is still spilled once, with its response.
+	logger := NewLogger()
+	logger.SetOption(SpillEntries(s))
+
+	recordRoundTrip(t, logger, "a", "body")
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("s.Close(): got %v, want no error", err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "har-000001.jsonl"))
+	if err != nil {
+		t.Fatalf("ioutil.ReadFile(): got %v, want no error", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if got, want := len(lines), 1; got != want {
+		t.Fatalf("spilled entries: got %d, want %d", got, want)
+	}
+
+	var e Entry
+	if err := json.Unmarshal([]byte(lines[0]), &e); err != nil {
+		t.Fatalf("json.Unmarshal(): got %v, want no error", err)
+	}
+	if e.Response == nil {
+		t.Fatal("e.Response: got nil, want response")
+	}
+	if got, want := string(e.Response.Content.Text), "body"; got != want {
+		t.Errorf("Content.Text: got %q, want %q", got, want)
+	}
+}
+
+func TestNewTimings(t *testing.T) {
+	t0 := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	at := func(ms int) time.Time {
+		return t0.Add(time.Duration(ms) * time.Millisecond)
+	}
+
+	tt := []struct {
+		name string
+		rt   martian.RoundTripTrace
+		want Timings
+	}{
+		{
+			name: "skipped round trip",
+			want: Timings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1},
+		},
+		{
+			name: "new connection",
+			rt: martian.RoundTripTrace{
+				Start:                at(1),
+				DNSStart:             at(2),
+				DNSDone:              at(5),
+				ConnectStart:         at(5),
+				ConnectDone:          at(10),
+				TLSHandshakeStart:    at(10),
+				TLSHandshakeDone:     at(20),
+				GotConn:              at(20),
+				WroteRequest:         at(22),
+				GotFirstResponseByte: at(50),
+			},
+			want: Timings{Blocked: 2, DNS: 3, Connect: 15, SSL: 10, Send: 2, Wait: 28, Receive: 10},
+		},
+		{
+			name: "reused connection after MITM handshake",
+			rt: martian.RoundTripTrace{
+				HandshakeStart:       at(0),
+				HandshakeDone:        at(8),
+				Start:                at(9),
+				GotConn:              at(10),
+				WroteRequest:         at(11),
+				GotFirstResponseByte: at(30),
+			},
+			want: Timings{Blocked: 2, DNS: -1, Connect: 8, SSL: 8, Send: 1, Wait: 19, Receive: 30},
+		},
+	}
+
+	for _, tc := range tt {
+		if got := newTimings(t0, tc.rt, at(60)); !reflect.DeepEqual(*got, tc.want) {
+			t.Errorf("%s: newTimings(): got %+v, want %+v", tc.name, *got, tc.want)
+		}
+	}
+}
+
+func TestIntegrationTimings(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		rw.Write([]byte("body"))
+	}))
+	defer srv.Close()
+
+	logger := NewLogger()
+
+	p := martian.NewProxy()
+	defer p.Close()
+	p.SetRequestModifier(logger)
+	p.SetResponseModifier(logger)
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+	go p.Serve(l)
+
+	c := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: l.Addr().String()})},
+		Timeout:   5 * time.Second,
+	}
+	for i := 0; i < 2; i++ {
+		res, err := c.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("%d. c.Get(): got %v, want no error", i, err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+
+	log := logger.Export().Log
+	if got, want := len(log.Entries), 2; got != want {
+		t.Fatalf("len(log.Entries): got %d, want %d", got, want)
+	}
+
+	for i, e := range log.Entries {
+		if got, want := e.ServerIPAddress, "127.0.0.1"; got != want {
+			t.Errorf("%d. e.ServerIPAddress: got %q, want %q", i, got, want)
+		}
+		if got, want := e.Connection, log.Entries[0].Connection; got == "" || got != want {
+			t.Errorf("%d. e.Connection: got %q, want the same non-empty port %q", i, got, want)
+		}
+		if got, min := e.Timings.Wait, int64(20); got < min {
+			t.Errorf("%d. e.Timings.Wait: got %dms, want at least %dms", i, got, min)
+		}
+		if got := e.Timings.Blocked; got < 0 {
+			t.Errorf("%d. e.Timings.Blocked: got %d, want not negative", i, got)
+		}
+		if got, want := e.Timings.SSL, int64(-1); got != want {
+			t.Errorf("%d. e.Timings.SSL: got %d, want %d", i, got, want)
+		}
+	}
+
+	if got := log.Entries[0].Timings.Connect; got < 0 {
+		t.Errorf("log.Entries[0].Timings.Connect: got %d, want not negative for a new connection", got)
+	}
+	if got, want := log.Entries[1].Timings.Connect, int64(-1); got != want {
+		t.Errorf("log.Entries[1].Timings.Connect: got %d, want %d for a reused connection", got, want)
+	}
+}
+
 func TestOptionRequestPostDataLogging(t *testing.T) {
 	logger := NewLogger()
 	logger.SetOption(PostDataLoggingForContentTypes("application/x-www-form-urlencoded"))
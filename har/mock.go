@@ -0,0 +1,329 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package har
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/google/martian/v3"
+	"github.com/google/martian/v3/parse"
+)
+
+func init() {
+	parse.Register("har.Mock", mockFromJSON)
+}
+
+// mockKey is the martian context key of the *mockResponse that answers a
+// request, or of a nil *mockResponse for unmatched requests answered with 404
+// Not Found.
+const mockKey = "har.Mock"
+
+// MockMode is how a Mock chooses among the entries of identical requests.
+type MockMode int
+
+const (
+	// MockSequential answers the nth identical request with the response of
+	// the nth entry for it, repeating the response of the last entry once
+	// they have all been served.
+	MockSequential MockMode = iota
+	// MockLatest answers identical requests with the response of the last
+	// entry for them.
+	MockLatest
+)
+
+// Mock is a request and response modifier that answers requests with the
+// responses of the entries of a HAR, skipping the round trip. Requests are
+// identical to the request of an entry if they have the same method, URL and
+// body.
+//
+// The request modifier should run after any modifier that changes the
+// request, and the response modifier before any modifier that reads or
+// changes the response, including loggers.
+type Mock struct {
+	mode        MockMode
+	passthrough bool
+
+	entries map[string][]*mockResponse
+
+	mu     sync.Mutex
+	served map[string]int
+}
+
+type mockJSON struct {
+	File        string               `json:"file"`
+	Mode        string               `json:"mode"`
+	Passthrough bool                 `json:"passthrough"`
+	Scope       []parse.ModifierType `json:"scope"`
+}
+
+// mockResponse is the response of an entry, ready to be served.
+type mockResponse struct {
+	status     int
+	statusText string
+	header     http.Header
+	body       []byte
+}
+
+// The HAR read by a Mock. Browsers write fractional sizes and timings, so
+// only the fields that are served are read rather than the full HAR.
+type mockHAR struct {
+	Log struct {
+		Entries []struct {
+			Request struct {
+				Method   string    `json:"method"`
+				URL      string    `json:"url"`
+				PostData *PostData `json:"postData"`
+			} `json:"request"`
+			Response struct {
+				Status     int      `json:"status"`
+				StatusText string   `json:"statusText"`
+				Headers    []Header `json:"headers"`
+				Content    *Content `json:"content"`
+			} `json:"response"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+// ReadMock returns a mock that answers requests from the HAR read from r.
+func ReadMock(r io.Reader) (*Mock, error) {
+	var h mockHAR
+	if err := json.NewDecoder(r).Decode(&h); err != nil {
+		return nil, fmt.Errorf("har: reading HAR: %v", err)
+	}
+
+	m := &Mock{
+		entries: make(map[string][]*mockResponse),
+		served:  make(map[string]int),
+	}
+
+	for i, e := range h.Log.Entries {
+		u, err := url.Parse(e.Request.URL)
+		if err != nil {
+			return nil, fmt.Errorf("har: entry %d: %v", i, err)
+		}
+		var body string
+		if e.Request.PostData != nil {
+			body = e.Request.PostData.Text
+		}
+		key := mockRequestKey(e.Request.Method, u, body)
+
+		mr := &mockResponse{
+			status:     e.Response.Status,
+			statusText: e.Response.StatusText,
+			header:     make(http.Header),
+		}
+		for _, h := range e.Response.Headers {
+			// HTTP/2 pseudo-headers and the framing of the recorded body do
+			// not apply to the decoded body that is served.
+			if strings.HasPrefix(h.Name, ":") {
+				continue
+			}
+			mr.header.Add(h.Name, h.Value)
+		}
+		mr.header.Del("Content-Length")
+		mr.header.Del("Content-Encoding")
+		mr.header.Del("Transfer-Encoding")
+		if e.Response.Content != nil {
+			mr.body = e.Response.Content.Text
+		}
+
+		m.entries[key] = append(m.entries[key], mr)
+	}
+
+	return m, nil
+}
+
+// LoadMock returns a mock that answers requests from the HAR file at path.
+func LoadMock(path string) (*Mock, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadMock(f)
+}
+
+// SetMode sets how the mock chooses among the entries of identical requests.
+// The default is MockSequential.
+func (m *Mock) SetMode(mode MockMode) {
+	m.mode = mode
+}
+
+// SetPassthrough sets whether requests that match no entry are sent upstream.
+// When false, the default, they are answered with 404 Not Found so that the
+// mock is hermetic.
+func (m *Mock) SetPassthrough(passthrough bool) {
+	m.passthrough = passthrough
+}
+
+// Reset serves the entries from the start again, as if no requests were
+// answered.
+func (m *Mock) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.served = make(map[string]int)
+}
+
+// match returns the response that answers the request with key, or nil if no
+// entry matches it.
+func (m *Mock) match(key string) *mockResponse {
+	rs := m.entries[key]
+	if len(rs) == 0 {
+		return nil
+	}
+	if m.mode == MockLatest {
+		return rs[len(rs)-1]
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := m.served[key]
+	m.served[key]++
+	if n >= len(rs) {
+		n = len(rs) - 1
+	}
+
+	return rs[n]
+}
+
+// ModifyRequest looks up the response for req, skipping the round trip
+// unless req is unmatched and passed through. CONNECT requests are always
+// passed through so that the requests of MITM'd HTTPS connections are matched
+// inside the tunnel.
+func (m *Mock) ModifyRequest(req *http.Request) error {
+	if req.Method == "CONNECT" {
+		return nil
+	}
+
+	ctx := martian.NewContext(req)
+	if ctx == nil {
+		return nil
+	}
+
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	mr := m.match(mockRequestKey(req.Method, req.URL, string(body)))
+	if mr == nil && m.passthrough {
+		return nil
+	}
+
+	ctx.SkipRoundTrip()
+	ctx.Set(mockKey, mr)
+
+	return nil
+}
+
+// ModifyResponse replaces res with the response for its request, or with 404
+// Not Found if there is none.
+func (m *Mock) ModifyResponse(res *http.Response) error {
+	ctx := martian.NewContext(res.Request)
+	if ctx == nil {
+		return nil
+	}
+	v, ok := ctx.Get(mockKey)
+	if !ok {
+		return nil
+	}
+	mr := v.(*mockResponse)
+
+	header := make(http.Header)
+	status := http.StatusNotFound
+	statusText := http.StatusText(status)
+	body := []byte(fmt.Sprintf("har: no entry for %s %s\n", res.Request.Method, res.Request.URL))
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	if mr != nil {
+		status = mr.status
+		statusText = mr.statusText
+		if statusText == "" {
+			statusText = http.StatusText(status)
+		}
+		header = mr.header.Clone()
+		body = mr.body
+	}
+
+	res.Body.Close()
+	res.StatusCode = status
+	res.Status = fmt.Sprintf("%d %s", status, statusText)
+	res.Header = header
+	res.TransferEncoding = nil
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+
+	return nil
+}
+
+// mockRequestKey returns the key of the entries of requests identical to the
+// request with method, u and body.
+func mockRequestKey(method string, u *url.URL, body string) string {
+	cu := *u
+	cu.Fragment = ""
+
+	return method + " " + cu.String() + "\n" + body
+}
+
+// mockFromJSON builds a har.Mock from JSON.
+//
+// Example JSON:
+// {
+//   "har.Mock": {
+//     "scope": ["request", "response"],
+//     "file": "/path/to/backend.har",
+//     "mode": "sequential",
+//     "passthrough": false
+//   }
+// }
+func mockFromJSON(b []byte) (*parse.Result, error) {
+	msg := &mockJSON{}
+	if err := json.Unmarshal(b, msg); err != nil {
+		return nil, err
+	}
+
+	m, err := LoadMock(msg.File)
+	if err != nil {
+		return nil, err
+	}
+
+	switch msg.Mode {
+	case "", "sequential":
+	case "latest":
+		m.SetMode(MockLatest)
+	default:
+		return nil, fmt.Errorf("har: unknown mock mode %q", msg.Mode)
+	}
+	m.SetPassthrough(msg.Passthrough)
+
+	return parse.NewResult(m, msg.Scope)
+}
@@ -0,0 +1,373 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package har
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/martian/v3"
+	"github.com/google/martian/v3/martiantest"
+	"github.com/google/martian/v3/mitm"
+	"github.com/google/martian/v3/parse"
+	"github.com/google/martian/v3/proxyutil"
+)
+
+// mockTestHAR is a HAR as exported by a browser, with fractional timings and
+// both plain and base64 encoded content.
+const mockTestHAR = `{
+  "log": {
+    "version": "1.2",
+    "creator": {"name": "WebInspector", "version": "537.36"},
+    "entries": [
+      {
+        "startedDateTime": "2021-06-01T10:00:00.000Z",
+        "time": 12.345,
+        "request": {
+          "method": "GET",
+          "url": "http://example.com/api",
+          "httpVersion": "HTTP/1.1",
+          "headers": [],
+          "queryString": [],
+          "cookies": [],
+          "headersSize": -1,
+          "bodySize": 0
+        },
+        "response": {
+          "status": 200,
+          "statusText": "OK",
+          "httpVersion": "HTTP/1.1",
+          "headers": [
+            {"name": "Content-Type", "value": "application/json"},
+            {"name": "Content-Encoding", "value": "gzip"},
+            {"name": "Content-Length", "value": "42"},
+            {"name": "Set-Cookie", "value": "a=1"},
+            {"name": "Set-Cookie", "value": "b=2"}
+          ],
+          "cookies": [],
+          "content": {"size": 9, "mimeType": "application/json", "text": "{\"n\": 1}\n"},
+          "redirectURL": "",
+          "headersSize": -1,
+          "bodySize": -1
+        },
+        "cache": {},
+        "timings": {"blocked": 0.5, "dns": -1, "connect": -1, "send": 0.1, "wait": 11.2, "receive": 0.545}
+      },
+      {
+        "startedDateTime": "2021-06-01T10:00:01.000Z",
+        "time": 10.5,
+        "request": {"method": "GET", "url": "http://example.com/api", "headers": []},
+        "response": {
+          "status": 201,
+          "statusText": "",
+          "headers": [{"name": ":status", "value": "201"}],
+          "content": {"size": 9, "mimeType": "application/json", "text": "eyJuIjogMn0K", "encoding": "base64"}
+        }
+      },
+      {
+        "startedDateTime": "2021-06-01T10:00:02.000Z",
+        "time": 8,
+        "request": {
+          "method": "POST",
+          "url": "http://example.com/api",
+          "postData": {"mimeType": "text/plain", "text": "hello"}
+        },
+        "response": {
+          "status": 202,
+          "statusText": "Accepted",
+          "headers": [],
+          "content": {"size": 0, "mimeType": "text/plain"}
+        }
+      }
+    ]
+  }
+}`
+
+func mockResponseFor(t *testing.T, m *Mock, method, url, body string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	ctx, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("martian.TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	if err := m.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+	if !ctx.SkippingRoundTrip() {
+		return nil
+	}
+
+	res := proxyutil.NewResponse(200, nil, req)
+	if err := m.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+
+	return res
+}
+
+func mockBody(t *testing.T, res *http.Response) string {
+	t.Helper()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+
+	return string(b)
+}
+
+func TestMockSequential(t *testing.T) {
+	m, err := ReadMock(strings.NewReader(mockTestHAR))
+	if err != nil {
+		t.Fatalf("ReadMock(): got %v, want no error", err)
+	}
+
+	tt := []struct {
+		status int
+		body   string
+	}{
+		{200, "{\"n\": 1}\n"},
+		{201, "{\"n\": 2}\n"},
+		{201, "{\"n\": 2}\n"},
+	}
+
+	for i, tc := range tt {
+		res := mockResponseFor(t, m, "GET", "http://example.com/api", "")
+		if res == nil {
+			t.Fatalf("%d. SkippingRoundTrip(): got false, want true", i)
+		}
+		if got, want := res.StatusCode, tc.status; got != want {
+			t.Errorf("%d. res.StatusCode: got %d, want %d", i, got, want)
+		}
+		if got, want := res.Status, fmt.Sprintf("%d %s", tc.status, http.StatusText(tc.status)); got != want {
+			t.Errorf("%d. res.Status: got %q, want %q", i, got, want)
+		}
+		if got, want := mockBody(t, res), tc.body; got != want {
+			t.Errorf("%d. res.Body: got %q, want %q", i, got, want)
+		}
+		if got, want := res.ContentLength, int64(len(tc.body)); got != want {
+			t.Errorf("%d. res.ContentLength: got %d, want %d", i, got, want)
+		}
+	}
+
+	m.Reset()
+	if got, want := mockResponseFor(t, m, "GET", "http://example.com/api", "").StatusCode, 200; got != want {
+		t.Errorf("res.StatusCode after Reset(): got %d, want %d", got, want)
+	}
+}
+
+func TestMockRestoresHeaders(t *testing.T) {
+	m, err := ReadMock(strings.NewReader(mockTestHAR))
+	if err != nil {
+		t.Fatalf("ReadMock(): got %v, want no error", err)
+	}
+
+	res := mockResponseFor(t, m, "GET", "http://example.com/api#top", "")
+	if res == nil {
+		t.Fatal("SkippingRoundTrip(): got false, want true")
+	}
+
+	if got, want := res.Header.Get("Content-Type"), "application/json"; got != want {
+		t.Errorf("res.Header.Get(%q): got %q, want %q", "Content-Type", got, want)
+	}
+	if got, want := len(res.Header["Set-Cookie"]), 2; got != want {
+		t.Errorf("len(res.Header[%q]): got %d, want %d", "Set-Cookie", got, want)
+	}
+	for _, h := range []string{"Content-Encoding", "Content-Length"} {
+		if got := res.Header.Get(h); got != "" {
+			t.Errorf("res.Header.Get(%q): got %q, want no header", h, got)
+		}
+	}
+
+	res = mockResponseFor(t, m, "GET", "http://example.com/api", "")
+	if got := res.Header.Get(":status"); got != "" {
+		t.Errorf("res.Header.Get(%q): got %q, want no header", ":status", got)
+	}
+}
+
+func TestMockLatest(t *testing.T) {
+	m, err := ReadMock(strings.NewReader(mockTestHAR))
+	if err != nil {
+		t.Fatalf("ReadMock(): got %v, want no error", err)
+	}
+	m.SetMode(MockLatest)
+
+	for i := 0; i < 2; i++ {
+		res := mockResponseFor(t, m, "GET", "http://example.com/api", "")
+		if got, want := res.StatusCode, 201; got != want {
+			t.Errorf("%d. res.StatusCode: got %d, want %d", i, got, want)
+		}
+	}
+}
+
+func TestMockMatchesBody(t *testing.T) {
+	m, err := ReadMock(strings.NewReader(mockTestHAR))
+	if err != nil {
+		t.Fatalf("ReadMock(): got %v, want no error", err)
+	}
+
+	res := mockResponseFor(t, m, "POST", "http://example.com/api", "hello")
+	if got, want := res.StatusCode, 202; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+	if got, want := res.Status, "202 Accepted"; got != want {
+		t.Errorf("res.Status: got %q, want %q", got, want)
+	}
+
+	res = mockResponseFor(t, m, "POST", "http://example.com/api", "goodbye")
+	if got, want := res.StatusCode, 404; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+}
+
+func TestMockUnmatched(t *testing.T) {
+	m, err := ReadMock(strings.NewReader(mockTestHAR))
+	if err != nil {
+		t.Fatalf("ReadMock(): got %v, want no error", err)
+	}
+
+	res := mockResponseFor(t, m, "GET", "http://example.com/missing", "")
+	if res == nil {
+		t.Fatal("SkippingRoundTrip(): got false, want true")
+	}
+	if got, want := res.StatusCode, 404; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+
+	m.SetPassthrough(true)
+	if res := mockResponseFor(t, m, "GET", "http://example.com/missing", ""); res != nil {
+		t.Errorf("SkippingRoundTrip(): got true, want false")
+	}
+}
+
+func TestIntegrationMockMITM(t *testing.T) {
+	t.Parallel()
+
+	ca, priv, err := mitm.NewAuthority("martian.proxy", "Martian Authority", 2*time.Hour)
+	if err != nil {
+		t.Fatalf("mitm.NewAuthority(): got %v, want no error", err)
+	}
+
+	mc, err := mitm.NewConfig(ca, priv)
+	if err != nil {
+		t.Fatalf("mitm.NewConfig(): got %v, want no error", err)
+	}
+
+	m, err := ReadMock(strings.NewReader(strings.Replace(mockTestHAR, "http://", "https://", -1)))
+	if err != nil {
+		t.Fatalf("ReadMock(): got %v, want no error", err)
+	}
+
+	p := martian.NewProxy()
+	defer p.Close()
+
+	p.SetMITM(mc)
+	p.SetRequestModifier(m)
+	p.SetResponseModifier(m)
+
+	// Every response must come from the HAR.
+	tr := martiantest.NewTransport()
+	tr.Respond(502)
+	p.SetRoundTripper(tr)
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+	go p.Serve(l)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	c := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(&url.URL{Scheme: "http", Host: l.Addr().String()}),
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		},
+		Timeout: 5 * time.Second,
+	}
+
+	res, err := c.Get("https://example.com/api")
+	if err != nil {
+		t.Fatalf("c.Get(): got %v, want no error", err)
+	}
+	defer res.Body.Close()
+
+	if got, want := res.StatusCode, 200; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+	if got, want := mockBody(t, res), "{\"n\": 1}\n"; got != want {
+		t.Errorf("res.Body: got %q, want %q", got, want)
+	}
+}
+
+func TestMockFromJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "har")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): got %v, want no error", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "backend.har")
+	if err := ioutil.WriteFile(path, []byte(mockTestHAR), 0600); err != nil {
+		t.Fatalf("ioutil.WriteFile(): got %v, want no error", err)
+	}
+
+	msg := []byte(fmt.Sprintf(`{
+		"har.Mock": {
+			"scope": ["request", "response"],
+			"file": %q,
+			"mode": "latest"
+		}
+	}`, path))
+
+	r, err := parse.FromJSON(msg)
+	if err != nil {
+		t.Fatalf("parse.FromJSON(): got %v, want no error", err)
+	}
+
+	m, ok := r.RequestModifier().(*Mock)
+	if !ok {
+		t.Fatalf("r.RequestModifier(): got %T, want *har.Mock", r.RequestModifier())
+	}
+	if r.ResponseModifier() == nil {
+		t.Fatal("r.ResponseModifier(): got nil, want not nil")
+	}
+	if got, want := mockResponseFor(t, m, "GET", "http://example.com/api", "").StatusCode, 201; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+
+	msg = []byte(fmt.Sprintf(`{"har.Mock": {"file": %q, "mode": "random"}}`, path))
+	if _, err := parse.FromJSON(msg); err == nil {
+		t.Error("parse.FromJSON(): got nil, want error for unknown mode")
+	}
+}
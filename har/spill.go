@@ -0,0 +1,185 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package har
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	spillPrefix = "har-"
+	spillExt    = ".jsonl"
+)
+
+// Spill writes HAR entries to rotating JSON Lines files in a directory, one
+// entry of log.entries per line, so that long-running captures can be kept
+// without holding them in memory.
+//
+// Files are named har-000001.jsonl, har-000002.jsonl and so on. A new file is
+// started when writing an entry would grow the current file past its maximum
+// size, and the oldest files are removed to keep at most the maximum number of
+// files.
+type Spill struct {
+	dir         string
+	maxFileSize int64
+	maxFiles    int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+	seq  int
+}
+
+// NewSpill returns a spill that writes files to dir, creating it if it does
+// not exist. Files are rotated once they would exceed maxFileSize bytes, and
+// at most maxFiles are kept; zero means no limit. Numbering continues after
+// the files already in dir.
+func NewSpill(dir string, maxFileSize int64, maxFiles int) (*Spill, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &Spill{
+		dir:         dir,
+		maxFileSize: maxFileSize,
+		maxFiles:    maxFiles,
+	}
+
+	names, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+	if len(names) > 0 {
+		s.seq = spillSeq(names[len(names)-1])
+	}
+
+	return s, nil
+}
+
+// Write appends e to the current file as a line of JSON.
+func (s *Spill) Write(e *Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil || (s.maxFileSize > 0 && s.size > 0 && s.size+int64(len(b)) > s.maxFileSize) {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.f.Write(b)
+	s.size += int64(n)
+
+	return err
+}
+
+// Close closes the current file.
+func (s *Spill) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+
+	return err
+}
+
+// rotate closes the current file, starts the next one and removes the oldest
+// files beyond the maximum.
+func (s *Spill) rotate() error {
+	if s.f != nil {
+		if err := s.f.Close(); err != nil {
+			return err
+		}
+		s.f = nil
+	}
+
+	s.seq++
+	name := filepath.Join(s.dir, fmt.Sprintf("%s%06d%s", spillPrefix, s.seq, spillExt))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	s.f = f
+	s.size = 0
+
+	if s.maxFiles <= 0 {
+		return nil
+	}
+
+	names, err := s.files()
+	if err != nil {
+		return err
+	}
+	for len(names) > s.maxFiles {
+		if err := os.Remove(filepath.Join(s.dir, names[0])); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		names = names[1:]
+	}
+
+	return nil
+}
+
+// files returns the names of the files of the spill in dir, oldest first.
+func (s *Spill) files() ([]string, error) {
+	fis, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, fi := range fis {
+		if !fi.IsDir() && spillSeq(fi.Name()) > 0 {
+			names = append(names, fi.Name())
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return spillSeq(names[i]) < spillSeq(names[j])
+	})
+
+	return names, nil
+}
+
+// spillSeq returns the sequence number of the spill file with name, or 0 if
+// name is not that of a spill file.
+func spillSeq(name string) int {
+	if !strings.HasPrefix(name, spillPrefix) || !strings.HasSuffix(name, spillExt) {
+		return 0
+	}
+
+	var seq int
+	if _, err := fmt.Sscanf(strings.TrimSuffix(strings.TrimPrefix(name, spillPrefix), spillExt), "%d", &seq); err != nil {
+		return 0
+	}
+
+	return seq
+}
@@ -0,0 +1,91 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package har
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func spillFiles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ioutil.ReadDir(): got %v, want no error", err)
+	}
+
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	return names
+}
+
+func TestSpillRotates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "har")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): got %v, want no error", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Each entry is well over half of the maximum file size, so every entry
+	// starts a new file.
+	s, err := NewSpill(dir, 120, 2)
+	if err != nil {
+		t.Fatalf("NewSpill(): got %v, want no error", err)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		if err := s.Write(&Entry{ID: id}); err != nil {
+			t.Fatalf("s.Write(%q): got %v, want no error", id, err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("s.Close(): got %v, want no error", err)
+	}
+
+	if got, want := spillFiles(t, dir), []string{"har-000002.jsonl", "har-000003.jsonl"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("files: got %v, want %v", got, want)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "har-000003.jsonl"))
+	if err != nil {
+		t.Fatalf("ioutil.ReadFile(): got %v, want no error", err)
+	}
+	if got, want := string(b), `"_id":"c"`; !strings.Contains(got, want) || strings.Count(got, "\n") != 1 {
+		t.Errorf("har-000003.jsonl: got %q, want a single line containing %q", got, want)
+	}
+
+	// A new spill continues after the existing files.
+	s, err = NewSpill(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("NewSpill(): got %v, want no error", err)
+	}
+	if err := s.Write(&Entry{ID: "d"}); err != nil {
+		t.Fatalf("s.Write(): got %v, want no error", err)
+	}
+	if err := s.Write(&Entry{ID: "e"}); err != nil {
+		t.Fatalf("s.Write(): got %v, want no error", err)
+	}
+	s.Close()
+
+	if got, want := spillFiles(t, dir), []string{"har-000002.jsonl", "har-000003.jsonl", "har-000004.jsonl"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("files: got %v, want %v", got, want)
+	}
+}
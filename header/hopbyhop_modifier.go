@@ -19,6 +19,7 @@ import (
 	"strings"
 
 	"github.com/google/martian/v3"
+	"github.com/google/martian/v3/proxyutil"
 )
 
 // Hop-by-hop headers as defined by RFC2616.
@@ -46,17 +47,36 @@ func NewHopByHopModifier() martian.RequestResponseModifier {
 
 // ModifyRequest removes all hop-by-hop headers defined by RFC2616 as
 // well as any additional hop-by-hop headers specified in the
-// Connection header.
+// Connection header. The Connection and Upgrade headers of protocol upgrade
+// requests, such as WebSocket handshakes, are preserved, along with the
+// HTTP2-Settings header of h2c upgrades.
 func (m *hopByHopModifier) ModifyRequest(req *http.Request) error {
+	upgrade := proxyutil.UpgradeType(req.Header)
+	settings := req.Header["Http2-Settings"]
 	removeHopByHopHeaders(req.Header)
+	restoreUpgrade(req.Header, upgrade)
+
+	// Upgrading to h2c requires the HTTP2-Settings header, which is listed in
+	// the Connection header.
+	// https://tools.ietf.org/html/rfc7540#section-3.2.1
+	if strings.EqualFold(upgrade, "h2c") && len(settings) > 0 {
+		req.Header["Http2-Settings"] = settings
+		req.Header.Set("Connection", "Upgrade, HTTP2-Settings")
+	}
 	return nil
 }
 
 // ModifyResponse removes all hop-by-hop headers defined by RFC2616 as
 // well as any additional hop-by-hop headers specified in the
-// Connection header.
+// Connection header. The Connection and Upgrade headers of 101 Switching
+// Protocols responses are preserved.
 func (m *hopByHopModifier) ModifyResponse(res *http.Response) error {
+	var upgrade string
+	if res.StatusCode == http.StatusSwitchingProtocols {
+		upgrade = proxyutil.UpgradeType(res.Header)
+	}
 	removeHopByHopHeaders(res.Header)
+	restoreUpgrade(res.Header, upgrade)
 	return nil
 }
 
@@ -74,3 +94,14 @@ func removeHopByHopHeaders(header http.Header) {
 		header.Del(k)
 	}
 }
+
+// restoreUpgrade sets the headers required to upgrade the connection to
+// protocol, if any.
+func restoreUpgrade(header http.Header, protocol string) {
+	if protocol == "" {
+		return
+	}
+
+	header.Set("Connection", "Upgrade")
+	header.Set("Upgrade", protocol)
+}
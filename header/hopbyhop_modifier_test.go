@@ -77,3 +77,73 @@ func TestRemoveHopByHopHeaders(t *testing.T) {
 		t.Errorf("res.Header[%q]: got !ok, want ok", "X-End-To-End")
 	}
 }
+
+func TestHopByHopModifierPreservesUpgrade(t *testing.T) {
+	m := NewHopByHopModifier()
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("Upgrade", "websocket")
+
+	if err := m.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+
+	if got, want := req.Header.Get("Connection"), "Upgrade"; got != want {
+		t.Errorf("req.Header.Get(%q): got %q, want %q", "Connection", got, want)
+	}
+	if got, want := req.Header.Get("Upgrade"), "websocket"; got != want {
+		t.Errorf("req.Header.Get(%q): got %q, want %q", "Upgrade", got, want)
+	}
+	if got, want := req.Header.Get("Keep-Alive"), ""; got != want {
+		t.Errorf("req.Header.Get(%q): got %q, want %q", "Keep-Alive", got, want)
+	}
+
+	res := proxyutil.NewResponse(101, nil, req)
+	res.Header.Set("Connection", "Upgrade")
+	res.Header.Set("Upgrade", "websocket")
+	if err := m.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+
+	if got, want := res.Header.Get("Upgrade"), "websocket"; got != want {
+		t.Errorf("res.Header.Get(%q): got %q, want %q", "Upgrade", got, want)
+	}
+
+	// Upgrade headers are only meaningful on 101 responses.
+	res = proxyutil.NewResponse(200, nil, req)
+	res.Header.Set("Connection", "Upgrade")
+	res.Header.Set("Upgrade", "websocket")
+	if err := m.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+
+	if got, want := res.Header.Get("Upgrade"), ""; got != want {
+		t.Errorf("res.Header.Get(%q): got %q, want %q", "Upgrade", got, want)
+	}
+}
+
+func TestHopByHopModifierPreservesH2CUpgrade(t *testing.T) {
+	m := NewHopByHopModifier()
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	req.Header.Set("Connection", "Upgrade, HTTP2-Settings")
+	req.Header.Set("Upgrade", "h2c")
+	req.Header.Set("HTTP2-Settings", "AAMAAABkAAQAAP__")
+
+	if err := m.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+
+	if got, want := req.Header.Get("Connection"), "Upgrade, HTTP2-Settings"; got != want {
+		t.Errorf("req.Header.Get(%q): got %q, want %q", "Connection", got, want)
+	}
+	if got, want := req.Header.Get("HTTP2-Settings"), "AAMAAABkAAQAAP__"; got != want {
+		t.Errorf("req.Header.Get(%q): got %q, want %q", "HTTP2-Settings", got, want)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+)
+
+// ConnHooks are functions called at points in the lifecycle of the client
+// connections handled by the proxy, with the session of the connection. Any of
+// the functions may be nil. They are called from the goroutine handling the
+// connection and should return quickly.
+type ConnHooks struct {
+	// Accept is called when a connection is accepted, before anything is read
+	// from it.
+	Accept func(s *Session, conn net.Conn)
+
+	// ConnectEstablished is called when the proxy has accepted a CONNECT
+	// request or a SOCKS connection to host, before the connection is
+	// tunneled or MITM'd.
+	ConnectEstablished func(s *Session, host string)
+
+	// MITMHandshakeDone is called when the TLS handshake with the client of a
+	// MITM'd connection completes.
+	MITMHandshakeDone func(s *Session, cs tls.ConnectionState)
+
+	// H2Negotiated is called when the client and the proxy agree on HTTP/2
+	// for traffic to host, either through ALPN on a MITM'd connection or over
+	// cleartext (h2c), before the connection is relayed.
+	H2Negotiated func(s *Session, host string)
+
+	// TunnelDone is called when a tunnel to host closes, with the number of
+	// bytes sent by the client and the number of bytes received from host.
+	TunnelDone func(s *Session, host string, sent, received int64)
+
+	// Closed is called when the proxy is done with the connection. The reason
+	// is nil if the connection was closed normally, such as by the client or
+	// after a tunnel finished, and the error that ended it otherwise, such as a
+	// timeout.
+	Closed func(s *Session, reason error)
+}
+
+// SetConnHooks sets the hooks called during the lifecycle of client
+// connections. When nil, no hooks are called.
+//
+// SetConnHooks should be called before the proxy starts serving requests.
+func (p *Proxy) SetConnHooks(hooks *ConnHooks) {
+	p.hooks = hooks
+}
+
+func (h *ConnHooks) accept(s *Session, conn net.Conn) {
+	if h != nil && h.Accept != nil {
+		h.Accept(s, conn)
+	}
+}
+
+func (h *ConnHooks) connectEstablished(s *Session, host string) {
+	if h != nil && h.ConnectEstablished != nil {
+		h.ConnectEstablished(s, host)
+	}
+}
+
+func (h *ConnHooks) mitmHandshakeDone(s *Session, cs tls.ConnectionState) {
+	if h != nil && h.MITMHandshakeDone != nil {
+		h.MITMHandshakeDone(s, cs)
+	}
+}
+
+func (h *ConnHooks) h2Negotiated(s *Session, host string) {
+	if h != nil && h.H2Negotiated != nil {
+		h.H2Negotiated(s, host)
+	}
+}
+
+func (h *ConnHooks) tunnelDone(s *Session, host string, sent, received int64) {
+	if h != nil && h.TunnelDone != nil {
+		h.TunnelDone(s, host, sent, received)
+	}
+}
+
+func (h *ConnHooks) closed(s *Session, reason error) {
+	if h == nil || h.Closed == nil {
+		return
+	}
+
+	switch reason {
+	case errClose, io.EOF:
+		reason = nil
+	}
+	h.Closed(s, reason)
+}
@@ -0,0 +1,325 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/martian/v3/martiantest"
+	"github.com/google/martian/v3/mitm"
+	"github.com/google/martian/v3/proxyutil"
+)
+
+// hookRecorder records the events reported by connection hooks.
+type hookRecorder struct {
+	mu     sync.Mutex
+	events []string
+	closed chan error
+}
+
+func newHookRecorder() *hookRecorder {
+	return &hookRecorder{
+		closed: make(chan error, 1),
+	}
+}
+
+func (r *hookRecorder) record(format string, args ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.events = append(r.events, fmt.Sprintf(format, args...))
+}
+
+func (r *hookRecorder) hooks() *ConnHooks {
+	return &ConnHooks{
+		Accept: func(s *Session, conn net.Conn) {
+			r.record("accept")
+		},
+		ConnectEstablished: func(s *Session, host string) {
+			r.record("connect %s", host)
+		},
+		MITMHandshakeDone: func(s *Session, cs tls.ConnectionState) {
+			r.record("mitm %s", cs.ServerName)
+		},
+		H2Negotiated: func(s *Session, host string) {
+			r.record("h2 %s", host)
+		},
+		TunnelDone: func(s *Session, host string, sent, received int64) {
+			r.record("tunnel sent=%d received=%d", sent, received)
+		},
+		Closed: func(s *Session, reason error) {
+			r.record("closed")
+			r.closed <- reason
+		},
+	}
+}
+
+func (r *hookRecorder) wait(t *testing.T) ([]string, error) {
+	t.Helper()
+
+	select {
+	case reason := <-r.closed:
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		return r.events, reason
+	case <-time.After(5 * time.Second):
+		t.Fatal("Closed hook was not called")
+	}
+
+	return nil, nil
+}
+
+func TestIntegrationConnHooksMITM(t *testing.T) {
+	t.Parallel()
+
+	ca, priv, err := mitm.NewAuthority("martian.proxy", "Martian Authority", 2*time.Hour)
+	if err != nil {
+		t.Fatalf("mitm.NewAuthority(): got %v, want no error", err)
+	}
+
+	mc, err := mitm.NewConfig(ca, priv)
+	if err != nil {
+		t.Fatalf("mitm.NewConfig(): got %v, want no error", err)
+	}
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	p.SetMITM(mc)
+	p.SetTimeout(2 * time.Second)
+
+	tr := martiantest.NewTransport()
+	tr.Func(func(req *http.Request) (*http.Response, error) {
+		return proxyutil.NewResponse(200, nil, req), nil
+	})
+	p.SetRoundTripper(tr)
+
+	rec := newHookRecorder()
+	var sessions []*Session
+	var mu sync.Mutex
+	hooks := rec.hooks()
+	accept := hooks.Accept
+	hooks.Accept = func(s *Session, conn net.Conn) {
+		mu.Lock()
+		sessions = append(sessions, s)
+		mu.Unlock()
+		accept(s, conn)
+	}
+	tm := martiantest.NewModifier()
+	tm.RequestFunc(func(req *http.Request) {
+		mu.Lock()
+		sessions = append(sessions, NewContext(req).Session())
+		mu.Unlock()
+	})
+	p.SetRequestModifier(tm)
+	p.SetConnHooks(hooks)
+
+	go p.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	req, err := http.NewRequest("CONNECT", "//example.com:443", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("req.Write(): got %v, want no error", err)
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	res.Body.Close()
+
+	if got, want := res.StatusCode, 200; got != want {
+		t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	tlsconn := tls.Client(conn, &tls.Config{
+		ServerName: "example.com",
+		RootCAs:    roots,
+	})
+
+	req, err = http.NewRequest("GET", "https://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.Write(tlsconn); err != nil {
+		t.Fatalf("req.Write(): got %v, want no error", err)
+	}
+
+	res, err = http.ReadResponse(bufio.NewReader(tlsconn), req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	res.Body.Close()
+
+	tlsconn.Close()
+
+	events, reason := rec.wait(t)
+	if reason != nil {
+		t.Errorf("Closed(): got reason %v, want nil", reason)
+	}
+
+	want := []string{"accept", "connect example.com:443", "mitm example.com", "closed"}
+	if got := fmt.Sprint(events); got != fmt.Sprint(want) {
+		t.Errorf("events: got %v, want %v", got, want)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// The session passed to the hooks is the session of the requests.
+	if got, want := len(sessions), 3; got != want {
+		t.Fatalf("len(sessions): got %d, want %d", got, want)
+	}
+	for i, s := range sessions[1:] {
+		if s != sessions[0] {
+			t.Errorf("sessions[%d]: got %p, want %p", i+1, s, sessions[0])
+		}
+	}
+}
+
+func TestIntegrationConnHooksTunnel(t *testing.T) {
+	t.Parallel()
+
+	sl, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+	defer sl.Close()
+
+	go func() {
+		sconn, err := sl.Accept()
+		if err != nil {
+			return
+		}
+		defer sconn.Close()
+
+		io.ReadFull(sconn, make([]byte, len("ping")))
+		io.WriteString(sconn, "pong!")
+	}()
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	p.SetTimeout(2 * time.Second)
+
+	rec := newHookRecorder()
+	p.SetConnHooks(rec.hooks())
+
+	go p.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	req, err := http.NewRequest("CONNECT", "//"+sl.Addr().String(), nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("req.Write(): got %v, want no error", err)
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+
+	if got, want := res.StatusCode, 200; got != want {
+		t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+	}
+
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatalf("conn.Write(): got %v, want no error", err)
+	}
+	got := make([]byte, len("pong!"))
+	if _, err := io.ReadFull(br, got); err != nil {
+		t.Fatalf("io.ReadFull(): got %v, want no error", err)
+	}
+	conn.Close()
+
+	events, reason := rec.wait(t)
+	if reason != nil {
+		t.Errorf("Closed(): got reason %v, want nil", reason)
+	}
+
+	want := []string{"accept", "connect " + sl.Addr().String(), "tunnel sent=4 received=5", "closed"}
+	if got := fmt.Sprint(events); got != fmt.Sprint(want) {
+		t.Errorf("events: got %v, want %v", got, want)
+	}
+}
+
+func TestIntegrationConnHooksClosedReason(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	p.SetTimeout(100 * time.Millisecond)
+
+	rec := newHookRecorder()
+	p.SetConnHooks(rec.hooks())
+
+	go p.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	_, reason := rec.wait(t)
+	if nerr, ok := reason.(net.Error); !ok || !nerr.Timeout() {
+		t.Errorf("Closed(): got reason %v, want timeout", reason)
+	}
+}
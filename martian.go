@@ -16,7 +16,10 @@
 // request and response modifiers.
 package martian
 
-import "net/http"
+import (
+	"context"
+	"net/http"
+)
 
 // RequestModifier is an interface that defines a request modifier that can be
 // used by a proxy.
@@ -39,6 +42,75 @@ type RequestResponseModifier interface {
 	ResponseModifier
 }
 
+// ContextRequestModifier is a RequestModifier that also accepts the context of
+// the request. The context is cancelled when the client connection is closed,
+// when the proxy is closed, or when the proxy timeout elapses, allowing
+// long-running modifiers to stop early. The proxy calls ModifyRequestContext
+// instead of ModifyRequest on modifiers that implement it.
+type ContextRequestModifier interface {
+	RequestModifier
+
+	// ModifyRequestContext modifies the request, stopping early when ctx is done.
+	ModifyRequestContext(ctx context.Context, req *http.Request) error
+}
+
+// ContextResponseModifier is a ResponseModifier that also accepts the context
+// of the request. See ContextRequestModifier for when the context is
+// cancelled.
+type ContextResponseModifier interface {
+	ResponseModifier
+
+	// ModifyResponseContext modifies the response, stopping early when ctx is
+	// done.
+	ModifyResponseContext(ctx context.Context, res *http.Response) error
+}
+
+// ModifyRequestWithContext modifies the request with reqmod, passing ctx along
+// if reqmod is a ContextRequestModifier. Modifier groups use it to propagate
+// the context to their children.
+//
+// Errors are attributed to the innermost modifier that returned them, for the
+// modifier error log of the proxy.
+func ModifyRequestWithContext(ctx context.Context, reqmod RequestModifier, req *http.Request) error {
+	var err error
+	if cm, ok := reqmod.(ContextRequestModifier); ok {
+		err = cm.ModifyRequestContext(ctx, req)
+	} else {
+		err = reqmod.ModifyRequest(req)
+	}
+
+	if err != nil {
+		if mctx := NewContext(req); mctx != nil {
+			mctx.noteModifierError(reqmod, err)
+		}
+	}
+
+	return err
+}
+
+// ModifyResponseWithContext modifies the response with resmod, passing ctx
+// along if resmod is a ContextResponseModifier. Modifier groups use it to
+// propagate the context to their children.
+//
+// Errors are attributed to the innermost modifier that returned them, for the
+// modifier error log of the proxy.
+func ModifyResponseWithContext(ctx context.Context, resmod ResponseModifier, res *http.Response) error {
+	var err error
+	if cm, ok := resmod.(ContextResponseModifier); ok {
+		err = cm.ModifyResponseContext(ctx, res)
+	} else {
+		err = resmod.ModifyResponse(res)
+	}
+
+	if err != nil && res.Request != nil {
+		if mctx := NewContext(res.Request); mctx != nil {
+			mctx.noteModifierError(resmod, err)
+		}
+	}
+
+	return err
+}
+
 // RequestModifierFunc is an adapter for using a function with the given
 // signature as a RequestModifier.
 type RequestModifierFunc func(req *http.Request) error
@@ -17,6 +17,7 @@ package martianhttp
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
@@ -80,18 +81,29 @@ func (m *Modifier) setResponseModifier(resmod martian.ResponseModifier) {
 
 // ModifyRequest runs reqmod.
 func (m *Modifier) ModifyRequest(req *http.Request) error {
+	return m.ModifyRequestContext(context.Background(), req)
+}
+
+// ModifyRequestContext runs reqmod, passing ctx to it if it accepts a context.
+func (m *Modifier) ModifyRequestContext(ctx context.Context, req *http.Request) error {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	return m.reqmod.ModifyRequest(req)
+	return martian.ModifyRequestWithContext(ctx, m.reqmod, req)
 }
 
 // ModifyResponse runs resmod.
 func (m *Modifier) ModifyResponse(res *http.Response) error {
+	return m.ModifyResponseContext(context.Background(), res)
+}
+
+// ModifyResponseContext runs resmod, passing ctx to it if it accepts a
+// context.
+func (m *Modifier) ModifyResponseContext(ctx context.Context, res *http.Response) error {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	return m.resmod.ModifyResponse(res)
+	return martian.ModifyResponseWithContext(ctx, m.resmod, res)
 }
 
 // VerifyRequests verifies reqmod, iff reqmod is a RequestVerifier.
@@ -16,6 +16,7 @@ package martianhttp
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -95,6 +96,60 @@ func TestModifyResponse(t *testing.T) {
 	}
 }
 
+// ctxModifier records the contexts it modifies requests and responses with.
+type ctxModifier struct {
+	reqctx, resctx context.Context
+}
+
+func (m *ctxModifier) ModifyRequest(req *http.Request) error {
+	return m.ModifyRequestContext(context.Background(), req)
+}
+
+func (m *ctxModifier) ModifyRequestContext(ctx context.Context, req *http.Request) error {
+	m.reqctx = ctx
+	return nil
+}
+
+func (m *ctxModifier) ModifyResponse(res *http.Response) error {
+	return m.ModifyResponseContext(context.Background(), res)
+}
+
+func (m *ctxModifier) ModifyResponseContext(ctx context.Context, res *http.Response) error {
+	m.resctx = ctx
+	return nil
+}
+
+func TestModifyContext(t *testing.T) {
+	m := NewModifier()
+	cm := &ctxModifier{}
+
+	m.SetRequestModifier(cm)
+	m.SetResponseModifier(cm)
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, "value")
+
+	if err := m.ModifyRequestContext(ctx, req); err != nil {
+		t.Fatalf("ModifyRequestContext(): got %v, want no error", err)
+	}
+	if cm.reqctx != ctx {
+		t.Errorf("ModifyRequestContext(): got context %v, want %v", cm.reqctx, ctx)
+	}
+
+	res := proxyutil.NewResponse(200, nil, req)
+	if err := m.ModifyResponseContext(ctx, res); err != nil {
+		t.Fatalf("ModifyResponseContext(): got %v, want no error", err)
+	}
+	if cm.resctx != ctx {
+		t.Errorf("ModifyResponseContext(): got context %v, want %v", cm.resctx, ctx)
+	}
+}
+
 func TestVerifyRequests(t *testing.T) {
 	m := NewModifier()
 
@@ -0,0 +1,61 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martianhttp
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/google/martian/v3"
+	"github.com/google/martian/v3/log"
+)
+
+type modifierErrorsHandler struct {
+	log *martian.ModifierErrorLog
+}
+
+// NewModifierErrorsHandler returns an http.Handler that exposes the errors
+// recorded in l. GET requests return the errors as JSON, oldest first, and
+// DELETE requests clear them.
+func NewModifierErrorsHandler(l *martian.ModifierErrorLog) http.Handler {
+	return &modifierErrorsHandler{
+		log: l,
+	}
+}
+
+// ServeHTTP writes the modifier errors to the client, or resets them.
+func (h *modifierErrorsHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		entries := h.log.Entries()
+		if entries == nil {
+			entries = []martian.ModifierErrorEntry{}
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(map[string]interface{}{
+			"errors": entries,
+		}); err != nil {
+			log.Errorf("martianhttp: failed to write modifier errors: %v", err)
+		}
+	case "DELETE":
+		h.log.Reset()
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		rw.Header().Set("Allow", "GET, DELETE")
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		log.Errorf("martianhttp: method not allowed: %s", req.Method)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martianhttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/martian/v3"
+)
+
+func TestModifierErrorsHandler(t *testing.T) {
+	l := martian.NewModifierErrorLog(10)
+	l.Add(martian.ModifierErrorEntry{
+		RequestID: "abc",
+		Phase:     "request",
+		Modifier:  "*header.Modifier",
+		Message:   "bad header",
+	})
+
+	h := NewModifierErrorsHandler(l)
+
+	req, err := http.NewRequest("GET", "/modifier-errors", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	if got, want := rw.Code, 200; got != want {
+		t.Fatalf("rw.Code: got %d, want %d", got, want)
+	}
+	if got, want := rw.Header().Get("Content-Type"), "application/json"; got != want {
+		t.Errorf("rw.Header().Get(%q): got %q, want %q", "Content-Type", got, want)
+	}
+
+	var body struct {
+		Errors []martian.ModifierErrorEntry `json:"errors"`
+	}
+	if err := json.Unmarshal(rw.Body.Bytes(), &body); err != nil {
+		t.Fatalf("json.Unmarshal(): got %v, want no error", err)
+	}
+	if got, want := len(body.Errors), 1; got != want {
+		t.Fatalf("len(body.Errors): got %d, want %d", got, want)
+	}
+	e := body.Errors[0]
+	if got, want := e.RequestID, "abc"; got != want {
+		t.Errorf("e.RequestID: got %q, want %q", got, want)
+	}
+	if got, want := e.Modifier, "*header.Modifier"; got != want {
+		t.Errorf("e.Modifier: got %q, want %q", got, want)
+	}
+	if got, want := e.Message, "bad header"; got != want {
+		t.Errorf("e.Message: got %q, want %q", got, want)
+	}
+
+	req, err = http.NewRequest("DELETE", "/modifier-errors", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	if got, want := rw.Code, 204; got != want {
+		t.Errorf("rw.Code: got %d, want %d", got, want)
+	}
+	if got := len(l.Entries()); got != 0 {
+		t.Errorf("len(l.Entries()): got %d, want 0", got)
+	}
+
+	req, err = http.NewRequest("POST", "/modifier-errors", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	if got, want := rw.Code, 405; got != want {
+		t.Errorf("rw.Code: got %d, want %d", got, want)
+	}
+	if got, want := rw.Header().Get("Allow"), "GET, DELETE"; got != want {
+		t.Errorf("rw.Header().Get(%q): got %q, want %q", "Allow", got, want)
+	}
+}
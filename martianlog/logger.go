@@ -34,12 +34,14 @@ type Logger struct {
 	log         func(line string)
 	headersOnly bool
 	decode      bool
+	bodyLimit   int64
 }
 
 type loggerJSON struct {
 	Scope       []parse.ModifierType `json:"scope"`
 	HeadersOnly bool                 `json:"headersOnly"`
 	Decode      bool                 `json:"decode"`
+	BodyLimit   int64                `json:"bodyLimit"`
 }
 
 func init() {
@@ -66,6 +68,15 @@ func (l *Logger) SetDecode(decode bool) {
 	l.decode = decode
 }
 
+// SetBodyLimit sets the maximum number of body bytes to log. When limit is
+// positive, bodies are not read into memory; instead, the first limit bytes
+// are captured as the body streams through the proxy, and the message is
+// logged once the body has been read. When limit is zero, the default, the
+// message is logged with its full body before it is sent.
+func (l *Logger) SetBodyLimit(limit int64) {
+	l.bodyLimit = limit
+}
+
 // SetLogFunc sets the logging function for the logger.
 func (l *Logger) SetLogFunc(logFunc func(line string)) {
 	l.log = logFunc
@@ -99,28 +110,14 @@ func (l *Logger) ModifyRequest(req *http.Request) error {
 
 	mv := messageview.New()
 	mv.SkipBody(l.headersOnly)
-	if err := mv.SnapshotRequest(req); err != nil {
-		return err
+	if l.bodyLimit > 0 {
+		return mv.StreamRequest(req, l.bodyLimit, func() { l.write(b, mv) })
 	}
-
-	var opts []messageview.Option
-	if l.decode {
-		opts = append(opts, messageview.Decode())
-	}
-
-	r, err := mv.Reader(opts...)
-	if err != nil {
+	if err := mv.SnapshotRequest(req); err != nil {
 		return err
 	}
 
-	io.Copy(b, r)
-
-	fmt.Fprintln(b, "")
-	fmt.Fprintln(b, strings.Repeat("-", 80))
-
-	l.log(b.String())
-
-	return nil
+	return l.write(b, mv)
 }
 
 // ModifyResponse logs the response, optionally including the body.
@@ -149,10 +146,18 @@ func (l *Logger) ModifyResponse(res *http.Response) error {
 
 	mv := messageview.New()
 	mv.SkipBody(l.headersOnly)
+	if l.bodyLimit > 0 {
+		return mv.StreamResponse(res, l.bodyLimit, func() { l.write(b, mv) })
+	}
 	if err := mv.SnapshotResponse(res); err != nil {
 		return err
 	}
 
+	return l.write(b, mv)
+}
+
+// write appends the message in mv to b and logs it.
+func (l *Logger) write(b *bytes.Buffer, mv *messageview.MessageView) error {
 	var opts []messageview.Option
 	if l.decode {
 		opts = append(opts, messageview.Decode())
@@ -160,12 +165,16 @@ func (l *Logger) ModifyResponse(res *http.Response) error {
 
 	r, err := mv.Reader(opts...)
 	if err != nil {
+		log.Errorf("martianlog: failed to read message: %v", err)
 		return err
 	}
 
 	io.Copy(b, r)
 
 	fmt.Fprintln(b, "")
+	if mv.Truncated() {
+		fmt.Fprintf(b, "(body truncated to %d bytes)\n", l.bodyLimit)
+	}
 	fmt.Fprintln(b, strings.Repeat("-", 80))
 
 	l.log(b.String())
@@ -180,7 +189,8 @@ func (l *Logger) ModifyResponse(res *http.Response) error {
 //   "log.Logger": {
 //     "scope": ["request", "response"],
 //		 "headersOnly": true,
-//		 "decode": true
+//		 "decode": true,
+//		 "bodyLimit": 4096
 //   }
 // }
 func loggerFromJSON(b []byte) (*parse.Result, error) {
@@ -192,6 +202,7 @@ func loggerFromJSON(b []byte) (*parse.Result, error) {
 	l := NewLogger()
 	l.SetHeadersOnly(msg.HeadersOnly)
 	l.SetDecode(msg.Decode)
+	l.SetBodyLimit(msg.BodyLimit)
 
 	return parse.NewResult(l, msg.Scope)
 }
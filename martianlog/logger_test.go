@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"strings"
 	"testing"
@@ -99,7 +100,8 @@ func TestLoggerFromJSON(t *testing.T) {
 		"log.Logger": {
 			"scope": ["request", "response"],
 			"headersOnly": true,
-			"decode": true
+			"decode": true,
+			"bodyLimit": 1024
 		}
 	}`)
 
@@ -133,4 +135,53 @@ func TestLoggerFromJSON(t *testing.T) {
 	if !l.decode {
 		t.Error("l.decode: got false, want true")
 	}
+
+	if got, want := l.bodyLimit, int64(1024); got != want {
+		t.Errorf("l.bodyLimit: got %d, want %d", got, want)
+	}
+}
+
+func TestLoggerBodyLimit(t *testing.T) {
+	var lines []string
+	l := NewLogger()
+	l.SetLogFunc(func(line string) {
+		lines = append(lines, line)
+	})
+	l.SetBodyLimit(8)
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	_, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("martian.TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	res := proxyutil.NewResponse(200, strings.NewReader("response content"), req)
+	res.ContentLength = 16
+
+	if err := l.ModifyResponse(res); err != nil {
+		t.Fatalf("l.ModifyResponse(): got %v, want no error", err)
+	}
+	if got := len(lines); got != 0 {
+		t.Fatalf("len(lines): got %d before the body was read, want 0", got)
+	}
+
+	got, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(res.Body): got %v, want no error", err)
+	}
+	if want := "response content"; string(got) != want {
+		t.Errorf("res.Body: got %q, want %q", got, want)
+	}
+
+	if got, want := len(lines), 1; got != want {
+		t.Fatalf("len(lines): got %d, want %d", got, want)
+	}
+	if want := "\r\n\r\nresponse\n(body truncated to 8 bytes)\n"; !strings.Contains(lines[0], want) {
+		t.Errorf("lines[0]: got %q, want to contain %q", lines[0], want)
+	}
 }
@@ -17,7 +17,9 @@
 package martiantest
 
 import (
+	"context"
 	"net/http"
+	"sync"
 	"sync/atomic"
 )
 
@@ -30,6 +32,10 @@ type Modifier struct {
 	reserr   error
 	reqfunc  func(*http.Request)
 	resfunc  func(*http.Response)
+
+	ctxmu  sync.Mutex
+	reqctx context.Context
+	resctx context.Context
 }
 
 // NewModifier returns a new test modifier.
@@ -99,8 +105,45 @@ func (m *Modifier) ModifyResponse(res *http.Response) error {
 	return m.reserr
 }
 
+// ModifyRequestContext records ctx and modifies the request with ModifyRequest.
+func (m *Modifier) ModifyRequestContext(ctx context.Context, req *http.Request) error {
+	m.ctxmu.Lock()
+	m.reqctx = ctx
+	m.ctxmu.Unlock()
+
+	return m.ModifyRequest(req)
+}
+
+// ModifyResponseContext records ctx and modifies the response with
+// ModifyResponse.
+func (m *Modifier) ModifyResponseContext(ctx context.Context, res *http.Response) error {
+	m.ctxmu.Lock()
+	m.resctx = ctx
+	m.ctxmu.Unlock()
+
+	return m.ModifyResponse(res)
+}
+
+// RequestContext returns the context passed to the last call of
+// ModifyRequestContext, or nil if it has not been called.
+func (m *Modifier) RequestContext() context.Context {
+	m.ctxmu.Lock()
+	defer m.ctxmu.Unlock()
+
+	return m.reqctx
+}
+
+// ResponseContext returns the context passed to the last call of
+// ModifyResponseContext, or nil if it has not been called.
+func (m *Modifier) ResponseContext() context.Context {
+	m.ctxmu.Lock()
+	defer m.ctxmu.Unlock()
+
+	return m.resctx
+}
+
 // Reset resets the request and response counts, the custom
-// functions, and the modifier errors.
+// functions, the modifier errors, and the recorded contexts.
 func (m *Modifier) Reset() {
 	atomic.StoreInt32(&m.reqcount, 0)
 	atomic.StoreInt32(&m.rescount, 0)
@@ -110,6 +153,11 @@ func (m *Modifier) Reset() {
 
 	m.reqerr = nil
 	m.reserr = nil
+
+	m.ctxmu.Lock()
+	m.reqctx = nil
+	m.resctx = nil
+	m.ctxmu.Unlock()
 }
 
 // Matcher is a stubbed matcher used in tests.
@@ -26,6 +26,7 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"strings"
+	"sync"
 )
 
 // MessageView is a static view of an HTTP request or response.
@@ -37,6 +38,7 @@ type MessageView struct {
 	compress      string
 	bodyoffset    int64
 	traileroffset int64
+	truncated     bool
 }
 
 type config struct {
@@ -75,6 +77,108 @@ func (mv *MessageView) SkipBodyUnlessContentType(cts ...string) {
 // it will also read the body into memory and replace the existing body with
 // the in-memory copy. This method is semantically a no-op.
 func (mv *MessageView) SnapshotRequest(req *http.Request) error {
+	buf := mv.requestHeader(req)
+
+	ct := req.Header.Get("Content-Type")
+	if mv.skipBody && !mv.matchContentType(ct) || req.Body == nil {
+		mv.message = buf.Bytes()
+		return nil
+	}
+
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	req.Body.Close()
+
+	req.Body = ioutil.NopCloser(bytes.NewReader(data))
+	mv.writeBody(buf, data, req.Trailer)
+
+	return nil
+}
+
+// SnapshotResponse reads the response into the MessageView. If mv.headersOnly
+// is false it will also read the body into memory and replace the existing
+// body with the in-memory copy. This method is semantically a no-op.
+func (mv *MessageView) SnapshotResponse(res *http.Response) error {
+	buf := mv.responseHeader(res)
+
+	ct := res.Header.Get("Content-Type")
+	if mv.skipBody && !mv.matchContentType(ct) || res.Body == nil {
+		mv.message = buf.Bytes()
+		return nil
+	}
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	res.Body = ioutil.NopCloser(bytes.NewReader(data))
+	mv.writeBody(buf, data, res.Trailer)
+
+	return nil
+}
+
+// StreamRequest reads the request headers into the MessageView and wraps the
+// body so that up to limit bytes of it are captured as it is read by the
+// proxy, instead of reading it into memory. done is called once the body has
+// been read to EOF or closed, at which point the MessageView holds the
+// captured prefix of the body. If mv.skipBody is true, done is called before
+// StreamRequest returns.
+func (mv *MessageView) StreamRequest(req *http.Request, limit int64, done func()) error {
+	buf := mv.requestHeader(req)
+	mv.message = buf.Bytes()
+
+	ct := req.Header.Get("Content-Type")
+	if mv.skipBody && !mv.matchContentType(ct) || req.Body == nil || req.Body == http.NoBody {
+		done()
+		return nil
+	}
+
+	req.Body = newCaptureBody(req.Body, limit, func(data []byte, n int64) {
+		mv.truncated = n > int64(len(data))
+		mv.writeBody(buf, data, req.Trailer)
+		done()
+	})
+
+	return nil
+}
+
+// StreamResponse reads the response headers into the MessageView and wraps
+// the body so that up to limit bytes of it are captured as it is read by the
+// proxy, instead of reading it into memory. done is called once the body has
+// been read to EOF or closed, at which point the MessageView holds the
+// captured prefix of the body. If mv.skipBody is true, done is called before
+// StreamResponse returns.
+func (mv *MessageView) StreamResponse(res *http.Response, limit int64, done func()) error {
+	buf := mv.responseHeader(res)
+	mv.message = buf.Bytes()
+
+	ct := res.Header.Get("Content-Type")
+	if mv.skipBody && !mv.matchContentType(ct) || res.Body == nil || res.Body == http.NoBody {
+		done()
+		return nil
+	}
+
+	res.Body = newCaptureBody(res.Body, limit, func(data []byte, n int64) {
+		mv.truncated = n > int64(len(data))
+		mv.writeBody(buf, data, res.Trailer)
+		done()
+	})
+
+	return nil
+}
+
+// Truncated returns whether the body captured by StreamRequest or
+// StreamResponse is only a prefix of the full body.
+func (mv *MessageView) Truncated() bool {
+	return mv.truncated
+}
+
+// requestHeader writes the Request-Line and headers of req to a new buffer.
+func (mv *MessageView) requestHeader(req *http.Request) *bytes.Buffer {
 	buf := new(bytes.Buffer)
 
 	fmt.Fprintf(buf, "%s %s HTTP/%d.%d\r\n", req.Method,
@@ -105,45 +209,11 @@ func (mv *MessageView) SnapshotRequest(req *http.Request) error {
 	mv.bodyoffset = int64(buf.Len())
 	mv.traileroffset = int64(buf.Len())
 
-	ct := req.Header.Get("Content-Type")
-	if mv.skipBody && !mv.matchContentType(ct) || req.Body == nil {
-		mv.message = buf.Bytes()
-		return nil
-	}
-
-	data, err := ioutil.ReadAll(req.Body)
-	if err != nil {
-		return err
-	}
-	req.Body.Close()
-
-	if mv.chunked {
-		cw := httputil.NewChunkedWriter(buf)
-		cw.Write(data)
-		cw.Close()
-	} else {
-		buf.Write(data)
-	}
-
-	mv.traileroffset = int64(buf.Len())
-
-	req.Body = ioutil.NopCloser(bytes.NewReader(data))
-
-	if req.Trailer != nil {
-		req.Trailer.Write(buf)
-	} else if mv.chunked {
-		fmt.Fprint(buf, "\r\n")
-	}
-
-	mv.message = buf.Bytes()
-
-	return nil
+	return buf
 }
 
-// SnapshotResponse reads the response into the MessageView. If mv.headersOnly
-// is false it will also read the body into memory and replace the existing
-// body with the in-memory copy. This method is semantically a no-op.
-func (mv *MessageView) SnapshotResponse(res *http.Response) error {
+// responseHeader writes the Status-Line and headers of res to a new buffer.
+func (mv *MessageView) responseHeader(res *http.Response) *bytes.Buffer {
 	buf := new(bytes.Buffer)
 
 	fmt.Fprintf(buf, "HTTP/%d.%d %s\r\n", res.ProtoMajor, res.ProtoMinor, res.Status)
@@ -172,18 +242,12 @@ func (mv *MessageView) SnapshotResponse(res *http.Response) error {
 	mv.bodyoffset = int64(buf.Len())
 	mv.traileroffset = int64(buf.Len())
 
-	ct := res.Header.Get("Content-Type")
-	if mv.skipBody && !mv.matchContentType(ct) || res.Body == nil {
-		mv.message = buf.Bytes()
-		return nil
-	}
-
-	data, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return err
-	}
-	res.Body.Close()
+	return buf
+}
 
+// writeBody writes the body and trailers of the message to buf, following
+// the headers, and sets the message of the view.
+func (mv *MessageView) writeBody(buf *bytes.Buffer, data []byte, trailer http.Header) {
 	if mv.chunked {
 		cw := httputil.NewChunkedWriter(buf)
 		cw.Write(data)
@@ -194,17 +258,72 @@ func (mv *MessageView) SnapshotResponse(res *http.Response) error {
 
 	mv.traileroffset = int64(buf.Len())
 
-	res.Body = ioutil.NopCloser(bytes.NewReader(data))
-
-	if res.Trailer != nil {
-		res.Trailer.Write(buf)
+	if trailer != nil {
+		trailer.Write(buf)
 	} else if mv.chunked {
 		fmt.Fprint(buf, "\r\n")
 	}
 
 	mv.message = buf.Bytes()
+}
 
-	return nil
+// captureBody retains up to limit bytes of the body as it is read, calling
+// done once with the retained bytes and the total number of bytes read when
+// the body returns an error or is closed.
+type captureBody struct {
+	rc    io.ReadCloser
+	limit int64
+
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	n    int64
+	done func(data []byte, n int64)
+}
+
+func newCaptureBody(rc io.ReadCloser, limit int64, done func(data []byte, n int64)) *captureBody {
+	return &captureBody{
+		rc:    rc,
+		limit: limit,
+		done:  done,
+	}
+}
+
+func (cb *captureBody) Read(p []byte) (int, error) {
+	n, err := cb.rc.Read(p)
+
+	cb.mu.Lock()
+	if rem := cb.limit - int64(cb.buf.Len()); rem > 0 {
+		if int64(n) < rem {
+			rem = int64(n)
+		}
+		cb.buf.Write(p[:rem])
+	}
+	cb.n += int64(n)
+	cb.mu.Unlock()
+
+	if err != nil {
+		cb.finish()
+	}
+
+	return n, err
+}
+
+func (cb *captureBody) Close() error {
+	err := cb.rc.Close()
+	cb.finish()
+
+	return err
+}
+
+func (cb *captureBody) finish() {
+	cb.mu.Lock()
+	done := cb.done
+	cb.done = nil
+	cb.mu.Unlock()
+
+	if done != nil {
+		done(cb.buf.Bytes(), cb.n)
+	}
 }
 
 // Reader returns the an io.ReadCloser that reads the full HTTP message.
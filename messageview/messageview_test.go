@@ -757,3 +757,92 @@ func TestResponseViewDecodeDeflateContentEncoding(t *testing.T) {
 		t.Fatalf("mv.Read(): got %q, want %q", got, want)
 	}
 }
+
+func TestRequestViewStream(t *testing.T) {
+	body := strings.NewReader("body content")
+	req, err := http.NewRequest("POST", "http://example.com/path", body)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	req.ContentLength = int64(body.Len())
+
+	var done bool
+	mv := New()
+	if err := mv.StreamRequest(req, 4, func() { done = true }); err != nil {
+		t.Fatalf("StreamRequest(): got %v, want no error", err)
+	}
+	if done {
+		t.Fatal("done: got true before the body was read, want false")
+	}
+
+	got, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(req.Body): got %v, want no error", err)
+	}
+	if want := "body content"; string(got) != want {
+		t.Errorf("req.Body: got %q, want %q", got, want)
+	}
+	if !done {
+		t.Fatal("done: got false after the body was read, want true")
+	}
+
+	br, err := mv.BodyReader()
+	if err != nil {
+		t.Fatalf("mv.BodyReader(): got %v, want no error", err)
+	}
+	got, err = ioutil.ReadAll(br)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(mv.BodyReader()): got %v, want no error", err)
+	}
+	if want := "body"; string(got) != want {
+		t.Errorf("mv.BodyReader(): got %q, want %q", got, want)
+	}
+	if !mv.Truncated() {
+		t.Error("mv.Truncated(): got false, want true")
+	}
+}
+
+func TestResponseViewStream(t *testing.T) {
+	res := proxyutil.NewResponse(200, strings.NewReader("body content"), nil)
+	res.TransferEncoding = []string{"chunked"}
+	res.Header.Set("Response-Header", "true")
+
+	var done bool
+	mv := New()
+	if err := mv.StreamResponse(res, 64, func() { done = true }); err != nil {
+		t.Fatalf("StreamResponse(): got %v, want no error", err)
+	}
+
+	// Closing the body before EOF completes the view with what was read.
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(res.Body, b); err != nil {
+		t.Fatalf("io.ReadFull(res.Body): got %v, want no error", err)
+	}
+	if done {
+		t.Fatal("done: got true before the body was closed, want false")
+	}
+	res.Body.Close()
+	if !done {
+		t.Fatal("done: got false after the body was closed, want true")
+	}
+
+	r, err := mv.Reader(Decode())
+	if err != nil {
+		t.Fatalf("mv.Reader(): got %v, want no error", err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(mv.Reader()): got %v, want no error", err)
+	}
+
+	want := "HTTP/1.1 200 OK\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"Response-Header: true\r\n\r\n" +
+		"body\r\n"
+	if string(got) != want {
+		t.Errorf("mv.Reader(): got %q, want %q", got, want)
+	}
+	if mv.Truncated() {
+		t.Error("mv.Truncated(): got true, want false")
+	}
+}
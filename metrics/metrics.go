@@ -0,0 +1,336 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// Package metrics provides counters, gauges and latency histograms for the
+// internals of the proxy, exposed in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the round trip latency
+// histogram buckets.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// DefaultMaxHosts is the default number of hosts that are given their own
+// label.
+const DefaultMaxHosts = 1000
+
+// OtherHost is the host label of the observations about hosts beyond the
+// maximum number of hosts.
+const OtherHost = "other"
+
+// Metrics records observations about the connections and requests handled by
+// the proxy. All methods are safe for concurrent use, and a nil *Metrics
+// discards all observations.
+type Metrics struct {
+	mu                sync.Mutex
+	buckets           []float64
+	connections       uint64
+	sessions          int64
+	tunnels           uint64
+	activeTunnels     int64
+	handshakeFailures uint64
+	maxHosts          int
+	hosts             map[string]bool
+	roundTrips        map[string]*histogram
+	upstreamErrors    map[string]uint64
+	modifierErrors    map[string]uint64
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// New returns metrics with the default histogram buckets.
+func New() *Metrics {
+	return NewWithBuckets(DefaultBuckets)
+}
+
+// NewWithBuckets returns metrics that record round trip latencies in
+// histograms with the given bucket upper bounds, in seconds.
+func NewWithBuckets(buckets []float64) *Metrics {
+	bs := append([]float64(nil), buckets...)
+	sort.Float64s(bs)
+
+	return &Metrics{
+		buckets:        bs,
+		maxHosts:       DefaultMaxHosts,
+		hosts:          make(map[string]bool),
+		roundTrips:     make(map[string]*histogram),
+		upstreamErrors: make(map[string]uint64),
+		modifierErrors: make(map[string]uint64),
+	}
+}
+
+// SetMaxHosts sets the number of hosts that are given their own label, since
+// every label is kept for the lifetime of the metrics. Observations about
+// further hosts are recorded with the OtherHost label. Zero means no limit.
+func (m *Metrics) SetMaxHosts(n int) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.maxHosts = n
+}
+
+// hostLabel returns the label that observations about host are recorded
+// with. m.mu must be held.
+func (m *Metrics) hostLabel(host string) string {
+	if m.hosts[host] {
+		return host
+	}
+	if m.maxHosts > 0 && len(m.hosts) >= m.maxHosts {
+		return OtherHost
+	}
+	m.hosts[host] = true
+
+	return host
+}
+
+// ConnectionAccepted records a connection accepted from a listener.
+func (m *Metrics) ConnectionAccepted() {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.connections++
+}
+
+// SessionStarted records that the proxy started handling a client connection.
+func (m *Metrics) SessionStarted() {
+	m.addSessions(1)
+}
+
+// SessionEnded records that the proxy is done handling a client connection.
+func (m *Metrics) SessionEnded() {
+	m.addSessions(-1)
+}
+
+func (m *Metrics) addSessions(n int64) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessions += n
+}
+
+// TunnelOpened records a tunnel established to relay a connection without
+// inspecting it, such as for a CONNECT request that is not MITM'd.
+func (m *Metrics) TunnelOpened() {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.tunnels++
+	m.activeTunnels++
+}
+
+// TunnelClosed records that a tunnel opened with TunnelOpened was closed.
+func (m *Metrics) TunnelClosed() {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.activeTunnels--
+}
+
+// HandshakeFailed records a failed TLS handshake with a client whose
+// connection is MITM'd.
+func (m *Metrics) HandshakeFailed() {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.handshakeFailures++
+}
+
+// ObserveRoundTrip records the time taken to receive the response headers of a
+// request sent to host.
+func (m *Metrics) ObserveRoundTrip(host string, d time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	host = m.hostLabel(host)
+	h, ok := m.roundTrips[host]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(m.buckets))}
+		m.roundTrips[host] = h
+	}
+
+	s := d.Seconds()
+	for i, b := range m.buckets {
+		if s <= b {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += s
+	h.count++
+}
+
+// UpstreamError records a request to host that failed, and for which the proxy
+// replied with an error response, such as a 502 Bad Gateway or a 504 Gateway
+// Timeout.
+func (m *Metrics) UpstreamError(host string) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.upstreamErrors[m.hostLabel(host)]++
+}
+
+// ModifierError records an error returned by a modifier. Phase is "request"
+// or "response".
+func (m *Metrics) ModifierError(phase string) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.modifierErrors[phase]++
+}
+
+// WriteText writes the metrics to w in the Prometheus text exposition format.
+func (m *Metrics) WriteText(w io.Writer) error {
+	if m == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ew := &errWriter{w: w}
+
+	ew.metric("martian_connections_accepted_total", "counter", "Connections accepted from listeners.")
+	ew.printf("martian_connections_accepted_total %d\n", m.connections)
+
+	ew.metric("martian_sessions_active", "gauge", "Client connections being handled.")
+	ew.printf("martian_sessions_active %d\n", m.sessions)
+
+	ew.metric("martian_tunnels_total", "counter", "Connections tunneled without being inspected.")
+	ew.printf("martian_tunnels_total %d\n", m.tunnels)
+
+	ew.metric("martian_tunnels_active", "gauge", "Tunnels currently open.")
+	ew.printf("martian_tunnels_active %d\n", m.activeTunnels)
+
+	ew.metric("martian_mitm_handshake_failures_total", "counter", "Failed TLS handshakes with MITM'd clients.")
+	ew.printf("martian_mitm_handshake_failures_total %d\n", m.handshakeFailures)
+
+	ew.metric("martian_round_trip_duration_seconds", "histogram", "Time taken to receive response headers from upstream.")
+	for _, host := range sortedKeys(m.roundTrips) {
+		h := m.roundTrips[host]
+		l := label("host", host)
+
+		var cum uint64
+		for i, b := range m.buckets {
+			cum += h.counts[i]
+			ew.printf("martian_round_trip_duration_seconds_bucket{%s,le=%q} %d\n", l, formatFloat(b), cum)
+		}
+		ew.printf("martian_round_trip_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", l, h.count)
+		ew.printf("martian_round_trip_duration_seconds_sum{%s} %s\n", l, formatFloat(h.sum))
+		ew.printf("martian_round_trip_duration_seconds_count{%s} %d\n", l, h.count)
+	}
+
+	ew.metric("martian_upstream_errors_total", "counter", "Requests that failed upstream and were answered with an error response.")
+	for _, host := range sortedKeys(m.upstreamErrors) {
+		ew.printf("martian_upstream_errors_total{%s} %d\n", label("host", host), m.upstreamErrors[host])
+	}
+
+	ew.metric("martian_modifier_errors_total", "counter", "Errors returned by modifiers.")
+	for _, phase := range sortedKeys(m.modifierErrors) {
+		ew.printf("martian_modifier_errors_total{%s} %d\n", label("phase", phase), m.modifierErrors[phase])
+	}
+
+	return ew.err
+}
+
+// errWriter writes to w until the first error.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) printf(format string, args ...interface{}) {
+	if ew.err != nil {
+		return
+	}
+	_, ew.err = fmt.Fprintf(ew.w, format, args...)
+}
+
+func (ew *errWriter) metric(name, typ, help string) {
+	ew.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func label(name, value string) string {
+	return name + `="` + labelEscaper.Replace(value) + `"`
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]*histogram:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]uint64:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
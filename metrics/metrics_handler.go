@@ -0,0 +1,52 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/google/martian/v3/log"
+)
+
+type handler struct {
+	metrics *Metrics
+}
+
+// NewHandler returns an http.Handler that writes the metrics in the Prometheus
+// text exposition format.
+func NewHandler(m *Metrics) http.Handler {
+	return &handler{
+		metrics: m,
+	}
+}
+
+// ServeHTTP writes the metrics to the response body.
+func (h *handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		rw.Header().Add("Allow", "GET, HEAD")
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		log.Errorf("metrics.ServeHTTP: method not allowed: %s", req.Method)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if req.Method == "HEAD" {
+		return
+	}
+
+	if err := h.metrics.WriteText(rw); err != nil {
+		log.Errorf("metrics.ServeHTTP: failed to write metrics: %v", err)
+	}
+}
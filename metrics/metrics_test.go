@@ -0,0 +1,164 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteText(t *testing.T) {
+	m := NewWithBuckets([]float64{1, 0.1})
+
+	m.ConnectionAccepted()
+	m.ConnectionAccepted()
+	m.SessionStarted()
+	m.SessionStarted()
+	m.SessionEnded()
+	m.TunnelOpened()
+	m.TunnelOpened()
+	m.TunnelClosed()
+	m.HandshakeFailed()
+	m.ObserveRoundTrip("example.com", 50*time.Millisecond)
+	m.ObserveRoundTrip("example.com", 500*time.Millisecond)
+	m.ObserveRoundTrip("example.com", 2*time.Second)
+	m.UpstreamError(`bad"host`)
+	m.ModifierError("request")
+	m.ModifierError("request")
+	m.ModifierError("response")
+
+	buf := new(bytes.Buffer)
+	if err := m.WriteText(buf); err != nil {
+		t.Fatalf("m.WriteText(): got %v, want no error", err)
+	}
+	got := buf.String()
+
+	for _, want := range []string{
+		"# TYPE martian_connections_accepted_total counter\n",
+		"martian_connections_accepted_total 2\n",
+		"# TYPE martian_sessions_active gauge\n",
+		"martian_sessions_active 1\n",
+		"martian_tunnels_total 2\n",
+		"martian_tunnels_active 1\n",
+		"martian_mitm_handshake_failures_total 1\n",
+		"# TYPE martian_round_trip_duration_seconds histogram\n",
+		"martian_round_trip_duration_seconds_bucket{host=\"example.com\",le=\"0.1\"} 1\n",
+		"martian_round_trip_duration_seconds_bucket{host=\"example.com\",le=\"1\"} 2\n",
+		"martian_round_trip_duration_seconds_bucket{host=\"example.com\",le=\"+Inf\"} 3\n",
+		"martian_round_trip_duration_seconds_sum{host=\"example.com\"} 2.55\n",
+		"martian_round_trip_duration_seconds_count{host=\"example.com\"} 3\n",
+		"martian_upstream_errors_total{host=\"bad\\\"host\"} 1\n",
+		"martian_modifier_errors_total{phase=\"request\"} 2\n",
+		"martian_modifier_errors_total{phase=\"response\"} 1\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("m.WriteText(): got\n%s\nwant to contain %q", got, want)
+		}
+	}
+}
+
+func TestMaxHosts(t *testing.T) {
+	m := NewWithBuckets([]float64{1})
+	m.SetMaxHosts(2)
+
+	m.ObserveRoundTrip("a.example.com", time.Second)
+	m.UpstreamError("b.example.com")
+	m.ObserveRoundTrip("c.example.com", time.Second)
+	m.UpstreamError("d.example.com")
+	m.UpstreamError("e.example.com")
+	m.ObserveRoundTrip("a.example.com", time.Second)
+
+	buf := new(bytes.Buffer)
+	if err := m.WriteText(buf); err != nil {
+		t.Fatalf("m.WriteText(): got %v, want no error", err)
+	}
+	got := buf.String()
+
+	for _, want := range []string{
+		"martian_round_trip_duration_seconds_count{host=\"a.example.com\"} 2\n",
+		"martian_round_trip_duration_seconds_count{host=\"other\"} 1\n",
+		"martian_upstream_errors_total{host=\"b.example.com\"} 1\n",
+		"martian_upstream_errors_total{host=\"other\"} 2\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("m.WriteText(): got\n%s\nwant to contain %q", got, want)
+		}
+	}
+	for _, host := range []string{"c.example.com", "d.example.com", "e.example.com"} {
+		if strings.Contains(got, host) {
+			t.Errorf("m.WriteText(): got\n%s\nwant not to contain %q", got, host)
+		}
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *Metrics
+
+	m.ConnectionAccepted()
+	m.SessionStarted()
+	m.TunnelOpened()
+	m.HandshakeFailed()
+	m.ObserveRoundTrip("example.com", time.Second)
+	m.UpstreamError("example.com")
+	m.ModifierError("request")
+	m.SetMaxHosts(1)
+
+	buf := new(bytes.Buffer)
+	if err := m.WriteText(buf); err != nil {
+		t.Fatalf("m.WriteText(): got %v, want no error", err)
+	}
+	if got := buf.Len(); got != 0 {
+		t.Errorf("buf.Len(): got %d, want 0", got)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	m := New()
+	m.ConnectionAccepted()
+
+	h := NewHandler(m)
+
+	req, err := http.NewRequest("GET", "http://martian.proxy/metrics", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	if got, want := rw.Code, 200; got != want {
+		t.Errorf("rw.Code: got %d, want %d", got, want)
+	}
+	if got, want := rw.Header().Get("Content-Type"), "text/plain; version=0.0.4; charset=utf-8"; got != want {
+		t.Errorf("rw.Header().Get(%q): got %q, want %q", "Content-Type", got, want)
+	}
+	if got, want := rw.Body.String(), "martian_connections_accepted_total 1\n"; !strings.Contains(got, want) {
+		t.Errorf("rw.Body: got %q, want to contain %q", got, want)
+	}
+
+	req, err = http.NewRequest("POST", "http://martian.proxy/metrics", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	if got, want := rw.Code, 405; got != want {
+		t.Errorf("rw.Code: got %d, want %d", got, want)
+	}
+}
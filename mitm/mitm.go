@@ -161,6 +161,12 @@ func (c *Config) SkipTLSVerify(skip bool) {
 	c.skipVerify = skip
 }
 
+// SkippingTLSVerify returns whether the TLS certification verification check
+// is skipped.
+func (c *Config) SkippingTLSVerify() bool {
+	return c.skipVerify
+}
+
 // SetOrganization sets the organization of the certificate.
 func (c *Config) SetOrganization(org string) {
 	c.org = org
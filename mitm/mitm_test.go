@@ -70,6 +70,9 @@ func TestMITM(t *testing.T) {
 	}
 
 	c.SkipTLSVerify(true)
+	if !c.SkippingTLSVerify() {
+		t.Error("c.SkippingTLSVerify(): got false, want true")
+	}
 
 	conf = c.TLSForHost("example.com")
 	if got := conf.NextProtos; !reflect.DeepEqual(got, protos) {
@@ -0,0 +1,191 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/martian/v3/proxyutil"
+)
+
+// ModifierErrorAction is what the proxy does when a modifier returns an error.
+type ModifierErrorAction int
+
+const (
+	// ContinueOnModifierError adds the error to the request or response as a
+	// Warning header and carries on, as if the modifier succeeded.
+	ContinueOnModifierError ModifierErrorAction = iota
+	// FailOnModifierError sends a response with the status of the policy to
+	// the client instead of sending the request upstream or relaying the
+	// response.
+	FailOnModifierError
+	// CloseOnModifierError closes the connection to the client without a
+	// response.
+	CloseOnModifierError
+)
+
+// SetModifierErrorPolicy sets what the proxy does when the request or
+// response modifiers return an error. The statusCode is the status of the
+// responses sent by FailOnModifierError, 500 Internal Server Error if zero.
+// The default is ContinueOnModifierError.
+//
+// For streams relayed over HTTP/2, FailOnModifierError fails only the stream:
+// a failed response is replaced with one with the status of the policy, and
+// a failed request is reset with RST_STREAM, since the stream has no response
+// to replace yet. CloseOnModifierError closes the HTTP/2 connection.
+func (p *Proxy) SetModifierErrorPolicy(action ModifierErrorAction, statusCode int) {
+	if statusCode == 0 {
+		statusCode = http.StatusInternalServerError
+	}
+
+	p.modErrAction = action
+	p.modErrStatus = statusCode
+}
+
+// SetModifierErrorLog sets the log that the errors returned by the request and
+// response modifiers are recorded in. When nil, errors are not recorded.
+func (p *Proxy) SetModifierErrorLog(l *ModifierErrorLog) {
+	p.modErrLog = l
+}
+
+// modifierError handles err, the error returned by the modifiers run in phase,
+// "request" or "response", for req, adding it to header as a Warning, and
+// returns the action to take. It returns ContinueOnModifierError if err is nil.
+func (p *Proxy) modifierError(phase string, req *http.Request, header http.Header, err error) ModifierErrorAction {
+	if err == nil {
+		return ContinueOnModifierError
+	}
+
+	p.metrics.ModifierError(phase)
+	proxyutil.Warning(header, err)
+
+	if p.modErrLog != nil {
+		var id string
+		ctx := NewContext(req)
+		if ctx != nil {
+			id = ctx.ID()
+		}
+
+		errs := []error{err}
+		if merr, ok := err.(*MultiError); ok {
+			errs = merr.Errors()
+		}
+		for _, err := range errs {
+			var modifier string
+			if ctx != nil {
+				modifier = ctx.modifierOf(err)
+			}
+
+			p.modErrLog.Add(ModifierErrorEntry{
+				Time:      time.Now(),
+				RequestID: id,
+				Phase:     phase,
+				Modifier:  modifier,
+				Method:    req.Method,
+				URL:       req.URL.String(),
+				Message:   err.Error(),
+			})
+		}
+	}
+
+	return p.modErrAction
+}
+
+// modifierErrorResponse returns the response sent to the client for req when
+// the modifiers fail with err under FailOnModifierError.
+func (p *Proxy) modifierErrorResponse(req *http.Request, err error) *http.Response {
+	body := []byte(err.Error() + "\n")
+
+	res := proxyutil.NewResponse(p.modErrStatus, bytes.NewReader(body), req)
+	res.ContentLength = int64(len(body))
+	res.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	proxyutil.Warning(res.Header, err)
+
+	return res
+}
+
+// ModifierErrorEntry is an error returned by a modifier.
+type ModifierErrorEntry struct {
+	Time time.Time `json:"time"`
+	// RequestID is the ID of the context of the request.
+	RequestID string `json:"requestId"`
+	// Phase is "request" or "response".
+	Phase string `json:"phase"`
+	// Modifier is the type of the innermost modifier that returned the error,
+	// such as "*header.Modifier", or empty if unknown.
+	Modifier string `json:"modifier"`
+	Method   string `json:"method"`
+	URL      string `json:"url"`
+	Message  string `json:"message"`
+}
+
+// ModifierErrorLog is a ring buffer of the most recent modifier errors.
+type ModifierErrorLog struct {
+	mu      sync.Mutex
+	entries []ModifierErrorEntry
+	next    int
+	full    bool
+}
+
+// NewModifierErrorLog returns a log that keeps the last size errors.
+func NewModifierErrorLog(size int) *ModifierErrorLog {
+	if size < 1 {
+		size = 1
+	}
+
+	return &ModifierErrorLog{
+		entries: make([]ModifierErrorEntry, size),
+	}
+}
+
+// Add records e, evicting the oldest entry if the log is full.
+func (l *ModifierErrorLog) Add(e ModifierErrorEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries[l.next] = e
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// Entries returns the recorded errors, oldest first.
+func (l *ModifierErrorLog) Entries() []ModifierErrorEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.full {
+		return append([]ModifierErrorEntry(nil), l.entries[:l.next]...)
+	}
+
+	entries := append([]ModifierErrorEntry(nil), l.entries[l.next:]...)
+	return append(entries, l.entries[:l.next]...)
+}
+
+// Reset removes all recorded errors.
+func (l *ModifierErrorLog) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i := range l.entries {
+		l.entries[i] = ModifierErrorEntry{}
+	}
+	l.next = 0
+	l.full = false
+}
@@ -0,0 +1,205 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/martian/v3/martiantest"
+	"github.com/google/martian/v3/proxyutil"
+)
+
+func TestModifierErrorLog(t *testing.T) {
+	l := NewModifierErrorLog(2)
+
+	if got := len(l.Entries()); got != 0 {
+		t.Fatalf("len(l.Entries()): got %d, want 0", got)
+	}
+
+	for _, msg := range []string{"first", "second", "third"} {
+		l.Add(ModifierErrorEntry{Message: msg})
+	}
+
+	entries := l.Entries()
+	if got, want := len(entries), 2; got != want {
+		t.Fatalf("len(l.Entries()): got %d, want %d", got, want)
+	}
+	if got, want := entries[0].Message, "second"; got != want {
+		t.Errorf("entries[0].Message: got %q, want %q", got, want)
+	}
+	if got, want := entries[1].Message, "third"; got != want {
+		t.Errorf("entries[1].Message: got %q, want %q", got, want)
+	}
+
+	l.Reset()
+	if got := len(l.Entries()); got != 0 {
+		t.Errorf("len(l.Entries()): got %d, want 0 after Reset", got)
+	}
+
+	l.Add(ModifierErrorEntry{Message: "fourth"})
+	if got, want := l.Entries()[0].Message, "fourth"; got != want {
+		t.Errorf("l.Entries()[0].Message: got %q, want %q", got, want)
+	}
+}
+
+func TestIntegrationModifierErrorPolicy(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		name   string
+		action ModifierErrorAction
+		status int
+		phase  string
+		want   int
+		closed bool
+	}{
+		{
+			name:   "continue request",
+			action: ContinueOnModifierError,
+			phase:  "request",
+			want:   200,
+		},
+		{
+			name:   "fail request",
+			action: FailOnModifierError,
+			status: 503,
+			phase:  "request",
+			want:   503,
+		},
+		{
+			name:   "fail response",
+			action: FailOnModifierError,
+			phase:  "response",
+			want:   500,
+		},
+		{
+			name:   "close request",
+			action: CloseOnModifierError,
+			phase:  "request",
+			closed: true,
+		},
+		{
+			name:   "close response",
+			action: CloseOnModifierError,
+			phase:  "response",
+			closed: true,
+		},
+	}
+
+	for _, tc := range tt {
+		l, err := net.Listen("tcp", "[::]:0")
+		if err != nil {
+			t.Fatalf("%s: net.Listen(): got %v, want no error", tc.name, err)
+		}
+
+		p := NewProxy()
+		defer p.Close()
+
+		var roundTrips int32
+		tr := martiantest.NewTransport()
+		tr.Func(func(req *http.Request) (*http.Response, error) {
+			atomic.AddInt32(&roundTrips, 1)
+			return proxyutil.NewResponse(200, nil, req), nil
+		})
+		p.SetRoundTripper(tr)
+		p.SetTimeout(200 * time.Millisecond)
+
+		el := NewModifierErrorLog(10)
+		p.SetModifierErrorLog(el)
+		p.SetModifierErrorPolicy(tc.action, tc.status)
+
+		moderr := errors.New("modifier error")
+		tm := martiantest.NewModifier()
+		if tc.phase == "request" {
+			tm.RequestError(moderr)
+		} else {
+			tm.ResponseError(moderr)
+		}
+
+		// Wrap the modifier like a group so that the error is attributed to
+		// the innermost modifier.
+		p.SetRequestModifier(RequestModifierFunc(func(req *http.Request) error {
+			return ModifyRequestWithContext(context.Background(), tm, req)
+		}))
+		p.SetResponseModifier(ResponseModifierFunc(func(res *http.Response) error {
+			return ModifyResponseWithContext(context.Background(), tm, res)
+		}))
+
+		go p.Serve(l)
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("%s: net.Dial(): got %v, want no error", tc.name, err)
+		}
+		defer conn.Close()
+
+		req, err := http.NewRequest("GET", "http://example.com", nil)
+		if err != nil {
+			t.Fatalf("%s: http.NewRequest(): got %v, want no error", tc.name, err)
+		}
+		if err := req.WriteProxy(conn); err != nil {
+			t.Fatalf("%s: req.WriteProxy(): got %v, want no error", tc.name, err)
+		}
+
+		res, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if tc.closed {
+			if err != io.ErrUnexpectedEOF && err != io.EOF {
+				t.Errorf("%s: http.ReadResponse(): got %v, want connection closed", tc.name, err)
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("%s: http.ReadResponse(): got %v, want no error", tc.name, err)
+			}
+			res.Body.Close()
+
+			if got := res.StatusCode; got != tc.want {
+				t.Errorf("%s: res.StatusCode: got %d, want %d", tc.name, got, tc.want)
+			}
+		}
+
+		if tc.phase == "request" && tc.action != ContinueOnModifierError && atomic.LoadInt32(&roundTrips) != 0 {
+			t.Errorf("%s: request was sent upstream, want not sent", tc.name)
+		}
+
+		entries := el.Entries()
+		if got, want := len(entries), 1; got != want {
+			t.Fatalf("%s: len(el.Entries()): got %d, want %d", tc.name, got, want)
+		}
+		e := entries[0]
+		if e.RequestID == "" {
+			t.Errorf("%s: e.RequestID: got empty, want request ID", tc.name)
+		}
+		if got, want := e.Phase, tc.phase; got != want {
+			t.Errorf("%s: e.Phase: got %q, want %q", tc.name, got, want)
+		}
+		if got, want := e.Modifier, "*martiantest.Modifier"; got != want {
+			t.Errorf("%s: e.Modifier: got %q, want %q", tc.name, got, want)
+		}
+		if got, want := e.Message, "modifier error"; got != want {
+			t.Errorf("%s: e.Message: got %q, want %q", tc.name, got, want)
+		}
+		if got, want := e.URL, "http://example.com/"; got != want {
+			t.Errorf("%s: e.URL: got %q, want %q", tc.name, got, want)
+		}
+	}
+}
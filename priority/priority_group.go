@@ -16,6 +16,7 @@
 package priority
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
@@ -165,11 +166,17 @@ func (pg *Group) RemoveResponseModifier(resmod martian.ResponseModifier) error {
 // their priority. If an error is returned by a RequestModifier the error is
 // returned and no further modifiers are run.
 func (pg *Group) ModifyRequest(req *http.Request) error {
+	return pg.ModifyRequestContext(context.Background(), req)
+}
+
+// ModifyRequestContext modifies the request like ModifyRequest, passing ctx to
+// each modifier in the group that accepts a context.
+func (pg *Group) ModifyRequestContext(ctx context.Context, req *http.Request) error {
 	pg.reqmu.RLock()
 	defer pg.reqmu.RUnlock()
 
 	for _, m := range pg.reqmods {
-		if err := m.reqmod.ModifyRequest(req); err != nil {
+		if err := martian.ModifyRequestWithContext(ctx, m.reqmod, req); err != nil {
 			return err
 		}
 	}
@@ -181,11 +188,17 @@ func (pg *Group) ModifyRequest(req *http.Request) error {
 // of their priority. If an error is returned by a ResponseModifier the error
 // is returned and no further modifiers are run.
 func (pg *Group) ModifyResponse(res *http.Response) error {
+	return pg.ModifyResponseContext(context.Background(), res)
+}
+
+// ModifyResponseContext modifies the response like ModifyResponse, passing ctx
+// to each modifier in the group that accepts a context.
+func (pg *Group) ModifyResponseContext(ctx context.Context, res *http.Response) error {
 	pg.resmu.RLock()
 	defer pg.resmu.RUnlock()
 
 	for _, m := range pg.resmods {
-		if err := m.resmod.ModifyResponse(res); err != nil {
+		if err := martian.ModifyResponseWithContext(ctx, m.resmod, res); err != nil {
 			return err
 		}
 	}
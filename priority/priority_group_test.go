@@ -15,6 +15,7 @@
 package priority
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"reflect"
@@ -172,6 +173,36 @@ func TestPriorityGroupModifyResponseHaltsOnError(t *testing.T) {
 	}
 }
 
+func TestPriorityGroupModifyContext(t *testing.T) {
+	pg := NewGroup()
+	tm := martiantest.NewModifier()
+
+	pg.AddRequestModifier(tm, 0)
+	pg.AddResponseModifier(tm, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := pg.ModifyRequestContext(ctx, req); err != nil {
+		t.Fatalf("pg.ModifyRequestContext(): got %v, want no error", err)
+	}
+	if got := tm.RequestContext(); got != ctx {
+		t.Errorf("tm.RequestContext(): got %v, want %v", got, ctx)
+	}
+
+	res := proxyutil.NewResponse(200, nil, req)
+	if err := pg.ModifyResponseContext(ctx, res); err != nil {
+		t.Fatalf("pg.ModifyResponseContext(): got %v, want no error", err)
+	}
+	if got := tm.ResponseContext(); got != ctx {
+		t.Errorf("tm.ResponseContext(): got %v, want %v", got, ctx)
+	}
+}
+
 func TestGroupFromJSON(t *testing.T) {
 	msg := []byte(`{
     "priority.Group": {
@@ -17,25 +17,39 @@ package martian
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"net/url"
 	"regexp"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/google/martian/v3/h2"
 	"github.com/google/martian/v3/log"
+	"github.com/google/martian/v3/metrics"
 	"github.com/google/martian/v3/mitm"
 	"github.com/google/martian/v3/nosigpipe"
 	"github.com/google/martian/v3/proxyutil"
 	"github.com/google/martian/v3/trafficshape"
+	"golang.org/x/net/http2"
 )
 
 var errClose = errors.New("closing connection")
+
+// keepAliveConn is a connection that supports TCP keep-alives, such as a
+// *net.TCPConn or a connection wrapping one.
+type keepAliveConn interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
 var noop = Noop("martian")
 
 func isCloseable(err error) bool {
@@ -55,37 +69,86 @@ func isCloseable(err error) bool {
 type Proxy struct {
 	roundTripper http.RoundTripper
 	dial         func(string, string) (net.Conn, error)
+	dialContext  func(context.Context, string, string) (net.Conn, error)
 	timeout      time.Duration
 	mitm         *mitm.Config
 	proxyURL     *url.URL
+	proxyFunc    func(*http.Request) ([]*url.URL, error)
+	proxyProto   int
 	conns        sync.WaitGroup
 	connsMu      sync.Mutex // protects conns.Add/Wait from concurrent access
 	closing      chan bool
+	closeOnce    sync.Once
+	socksAuth    func(username, password string) bool
+	originH2     bool
+	h2c          *h2.Config
+	flushPolicy  FlushPolicy
+	metrics      *metrics.Metrics
+	hooks        *ConnHooks
+	errorPages   *ErrorPages
+	modErrAction ModifierErrorAction
+	modErrStatus int
+	modErrLog    *ModifierErrorLog
+
+	readHeaderTimeout     time.Duration
+	idleTimeout           time.Duration
+	writeTimeout          time.Duration
+	responseHeaderTimeout time.Duration
+
+	// ctx is the parent of all request contexts; cancel cancels it on Close.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// abortCtx is the parent of the contexts of requests sent upstream; abort
+	// cancels it when Shutdown closes the remaining connections.
+	abortCtx context.Context
+	abort    context.CancelFunc
+
+	activeMu  sync.Mutex
+	active    map[io.Closer]bool // true for client connections
+	listeners map[net.Listener]struct{}
 
 	reqmod RequestModifier
 	resmod ResponseModifier
+	wsmod  WebSocketModifier
+
+	wsMaxFrameSize   int64
+	wsMaxMessageSize int64
+
+	h2MaxBody int64
 }
 
 // NewProxy returns a new HTTP proxy.
 func NewProxy() *Proxy {
 	proxy := &Proxy{
 		roundTripper: &http.Transport{
-			// TODO(adamtanner): This forces the http.Transport to not upgrade requests
-			// to HTTP/2 in Go 1.6+. Remove this once Martian can support HTTP/2.
-			TLSNextProto:          make(map[string]func(string, *tls.Conn) http.RoundTripper),
-			Proxy:                 http.ProxyFromEnvironment,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: time.Second,
+			// This forces the http.Transport to not upgrade requests to HTTP/2 in
+			// Go 1.6+. HTTP/2 to origin servers is enabled with SetOriginHTTP2.
+			TLSNextProto:           make(map[string]func(string, *tls.Conn) http.RoundTripper),
+			Proxy:                  http.ProxyFromEnvironment,
+			TLSHandshakeTimeout:    10 * time.Second,
+			ExpectContinueTimeout:  time.Second,
+			OnProxyConnectResponse: proxyConnectResponse(nil),
 		},
-		timeout: 5 * time.Minute,
-		closing: make(chan bool),
-		reqmod:  noop,
-		resmod:  noop,
+		timeout:      5 * time.Minute,
+		closing:      make(chan bool),
+		flushPolicy:  defaultFlushPolicy,
+		modErrStatus: http.StatusInternalServerError,
+		active:       make(map[io.Closer]bool),
+		listeners:    make(map[net.Listener]struct{}),
+		reqmod:       noop,
+		resmod:       noop,
+
+		wsMaxFrameSize:   DefaultWebSocketMaxFrameSize,
+		wsMaxMessageSize: DefaultWebSocketMaxMessageSize,
+
+		h2MaxBody: DefaultH2MaxBodySize,
 	}
-	proxy.SetDial((&net.Dialer{
+	proxy.ctx, proxy.cancel = context.WithCancel(context.Background())
+	proxy.abortCtx, proxy.abort = context.WithCancel(context.Background())
+	proxy.SetDialContext((&net.Dialer{
 		Timeout:   30 * time.Second,
 		KeepAlive: 30 * time.Second,
-	}).Dial)
+	}).DialContext)
 	return proxy
 }
 
@@ -94,57 +157,192 @@ func (p *Proxy) GetRoundTripper() http.RoundTripper {
 	return p.roundTripper
 }
 
-// SetRoundTripper sets the http.RoundTripper of the proxy.
+// SetRoundTripper sets the http.RoundTripper of the proxy. An *http.Transport
+// dials with the dial func of the proxy. Its OnProxyConnectResponse func, if
+// any, is kept and called first when a downstream proxy responds to CONNECT.
 func (p *Proxy) SetRoundTripper(rt http.RoundTripper) {
+	prev := p.roundTripper
 	p.roundTripper = rt
 
 	if tr, ok := p.roundTripper.(*http.Transport); ok {
+		p.configureHTTP2(tr)
+		tr.Proxy = p.transportProxy
+		tr.Dial = nil
+		tr.DialContext = p.dialContext
+		if rt != prev {
+			tr.OnProxyConnectResponse = proxyConnectResponse(tr.OnProxyConnectResponse)
+		}
+		if p.responseHeaderTimeout > 0 {
+			tr.ResponseHeaderTimeout = p.responseHeaderTimeout
+		}
+	}
+}
+
+// SetOriginHTTP2 sets whether HTTP/2 is negotiated with origin servers over
+// TLS when the round tripper of the proxy is an *http.Transport. Requests and
+// responses exchanged over HTTP/2 are still passed to the request and response
+// modifiers as *http.Request and *http.Response, and responses are written to
+// the client as HTTP/1.1. Disabled by default.
+//
+// SetOriginHTTP2 should be called before the proxy starts serving requests.
+func (p *Proxy) SetOriginHTTP2(enabled bool) {
+	p.originH2 = enabled
+
+	if tr, ok := p.roundTripper.(*http.Transport); ok {
+		p.configureHTTP2(tr)
+	}
+}
+
+// configureHTTP2 enables or disables HTTP/2 support in tr to match the proxy.
+func (p *Proxy) configureHTTP2(tr *http.Transport) {
+	if !p.originH2 {
 		tr.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
-		tr.Proxy = http.ProxyURL(p.proxyURL)
-		tr.Dial = p.dial
+		if tr.TLSClientConfig != nil {
+			var protos []string
+			for _, proto := range tr.TLSClientConfig.NextProtos {
+				if proto != "h2" {
+					protos = append(protos, proto)
+				}
+			}
+			tr.TLSClientConfig.NextProtos = protos
+		}
+		return
+	}
+
+	if _, ok := tr.TLSNextProto["h2"]; ok {
+		return
+	}
+	if err := http2.ConfigureTransport(tr); err != nil {
+		log.Errorf("martian: failed to enable HTTP/2 for origin servers: %v", err)
 	}
 }
 
 // SetDownstreamProxy sets the proxy that receives requests from the upstream
-// proxy.
+// proxy. The user information of proxyURL, if any, is sent to the downstream
+// proxy as Basic credentials in the Proxy-Authorization header of CONNECT and
+// absolute-form requests.
 func (p *Proxy) SetDownstreamProxy(proxyURL *url.URL) {
 	p.proxyURL = proxyURL
 
 	if tr, ok := p.roundTripper.(*http.Transport); ok {
-		tr.Proxy = http.ProxyURL(p.proxyURL)
+		tr.Proxy = p.transportProxy
 	}
 }
 
-// SetTimeout sets the request timeout of the proxy.
+// SetTimeout sets the request timeout of the proxy. It bounds the time taken
+// to read each request, including its body, and to handle it, as well as the
+// time waiting for requests when no more specific timeout is set.
 func (p *Proxy) SetTimeout(timeout time.Duration) {
 	p.timeout = timeout
 }
 
+// SetReadHeaderTimeout sets the amount of time allowed to read the headers of
+// a request once the client has started sending it. If zero, the request
+// timeout is used.
+func (p *Proxy) SetReadHeaderTimeout(timeout time.Duration) {
+	p.readHeaderTimeout = timeout
+}
+
+// SetIdleTimeout sets the maximum amount of time to wait for the next request
+// on a keep-alive connection. If zero, the request timeout is used.
+func (p *Proxy) SetIdleTimeout(timeout time.Duration) {
+	p.idleTimeout = timeout
+}
+
+// SetWriteTimeout sets the maximum amount of time allowed to write each
+// response back to the client. If zero, writes are only bounded by the
+// request timeout.
+func (p *Proxy) SetWriteTimeout(timeout time.Duration) {
+	p.writeTimeout = timeout
+}
+
+// SetResponseHeaderTimeout sets the amount of time to wait for the response
+// headers of the upstream server after the request has been written, when the
+// round tripper of the proxy is an *http.Transport. If zero, there is no
+// response header timeout other than the request timeout.
+func (p *Proxy) SetResponseHeaderTimeout(timeout time.Duration) {
+	p.responseHeaderTimeout = timeout
+
+	if tr, ok := p.roundTripper.(*http.Transport); ok {
+		tr.ResponseHeaderTimeout = timeout
+	}
+}
+
+// timeoutOr returns timeout if set, and the request timeout otherwise.
+func (p *Proxy) timeoutOr(timeout time.Duration) time.Duration {
+	if timeout > 0 {
+		return timeout
+	}
+	return p.timeout
+}
+
+// SetMetrics sets the metrics that the proxy records observations about its
+// connections and requests to. When nil, no metrics are recorded.
+func (p *Proxy) SetMetrics(m *metrics.Metrics) {
+	p.metrics = m
+}
+
 // SetMITM sets the config to use for MITMing of CONNECT requests.
 func (p *Proxy) SetMITM(config *mitm.Config) {
 	p.mitm = config
 }
 
-// SetDial sets the dial func used to establish a connection.
+// SetDial sets the dial func used to establish a connection. The DNS lookups
+// made by dial are traced as part of connecting; use SetDialContext to trace
+// them separately.
 func (p *Proxy) SetDial(dial func(string, string) (net.Conn, error)) {
-	p.dial = func(a, b string) (net.Conn, error) {
-		c, e := dial(a, b)
+	p.SetDialContext(traceDial(func(_ context.Context, network, addr string) (net.Conn, error) {
+		return dial(network, addr)
+	}))
+}
+
+// traceDial returns a dial func that calls the ConnectStart and ConnectDone
+// hooks of the httptrace.ClientTrace of its ctx around dial, and ignores
+// SIGPIPE on the connection.
+func traceDial(dial func(context.Context, string, string) (net.Conn, error)) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		trace := httptrace.ContextClientTrace(ctx)
+		if trace != nil && trace.ConnectStart != nil {
+			trace.ConnectStart(network, addr)
+		}
+		c, err := dial(ctx, network, addr)
+		if trace != nil && trace.ConnectDone != nil {
+			trace.ConnectDone(network, addr, err)
+		}
+		nosigpipe.IgnoreSIGPIPE(c)
+		return c, err
+	}
+}
+
+// SetDialContext sets the dial func used to establish a connection. The
+// httptrace.ClientTrace of ctx is called by dial, such as by the DialContext
+// of a net.Dialer, to trace the DNS lookup and the connection.
+func (p *Proxy) SetDialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) {
+	p.dialContext = func(ctx context.Context, a, b string) (net.Conn, error) {
+		c, e := dial(ctx, a, b)
 		nosigpipe.IgnoreSIGPIPE(c)
 		return c, e
 	}
+	p.dial = func(a, b string) (net.Conn, error) {
+		return p.dialContext(context.Background(), a, b)
+	}
 
 	if tr, ok := p.roundTripper.(*http.Transport); ok {
-		tr.Dial = p.dial
+		tr.Dial = nil
+		tr.DialContext = p.dialContext
 	}
 }
 
 // Close sets the proxy to the closing state so it stops receiving new connections,
 // finishes processing any inflight requests, and closes existing connections without
-// reading anymore requests from them.
+// reading anymore requests from them. The contexts passed to modifiers are
+// cancelled. Close blocks until all connections are closed; use Shutdown to
+// bound the wait.
 func (p *Proxy) Close() {
 	log.Infof("martian: closing down proxy")
 
-	close(p.closing)
+	p.startClosing()
+	p.cancel()
 
 	log.Infof("martian: waiting for connections to close")
 	p.connsMu.Lock()
@@ -153,6 +351,137 @@ func (p *Proxy) Close() {
 	log.Infof("martian: all connections closed")
 }
 
+// Shutdown gracefully shuts down the proxy. It closes the listeners being
+// served and idle connections, then waits for in-flight requests, CONNECT
+// tunnels and other connections to finish. If ctx is done first, Shutdown
+// closes the remaining connections, including tunnels, HTTP/2 relays and
+// hijacked connections, cancels the requests in flight upstream, and returns
+// the number of client connections that were cut off along with ctx.Err().
+func (p *Proxy) Shutdown(ctx context.Context) (int, error) {
+	log.Infof("martian: shutting down proxy")
+
+	p.startClosing()
+	p.closeListeners()
+
+	donec := make(chan struct{})
+	go func() {
+		p.connsMu.Lock()
+		p.conns.Wait()
+		p.connsMu.Unlock()
+		close(donec)
+	}()
+
+	select {
+	case <-donec:
+		log.Infof("martian: all connections closed")
+		return 0, nil
+	case <-ctx.Done():
+	}
+
+	n := p.closeActive()
+	log.Infof("martian: closed %d connections that did not finish before shutdown", n)
+
+	return n, ctx.Err()
+}
+
+// startClosing sets the proxy to the closing state.
+func (p *Proxy) startClosing() {
+	p.closeOnce.Do(func() {
+		close(p.closing)
+	})
+}
+
+// closeListeners closes the listeners being served.
+func (p *Proxy) closeListeners() {
+	p.activeMu.Lock()
+	defer p.activeMu.Unlock()
+
+	for l := range p.listeners {
+		l.Close()
+	}
+}
+
+// closeActive cancels all requests and closes all tracked connections,
+// returning the number of client connections that were closed.
+func (p *Proxy) closeActive() int {
+	p.abort()
+	p.cancel()
+
+	p.activeMu.Lock()
+	active := make(map[io.Closer]bool, len(p.active))
+	for c, client := range p.active {
+		active[c] = client
+	}
+	p.activeMu.Unlock()
+
+	var n int
+	for c, client := range active {
+		c.Close()
+		if client {
+			n++
+		}
+	}
+
+	return n
+}
+
+// trackConn registers conn as a client connection that is being handled. The
+// returned function must be called once the connection is done.
+func (p *Proxy) trackConn(conn net.Conn) func() {
+	p.connsMu.Lock()
+	p.conns.Add(1)
+	p.connsMu.Unlock()
+	p.metrics.SessionStarted()
+
+	p.activeMu.Lock()
+	p.active[conn] = true
+	p.activeMu.Unlock()
+
+	return func() {
+		p.activeMu.Lock()
+		delete(p.active, conn)
+		p.activeMu.Unlock()
+
+		p.metrics.SessionEnded()
+		p.conns.Done()
+	}
+}
+
+// trackUpstream returns conn wrapped so that it is closed if Shutdown cuts
+// off the remaining connections.
+func (p *Proxy) trackUpstream(conn net.Conn) net.Conn {
+	p.activeMu.Lock()
+	defer p.activeMu.Unlock()
+
+	uc := &upstreamConn{Conn: conn}
+	uc.untrack = func() {
+		p.activeMu.Lock()
+		defer p.activeMu.Unlock()
+
+		delete(p.active, uc)
+	}
+	p.active[uc] = false
+
+	return uc
+}
+
+// upstreamConn is an upstream connection tracked by the proxy.
+type upstreamConn struct {
+	net.Conn
+	untrack func()
+}
+
+func (c *upstreamConn) Close() error {
+	c.untrack()
+	return c.Conn.Close()
+}
+
+// ReadFrom copies from r without buffering, as a *net.TCPConn would, so that
+// a bufio.Writer wrapping the connection writes through as data arrives.
+func (c *upstreamConn) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(c.Conn, r)
+}
+
 // Closing returns whether the proxy is in the closing state.
 func (p *Proxy) Closing() bool {
 	select {
@@ -181,10 +510,58 @@ func (p *Proxy) SetResponseModifier(resmod ResponseModifier) {
 	p.resmod = resmod
 }
 
+// SetWebSocketModifier sets the modifier for messages relayed over WebSocket
+// connections. When nil, upgraded connections are relayed without inspecting
+// individual frames.
+func (p *Proxy) SetWebSocketModifier(wsmod WebSocketModifier) {
+	p.wsmod = wsmod
+}
+
+// SetWebSocketMaxFrameSize sets the maximum payload size in bytes of a frame
+// relayed through the WebSocketModifier. A peer that sends a larger frame has
+// its connection closed with status 1009 (message too big).
+func (p *Proxy) SetWebSocketMaxFrameSize(n int64) {
+	p.wsMaxFrameSize = n
+}
+
+// SetWebSocketMaxMessageSize sets the maximum size in bytes of a message,
+// reassembled from its fragments, passed to the WebSocketModifier. A peer that
+// sends a larger message has its connection closed with status 1009 (message
+// too big).
+func (p *Proxy) SetWebSocketMaxMessageSize(n int64) {
+	p.wsMaxMessageSize = n
+}
+
+// SetH2CConfig sets the config used to proxy cleartext HTTP/2 (h2c) for hosts
+// permitted by its AllowedHostsFilter. Connections that start with the HTTP/2
+// connection preface on a known destination, such as transparently proxied and
+// SOCKS connections, and requests that are upgraded with "Upgrade: h2c" are
+// relayed through the h2 package with the configured StreamProcessorFactories.
+// When nil, h2c connections with a known destination are tunneled and upgraded
+// requests are relayed without inspecting frames.
+func (p *Proxy) SetH2CConfig(config *h2.Config) {
+	p.h2c = config
+}
+
 // Serve accepts connections from the listener and handles the requests.
 func (p *Proxy) Serve(l net.Listener) error {
+	return p.serve(l, p.handleLoop)
+}
+
+// serve accepts connections from the listener and passes them to handler in a
+// new goroutine until the listener fails or the proxy is closed.
+func (p *Proxy) serve(l net.Listener, handler func(net.Conn)) error {
 	defer l.Close()
 
+	p.activeMu.Lock()
+	p.listeners[l] = struct{}{}
+	p.activeMu.Unlock()
+	defer func() {
+		p.activeMu.Lock()
+		delete(p.listeners, l)
+		p.activeMu.Unlock()
+	}()
+
 	var delay time.Duration
 	for {
 		if p.Closing() {
@@ -209,26 +586,32 @@ func (p *Proxy) Serve(l net.Listener) error {
 				continue
 			}
 
+			if p.Closing() {
+				return nil
+			}
+
 			log.Errorf("martian: failed to accept: %v", err)
 			return err
 		}
 		delay = 0
-		log.Debugf("martian: accepted connection from %s", conn.RemoteAddr())
 
-		if tconn, ok := conn.(*net.TCPConn); ok {
-			tconn.SetKeepAlive(true)
-			tconn.SetKeepAlivePeriod(3 * time.Minute)
+		if kconn, ok := conn.(keepAliveConn); ok {
+			kconn.SetKeepAlive(true)
+			kconn.SetKeepAlivePeriod(3 * time.Minute)
 		}
 
-		go p.handleLoop(conn)
+		p.metrics.ConnectionAccepted()
+		go func() {
+			// The remote address of connections from wrapped listeners, such as
+			// PROXY protocol listeners, may block until the client sends data.
+			log.Debugf("martian: accepted connection from %s", conn.RemoteAddr())
+			handler(conn)
+		}()
 	}
 }
 
 func (p *Proxy) handleLoop(conn net.Conn) {
-	p.connsMu.Lock()
-	p.conns.Add(1)
-	p.connsMu.Unlock()
-	defer p.conns.Done()
+	defer p.trackConn(conn)()
 	defer conn.Close()
 	if p.Closing() {
 		return
@@ -241,21 +624,37 @@ func (p *Proxy) handleLoop(conn net.Conn) {
 		log.Errorf("martian: failed to create session: %v", err)
 		return
 	}
+	p.hooks.accept(s, conn)
+
+	p.hooks.closed(s, p.handleSession(s, conn, brw))
+}
 
+// handleSession reads and handles requests from conn until the connection is
+// closed, and returns the error that caused it to be closed.
+func (p *Proxy) handleSession(s *Session, conn net.Conn, brw *bufio.ReadWriter) error {
 	ctx, err := withSession(s)
 	if err != nil {
 		log.Errorf("martian: failed to create context: %v", err)
-		return
+		return err
 	}
 
+	var failure error
 	for {
-		deadline := time.Now().Add(p.timeout)
-		conn.SetDeadline(deadline)
-
-		if err := p.handle(ctx, conn, brw); isCloseable(err) {
+		err := p.handle(ctx, conn, brw)
+		if isCloseable(err) {
 			log.Debugf("martian: closing connection: %v", conn.RemoteAddr())
-			return
+
+			// Report the failure of the previous request, if any, rather than
+			// the error reading from the broken connection after it.
+			if failure != nil && (err == errClose || err == io.EOF) {
+				return failure
+			}
+			return err
 		}
+		failure = err
+
+		// Subsequent requests on the connection are subject to the idle timeout.
+		s.keepAlive = true
 	}
 }
 
@@ -263,7 +662,17 @@ func (p *Proxy) readRequest(ctx *Context, conn net.Conn, brw *bufio.ReadWriter)
 	var req *http.Request
 	reqc := make(chan *http.Request, 1)
 	errc := make(chan error, 1)
+	idle := ctx.Session().keepAlive
 	go func() {
+		if idle {
+			conn.SetReadDeadline(time.Now().Add(p.timeoutOr(p.idleTimeout)))
+			if _, err := brw.Peek(1); err != nil {
+				errc <- err
+				return
+			}
+		}
+
+		conn.SetDeadline(time.Now().Add(p.timeoutOr(p.readHeaderTimeout)))
 		r, err := http.ReadRequest(brw.Reader)
 		if err != nil {
 			errc <- err
@@ -275,9 +684,9 @@ func (p *Proxy) readRequest(ctx *Context, conn net.Conn, brw *bufio.ReadWriter)
 	case err := <-errc:
 		if isCloseable(err) {
 			log.Debugf("martian: connection closed prematurely: %v", err)
-		} else {
-			log.Errorf("martian: failed to read request: %v", err)
+			return nil, err
 		}
+		log.Errorf("martian: failed to read request: %v", err)
 
 		// TODO: TCPConn.WriteClose() to avoid sending an RST to the client.
 
@@ -287,32 +696,50 @@ func (p *Proxy) readRequest(ctx *Context, conn net.Conn, brw *bufio.ReadWriter)
 		return nil, errClose
 	}
 
+	// The body of the request and handling it are subject to the request
+	// timeout.
+	conn.SetDeadline(time.Now().Add(p.timeout))
+
 	return req, nil
 }
 
-func (p *Proxy) handleConnectRequest(ctx *Context, req *http.Request, session *Session, brw *bufio.ReadWriter, conn net.Conn) error {
-	if err := p.reqmod.ModifyRequest(req); err != nil {
-		log.Errorf("martian: error modifying CONNECT request: %v", err)
-		proxyutil.Warning(req.Header, err)
+func (p *Proxy) handleConnectRequest(ctx *Context, rctx context.Context, req *http.Request, session *Session, brw *bufio.ReadWriter, conn net.Conn) error {
+	reqerr := ModifyRequestWithContext(rctx, p.reqmod, req)
+	if reqerr != nil {
+		log.Errorf("martian: error modifying CONNECT request: %v", reqerr)
 	}
+	action := p.modifierError("request", req, req.Header, reqerr)
 	if session.Hijacked() {
 		log.Debugf("martian: connection hijacked by request modifier")
 		return nil
 	}
+	switch action {
+	case CloseOnModifierError:
+		return errClose
+	case FailOnModifierError:
+		return p.writeConnectFailure(rctx, session, brw, p.modifierErrorResponse(req, reqerr))
+	}
 
 	if p.mitm != nil {
 		log.Debugf("martian: attempting MITM for connection: %s / %s", req.Host, req.URL.String())
 
 		res := proxyutil.NewResponse(200, nil, req)
 
-		if err := p.resmod.ModifyResponse(res); err != nil {
-			log.Errorf("martian: error modifying CONNECT response: %v", err)
-			proxyutil.Warning(res.Header, err)
+		reserr := ModifyResponseWithContext(rctx, p.resmod, res)
+		if reserr != nil {
+			log.Errorf("martian: error modifying CONNECT response: %v", reserr)
 		}
+		action := p.modifierError("response", req, res.Header, reserr)
 		if session.Hijacked() {
 			log.Infof("martian: connection hijacked by response modifier")
 			return nil
 		}
+		switch action {
+		case CloseOnModifierError:
+			return errClose
+		case FailOnModifierError:
+			return p.writeConnectFailure(rctx, session, brw, p.modifierErrorResponse(req, reserr))
+		}
 
 		if err := res.Write(brw); err != nil {
 			log.Errorf("martian: got error while writing response back to client: %v", err)
@@ -322,6 +749,7 @@ func (p *Proxy) handleConnectRequest(ctx *Context, req *http.Request, session *S
 		}
 
 		log.Debugf("martian: completed MITM for connection: %s", req.Host)
+		p.hooks.connectEstablished(session, req.Host)
 
 		b := make([]byte, 1)
 		if _, err := brw.Read(b); err != nil {
@@ -339,12 +767,18 @@ func (p *Proxy) handleConnectRequest(ctx *Context, req *http.Request, session *S
 			// http.ReadRequest.
 			tlsconn := tls.Server(&peekedConn{conn, io.MultiReader(bytes.NewReader(b), bytes.NewReader(buf), conn)}, p.mitm.TLSForHost(req.Host))
 
+			hsStart := time.Now()
 			if err := tlsconn.Handshake(); err != nil {
 				p.mitm.HandshakeErrorCallback(req, err)
+				p.metrics.HandshakeFailed()
 				return err
 			}
-			if tlsconn.ConnectionState().NegotiatedProtocol == "h2" {
-				return p.mitm.H2Config().Proxy(p.closing, tlsconn, req.URL)
+			session.handshakeStart, session.handshakeDone = hsStart, time.Now()
+			cs := tlsconn.ConnectionState()
+			p.hooks.mitmHandshakeDone(session, cs)
+			if cs.NegotiatedProtocol == "h2" {
+				p.hooks.h2Negotiated(session, req.Host)
+				return p.proxyH2(tlsconn, req)
 			}
 
 			var nconn net.Conn
@@ -361,6 +795,9 @@ func (p *Proxy) handleConnectRequest(ctx *Context, req *http.Request, session *S
 
 		// Prepend the previously read data to be read again by http.ReadRequest.
 		brw.Reader.Reset(io.MultiReader(bytes.NewReader(b), bytes.NewReader(buf), conn))
+		// The target of the CONNECT is the destination of cleartext traffic,
+		// such as HTTP/2 with prior knowledge, that does not name its own.
+		session.setOriginalDestination(req.Host)
 		return p.handle(ctx, conn, brw)
 	}
 
@@ -368,38 +805,28 @@ func (p *Proxy) handleConnectRequest(ctx *Context, req *http.Request, session *S
 	res, cconn, cerr := p.connect(req)
 	if cerr != nil {
 		log.Errorf("martian: failed to CONNECT: %v", cerr)
-		res = proxyutil.NewResponse(502, nil, req)
-		proxyutil.Warning(res.Header, cerr)
+		p.metrics.UpstreamError(req.URL.Host)
 
-		if err := p.resmod.ModifyResponse(res); err != nil {
-			log.Errorf("martian: error modifying CONNECT response: %v", err)
-			proxyutil.Warning(res.Header, err)
-		}
-		if session.Hijacked() {
-			log.Infof("martian: connection hijacked by response modifier")
-			return nil
-		}
-
-		if err := res.Write(brw); err != nil {
-			log.Errorf("martian: got error while writing response back to client: %v", err)
-		}
-		err := brw.Flush()
-		if err != nil {
-			log.Errorf("martian: got error while flushing response back to client: %v", err)
-		}
-		return err
+		return p.writeConnectFailure(rctx, session, brw, p.errorResponse(req, cerr))
 	}
 	defer res.Body.Close()
 	defer cconn.Close()
 
-	if err := p.resmod.ModifyResponse(res); err != nil {
-		log.Errorf("martian: error modifying CONNECT response: %v", err)
-		proxyutil.Warning(res.Header, err)
+	reserr := ModifyResponseWithContext(rctx, p.resmod, res)
+	if reserr != nil {
+		log.Errorf("martian: error modifying CONNECT response: %v", reserr)
 	}
+	action = p.modifierError("response", req, res.Header, reserr)
 	if session.Hijacked() {
 		log.Infof("martian: connection hijacked by response modifier")
 		return nil
 	}
+	switch action {
+	case CloseOnModifierError:
+		return errClose
+	case FailOnModifierError:
+		return p.writeConnectFailure(rctx, session, brw, p.modifierErrorResponse(req, reserr))
+	}
 
 	res.ContentLength = -1
 	if err := res.Write(brw); err != nil {
@@ -409,12 +836,17 @@ func (p *Proxy) handleConnectRequest(ctx *Context, req *http.Request, session *S
 		log.Errorf("martian: got error while flushing response back to client: %v", err)
 	}
 
+	if res.StatusCode == 200 {
+		p.hooks.connectEstablished(session, req.URL.Host)
+	}
+
 	cbw := bufio.NewWriter(cconn)
 	cbr := bufio.NewReader(cconn)
 	defer cbw.Flush()
 
-	copySync := func(w io.Writer, r io.Reader, donec chan<- bool) {
-		if _, err := io.Copy(w, r); err != nil && err != io.EOF {
+	copySync := func(w io.Writer, r io.Reader, n *int64, donec chan<- bool) {
+		var err error
+		if *n, err = io.Copy(w, r); err != nil && err != io.EOF {
 			log.Errorf("martian: failed to copy CONNECT tunnel: %v", err)
 		}
 
@@ -422,18 +854,49 @@ func (p *Proxy) handleConnectRequest(ctx *Context, req *http.Request, session *S
 		donec <- true
 	}
 
+	var sent, received int64
 	donec := make(chan bool, 2)
-	go copySync(cbw, brw, donec)
-	go copySync(brw, cbr, donec)
+	go copySync(cbw, brw, &sent, donec)
+	go copySync(brw, cbr, &received, donec)
+
+	p.metrics.TunnelOpened()
+	defer p.metrics.TunnelClosed()
 
 	log.Debugf("martian: established CONNECT tunnel, proxying traffic")
 	<-donec
 	<-donec
 	log.Debugf("martian: closed CONNECT tunnel")
+	p.hooks.tunnelDone(session, req.URL.Host, sent, received)
 
 	return errClose
 }
 
+// writeConnectFailure runs the response modifiers on res, the response to a
+// CONNECT request that failed, and writes it to the client.
+func (p *Proxy) writeConnectFailure(rctx context.Context, session *Session, brw *bufio.ReadWriter, res *http.Response) error {
+	reserr := ModifyResponseWithContext(rctx, p.resmod, res)
+	if reserr != nil {
+		log.Errorf("martian: error modifying CONNECT response: %v", reserr)
+	}
+	action := p.modifierError("response", res.Request, res.Header, reserr)
+	if session.Hijacked() {
+		log.Infof("martian: connection hijacked by response modifier")
+		return nil
+	}
+	if action == CloseOnModifierError {
+		return errClose
+	}
+
+	if err := res.Write(brw); err != nil {
+		log.Errorf("martian: got error while writing response back to client: %v", err)
+	}
+	err := brw.Flush()
+	if err != nil {
+		log.Errorf("martian: got error while flushing response back to client: %v", err)
+	}
+	return err
+}
+
 func (p *Proxy) handle(ctx *Context, conn net.Conn, brw *bufio.ReadWriter) error {
 	log.Debugf("martian: waiting for request: %v", conn.RemoteAddr())
 
@@ -441,18 +904,40 @@ func (p *Proxy) handle(ctx *Context, conn net.Conn, brw *bufio.ReadWriter) error
 	if err != nil {
 		return err
 	}
-	defer req.Body.Close()
+	// Close the body last set on the request, so that bodies wrapped by
+	// modifiers learn that the request is done even if it was not sent.
+	defer func() { req.Body.Close() }()
 
 	session := ctx.Session()
+	if isH2CPreface(req) {
+		return p.handleH2CPriorKnowledge(session, conn, brw)
+	}
 	ctx, err = withSession(session)
 	if err != nil {
 		log.Errorf("martian: failed to build new context: %v", err)
 		return err
 	}
 
+	// Requests sent upstream are cancelled if Shutdown cuts off the connection.
+	actx, abort := context.WithCancel(p.abortCtx)
+	defer abort()
+	req = req.WithContext(actx)
+
 	link(req, ctx)
 	defer unlink(req)
 
+	// The MITM handshake is reported with the first request read after it.
+	if !session.handshakeStart.IsZero() {
+		start, done := session.handshakeStart, session.handshakeDone
+		session.handshakeStart, session.handshakeDone = time.Time{}, time.Time{}
+		ctx.updateTrace(func(t *RoundTripTrace) {
+			t.HandshakeStart, t.HandshakeDone = start, done
+		})
+	}
+
+	rctx, cancel := context.WithTimeout(p.ctx, p.timeout)
+	defer cancel()
+
 	if tsconn, ok := conn.(*trafficshape.Conn); ok {
 		wrconn := tsconn.GetWrappedConn()
 		if sconn, ok := wrconn.(*tls.Conn); ok {
@@ -477,29 +962,69 @@ func (p *Proxy) handle(ctx *Context, conn net.Conn, brw *bufio.ReadWriter) error
 	}
 
 	req.RemoteAddr = conn.RemoteAddr().String()
+	if req.Host == "" {
+		req.Host = session.OriginalDestination()
+	}
 	if req.URL.Host == "" {
 		req.URL.Host = req.Host
 	}
 
 	if req.Method == "CONNECT" {
-		return p.handleConnectRequest(ctx, req, session, brw, conn)
+		return p.handleConnectRequest(ctx, rctx, req, session, brw, conn)
 	}
 
 	// Not a CONNECT request
-	if err := p.reqmod.ModifyRequest(req); err != nil {
-		log.Errorf("martian: error modifying request: %v", err)
-		proxyutil.Warning(req.Header, err)
+	var expect *expectContinueBody
+	if expectsContinue(req) {
+		expect = &expectContinueBody{ReadCloser: req.Body, w: brw.Writer}
+		req.Body = expect
+	}
+
+	stopWatching := func() {}
+	if _, ok := conn.(*trafficshape.Conn); !ok {
+		// Cancel the request context if the client closes the connection. The
+		// connection can only be watched once the request body has been read.
+		w := newDisconnectWatcher(conn, brw.Reader, cancel, p.timeout)
+		stopWatching = w.stop
+		defer w.stop()
+		session.setHijackHook(w.stop)
+		defer session.setHijackHook(nil)
+
+		if req.Body == http.NoBody {
+			w.start()
+		} else {
+			req.Body = &eofSignalBody{ReadCloser: req.Body, onEOF: w.start}
+		}
 	}
+
+	reqerr := ModifyRequestWithContext(rctx, p.reqmod, req)
+	if reqerr != nil {
+		log.Errorf("martian: error modifying request: %v", reqerr)
+	}
+	action := p.modifierError("request", req, req.Header, reqerr)
 	if session.Hijacked() {
 		return nil
 	}
+	if action == CloseOnModifierError {
+		return errClose
+	}
 
-	// perform the HTTP roundtrip
-	res, err := p.roundTrip(ctx, req)
-	if err != nil {
-		log.Errorf("martian: failed to round trip: %v", err)
-		res = proxyutil.NewResponse(502, nil, req)
-		proxyutil.Warning(res.Header, err)
+	if p.wsmod != nil && strings.EqualFold(proxyutil.UpgradeType(req.Header), "websocket") {
+		// Compressed frames can not be inspected by the WebSocketModifier.
+		req.Header.Del("Sec-WebSocket-Extensions")
+	}
+
+	var res *http.Response
+	if action == FailOnModifierError {
+		res = p.modifierErrorResponse(req, reqerr)
+	} else {
+		// perform the HTTP roundtrip
+		res, err = p.roundTrip(ctx, req)
+		if err != nil {
+			log.Errorf("martian: failed to round trip: %v", err)
+			p.metrics.UpstreamError(req.URL.Host)
+			res = p.errorResponse(req, err)
+		}
 	}
 	defer res.Body.Close()
 
@@ -507,14 +1032,37 @@ func (p *Proxy) handle(ctx *Context, conn net.Conn, brw *bufio.ReadWriter) error
 	// see https://github.com/google/martian/issues/298
 	res.Request = req
 
-	if err := p.resmod.ModifyResponse(res); err != nil {
-		log.Errorf("martian: error modifying response: %v", err)
-		proxyutil.Warning(res.Header, err)
+	reserr := ModifyResponseWithContext(rctx, p.resmod, res)
+	if reserr != nil {
+		log.Errorf("martian: error modifying response: %v", reserr)
 	}
+	action = p.modifierError("response", req, res.Header, reserr)
 	if session.Hijacked() {
 		log.Infof("martian: connection hijacked by response modifier")
 		return nil
 	}
+	switch action {
+	case CloseOnModifierError:
+		return errClose
+	case FailOnModifierError:
+		res = p.modifierErrorResponse(req, reserr)
+	}
+
+	if res.StatusCode == http.StatusSwitchingProtocols {
+		if rwc, ok := res.Body.(io.ReadWriteCloser); ok {
+			stopWatching()
+			return p.handleUpgrade(req, res, rwc, conn, brw)
+		}
+	}
+
+	if res.ProtoMajor == 2 {
+		// Responses from HTTP/2 origins are relayed to the client as HTTP/1.1,
+		// chunking bodies of unknown length to keep the connection reusable.
+		res.Proto, res.ProtoMajor, res.ProtoMinor = "HTTP/1.1", 1, 1
+		if res.ContentLength == -1 && len(res.TransferEncoding) == 0 {
+			res.TransferEncoding = []string{"chunked"}
+		}
+	}
 
 	var closing error
 	if req.Close || res.Close || p.Closing() {
@@ -522,6 +1070,11 @@ func (p *Proxy) handle(ctx *Context, conn net.Conn, brw *bufio.ReadWriter) error
 		res.Close = true
 		closing = errClose
 	}
+	if expect != nil && !expect.finish() {
+		log.Debugf("martian: closing connection after rejecting request before its body: %v", req.RemoteAddr)
+		res.Close = true
+		closing = errClose
+	}
 
 	// check if conn is a traffic shaped connection.
 	if ptsconn, ok := conn.(*trafficshape.Conn); ok {
@@ -562,7 +1115,13 @@ func (p *Proxy) handle(ctx *Context, conn net.Conn, brw *bufio.ReadWriter) error
 		}
 	}
 
-	err = res.Write(brw)
+	if p.writeTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(p.writeTimeout))
+	}
+
+	w, stopFlushing := newFlushWriter(brw.Writer, p.flushInterval(ctx, res))
+	err = res.Write(w)
+	stopFlushing()
 	if err != nil {
 		log.Errorf("martian: got error while writing response back to client: %v", err)
 		if _, ok := err.(*trafficshape.ErrForceClose); ok {
@@ -579,6 +1138,91 @@ func (p *Proxy) handle(ctx *Context, conn net.Conn, brw *bufio.ReadWriter) error
 	return closing
 }
 
+// handleUpgrade writes the 101 Switching Protocols response to the client and
+// relays the upgraded connection in both directions until either side closes.
+// WebSocket connections are relayed frame by frame through the WebSocket
+// modifier when one is set.
+func (p *Proxy) handleUpgrade(req *http.Request, res *http.Response, rwc io.ReadWriteCloser, conn net.Conn, brw *bufio.ReadWriter) error {
+	defer rwc.Close()
+
+	// The body of a 101 response is the upgraded connection and must not be
+	// written as part of the response.
+	ures := *res
+	ures.Body = nil
+	if err := ures.Write(brw); err != nil {
+		log.Errorf("martian: got error while writing response back to client: %v", err)
+		return errClose
+	}
+	if err := brw.Flush(); err != nil {
+		log.Errorf("martian: got error while flushing response back to client: %v", err)
+		return errClose
+	}
+
+	// Upgraded connections are long-lived and are not subject to the request
+	// timeout.
+	conn.SetDeadline(time.Time{})
+
+	upgrade := proxyutil.UpgradeType(req.Header)
+	log.Debugf("martian: switched protocols to %q for %s", upgrade, req.URL)
+
+	if strings.EqualFold(upgrade, "h2c") && p.h2cAllowedHost(req.Host) {
+		if ctx := NewContext(req); ctx != nil {
+			p.hooks.h2Negotiated(ctx.Session(), req.Host)
+		}
+		cc := struct {
+			io.Reader
+			io.Writer
+		}{brw.Reader, conn}
+		if err := p.h2c.Relay(p.closing, cc, rwc, req.URL); err != nil {
+			log.Errorf("martian: failed to proxy h2c for %s: %v", req.URL, err)
+		}
+		return errClose
+	}
+
+	toServer := &wsWriter{w: bufio.NewWriter(rwc), masked: true}
+	toClient := &wsWriter{w: bufio.NewWriter(conn)}
+
+	copySync := func(w io.Writer, r *bufio.Reader, fromClient bool, donec chan<- bool) {
+		var err error
+		if p.wsmod != nil && strings.EqualFold(upgrade, "websocket") {
+			if fromClient {
+				err = p.relayWebSocket(req, fromClient, toServer, toClient, r)
+			} else {
+				err = p.relayWebSocket(req, fromClient, toClient, toServer, r)
+			}
+		} else {
+			_, err = io.Copy(w, r)
+		}
+		if err != nil && !isCloseable(err) {
+			log.Debugf("martian: upgraded connection finished copying: %v", err)
+		}
+
+		donec <- true
+	}
+
+	donec := make(chan bool, 2)
+	go copySync(rwc, brw.Reader, true, donec)
+	go copySync(conn, bufio.NewReader(rwc), false, donec)
+
+	// Once either side is done, close both so the other copy unblocks.
+	pending := 2
+	select {
+	case <-donec:
+		pending--
+	case <-p.closing:
+		log.Debugf("martian: closing upgraded connection for %s", req.URL)
+	}
+	rwc.Close()
+	conn.Close()
+	for ; pending > 0; pending-- {
+		<-donec
+	}
+
+	log.Debugf("martian: closed upgraded connection for %s", req.URL)
+
+	return errClose
+}
+
 // A peekedConn subverts the net.Conn.Read implementation, primarily so that
 // sniffed bytes can be transparently prepended.
 type peekedConn struct {
@@ -591,43 +1235,274 @@ type peekedConn struct {
 // be read again.
 func (c *peekedConn) Read(buf []byte) (int, error) { return c.r.Read(buf) }
 
+// disconnectWatcher cancels a request context when the client closes its
+// connection. It waits in the background for the next bytes from the client,
+// so it may only be started once the request has been read in full.
+type disconnectWatcher struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	cancel  context.CancelFunc
+	timeout time.Duration
+	done    chan struct{}
+
+	mu       sync.Mutex
+	started  bool
+	stopping bool
+}
+
+func newDisconnectWatcher(conn net.Conn, br *bufio.Reader, cancel context.CancelFunc, timeout time.Duration) *disconnectWatcher {
+	return &disconnectWatcher{
+		conn:    conn,
+		br:      br,
+		cancel:  cancel,
+		timeout: timeout,
+		done:    make(chan struct{}),
+	}
+}
+
+// start begins watching the connection. It is a no-op if the watcher has
+// already been started or stopped.
+func (w *disconnectWatcher) start() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.started || w.stopping {
+		return
+	}
+	w.started = true
+
+	go func() {
+		defer close(w.done)
+
+		// Peek leaves any pipelined request in the buffer to be read later.
+		if _, err := w.br.Peek(1); err != nil {
+			w.mu.Lock()
+			stopping := w.stopping
+			w.mu.Unlock()
+
+			if !stopping {
+				log.Debugf("martian: client connection closed: %v", err)
+				w.cancel()
+			}
+		}
+	}()
+}
+
+// stop stops watching the connection and waits for the background read to
+// return, so that the connection can be read from again.
+func (w *disconnectWatcher) stop() {
+	w.mu.Lock()
+	if w.stopping {
+		w.mu.Unlock()
+		return
+	}
+	w.stopping = true
+	started := w.started
+	w.mu.Unlock()
+
+	if !started {
+		return
+	}
+
+	// Unblock the pending read and restore the deadline once it returns.
+	w.conn.SetReadDeadline(time.Unix(1, 0))
+	<-w.done
+	w.conn.SetReadDeadline(time.Now().Add(w.timeout))
+}
+
+// eofSignalBody calls onEOF once the wrapped body has been read in full.
+type eofSignalBody struct {
+	io.ReadCloser
+	onEOF func()
+}
+
+func (b *eofSignalBody) Read(buf []byte) (int, error) {
+	n, err := b.ReadCloser.Read(buf)
+	if err == io.EOF {
+		b.onEOF()
+	}
+
+	return n, err
+}
+
 func (p *Proxy) roundTrip(ctx *Context, req *http.Request) (*http.Response, error) {
 	if ctx.SkippingRoundTrip() {
 		log.Debugf("martian: skipping round trip")
 		return proxyutil.NewResponse(200, nil, req), nil
 	}
 
-	return p.roundTripper.RoundTrip(req)
+	start := time.Now()
+	ctx.updateTrace(func(t *RoundTripTrace) {
+		t.Start = start
+	})
+
+	// The traced request is linked too, so that round trippers can find the
+	// context of the request.
+	treq := req.WithContext(httptrace.WithClientTrace(req.Context(), ctx.clientTrace()))
+	link(treq, ctx)
+	defer unlink(treq)
+
+	res, err := p.roundTripDownstream(treq)
+	if err == nil {
+		p.metrics.ObserveRoundTrip(req.URL.Host, time.Since(start))
+	}
+
+	return res, err
 }
 
 func (p *Proxy) connect(req *http.Request) (*http.Response, net.Conn, error) {
-	if p.proxyURL != nil {
-		log.Debugf("martian: CONNECT with downstream proxy: %s", p.proxyURL.Host)
+	proxies, err := p.downstreamProxies(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The dials are traced like those of requests sent by the round tripper.
+	dctx := req.Context()
+	if ctx := NewContext(req); ctx != nil {
+		start := time.Now()
+		ctx.updateTrace(func(t *RoundTripTrace) {
+			t.Start = start
+		})
+		dctx = httptrace.WithClientTrace(dctx, ctx.clientTrace())
+	}
+
+	for i, proxyURL := range proxies {
+		var res *http.Response
+		var conn net.Conn
+		res, conn, err = p.connectVia(dctx, proxyURL, req)
+		if err == nil {
+			return res, conn, nil
+		}
+		if i < len(proxies)-1 {
+			log.Infof("martian: failed to CONNECT via %s, trying next: %v", proxyName(proxyURL), err)
+		}
+	}
 
-		conn, err := p.dial("tcp", p.proxyURL.Host)
+	return nil, nil, err
+}
+
+// connectVia connects to the target of the CONNECT request through proxyURL,
+// or directly if proxyURL is nil, dialing with ctx.
+func (p *Proxy) connectVia(ctx context.Context, proxyURL *url.URL, req *http.Request) (*http.Response, net.Conn, error) {
+	if proxyURL == nil {
+		log.Debugf("martian: CONNECT to host directly: %s", req.URL.Host)
+
+		conn, err := p.dialContext(ctx, "tcp", req.URL.Host)
 		if err != nil {
 			return nil, nil, err
 		}
-		pbw := bufio.NewWriter(conn)
-		pbr := bufio.NewReader(conn)
+		traceConn(req, conn)
+		if err := p.writeProxyHeader(conn, req); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		traceRequest(req, func(t *RoundTripTrace) {
+			t.WroteRequest, t.GotFirstResponseByte = t.GotConn, t.GotConn
+		})
 
-		req.Write(pbw)
-		pbw.Flush()
+		return proxyutil.NewResponse(200, nil, req), p.trackUpstream(conn), nil
+	}
 
-		res, err := http.ReadResponse(pbr, req)
-		if err != nil {
+	log.Debugf("martian: CONNECT with downstream proxy: %s", proxyURL.Host)
+
+	conn, err := p.dialContext(ctx, "tcp", proxyAddr(proxyURL))
+	if err != nil {
+		return nil, nil, err
+	}
+	traceConn(req, conn)
+	if err := p.writeProxyHeader(conn, req); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		conn.SetDeadline(time.Now().Add(p.timeout))
+		if err := socksClientConnect(conn, proxyURL.User, req.URL.Host); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		done := time.Now()
+		traceRequest(req, func(t *RoundTripTrace) {
+			t.WroteRequest, t.GotFirstResponseByte = t.GotConn, done
+		})
+
+		return proxyutil.NewResponse(200, nil, req), p.trackUpstream(conn), nil
+	case "https":
+		// The proxy is verified and the handshake bounded like those of the
+		// downstream proxies dialed by the *http.Transport.
+		config := &tls.Config{}
+		timeout := p.timeout
+		if tr, ok := p.roundTripper.(*http.Transport); ok {
+			if tr.TLSClientConfig != nil {
+				config = tr.TLSClientConfig.Clone()
+			}
+			if tr.TLSHandshakeTimeout > 0 {
+				timeout = tr.TLSHandshakeTimeout
+			}
+		}
+		config.ServerName = proxyURL.Hostname()
+		// The CONNECT request is sent as HTTP/1.1.
+		config.NextProtos = nil
+
+		tlsconn := tls.Client(conn, config)
+		hsStart := time.Now()
+		if timeout > 0 {
+			conn.SetDeadline(hsStart.Add(timeout))
+		}
+		if err := tlsconn.Handshake(); err != nil {
+			conn.Close()
 			return nil, nil, err
 		}
+		conn.SetDeadline(time.Time{})
+		hsDone := time.Now()
+		traceRequest(req, func(t *RoundTripTrace) {
+			t.TLSHandshakeStart, t.TLSHandshakeDone, t.GotConn = hsStart, hsDone, hsDone
+		})
+		conn = tlsconn
+	}
 
-		return res, conn, nil
+	pbw := bufio.NewWriter(conn)
+	pbr := bufio.NewReader(conn)
+
+	creq := req
+	if proxyURL.User != nil {
+		creq = new(http.Request)
+		*creq = *req
+		creq.Header = req.Header.Clone()
+		creq.Header.Set("Proxy-Authorization", proxyAuthorization(proxyURL.User))
 	}
+	creq.Write(pbw)
+	pbw.Flush()
+	wrote := time.Now()
 
-	log.Debugf("martian: CONNECT to host directly: %s", req.URL.Host)
+	if _, err := pbr.Peek(1); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	firstByte := time.Now()
+	traceRequest(req, func(t *RoundTripTrace) {
+		t.WroteRequest, t.GotFirstResponseByte = wrote, firstByte
+	})
 
-	conn, err := p.dial("tcp", req.URL.Host)
+	res, err := http.ReadResponse(pbr, req)
 	if err != nil {
+		conn.Close()
 		return nil, nil, err
 	}
+	if res.StatusCode/100 != 2 {
+		res.Body.Close()
+		conn.Close()
+		return nil, nil, &downstreamProxyError{proxyURL: proxyURL, statusCode: res.StatusCode}
+	}
+
+	// Everything after the response headers belongs to the tunnel.
+	res.Body.Close()
+	res.Body = http.NoBody
+	if pbr.Buffered() > 0 {
+		conn = &peekedConn{conn, pbr}
+	}
 
-	return proxyutil.NewResponse(200, nil, req), conn, nil
+	return res, p.trackUpstream(conn), nil
 }
@@ -17,6 +17,7 @@ package martian
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
@@ -25,6 +26,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"strings"
@@ -33,6 +35,7 @@ import (
 
 	"github.com/google/martian/v3/log"
 	"github.com/google/martian/v3/martiantest"
+	"github.com/google/martian/v3/metrics"
 	"github.com/google/martian/v3/mitm"
 	"github.com/google/martian/v3/proxyutil"
 )
@@ -182,6 +185,99 @@ func TestIntegrationHTTP(t *testing.T) {
 	}
 }
 
+func TestIntegrationOriginHTTP2(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Origin-Proto", req.Proto)
+		rw.Header().Set("Origin-Header", req.Header.Get("Martian-Request"))
+		rw.Write([]byte("origin"))
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	p.SetRoundTripper(&http.Transport{
+		TLSClientConfig: &tls.Config{
+			RootCAs: roots,
+		},
+	})
+	p.SetOriginHTTP2(true)
+	p.SetTimeout(time.Second)
+
+	var proto string
+	tm := martiantest.NewModifier()
+	tm.RequestFunc(func(req *http.Request) {
+		// Requests received over plain connections are sent with the http scheme.
+		req.URL.Scheme = "https"
+		req.Header.Set("Martian-Request", "true")
+	})
+	tm.ResponseFunc(func(res *http.Response) {
+		proto = res.Proto
+		res.Header.Set("Martian-Response", "true")
+	})
+	p.SetRequestModifier(tm)
+	p.SetResponseModifier(tm)
+
+	go p.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	if err := req.WriteProxy(conn); err != nil {
+		t.Fatalf("req.WriteProxy(): got %v, want no error", err)
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	defer res.Body.Close()
+
+	if got, want := res.Proto, "HTTP/1.1"; got != want {
+		t.Errorf("res.Proto: got %q, want %q", got, want)
+	}
+	if got, want := proto, "HTTP/2.0"; got != want {
+		t.Errorf("res.Proto in modifier: got %q, want %q", got, want)
+	}
+	if got, want := res.Header.Get("Origin-Proto"), "HTTP/2.0"; got != want {
+		t.Errorf("res.Header.Get(%q): got %q, want %q", "Origin-Proto", got, want)
+	}
+	if got, want := res.Header.Get("Origin-Header"), "true"; got != want {
+		t.Errorf("res.Header.Get(%q): got %q, want %q", "Origin-Header", got, want)
+	}
+	if got, want := res.Header.Get("Martian-Response"), "true"; got != want {
+		t.Errorf("res.Header.Get(%q): got %q, want %q", "Martian-Response", got, want)
+	}
+
+	got, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	if want := "origin"; string(got) != want {
+		t.Errorf("res.Body: got %q, want %q", got, want)
+	}
+}
+
 func TestIntegrationHTTP100Continue(t *testing.T) {
 	t.Parallel()
 
@@ -260,14 +356,22 @@ func TestIntegrationHTTP100Continue(t *testing.T) {
 		t.Fatalf("conn.Write(headers): got %v, want no error", err)
 	}
 
-	go func() {
-		select {
-		case <-time.After(time.Second):
-			conn.Write([]byte("body content"))
-		}
-	}()
+	br := bufio.NewReader(conn)
 
-	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	// The client is asked for the body once the server asks the proxy for it.
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	if got, want := res.StatusCode, 100; got != want {
+		t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+	}
+
+	if _, err := conn.Write([]byte("body content")); err != nil {
+		t.Fatalf("conn.Write(body): got %v, want no error", err)
+	}
+
+	res, err = http.ReadResponse(br, nil)
 	if err != nil {
 		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
 	}
@@ -294,6 +398,130 @@ func TestIntegrationHTTP100Continue(t *testing.T) {
 	}
 }
 
+func TestIntegrationHTTP100ContinueRejectedByModifier(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	var called bool
+	tr := martiantest.NewTransport()
+	tr.Func(func(req *http.Request) (*http.Response, error) {
+		called = true
+		return proxyutil.NewResponse(200, nil, req), nil
+	})
+	p.SetRoundTripper(tr)
+	p.SetTimeout(2 * time.Second)
+
+	// Requests that are too large are rejected without reading their body.
+	tm := martiantest.NewModifier()
+	tm.RequestFunc(func(req *http.Request) {
+		if req.ContentLength > 1024 {
+			NewContext(req).SkipRoundTrip()
+		}
+	})
+	tm.ResponseFunc(func(res *http.Response) {
+		if res.Request.ContentLength > 1024 {
+			res.StatusCode = 413
+			res.Status = http.StatusText(413)
+		}
+	})
+	p.SetRequestModifier(tm)
+	p.SetResponseModifier(tm)
+
+	go p.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	raw := "POST http://example.com/ HTTP/1.1\r\n" +
+		"Host: example.com\r\n" +
+		"Content-Length: 1048576\r\n" +
+		"Expect: 100-continue\r\n\r\n"
+	if _, err := conn.Write([]byte(raw)); err != nil {
+		t.Fatalf("conn.Write(headers): got %v, want no error", err)
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	res.Body.Close()
+
+	if got, want := res.StatusCode, 413; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+	if !res.Close {
+		t.Error("res.Close: got false, want true")
+	}
+	if called {
+		t.Error("RoundTrip(): got called, want skipped")
+	}
+
+	// The connection is closed since the body may still be sent.
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("br.ReadByte(): got %v, want %v", err, io.EOF)
+	}
+}
+
+func TestIntegrationHTTP100ContinueRejectedByServer(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	p.SetTimeout(2 * time.Second)
+
+	// The server rejects the request without asking for the body.
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(401)
+	}))
+	defer server.Close()
+
+	go p.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	raw := fmt.Sprintf("POST %s/ HTTP/1.1\r\n"+
+		"Host: %s\r\n"+
+		"Content-Length: 12\r\n"+
+		"Expect: 100-continue\r\n\r\n", server.URL, strings.TrimPrefix(server.URL, "http://"))
+	if _, err := conn.Write([]byte(raw)); err != nil {
+		t.Fatalf("conn.Write(headers): got %v, want no error", err)
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	res.Body.Close()
+
+	if got, want := res.StatusCode, 401; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+	if !res.Close {
+		t.Error("res.Close: got false, want true")
+	}
+}
+
 func TestIntegrationHTTPDownstreamProxy(t *testing.T) {
 	t.Parallel()
 
@@ -1350,3 +1578,538 @@ func TestRacyClose(t *testing.T) {
 		openAndConnect()
 	}
 }
+
+// contextModifier is a ContextRequestModifier that reads the request body and
+// then waits for the request context to be done.
+type contextModifier struct {
+	started chan struct{}
+	errc    chan error
+}
+
+func newContextModifier() *contextModifier {
+	return &contextModifier{
+		started: make(chan struct{}),
+		errc:    make(chan error, 1),
+	}
+}
+
+func (m *contextModifier) ModifyRequest(req *http.Request) error {
+	return errors.New("contextModifier: ModifyRequest called instead of ModifyRequestContext")
+}
+
+func (m *contextModifier) ModifyRequestContext(ctx context.Context, req *http.Request) error {
+	if _, err := ioutil.ReadAll(req.Body); err != nil {
+		return err
+	}
+	close(m.started)
+
+	select {
+	case <-ctx.Done():
+		m.errc <- ctx.Err()
+	case <-time.After(5 * time.Second):
+		m.errc <- nil
+	}
+
+	return nil
+}
+
+func TestIntegrationContextCancelledOnClientClose(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		name string
+		body io.Reader
+	}{
+		{name: "no body"},
+		{name: "body", body: strings.NewReader("request body")},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "[::]:0")
+			if err != nil {
+				t.Fatalf("net.Listen(): got %v, want no error", err)
+			}
+
+			p := NewProxy()
+			defer p.Close()
+
+			p.SetRoundTripper(martiantest.NewTransport())
+			p.SetTimeout(10 * time.Second)
+
+			cm := newContextModifier()
+			p.SetRequestModifier(cm)
+
+			go p.Serve(l)
+
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatalf("net.Dial(): got %v, want no error", err)
+			}
+			defer conn.Close()
+
+			req, err := http.NewRequest("POST", "http://example.com", tc.body)
+			if err != nil {
+				t.Fatalf("http.NewRequest(): got %v, want no error", err)
+			}
+
+			if err := req.WriteProxy(conn); err != nil {
+				t.Fatalf("req.WriteProxy(): got %v, want no error", err)
+			}
+
+			select {
+			case <-cm.started:
+			case <-time.After(5 * time.Second):
+				t.Fatal("modifier was not called")
+			}
+			conn.Close()
+
+			if got, want := <-cm.errc, context.Canceled; got != want {
+				t.Errorf("ctx.Err(): got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestIntegrationContextCancelledOnClose(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	p.SetRoundTripper(martiantest.NewTransport())
+	p.SetTimeout(10 * time.Second)
+
+	cm := newContextModifier()
+	p.SetRequestModifier(cm)
+
+	go p.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	if err := req.WriteProxy(conn); err != nil {
+		t.Fatalf("req.WriteProxy(): got %v, want no error", err)
+	}
+
+	select {
+	case <-cm.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("modifier was not called")
+	}
+	p.Close()
+
+	if got, want := <-cm.errc, context.Canceled; got != want {
+		t.Errorf("ctx.Err(): got %v, want %v", got, want)
+	}
+}
+
+func TestIntegrationShutdownClosesIdleConnections(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	p.SetRoundTripper(martiantest.NewTransport())
+	p.SetTimeout(10 * time.Second)
+
+	servec := make(chan error, 1)
+	go func() { servec <- p.Serve(l) }()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.WriteProxy(conn); err != nil {
+		t.Fatalf("req.WriteProxy(): got %v, want no error", err)
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	res.Body.Close()
+
+	// The connection is now idle, waiting for the next request.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	n, err := p.Shutdown(ctx)
+	if err != nil {
+		t.Fatalf("p.Shutdown(): got %v, want no error", err)
+	}
+	if got, want := n, 0; got != want {
+		t.Errorf("p.Shutdown(): got %d connections cut off, want %d", got, want)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("br.ReadByte(): got %v, want %v", err, io.EOF)
+	}
+
+	if err := <-servec; err != nil {
+		t.Errorf("p.Serve(): got %v, want no error", err)
+	}
+}
+
+func TestIntegrationShutdownCutsOffTunnel(t *testing.T) {
+	t.Parallel()
+
+	// The target accepts connections and never responds.
+	tl, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+	defer tl.Close()
+
+	go func() {
+		for {
+			conn, err := tl.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	p.SetTimeout(10 * time.Second)
+
+	go p.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	req, err := http.NewRequest("CONNECT", "//"+tl.Addr().String(), nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("req.Write(): got %v, want no error", err)
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	if got, want := res.StatusCode, 200; got != want {
+		t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	n, err := p.Shutdown(ctx)
+	if got, want := err, context.DeadlineExceeded; got != want {
+		t.Errorf("p.Shutdown(): got %v, want %v", got, want)
+	}
+	if got, want := n, 1; got != want {
+		t.Errorf("p.Shutdown(): got %d connections cut off, want %d", got, want)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("br.ReadByte(): got %v, want %v", err, io.EOF)
+	}
+}
+
+func TestIntegrationShutdownCancelsHangingRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	p.SetTimeout(10 * time.Second)
+
+	started := make(chan struct{})
+	errc := make(chan error, 1)
+	tr := martiantest.NewTransport()
+	tr.Func(func(req *http.Request) (*http.Response, error) {
+		close(started)
+		<-req.Context().Done()
+		errc <- req.Context().Err()
+
+		return nil, req.Context().Err()
+	})
+	p.SetRoundTripper(tr)
+
+	go p.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.WriteProxy(conn); err != nil {
+		t.Fatalf("req.WriteProxy(): got %v, want no error", err)
+	}
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	n, err := p.Shutdown(ctx)
+	if got, want := err, context.DeadlineExceeded; got != want {
+		t.Errorf("p.Shutdown(): got %v, want %v", got, want)
+	}
+	if got, want := n, 1; got != want {
+		t.Errorf("p.Shutdown(): got %d connections cut off, want %d", got, want)
+	}
+
+	select {
+	case err := <-errc:
+		if got, want := err, context.Canceled; got != want {
+			t.Errorf("req.Context().Err(): got %v, want %v", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("round trip was not cancelled")
+	}
+}
+
+func TestIntegrationIdleTimeout(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	p.SetRoundTripper(martiantest.NewTransport())
+	p.SetTimeout(10 * time.Second)
+	p.SetIdleTimeout(100 * time.Millisecond)
+
+	go p.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	// The first request is not subject to the idle timeout.
+	time.Sleep(200 * time.Millisecond)
+	if err := req.WriteProxy(conn); err != nil {
+		t.Fatalf("req.WriteProxy(): got %v, want no error", err)
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	res.Body.Close()
+
+	if got, want := res.StatusCode, 200; got != want {
+		t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+	}
+
+	// The idle connection is closed long before the request timeout.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("br.ReadByte(): got %v, want %v", err, io.EOF)
+	}
+}
+
+func TestIntegrationReadHeaderTimeout(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	p.SetRoundTripper(martiantest.NewTransport())
+	p.SetTimeout(10 * time.Second)
+	p.SetReadHeaderTimeout(100 * time.Millisecond)
+
+	go p.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	// A request body that is slower than the read header timeout is read.
+	if _, err := io.WriteString(conn, "POST http://example.com/upload HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\n\r\nab"); err != nil {
+		t.Fatalf("conn.Write(): got %v, want no error", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, err := io.WriteString(conn, "cd"); err != nil {
+		t.Fatalf("conn.Write(): got %v, want no error", err)
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	res.Body.Close()
+
+	if got, want := res.StatusCode, 200; got != want {
+		t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+	}
+
+	// Headers that are not complete in time close the connection.
+	if _, err := io.WriteString(conn, "GET http://example.com/ HTTP/1.1\r\nHost: exa"); err != nil {
+		t.Fatalf("conn.Write(): got %v, want no error", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("br.ReadByte(): got %v, want %v", err, io.EOF)
+	}
+}
+
+func TestSetResponseHeaderTimeout(t *testing.T) {
+	p := NewProxy()
+	defer p.Close()
+
+	p.SetResponseHeaderTimeout(time.Second)
+
+	tr, ok := p.GetRoundTripper().(*http.Transport)
+	if !ok {
+		t.Fatalf("p.GetRoundTripper(): got %T, want *http.Transport", p.GetRoundTripper())
+	}
+	if got, want := tr.ResponseHeaderTimeout, time.Second; got != want {
+		t.Errorf("tr.ResponseHeaderTimeout: got %v, want %v", got, want)
+	}
+
+	// The timeout is applied to transports set afterwards.
+	tr = &http.Transport{}
+	p.SetRoundTripper(tr)
+	if got, want := tr.ResponseHeaderTimeout, time.Second; got != want {
+		t.Errorf("tr.ResponseHeaderTimeout: got %v, want %v", got, want)
+	}
+}
+
+func TestIntegrationMetrics(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	m := metrics.New()
+	p.SetMetrics(m)
+
+	tr := martiantest.NewTransport()
+	tr.Func(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Host == "fail.example.com" {
+			return nil, errors.New("connection refused")
+		}
+		return proxyutil.NewResponse(200, nil, req), nil
+	})
+	p.SetRoundTripper(tr)
+	p.SetTimeout(200 * time.Millisecond)
+
+	tm := martiantest.NewModifier()
+	tm.RequestError(errors.New("request modifier error"))
+	p.SetRequestModifier(tm)
+
+	go p.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	for _, tc := range []struct {
+		url  string
+		want int
+	}{
+		{"http://example.com", 200},
+		{"http://fail.example.com", 502},
+	} {
+		req, err := http.NewRequest("GET", tc.url, nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest(): got %v, want no error", err)
+		}
+		if err := req.WriteProxy(conn); err != nil {
+			t.Fatalf("req.WriteProxy(): got %v, want no error", err)
+		}
+
+		res, err := http.ReadResponse(br, req)
+		if err != nil {
+			t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+		}
+		res.Body.Close()
+
+		if got := res.StatusCode; got != tc.want {
+			t.Fatalf("%s: res.StatusCode: got %d, want %d", tc.url, got, tc.want)
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := m.WriteText(buf); err != nil {
+		t.Fatalf("m.WriteText(): got %v, want no error", err)
+	}
+	got := buf.String()
+
+	for _, want := range []string{
+		"martian_connections_accepted_total 1\n",
+		"martian_sessions_active 1\n",
+		"martian_round_trip_duration_seconds_count{host=\"example.com\"} 1\n",
+		"martian_upstream_errors_total{host=\"fail.example.com\"} 1\n",
+		"martian_modifier_errors_total{phase=\"request\"} 2\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("m.WriteText(): got\n%s\nwant to contain %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/google/martian/v3/proxyproto"
+)
+
+// SetUpstreamProxyProtocol sets the version of the PROXY protocol header, 1 or
+// 2, that is sent at the start of the connections that the proxy makes for
+// CONNECT tunnels, to the target or to the downstream proxy. The header
+// carries the addresses of the client connection. Zero, the default, sends no
+// header.
+//
+// Requests sent through the round tripper are not preceded by a header, since
+// their connections may be shared between clients.
+func (p *Proxy) SetUpstreamProxyProtocol(version int) {
+	p.proxyProto = version
+}
+
+// writeProxyHeader writes the PROXY protocol header for the client connection
+// of req to conn, if enabled. The addresses are sent as unknown when req is
+// not linked to a session.
+func (p *Proxy) writeProxyHeader(conn net.Conn, req *http.Request) error {
+	if p.proxyProto == 0 {
+		return nil
+	}
+
+	hdr := &proxyproto.Header{Version: p.proxyProto}
+	if ctx := NewContext(req); ctx != nil {
+		s := ctx.Session()
+		s.mu.RLock()
+		cconn := s.conn
+		s.mu.RUnlock()
+
+		if cconn != nil {
+			hdr.Source = cconn.RemoteAddr()
+			hdr.Destination = cconn.LocalAddr()
+		}
+	}
+
+	_, err := hdr.WriteTo(conn)
+	return err
+}
@@ -0,0 +1,264 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxyproto
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/martian/v3/log"
+)
+
+// DefaultReadHeaderTimeout is the default time allowed to read the header of
+// a connection.
+const DefaultReadHeaderTimeout = 10 * time.Second
+
+// Listener wraps a net.Listener and reads the PROXY protocol header that each
+// accepted connection starts with, so that the RemoteAddr and LocalAddr of
+// the connection are those of the client connection to the load balancer.
+//
+// Only connections from trusted sources are expected to have a header, since
+// any client that can reach the listener could otherwise claim to be any
+// address. By default all sources are trusted; see SetTrustedSources.
+//
+// To compose with a trafficshape.Listener, wrap the Listener in the
+// trafficshape.Listener rather than the other way around, so that the
+// connections served by the proxy are traffic shaped connections.
+type Listener struct {
+	net.Listener
+
+	mu       sync.RWMutex
+	timeout  time.Duration
+	optional bool
+	trusted  []*net.IPNet
+}
+
+// NewListener returns a listener that reads PROXY protocol headers from the
+// connections accepted by l.
+func NewListener(l net.Listener) *Listener {
+	return &Listener{
+		Listener: l,
+		timeout:  DefaultReadHeaderTimeout,
+	}
+}
+
+// SetReadHeaderTimeout sets the time allowed to read the header of each
+// connection. Zero means no timeout beyond the read deadline set on the
+// connection.
+func (l *Listener) SetReadHeaderTimeout(timeout time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.timeout = timeout
+}
+
+// SetOptional sets whether connections may omit the header, in which case
+// their addresses are left unchanged. By default connections without a header
+// fail with ErrNoHeader when read from.
+func (l *Listener) SetOptional(optional bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.optional = optional
+}
+
+// SetTrustedSources sets the networks of the load balancers that connections
+// with a header are accepted from. The header of connections from other
+// sources is not read, so their addresses are left unchanged and a header they
+// send is read as data. Nil, the default, trusts all sources.
+func (l *Listener) SetTrustedSources(nets []*net.IPNet) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.trusted = nets
+}
+
+// Accept waits for and returns the next connection to the listener. The
+// header of the connection is read on its first use, so that slow clients do
+// not hold up Accept.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return &Conn{
+		Conn:      conn,
+		br:        bufio.NewReader(conn),
+		timeout:   l.timeout,
+		optional:  l.optional,
+		untrusted: !l.trusts(conn.RemoteAddr()),
+	}, nil
+}
+
+// trusts returns whether connections from addr may have a header. l.mu must
+// be held.
+func (l *Listener) trusts(addr net.Addr) bool {
+	if l.trusted == nil {
+		return true
+	}
+
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.IPAddr:
+		ip = addr.IP
+	}
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range l.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Conn is a connection that starts with a PROXY protocol header. The header
+// is read on the first call to Read, RemoteAddr, LocalAddr or Header, unless
+// the connection is not from a trusted source.
+type Conn struct {
+	net.Conn
+
+	br        *bufio.Reader
+	timeout   time.Duration
+	optional  bool
+	untrusted bool
+
+	once sync.Once
+	hdr  *Header
+	err  error
+
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+// Header returns the PROXY protocol header of the connection, reading it if
+// needed. The header is nil if it was optional and omitted, or if the
+// connection is not from a trusted source.
+func (c *Conn) Header() (*Header, error) {
+	c.once.Do(c.readHeader)
+
+	return c.hdr, c.err
+}
+
+func (c *Conn) readHeader() {
+	if c.untrusted {
+		return
+	}
+
+	c.mu.Lock()
+	deadline := c.readDeadline
+	c.mu.Unlock()
+
+	if c.timeout > 0 {
+		d := time.Now().Add(c.timeout)
+		if deadline.IsZero() || d.Before(deadline) {
+			c.Conn.SetReadDeadline(d)
+		}
+		defer func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+
+			c.Conn.SetReadDeadline(c.readDeadline)
+		}()
+	}
+
+	c.hdr, c.err = ReadHeader(c.br)
+	if c.err == ErrNoHeader && c.optional {
+		c.err = nil
+	}
+	if c.err != nil {
+		log.Errorf("proxyproto: failed to read header from %s: %v", c.Conn.RemoteAddr(), c.err)
+	}
+}
+
+// Read reads data from the connection after the header.
+func (c *Conn) Read(b []byte) (int, error) {
+	if _, err := c.Header(); err != nil {
+		return 0, err
+	}
+
+	return c.br.Read(b)
+}
+
+// RemoteAddr returns the source address of the header, or the remote address
+// of the connection if the header does not have one.
+func (c *Conn) RemoteAddr() net.Addr {
+	if hdr, _ := c.Header(); hdr != nil && hdr.Source != nil {
+		return hdr.Source
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address of the header, or the local
+// address of the connection if the header does not have one.
+func (c *Conn) LocalAddr() net.Addr {
+	if hdr, _ := c.Header(); hdr != nil && hdr.Destination != nil {
+		return hdr.Destination
+	}
+
+	return c.Conn.LocalAddr()
+}
+
+// SetDeadline sets the read and write deadlines of the connection.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the connection.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetKeepAlive enables TCP keep-alives on the connection if it is a TCP
+// connection.
+func (c *Conn) SetKeepAlive(keepalive bool) error {
+	if tconn, ok := c.Conn.(*net.TCPConn); ok {
+		return tconn.SetKeepAlive(keepalive)
+	}
+
+	return nil
+}
+
+// SetKeepAlivePeriod sets the period between TCP keep-alives on the connection
+// if it is a TCP connection.
+func (c *Conn) SetKeepAlivePeriod(d time.Duration) error {
+	if tconn, ok := c.Conn.(*net.TCPConn); ok {
+		return tconn.SetKeepAlivePeriod(d)
+	}
+
+	return nil
+}
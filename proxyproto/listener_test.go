@@ -0,0 +1,193 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxyproto
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// acceptOne dials the listener, writes data and closes the connection, and
+// returns the accepted connection.
+func acceptOne(t *testing.T, l net.Listener, data string) net.Conn {
+	t.Helper()
+
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.Write([]byte(data))
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("l.Accept(): got %v, want no error", err)
+	}
+
+	return conn
+}
+
+func TestListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+	l := NewListener(ln)
+	defer l.Close()
+
+	conn := acceptOne(t, l, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nhello")
+	defer conn.Close()
+
+	if got, want := conn.RemoteAddr().String(), "192.0.2.1:56324"; got != want {
+		t.Errorf("conn.RemoteAddr(): got %q, want %q", got, want)
+	}
+	if got, want := conn.LocalAddr().String(), "198.51.100.1:443"; got != want {
+		t.Errorf("conn.LocalAddr(): got %q, want %q", got, want)
+	}
+
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	if got, want := string(b), "hello"; got != want {
+		t.Errorf("conn.Read(): got %q, want %q", got, want)
+	}
+}
+
+func TestListenerNoHeader(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+	l := NewListener(ln)
+	defer l.Close()
+
+	conn := acceptOne(t, l, "hello")
+	defer conn.Close()
+
+	if _, err := conn.Read(make([]byte, 5)); err != ErrNoHeader {
+		t.Errorf("conn.Read(): got %v, want %v", err, ErrNoHeader)
+	}
+
+	l.SetOptional(true)
+
+	conn = acceptOne(t, l, "hello")
+	defer conn.Close()
+
+	if got, want := conn.RemoteAddr().(*net.TCPAddr).IP.String(), "127.0.0.1"; got != want {
+		t.Errorf("conn.RemoteAddr(): got %q, want %q", got, want)
+	}
+
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	if got, want := string(b), "hello"; got != want {
+		t.Errorf("conn.Read(): got %q, want %q", got, want)
+	}
+}
+
+func TestListenerReadHeaderTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+	l := NewListener(ln)
+	defer l.Close()
+
+	l.SetReadHeaderTimeout(50 * time.Millisecond)
+
+	donec := make(chan bool)
+	defer close(donec)
+
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.Write([]byte("PROXY TCP4"))
+		<-donec
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("l.Accept(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	// The read deadline set on the connection is restored after the header
+	// times out.
+	deadline := time.Now().Add(time.Hour)
+	conn.SetReadDeadline(deadline)
+
+	_, err = conn.Read(make([]byte, 1))
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatalf("conn.Read(): got %v, want timeout", err)
+	}
+	if got, want := conn.(*Conn).readDeadline, deadline; !got.Equal(want) {
+		t.Errorf("conn.readDeadline: got %v, want %v", got, want)
+	}
+}
+
+func TestListenerTrustedSources(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+	l := NewListener(ln)
+	defer l.Close()
+
+	_, lb, err := net.ParseCIDR("192.0.2.0/24")
+	if err != nil {
+		t.Fatalf("net.ParseCIDR(): got %v, want no error", err)
+	}
+	l.SetTrustedSources([]*net.IPNet{lb})
+
+	// The header of a connection from an untrusted source is read as data.
+	data := "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nhello"
+	conn := acceptOne(t, l, data)
+	defer conn.Close()
+
+	if got, want := conn.RemoteAddr().(*net.TCPAddr).IP.String(), "127.0.0.1"; got != want {
+		t.Errorf("conn.RemoteAddr(): got %q, want %q", got, want)
+	}
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	if got, want := string(b), data; got != want {
+		t.Errorf("conn.Read(): got %q, want %q", got, want)
+	}
+
+	_, local, err := net.ParseCIDR("127.0.0.0/8")
+	if err != nil {
+		t.Fatalf("net.ParseCIDR(): got %v, want no error", err)
+	}
+	l.SetTrustedSources([]*net.IPNet{lb, local})
+
+	conn = acceptOne(t, l, data)
+	defer conn.Close()
+
+	if got, want := conn.RemoteAddr().String(), "192.0.2.1:56324"; got != want {
+		t.Errorf("conn.RemoteAddr(): got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,353 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package proxyproto implements version 1 and 2 of the PROXY protocol, which
+// load balancers use to pass the addresses of the client connection on to the
+// server.
+//
+// https://www.haproxy.org/download/2.4/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ErrNoHeader is returned when a connection does not start with a PROXY
+// protocol header.
+var ErrNoHeader = errors.New("proxyproto: no PROXY protocol header")
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	// v1MaxLen is the maximum length of a version 1 header, including CRLF.
+	v1MaxLen = 107
+
+	v2CmdLocal = 0x00
+	v2CmdProxy = 0x01
+
+	v2FamUnspec = 0x00
+	v2FamInet   = 0x10
+	v2FamInet6  = 0x20
+	v2FamUnix   = 0x30
+
+	v2ProtoUnspec = 0x00
+	v2ProtoStream = 0x01
+	v2ProtoDgram  = 0x02
+
+	v2AddrLenInet  = 12
+	v2AddrLenInet6 = 36
+	v2AddrLenUnix  = 216
+)
+
+// Header is a PROXY protocol header.
+type Header struct {
+	// Version is the version of the PROXY protocol, 1 or 2.
+	Version int
+	// Local is set for version 2 headers of connections that the load balancer
+	// made on its own behalf, such as health checks. The addresses of these
+	// connections are those of the connection itself.
+	Local bool
+	// Source is the address of the client, or nil when it is unknown.
+	Source net.Addr
+	// Destination is the address that the client connected to, or nil when it
+	// is unknown.
+	Destination net.Addr
+}
+
+// ReadHeader reads a version 1 or 2 header from r. It returns ErrNoHeader
+// without consuming any input if r does not start with a header.
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	ok, err := hasPrefix(r, v2Signature)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return readV2(r)
+	}
+
+	ok, err = hasPrefix(r, v1Prefix)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return readV1(r)
+	}
+
+	return nil, ErrNoHeader
+}
+
+// hasPrefix returns whether the input of r starts with prefix, reading only as
+// much as is needed to tell.
+func hasPrefix(r *bufio.Reader, prefix []byte) (bool, error) {
+	for i := 1; i <= len(prefix); i++ {
+		b, err := r.Peek(i)
+		if err != nil {
+			if err == io.EOF && i > 1 {
+				return false, io.ErrUnexpectedEOF
+			}
+			return false, err
+		}
+		if !bytes.Equal(b, prefix[:i]) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == v1MaxLen {
+			return nil, fmt.Errorf("proxyproto: header longer than %d bytes", v1MaxLen)
+		}
+
+		b, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Split(string(line[len(v1Prefix):len(line)-2]), " ")
+
+	hdr := &Header{Version: 1}
+	switch fields[0] {
+	case "UNKNOWN":
+		return hdr, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("proxyproto: unsupported protocol %q", fields[0])
+	}
+
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("proxyproto: malformed header %q", line)
+	}
+
+	src, err := parseV1Addr(fields[0], fields[1], fields[3])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseV1Addr(fields[0], fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	hdr.Source = src
+	hdr.Destination = dst
+
+	return hdr, nil
+}
+
+func parseV1Addr(proto, host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || strings.Contains(host, ":") != (proto == "TCP6") {
+		return nil, fmt.Errorf("proxyproto: invalid %s address %q", proto, host)
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return nil, fmt.Errorf("proxyproto: invalid port %q", port)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	var b [16]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	if v := b[12] >> 4; v != 2 {
+		return nil, fmt.Errorf("proxyproto: unsupported version %d", v)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(b[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	hdr := &Header{Version: 2}
+	switch b[12] & 0x0f {
+	case v2CmdLocal:
+		hdr.Local = true
+		return hdr, nil
+	case v2CmdProxy:
+	default:
+		return nil, fmt.Errorf("proxyproto: unsupported command %#x", b[12]&0x0f)
+	}
+
+	fam, proto := b[13]&0xf0, b[13]&0x0f
+	if fam == v2FamUnspec || (proto != v2ProtoStream && proto != v2ProtoDgram) {
+		// The addresses are unknown and the rest of the header is ignored.
+		return hdr, nil
+	}
+
+	var n int
+	switch fam {
+	case v2FamInet:
+		n = v2AddrLenInet
+	case v2FamInet6:
+		n = v2AddrLenInet6
+	case v2FamUnix:
+		n = v2AddrLenUnix
+	default:
+		return nil, fmt.Errorf("proxyproto: unsupported address family %#x", fam)
+	}
+	if len(payload) < n {
+		return nil, fmt.Errorf("proxyproto: address block of %d bytes too short for family %#x", len(payload), fam)
+	}
+
+	// Any TLVs after the addresses are ignored.
+	switch fam {
+	case v2FamInet, v2FamInet6:
+		l := (n - 4) / 2
+		src := net.IP(append([]byte(nil), payload[:l]...))
+		dst := net.IP(append([]byte(nil), payload[l:2*l]...))
+		sport := int(binary.BigEndian.Uint16(payload[2*l:]))
+		dport := int(binary.BigEndian.Uint16(payload[2*l+2:]))
+
+		if proto == v2ProtoStream {
+			hdr.Source = &net.TCPAddr{IP: src, Port: sport}
+			hdr.Destination = &net.TCPAddr{IP: dst, Port: dport}
+		} else {
+			hdr.Source = &net.UDPAddr{IP: src, Port: sport}
+			hdr.Destination = &net.UDPAddr{IP: dst, Port: dport}
+		}
+	case v2FamUnix:
+		network := "unix"
+		if proto == v2ProtoDgram {
+			network = "unixgram"
+		}
+		hdr.Source = &net.UnixAddr{Name: unixPath(payload[:108]), Net: network}
+		hdr.Destination = &net.UnixAddr{Name: unixPath(payload[108:216]), Net: network}
+	}
+
+	return hdr, nil
+}
+
+// unixPath returns the NUL-terminated path in b.
+func unixPath(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+
+	return string(b)
+}
+
+// WriteTo writes the header to w. Addresses that can not be represented in the
+// version of the header are sent as unknown.
+func (h *Header) WriteTo(w io.Writer) (int64, error) {
+	var b []byte
+	switch h.Version {
+	case 1:
+		b = h.formatV1()
+	case 2:
+		b = h.formatV2()
+	default:
+		return 0, fmt.Errorf("proxyproto: unsupported version %d", h.Version)
+	}
+
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+func (h *Header) formatV1() []byte {
+	src, sok := h.Source.(*net.TCPAddr)
+	dst, dok := h.Destination.(*net.TCPAddr)
+	if !sok || !dok || (src.IP.To4() == nil) != (dst.IP.To4() == nil) {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	proto := "TCP6"
+	if src.IP.To4() != nil {
+		proto = "TCP4"
+	}
+
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, src.IP, dst.IP, src.Port, dst.Port))
+}
+
+func (h *Header) formatV2() []byte {
+	b := append([]byte(nil), v2Signature...)
+
+	if h.Local {
+		return append(b, 0x20|v2CmdLocal, v2FamUnspec|v2ProtoUnspec, 0, 0)
+	}
+	b = append(b, 0x20|v2CmdProxy)
+
+	var addrs []byte
+	famProto := byte(v2FamUnspec | v2ProtoUnspec)
+	switch src := h.Source.(type) {
+	case *net.TCPAddr:
+		if dst, ok := h.Destination.(*net.TCPAddr); ok {
+			famProto, addrs = v2IPAddrs(src.IP, dst.IP, src.Port, dst.Port, v2ProtoStream)
+		}
+	case *net.UDPAddr:
+		if dst, ok := h.Destination.(*net.UDPAddr); ok {
+			famProto, addrs = v2IPAddrs(src.IP, dst.IP, src.Port, dst.Port, v2ProtoDgram)
+		}
+	case *net.UnixAddr:
+		if dst, ok := h.Destination.(*net.UnixAddr); ok && len(src.Name) <= 108 && len(dst.Name) <= 108 {
+			famProto = v2FamUnix | v2ProtoStream
+			if src.Net == "unixgram" {
+				famProto = v2FamUnix | v2ProtoDgram
+			}
+			addrs = make([]byte, v2AddrLenUnix)
+			copy(addrs, src.Name)
+			copy(addrs[108:], dst.Name)
+		}
+	}
+
+	b = append(b, famProto, byte(len(addrs)>>8), byte(len(addrs)))
+	return append(b, addrs...)
+}
+
+// v2IPAddrs returns the family and protocol byte and the address block of a
+// version 2 header for the IP addresses.
+func v2IPAddrs(src, dst net.IP, sport, dport int, proto byte) (byte, []byte) {
+	fam := byte(v2FamInet6)
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		fam, src, dst = v2FamInet, src4, dst4
+	} else {
+		src, dst = src.To16(), dst.To16()
+	}
+	if src == nil || dst == nil {
+		return v2FamUnspec | v2ProtoUnspec, nil
+	}
+
+	addrs := append(append([]byte(nil), src...), dst...)
+	addrs = append(addrs, byte(sport>>8), byte(sport), byte(dport>>8), byte(dport))
+
+	return fam | proto, addrs
+}
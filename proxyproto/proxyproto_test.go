@@ -0,0 +1,270 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadHeaderV1(t *testing.T) {
+	tt := []struct {
+		input   string
+		want    *Header
+		wantErr bool
+	}{
+		{
+			input: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET /",
+			want: &Header{
+				Version:     1,
+				Source:      &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324},
+				Destination: &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443},
+			},
+		},
+		{
+			input: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\nGET /",
+			want: &Header{
+				Version:     1,
+				Source:      &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+				Destination: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+			},
+		},
+		{
+			input: "PROXY UNKNOWN ffff::1 ffff::2 1 2\r\nGET /",
+			want:  &Header{Version: 1},
+		},
+		{input: "PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n", wantErr: true},
+		{input: "PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", wantErr: true},
+		{input: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 70000\r\n", wantErr: true},
+		{input: "PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n", wantErr: true},
+		{input: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443", wantErr: true},
+		{input: "PROXY " + strings.Repeat("A", 200) + "\r\n", wantErr: true},
+	}
+
+	for i, tc := range tt {
+		br := bufio.NewReader(strings.NewReader(tc.input))
+
+		got, err := ReadHeader(br)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%d. ReadHeader(%q): got no error, want error", i, tc.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d. ReadHeader(%q): got %v, want no error", i, tc.input, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%d. ReadHeader(%q): got %+v, want %+v", i, tc.input, got, tc.want)
+		}
+
+		rest, _ := ioutil.ReadAll(br)
+		if got, want := string(rest), "GET /"; got != want {
+			t.Errorf("%d. rest: got %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestReadHeaderV2(t *testing.T) {
+	sig := string(v2Signature)
+
+	tt := []struct {
+		input   string
+		want    *Header
+		wantErr bool
+	}{
+		{
+			// TCP over IPv4 with a TLV after the addresses.
+			input: sig + "\x21\x11\x00\x0f" +
+				"\xc0\x00\x02\x01" + "\xc6\x33\x64\x01" + "\xdc\x04" + "\x01\xbb" +
+				"\x04\x00\x00" + "GET /",
+			want: &Header{
+				Version:     2,
+				Source:      &net.TCPAddr{IP: net.IP{192, 0, 2, 1}, Port: 56324},
+				Destination: &net.TCPAddr{IP: net.IP{198, 51, 100, 1}, Port: 443},
+			},
+		},
+		{
+			// UDP over IPv6.
+			input: sig + "\x21\x22\x00\x24" +
+				"\x20\x01\x0d\xb8" + strings.Repeat("\x00", 11) + "\x01" +
+				"\x20\x01\x0d\xb8" + strings.Repeat("\x00", 11) + "\x02" +
+				"\xdc\x04" + "\x00\x35" + "GET /",
+			want: &Header{
+				Version:     2,
+				Source:      &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+				Destination: &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 53},
+			},
+		},
+		{
+			input: sig + "\x20\x00\x00\x00" + "GET /",
+			want:  &Header{Version: 2, Local: true},
+		},
+		{
+			input: sig + "\x21\x00\x00\x02\x00\x00" + "GET /",
+			want:  &Header{Version: 2},
+		},
+		{input: sig + "\x11\x11\x00\x0c", wantErr: true},
+		{input: sig + "\x2f\x11\x00\x00", wantErr: true},
+		{input: sig + "\x21\x11\x00\x04\xc0\x00\x02\x01", wantErr: true},
+		{input: sig + "\x21\x11\x00\x0c\xc0\x00", wantErr: true},
+	}
+
+	for i, tc := range tt {
+		br := bufio.NewReader(strings.NewReader(tc.input))
+
+		got, err := ReadHeader(br)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%d. ReadHeader(): got no error, want error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d. ReadHeader(): got %v, want no error", i, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%d. ReadHeader(): got %+v, want %+v", i, got, tc.want)
+		}
+
+		rest, _ := ioutil.ReadAll(br)
+		if got, want := string(rest), "GET /"; got != want {
+			t.Errorf("%d. rest: got %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestReadHeaderNoHeader(t *testing.T) {
+	for _, input := range []string{"GET / HTTP/1.1\r\n", "PUT / HTTP/1.1\r\n", "\r\n\r\nhello"} {
+		br := bufio.NewReader(strings.NewReader(input))
+
+		if _, err := ReadHeader(br); err != ErrNoHeader {
+			t.Errorf("ReadHeader(%q): got %v, want %v", input, err, ErrNoHeader)
+		}
+
+		rest, _ := ioutil.ReadAll(br)
+		if got, want := string(rest), input; got != want {
+			t.Errorf("rest: got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestHeaderWriteTo(t *testing.T) {
+	tt := []struct {
+		hdr  *Header
+		want *Header
+	}{
+		{
+			hdr: &Header{
+				Version:     1,
+				Source:      &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324},
+				Destination: &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443},
+			},
+		},
+		{
+			hdr: &Header{
+				Version:     1,
+				Source:      &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+				Destination: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+			},
+		},
+		{
+			hdr: &Header{
+				Version:     1,
+				Source:      &net.UnixAddr{Name: "/tmp/src", Net: "unix"},
+				Destination: &net.UnixAddr{Name: "/tmp/dst", Net: "unix"},
+			},
+			want: &Header{Version: 1},
+		},
+		{
+			hdr: &Header{
+				Version:     2,
+				Source:      &net.TCPAddr{IP: net.IP{192, 0, 2, 1}, Port: 56324},
+				Destination: &net.TCPAddr{IP: net.IP{198, 51, 100, 1}, Port: 443},
+			},
+		},
+		{
+			hdr: &Header{
+				Version:     2,
+				Source:      &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+				Destination: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443},
+			},
+			want: &Header{
+				Version:     2,
+				Source:      &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+				Destination: &net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 443},
+			},
+		},
+		{
+			hdr: &Header{
+				Version:     2,
+				Source:      &net.UnixAddr{Name: "/tmp/src", Net: "unix"},
+				Destination: &net.UnixAddr{Name: "/tmp/dst", Net: "unix"},
+			},
+		},
+		{
+			hdr: &Header{Version: 2, Local: true},
+		},
+		{
+			hdr: &Header{Version: 2},
+		},
+	}
+
+	for i, tc := range tt {
+		want := tc.want
+		if want == nil {
+			want = tc.hdr
+		}
+
+		buf := &bytes.Buffer{}
+		if _, err := tc.hdr.WriteTo(buf); err != nil {
+			t.Fatalf("%d. hdr.WriteTo(): got %v, want no error", i, err)
+		}
+
+		got, err := ReadHeader(bufio.NewReader(buf))
+		if err != nil {
+			t.Fatalf("%d. ReadHeader(): got %v, want no error", i, err)
+		}
+		if got, want := got.Version, want.Version; got != want {
+			t.Errorf("%d. hdr.Version: got %d, want %d", i, got, want)
+		}
+		if got, want := got.Local, want.Local; got != want {
+			t.Errorf("%d. hdr.Local: got %t, want %t", i, got, want)
+		}
+		if got, want := addrString(got.Source), addrString(want.Source); got != want {
+			t.Errorf("%d. hdr.Source: got %q, want %q", i, got, want)
+		}
+		if got, want := addrString(got.Destination), addrString(want.Destination); got != want {
+			t.Errorf("%d. hdr.Destination: got %q, want %q", i, got, want)
+		}
+	}
+
+	if _, err := (&Header{Version: 3}).WriteTo(ioutil.Discard); err == nil {
+		t.Error("hdr.WriteTo(): got no error, want error for version 3")
+	}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+
+	return addr.Network() + " " + addr.String()
+}
@@ -0,0 +1,137 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/martian/v3/martiantest"
+	"github.com/google/martian/v3/proxyproto"
+	"github.com/google/martian/v3/proxyutil"
+	"github.com/google/martian/v3/trafficshape"
+)
+
+func TestIntegrationProxyProtocol(t *testing.T) {
+	t.Parallel()
+
+	// The upstream reads the header of the tunnel connection and closes it.
+	ul, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+	defer ul.Close()
+
+	hdrc := make(chan *proxyproto.Header, 1)
+	go func() {
+		conn, err := ul.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		hdr, err := proxyproto.ReadHeader(bufio.NewReader(conn))
+		if err != nil {
+			t.Errorf("proxyproto.ReadHeader(): got %v, want no error", err)
+		}
+		hdrc <- hdr
+	}()
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	p.SetTimeout(500 * time.Millisecond)
+	p.SetUpstreamProxyProtocol(2)
+
+	var remoteAddr string
+	tr := martiantest.NewTransport()
+	tr.Func(func(req *http.Request) (*http.Response, error) {
+		remoteAddr = req.RemoteAddr
+		return proxyutil.NewResponse(200, nil, req), nil
+	})
+	p.SetRoundTripper(tr)
+
+	go p.Serve(trafficshape.NewListener(proxyproto.NewListener(l)))
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 8080\r\n")); err != nil {
+		t.Fatalf("conn.Write(): got %v, want no error", err)
+	}
+
+	br := bufio.NewReader(conn)
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.WriteProxy(conn); err != nil {
+		t.Fatalf("req.WriteProxy(): got %v, want no error", err)
+	}
+
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	res.Body.Close()
+
+	if got, want := remoteAddr, "192.0.2.1:56324"; got != want {
+		t.Errorf("req.RemoteAddr: got %q, want %q", got, want)
+	}
+
+	req, err = http.NewRequest("CONNECT", "//"+ul.Addr().String(), nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("req.Write(): got %v, want no error", err)
+	}
+
+	res, err = http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+
+	if got, want := res.StatusCode, 200; got != want {
+		t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+	}
+
+	select {
+	case hdr := <-hdrc:
+		if got, want := hdr.Version, 2; got != want {
+			t.Errorf("hdr.Version: got %d, want %d", got, want)
+		}
+		if got, want := hdr.Source.String(), "192.0.2.1:56324"; got != want {
+			t.Errorf("hdr.Source: got %q, want %q", got, want)
+		}
+		if got, want := hdr.Destination.String(), "198.51.100.1:8080"; got != want {
+			t.Errorf("hdr.Destination: got %q, want %q", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("upstream did not receive a PROXY protocol header")
+	}
+}
@@ -75,6 +75,21 @@ func Warning(header http.Header, err error) {
 	header.Add("Warning", w)
 }
 
+// UpgradeType returns the protocol in the Upgrade header if the Connection
+// header contains the "upgrade" token, or the empty string if the message is
+// not a protocol upgrade.
+func UpgradeType(header http.Header) string {
+	for _, vs := range header["Connection"] {
+		for _, v := range strings.Split(vs, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), "upgrade") {
+				return header.Get("Upgrade")
+			}
+		}
+	}
+
+	return ""
+}
+
 // GetRangeStart returns the byte index of the start of the range, if it has one.
 // Returns 0 if the range header is absent, and -1 if the range header is invalid or
 // has multi-part ranges.
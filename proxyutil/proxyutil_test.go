@@ -86,3 +86,21 @@ func TestWarning(t *testing.T) {
 		t.Errorf("hdr[%q][1]: got %q, want %q", "Warning", got, want)
 	}
 }
+
+func TestUpgradeType(t *testing.T) {
+	tt := []struct {
+		header http.Header
+		want   string
+	}{
+		{http.Header{}, ""},
+		{http.Header{"Upgrade": {"websocket"}}, ""},
+		{http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}}, "websocket"},
+		{http.Header{"Connection": {"keep-alive, upgrade"}, "Upgrade": {"h2c"}}, "h2c"},
+	}
+
+	for i, tc := range tt {
+		if got := UpgradeType(tc.header); got != tc.want {
+			t.Errorf("%d. UpgradeType(%v): got %q, want %q", i, tc.header, got, tc.want)
+		}
+	}
+}
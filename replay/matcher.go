@@ -0,0 +1,171 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replay
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"net/http"
+	"net/url"
+)
+
+// Matcher decides which archived requests a request matches. By default the
+// method, host, path and query must be equal, and bodies are not compared.
+type Matcher struct {
+	method       bool
+	host         bool
+	path         bool
+	query        bool
+	body         bool
+	ignoreParams map[string]bool
+}
+
+// NewMatcher returns a matcher that compares the method, host, path and
+// query of requests.
+func NewMatcher() *Matcher {
+	return &Matcher{
+		method:       true,
+		host:         true,
+		path:         true,
+		query:        true,
+		ignoreParams: make(map[string]bool),
+	}
+}
+
+// SetMatchMethod sets whether the methods of requests must be equal.
+func (m *Matcher) SetMatchMethod(match bool) {
+	m.method = match
+}
+
+// SetMatchHost sets whether the hosts of requests must be equal.
+func (m *Matcher) SetMatchHost(match bool) {
+	m.host = match
+}
+
+// SetMatchPath sets whether the paths of requests must be equal.
+func (m *Matcher) SetMatchPath(match bool) {
+	m.path = match
+}
+
+// SetMatchQuery sets whether the query parameters of requests, other than
+// those ignored, must be equal.
+func (m *Matcher) SetMatchQuery(match bool) {
+	m.query = match
+}
+
+// SetMatchBody sets whether the SHA-256 hashes of the bodies of requests must
+// be equal.
+func (m *Matcher) SetMatchBody(match bool) {
+	m.body = match
+}
+
+// IgnoreQueryParams excludes the query parameters with the names from the
+// comparison of queries, such as cache busters and timestamps.
+func (m *Matcher) IgnoreQueryParams(names ...string) {
+	for _, name := range names {
+		m.ignoreParams[name] = true
+	}
+}
+
+// request is a request being matched.
+type request struct {
+	method string
+	url    *url.URL
+	query  url.Values
+	body   [sha256.Size]byte
+}
+
+// newRequest returns the request to match for an archived or live request.
+func newRequest(method string, u *url.URL, body []byte) *request {
+	return &request{
+		method: method,
+		url:    u,
+		query:  u.Query(),
+		body:   sha256.Sum256(body),
+	}
+}
+
+// matches returns whether the live request r matches the archived request a,
+// and a score that ranks the matches of r by how similar they are.
+func (m *Matcher) matches(r, a *request) (bool, int) {
+	if m.method && r.method != a.method {
+		return false, 0
+	}
+	if m.host && r.url.Host != a.url.Host {
+		return false, 0
+	}
+	if m.path && r.url.Path != a.url.Path {
+		return false, 0
+	}
+	if m.body && !bytes.Equal(r.body[:], a.body[:]) {
+		return false, 0
+	}
+
+	var score int
+	for name := range union(r.query, a.query) {
+		equal := equalValues(r.query[name], a.query[name])
+		if m.query && !m.ignoreParams[name] && !equal {
+			return false, 0
+		}
+		if equal {
+			score++
+		}
+	}
+	if r.url.Scheme == a.url.Scheme {
+		score++
+	}
+
+	return true, score
+}
+
+// union returns the names of the parameters in either a or b.
+func union(a, b url.Values) map[string]bool {
+	names := make(map[string]bool)
+	for name := range a {
+		names[name] = true
+	}
+	for name := range b {
+		names[name] = true
+	}
+
+	return names
+}
+
+func equalValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// liveRequest returns the request to match for req, reading its body if the
+// bodies of requests are compared.
+func (m *Matcher) liveRequest(req *http.Request) (*request, error) {
+	var body []byte
+	if m.body {
+		var err error
+		if body, err = readBody(&req.Body); err != nil {
+			return nil, err
+		}
+	}
+
+	return newRequest(req.Method, req.URL, body), nil
+}
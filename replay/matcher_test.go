@@ -0,0 +1,182 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replay
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMatcher(t *testing.T) {
+	archived := newRequest("POST", mustParse(t, "https://example.com/path?a=1&cb=123"), []byte("body"))
+
+	tt := []struct {
+		name      string
+		configure func(m *Matcher)
+		method    string
+		url       string
+		body      string
+		want      bool
+	}{
+		{
+			name:   "equal",
+			method: "POST",
+			url:    "https://example.com/path?a=1&cb=123",
+			want:   true,
+		},
+		{
+			name:   "different method",
+			method: "GET",
+			url:    "https://example.com/path?a=1&cb=123",
+		},
+		{
+			name:      "different method ignored",
+			configure: func(m *Matcher) { m.SetMatchMethod(false) },
+			method:    "GET",
+			url:       "https://example.com/path?a=1&cb=123",
+			want:      true,
+		},
+		{
+			name:   "different host",
+			method: "POST",
+			url:    "https://www.example.com/path?a=1&cb=123",
+		},
+		{
+			name:      "different host ignored",
+			configure: func(m *Matcher) { m.SetMatchHost(false) },
+			method:    "POST",
+			url:       "https://www.example.com/path?a=1&cb=123",
+			want:      true,
+		},
+		{
+			name:   "different path",
+			method: "POST",
+			url:    "https://example.com/other?a=1&cb=123",
+		},
+		{
+			name:      "different path ignored",
+			configure: func(m *Matcher) { m.SetMatchPath(false) },
+			method:    "POST",
+			url:       "https://example.com/other?a=1&cb=123",
+			want:      true,
+		},
+		{
+			name:   "different query param",
+			method: "POST",
+			url:    "https://example.com/path?a=1&cb=456",
+		},
+		{
+			name:      "ignored query param",
+			configure: func(m *Matcher) { m.IgnoreQueryParams("cb") },
+			method:    "POST",
+			url:       "https://example.com/path?a=1&cb=456",
+			want:      true,
+		},
+		{
+			name:      "missing ignored query param",
+			configure: func(m *Matcher) { m.IgnoreQueryParams("cb") },
+			method:    "POST",
+			url:       "https://example.com/path?a=1",
+			want:      true,
+		},
+		{
+			name:      "query ignored",
+			configure: func(m *Matcher) { m.SetMatchQuery(false) },
+			method:    "POST",
+			url:       "https://example.com/path",
+			want:      true,
+		},
+		{
+			name:      "equal body",
+			configure: func(m *Matcher) { m.SetMatchBody(true) },
+			method:    "POST",
+			url:       "https://example.com/path?a=1&cb=123",
+			body:      "body",
+			want:      true,
+		},
+		{
+			name:      "different body",
+			configure: func(m *Matcher) { m.SetMatchBody(true) },
+			method:    "POST",
+			url:       "https://example.com/path?a=1&cb=123",
+			body:      "other",
+		},
+	}
+
+	for _, tc := range tt {
+		m := NewMatcher()
+		if tc.configure != nil {
+			tc.configure(m)
+		}
+
+		live := newRequest(tc.method, mustParse(t, tc.url), []byte(tc.body))
+		if got, _ := m.matches(live, archived); got != tc.want {
+			t.Errorf("%s: m.matches(): got %t, want %t", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMatcherScore(t *testing.T) {
+	m := NewMatcher()
+	m.IgnoreQueryParams("cb")
+
+	live := newRequest("GET", mustParse(t, "http://example.com/?cb=1"), nil)
+
+	_, exact := m.matches(live, newRequest("GET", mustParse(t, "http://example.com/?cb=1"), nil))
+	_, other := m.matches(live, newRequest("GET", mustParse(t, "http://example.com/?cb=2"), nil))
+	_, scheme := m.matches(live, newRequest("GET", mustParse(t, "https://example.com/?cb=1"), nil))
+
+	if exact <= other {
+		t.Errorf("m.matches(): got score %d for equal cb, want more than %d for different cb", exact, other)
+	}
+	if exact <= scheme {
+		t.Errorf("m.matches(): got score %d for equal scheme, want more than %d for different scheme", exact, scheme)
+	}
+}
+
+func TestMatcherLiveRequestKeepsBody(t *testing.T) {
+	m := NewMatcher()
+	m.SetMatchBody(true)
+
+	req, err := http.NewRequest("POST", "http://example.com", strings.NewReader("body"))
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	if _, err := m.liveRequest(req); err != nil {
+		t.Fatalf("m.liveRequest(): got %v, want no error", err)
+	}
+
+	body, err := readBody(&req.Body)
+	if err != nil {
+		t.Fatalf("readBody(): got %v, want no error", err)
+	}
+	if got, want := string(body), "body"; got != want {
+		t.Errorf("req.Body: got %q, want %q", got, want)
+	}
+}
+
+func mustParse(t *testing.T, raw string) *url.URL {
+	t.Helper()
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatalf("url.Parse(%q): got %v, want no error", raw, err)
+	}
+
+	return u
+}
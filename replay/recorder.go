@@ -0,0 +1,132 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replay
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/google/martian/v3"
+)
+
+// recordKey is the martian context key of the *Request recorded for a
+// request.
+const recordKey = "replay.Request"
+
+// Recorder is a request and response modifier that records every request
+// and its response in an archive. Responses that did not come from the
+// upstream, such as those of skipped round trips, and responses whose body is
+// a stream without an end, such as protocol upgrades and event streams, are
+// not recorded.
+//
+// The request modifier should run after any modifier that changes the
+// request, and the response modifier before any modifier that changes the
+// response, so that the archive holds the traffic exchanged with the
+// upstream.
+type Recorder struct {
+	archive Adder
+}
+
+// Adder is an archive that a Recorder adds entries to, such as an *Archive
+// or a *Writer.
+type Adder interface {
+	// Add adds e to the archive.
+	Add(e *Entry) error
+}
+
+// NewRecorder returns a recorder that adds to a.
+func NewRecorder(a Adder) *Recorder {
+	return &Recorder{
+		archive: a,
+	}
+}
+
+// ModifyRequest records req, reading its body into memory.
+func (r *Recorder) ModifyRequest(req *http.Request) error {
+	ctx := martian.NewContext(req)
+	if ctx == nil || ctx.SkippingLogging() || ctx.SkippingRoundTrip() {
+		return nil
+	}
+
+	body, err := readBody(&req.Body)
+	if err != nil {
+		return err
+	}
+
+	ctx.Set(recordKey, &Request{
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Header: req.Header.Clone(),
+		Body:   body,
+	})
+
+	return nil
+}
+
+// ModifyResponse records res with its request, reading its body into memory.
+func (r *Recorder) ModifyResponse(res *http.Response) error {
+	ctx := martian.NewContext(res.Request)
+	if ctx == nil || ctx.SkippingRoundTrip() || streaming(res) {
+		return nil
+	}
+	v, ok := ctx.Get(recordKey)
+	if !ok {
+		return nil
+	}
+
+	body, err := readBody(&res.Body)
+	if err != nil {
+		return err
+	}
+
+	return r.archive.Add(&Entry{
+		Request: v.(*Request),
+		Response: &Response{
+			StatusCode: res.StatusCode,
+			Header:     res.Header.Clone(),
+			Body:       body,
+		},
+	})
+}
+
+// streaming returns whether the body of res is a stream that ends only when
+// the connection does.
+func streaming(res *http.Response) bool {
+	if res.StatusCode == http.StatusSwitchingProtocols || res.Header.Get("Upgrade") != "" {
+		return true
+	}
+
+	ct := res.Header.Get("Content-Type")
+	return strings.HasPrefix(ct, "text/event-stream")
+}
+
+// readBody reads the body that rc points to and replaces it with a copy.
+func readBody(rc *io.ReadCloser) ([]byte, error) {
+	if *rc == nil || *rc == http.NoBody {
+		return nil, nil
+	}
+
+	body, err := ioutil.ReadAll(*rc)
+	(*rc).Close()
+	if err != nil {
+		return nil, err
+	}
+	*rc = ioutil.NopCloser(bytes.NewReader(body))
+
+	return body, nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replay
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/martian/v3"
+	"github.com/google/martian/v3/proxyutil"
+)
+
+// unreadBody fails the test when it is read.
+type unreadBody struct {
+	t *testing.T
+}
+
+func (b unreadBody) Read([]byte) (int, error) {
+	b.t.Error("body read: got read, want not read")
+	return 0, io.EOF
+}
+
+func TestRecorder(t *testing.T) {
+	tt := []struct {
+		name string
+		// skip is when the round trip is skipped: "request" before the
+		// recorder modifies the request, "response" after.
+		skip   string
+		status int
+		header http.Header
+		body   io.Reader
+		want   bool
+	}{
+		{name: "upstream response", status: 200, body: strings.NewReader("body"), want: true},
+		{name: "skipped before request", skip: "request", status: 200, want: false},
+		{name: "skipped after request", skip: "response", status: 200, want: false},
+		{
+			name:   "upgrade",
+			status: 101,
+			header: http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}},
+			body:   unreadBody{t},
+			want:   false,
+		},
+		{
+			name:   "event stream",
+			status: 200,
+			header: http.Header{"Content-Type": {"text/event-stream"}},
+			body:   unreadBody{t},
+			want:   false,
+		},
+	}
+
+	for _, tc := range tt {
+		a := NewArchive()
+		rec := NewRecorder(a)
+
+		req, err := http.NewRequest("GET", "http://example.com/", nil)
+		if err != nil {
+			t.Fatalf("%s: http.NewRequest(): got %v, want no error", tc.name, err)
+		}
+		ctx, remove, err := martian.TestContext(req, nil, nil)
+		if err != nil {
+			t.Fatalf("%s: martian.TestContext(): got %v, want no error", tc.name, err)
+		}
+
+		if tc.skip == "request" {
+			ctx.SkipRoundTrip()
+		}
+		if err := rec.ModifyRequest(req); err != nil {
+			t.Fatalf("%s: ModifyRequest(): got %v, want no error", tc.name, err)
+		}
+		if tc.skip == "response" {
+			ctx.SkipRoundTrip()
+		}
+
+		res := proxyutil.NewResponse(tc.status, tc.body, req)
+		for k, v := range tc.header {
+			res.Header[k] = v
+		}
+		if err := rec.ModifyResponse(res); err != nil {
+			t.Fatalf("%s: ModifyResponse(): got %v, want no error", tc.name, err)
+		}
+		remove()
+
+		if got := len(a.Entries()) == 1; got != tc.want {
+			t.Errorf("%s: recorded: got %t, want %t", tc.name, got, tc.want)
+		}
+	}
+}
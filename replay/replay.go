@@ -0,0 +1,243 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package replay records the traffic of the proxy into an archive and replays
+// it, for deterministic page load tests.
+//
+// In record mode, a Recorder stores every request and its response, including
+// those of MITM'd HTTPS connections, in an Archive that is saved to a file, or
+// appends them to the file with a Writer as they complete.
+// In replay mode, a Replayer answers requests from a loaded Archive only,
+// skipping the round trip, and applies an UnmatchedPolicy to the requests
+// that a Matcher finds no archived response for.
+package replay
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// archiveVersion is the version of the archive file format.
+const archiveVersion = 1
+
+// Entry is an archived request and its response.
+type Entry struct {
+	Request  *Request  `json:"request"`
+	Response *Response `json:"response"`
+}
+
+// Request is an archived request.
+type Request struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body,omitempty"`
+}
+
+// Response is an archived response. The body is archived as received, before
+// any content decoding.
+type Response struct {
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body,omitempty"`
+}
+
+// Archive is a list of recorded requests and their responses.
+type Archive struct {
+	mu      sync.RWMutex
+	entries []*Entry
+}
+
+// archiveJSON is the header of the archive file format. It is followed by
+// the entries of the archive, one JSON object per line.
+type archiveJSON struct {
+	Version int `json:"version"`
+}
+
+// NewArchive returns an empty archive.
+func NewArchive() *Archive {
+	return &Archive{}
+}
+
+// ReadArchive reads an archive written by Archive.WriteTo or a Writer from r.
+func ReadArchive(r io.Reader) (*Archive, error) {
+	dec := json.NewDecoder(r)
+
+	var aj archiveJSON
+	if err := dec.Decode(&aj); err != nil {
+		return nil, err
+	}
+	if aj.Version != archiveVersion {
+		return nil, fmt.Errorf("replay: unsupported archive version: %d", aj.Version)
+	}
+
+	var entries []*Entry
+	for {
+		var e *Entry
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	for i, e := range entries {
+		if e == nil || e.Request == nil || e.Response == nil {
+			return nil, fmt.Errorf("replay: archive entry %d: missing request or response", i)
+		}
+	}
+
+	return &Archive{
+		entries: entries,
+	}, nil
+}
+
+// LoadArchive reads the archive in the file at path.
+func LoadArchive(path string) (*Archive, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadArchive(f)
+}
+
+// Add appends e to the archive. It never returns an error.
+func (a *Archive) Add(e *Entry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.entries = append(a.entries, e)
+
+	return nil
+}
+
+// Entries returns the archived entries in the order they were added.
+func (a *Archive) Entries() []*Entry {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return append([]*Entry(nil), a.entries...)
+}
+
+// WriteTo writes the archive to w as JSON.
+func (a *Archive) WriteTo(w io.Writer) (int64, error) {
+	cw := &countWriter{w: w}
+
+	aw, err := NewWriter(cw)
+	if err != nil {
+		return cw.n, err
+	}
+	for _, e := range a.Entries() {
+		if err := aw.Add(e); err != nil {
+			return cw.n, err
+		}
+	}
+
+	return cw.n, nil
+}
+
+// Save writes the archive to the file at path, replacing it atomically.
+func (a *Archive) Save(path string) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := a.WriteTo(f); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// Writer appends entries to an archive as they are added, without keeping
+// them in memory. An archive file written by a Writer holds every entry added
+// before the proxy exits, even if it is not shut down cleanly.
+type Writer struct {
+	mu sync.Mutex
+	w  io.Writer
+	n  int
+}
+
+// NewWriter writes the header of an empty archive to w and returns a Writer
+// that appends entries to it.
+func NewWriter(w io.Writer) (*Writer, error) {
+	if err := writeJSONLine(w, &archiveJSON{Version: archiveVersion}); err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		w: w,
+	}, nil
+}
+
+// Add appends e to the archive.
+func (w *Writer) Add(e *Entry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := writeJSONLine(w.w, e); err != nil {
+		return err
+	}
+	w.n++
+
+	return nil
+}
+
+// Len returns the number of entries appended to the archive.
+func (w *Writer) Len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.n
+}
+
+// writeJSONLine writes v to w as a single line of JSON.
+func writeJSONLine(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// countWriter counts the bytes written to w.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
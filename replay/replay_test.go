@@ -0,0 +1,135 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replay
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestArchiveSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "martian-replay")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): got %v, want no error", err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := NewArchive()
+	e := &Entry{
+		Request: &Request{
+			Method: "POST",
+			URL:    "https://example.com/submit?q=1",
+			Header: http.Header{"Content-Type": []string{"text/plain"}},
+			Body:   []byte("request"),
+		},
+		Response: &Response{
+			StatusCode: 200,
+			Header:     http.Header{"Content-Encoding": []string{"gzip"}},
+			Body:       []byte{0x1f, 0x8b, 0x00},
+		},
+	}
+	a.Add(e)
+
+	path := filepath.Join(dir, "archive.json")
+	if err := a.Save(path); err != nil {
+		t.Fatalf("a.Save(): got %v, want no error", err)
+	}
+
+	la, err := LoadArchive(path)
+	if err != nil {
+		t.Fatalf("LoadArchive(): got %v, want no error", err)
+	}
+	if got, want := la.Entries(), []*Entry{e}; !reflect.DeepEqual(got, want) {
+		t.Errorf("la.Entries(): got %+v, want %+v", got, want)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	if err != nil {
+		t.Fatalf("NewWriter(): got %v, want no error", err)
+	}
+
+	var want []*Entry
+	for _, u := range []string{"http://example.com/a", "http://example.com/b"} {
+		e := &Entry{
+			Request:  &Request{Method: "GET", URL: u, Header: http.Header{}},
+			Response: &Response{StatusCode: 200, Header: http.Header{}, Body: []byte(u)},
+		}
+		if err := w.Add(e); err != nil {
+			t.Fatalf("w.Add(): got %v, want no error", err)
+		}
+		want = append(want, e)
+
+		// Every entry is readable as soon as it is added.
+		a, err := ReadArchive(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("ReadArchive(): got %v, want no error", err)
+		}
+		if got := a.Entries(); !reflect.DeepEqual(got, want) {
+			t.Errorf("a.Entries(): got %+v, want %+v", got, want)
+		}
+	}
+	if got, want := w.Len(), 2; got != want {
+		t.Errorf("w.Len(): got %d, want %d", got, want)
+	}
+
+	// An entry cut off while it was written is an error.
+	b := buf.Bytes()
+	if _, err := ReadArchive(bytes.NewReader(b[:len(b)-10])); err == nil {
+		t.Error("ReadArchive(truncated): got no error, want error")
+	}
+}
+
+func TestReadArchiveErrors(t *testing.T) {
+	tt := []struct {
+		name string
+		json string
+	}{
+		{
+			name: "malformed",
+			json: `{"version": 1,`,
+		},
+		{
+			name: "unsupported version",
+			json: `{"version": 2}`,
+		},
+		{
+			name: "missing response",
+			json: "{\"version\": 1}\n{\"request\": {\"method\": \"GET\", \"url\": \"http://example.com\"}}\n",
+		},
+	}
+
+	for _, tc := range tt {
+		if _, err := ReadArchive(strings.NewReader(tc.json)); err == nil {
+			t.Errorf("%s: ReadArchive(): got no error, want error", tc.name)
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := NewArchive().WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo(): got %v, want no error", err)
+	}
+	if _, err := ReadArchive(&buf); err != nil {
+		t.Errorf("ReadArchive(): got %v, want no error for empty archive", err)
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replay
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/google/martian/v3"
+)
+
+// replayKey is the martian context key of the *Response that answers a
+// request, or of a nil *Response for unmatched requests answered with 404 Not
+// Found.
+const replayKey = "replay.Response"
+
+// UnmatchedPolicy is what a Replayer does with requests that match no
+// archived request.
+type UnmatchedPolicy int
+
+const (
+	// UnmatchedNotFound answers unmatched requests with 404 Not Found.
+	UnmatchedNotFound UnmatchedPolicy = iota
+	// UnmatchedPassthrough sends unmatched requests upstream.
+	UnmatchedPassthrough
+	// UnmatchedFail answers unmatched requests with 404 Not Found and fails
+	// the request verification of the Replayer.
+	UnmatchedFail
+)
+
+// Replayer is a request and response modifier that answers requests with the
+// responses in an archive, skipping the round trip.
+//
+// A request is answered with the response of the most similar archived
+// request that the matcher accepts; requests with the same score are served
+// in turn, in the order they were recorded, so that a page that fetches the
+// same URL several times gets the responses it got when recorded.
+//
+// The request modifier should run after any modifier that changes the
+// request, and the response modifier before any modifier that reads or
+// changes the response, including loggers.
+type Replayer struct {
+	matcher *Matcher
+	policy  UnmatchedPolicy
+
+	entries []*Entry
+	reqs    []*request
+
+	mu     sync.Mutex
+	served []int
+	reqerr *martian.MultiError
+}
+
+// NewReplayer returns a replayer that answers requests from a, matched by m.
+// If m is nil, NewMatcher() is used.
+func NewReplayer(a *Archive, m *Matcher) (*Replayer, error) {
+	if m == nil {
+		m = NewMatcher()
+	}
+
+	r := &Replayer{
+		matcher: m,
+		entries: a.Entries(),
+		reqerr:  martian.NewMultiError(),
+	}
+
+	for i, e := range r.entries {
+		u, err := url.Parse(e.Request.URL)
+		if err != nil {
+			return nil, fmt.Errorf("replay: archive entry %d: %v", i, err)
+		}
+		r.reqs = append(r.reqs, newRequest(e.Request.Method, u, e.Request.Body))
+	}
+	r.served = make([]int, len(r.entries))
+
+	return r, nil
+}
+
+// SetUnmatchedPolicy sets what the replayer does with requests that match no
+// archived request. The default is UnmatchedNotFound.
+func (r *Replayer) SetUnmatchedPolicy(policy UnmatchedPolicy) {
+	r.policy = policy
+}
+
+// match returns the archived response that answers req, or nil if req
+// matches no archived request.
+func (r *Replayer) match(req *http.Request) (*Response, error) {
+	lr, err := r.matcher.liveRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	best, bestScore := -1, -1
+	for i, a := range r.reqs {
+		ok, score := r.matcher.matches(lr, a)
+		if !ok {
+			continue
+		}
+		if score > bestScore || (score == bestScore && r.served[i] < r.served[best]) {
+			best, bestScore = i, score
+		}
+	}
+	if best < 0 {
+		return nil, nil
+	}
+
+	r.served[best]++
+	return r.entries[best].Response, nil
+}
+
+// ModifyRequest looks up the archived response for req, skipping the round
+// trip unless req is unmatched and passed through.
+func (r *Replayer) ModifyRequest(req *http.Request) error {
+	ctx := martian.NewContext(req)
+	if ctx == nil {
+		return nil
+	}
+
+	ar, err := r.match(req)
+	if err != nil {
+		return err
+	}
+
+	if ar == nil {
+		switch r.policy {
+		case UnmatchedPassthrough:
+			return nil
+		case UnmatchedFail:
+			r.mu.Lock()
+			r.reqerr.Add(fmt.Errorf("replay: no archived response for %s %s", req.Method, req.URL))
+			r.mu.Unlock()
+		}
+	}
+
+	ctx.SkipRoundTrip()
+	ctx.Set(replayKey, ar)
+
+	return nil
+}
+
+// ModifyResponse replaces res with the archived response for its request, or
+// with 404 Not Found if there is none.
+func (r *Replayer) ModifyResponse(res *http.Response) error {
+	ctx := martian.NewContext(res.Request)
+	if ctx == nil {
+		return nil
+	}
+	v, ok := ctx.Get(replayKey)
+	if !ok {
+		return nil
+	}
+	ar := v.(*Response)
+
+	header := make(http.Header)
+	status := http.StatusNotFound
+	body := []byte(fmt.Sprintf("replay: no archived response for %s %s\n", res.Request.Method, res.Request.URL))
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	if ar != nil {
+		status = ar.StatusCode
+		header = ar.Header.Clone()
+		header.Del("Transfer-Encoding")
+		body = ar.Body
+	}
+
+	res.Body.Close()
+	res.StatusCode = status
+	res.Status = fmt.Sprintf("%d %s", status, http.StatusText(status))
+	res.Header = header
+	res.TransferEncoding = nil
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+
+	return nil
+}
+
+// VerifyRequests returns an error if requests matched no archived request
+// under UnmatchedFail. If an error is returned it will be of type
+// *martian.MultiError.
+func (r *Replayer) VerifyRequests() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.reqerr.Empty() {
+		return nil
+	}
+
+	return r.reqerr
+}
+
+// ResetRequestVerifications clears the unmatched requests.
+func (r *Replayer) ResetRequestVerifications() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.reqerr = martian.NewMultiError()
+}
+
+// Reset serves the archived responses from the start again, as if no
+// requests were answered.
+func (r *Replayer) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.served = make([]int, len(r.entries))
+}
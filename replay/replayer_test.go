@@ -0,0 +1,244 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replay
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/martian/v3"
+	"github.com/google/martian/v3/proxyutil"
+)
+
+// replay runs a request for the method and URL through r as the proxy would,
+// and returns the response.
+func replay(t *testing.T, r *Replayer, method, u string) (*http.Response, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	ctx, remove, err := martian.TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("martian.TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	if err := r.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+
+	res := proxyutil.NewResponse(200, strings.NewReader("upstream"), req)
+	if ctx.SkippingRoundTrip() {
+		res = proxyutil.NewResponse(200, nil, req)
+	}
+	if err := r.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+
+	return res, string(body)
+}
+
+func archiveOf(urls ...string) *Archive {
+	a := NewArchive()
+	for i, u := range urls {
+		a.Add(&Entry{
+			Request: &Request{
+				Method: "GET",
+				URL:    u,
+				Header: http.Header{},
+			},
+			Response: &Response{
+				StatusCode: 200,
+				Header:     http.Header{"X-Entry": []string{fmt.Sprint(i)}},
+				Body:       []byte(fmt.Sprintf("response %d", i)),
+			},
+		})
+	}
+
+	return a
+}
+
+func TestReplayerServesInTurn(t *testing.T) {
+	r, err := NewReplayer(archiveOf("http://example.com/a", "http://example.com/a", "http://example.com/b"), nil)
+	if err != nil {
+		t.Fatalf("NewReplayer(): got %v, want no error", err)
+	}
+
+	for _, want := range []string{"response 0", "response 1", "response 0"} {
+		if _, got := replay(t, r, "GET", "http://example.com/a"); got != want {
+			t.Errorf("body: got %q, want %q", got, want)
+		}
+	}
+
+	res, body := replay(t, r, "GET", "http://example.com/b")
+	if got, want := body, "response 2"; got != want {
+		t.Errorf("body: got %q, want %q", got, want)
+	}
+	if got, want := res.Header.Get("X-Entry"), "2"; got != want {
+		t.Errorf("res.Header.Get(%q): got %q, want %q", "X-Entry", got, want)
+	}
+	if got, want := res.ContentLength, int64(len("response 2")); got != want {
+		t.Errorf("res.ContentLength: got %d, want %d", got, want)
+	}
+
+	r.Reset()
+	if _, got := replay(t, r, "GET", "http://example.com/a"); got != "response 0" {
+		t.Errorf("body: got %q, want %q after Reset", got, "response 0")
+	}
+}
+
+func TestReplayerUnmatchedPolicy(t *testing.T) {
+	tt := []struct {
+		name   string
+		policy UnmatchedPolicy
+		status int
+		body   string
+		fail   bool
+	}{
+		{
+			name:   "not found",
+			policy: UnmatchedNotFound,
+			status: 404,
+			body:   "replay: no archived response for GET http://example.com/missing\n",
+		},
+		{
+			name:   "passthrough",
+			policy: UnmatchedPassthrough,
+			status: 200,
+			body:   "upstream",
+		},
+		{
+			name:   "fail",
+			policy: UnmatchedFail,
+			status: 404,
+			body:   "replay: no archived response for GET http://example.com/missing\n",
+			fail:   true,
+		},
+	}
+
+	for _, tc := range tt {
+		r, err := NewReplayer(archiveOf("http://example.com/a"), nil)
+		if err != nil {
+			t.Fatalf("%s: NewReplayer(): got %v, want no error", tc.name, err)
+		}
+		r.SetUnmatchedPolicy(tc.policy)
+
+		res, body := replay(t, r, "GET", "http://example.com/missing")
+		if got := res.StatusCode; got != tc.status {
+			t.Errorf("%s: res.StatusCode: got %d, want %d", tc.name, got, tc.status)
+		}
+		if got := body; got != tc.body {
+			t.Errorf("%s: body: got %q, want %q", tc.name, got, tc.body)
+		}
+
+		err = r.VerifyRequests()
+		if got := err != nil; got != tc.fail {
+			t.Errorf("%s: r.VerifyRequests(): got %v, want error %t", tc.name, err, tc.fail)
+		}
+
+		r.ResetRequestVerifications()
+		if err := r.VerifyRequests(); err != nil {
+			t.Errorf("%s: r.VerifyRequests(): got %v, want no error after reset", tc.name, err)
+		}
+	}
+}
+
+func TestIntegrationRecordAndReplay(t *testing.T) {
+	var hits int
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		hits++
+		rw.Header().Set("X-Hit", fmt.Sprint(hits))
+		fmt.Fprintf(rw, "hello %s", req.URL.Query().Get("name"))
+	}))
+
+	a := NewArchive()
+	rec := NewRecorder(a)
+
+	do := func(mod martian.RequestResponseModifier, name string) (*http.Response, string) {
+		t.Helper()
+
+		p := martian.NewProxy()
+		defer p.Close()
+		p.SetRequestModifier(mod)
+		p.SetResponseModifier(mod)
+
+		l, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatalf("net.Listen(): got %v, want no error", err)
+		}
+		go p.Serve(l)
+
+		proxyURL := &url.URL{Scheme: "http", Host: l.Addr().String()}
+		c := &http.Client{
+			Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+			Timeout:   5 * time.Second,
+		}
+
+		res, err := c.Get(srv.URL + "/?name=" + name)
+		if err != nil {
+			t.Fatalf("c.Get(): got %v, want no error", err)
+		}
+		defer res.Body.Close()
+
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+		}
+
+		return res, string(body)
+	}
+
+	do(rec, "martian")
+	srv.Close()
+
+	if got, want := len(a.Entries()), 1; got != want {
+		t.Fatalf("len(a.Entries()): got %d, want %d", got, want)
+	}
+
+	r, err := NewReplayer(a, nil)
+	if err != nil {
+		t.Fatalf("NewReplayer(): got %v, want no error", err)
+	}
+
+	res, body := do(r, "martian")
+	if got, want := res.StatusCode, 200; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+	if got, want := body, "hello martian"; got != want {
+		t.Errorf("body: got %q, want %q", got, want)
+	}
+	if got, want := res.Header.Get("X-Hit"), "1"; got != want {
+		t.Errorf("res.Header.Get(%q): got %q, want %q", "X-Hit", got, want)
+	}
+
+	res, _ = do(r, "other")
+	if got, want := res.StatusCode, 404; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d for unmatched request", got, want)
+	}
+}
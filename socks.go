@@ -0,0 +1,384 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/martian/v3/log"
+)
+
+// SOCKSUsernameKey is the session key of the username that a SOCKS5 client
+// authenticated with. The auth package uses it as the default auth ID.
+const SOCKSUsernameKey = "martian.SOCKSUsername"
+
+// SOCKS5 protocol constants.
+//
+// https://tools.ietf.org/html/rfc1928
+// https://tools.ietf.org/html/rfc1929
+const (
+	socksVersion = 0x05
+
+	socksAuthNone         = 0x00
+	socksAuthPassword     = 0x02
+	socksAuthNoAcceptable = 0xff
+
+	socksPasswordVersion = 0x01
+
+	socksCmdConnect = 0x01
+
+	socksAddrIPv4   = 0x01
+	socksAddrDomain = 0x03
+	socksAddrIPv6   = 0x04
+
+	socksSucceeded           = 0x00
+	socksGeneralFailure      = 0x01
+	socksCmdNotSupported     = 0x07
+	socksAddrTypeUnsupported = 0x08
+)
+
+// SetSOCKSAuthenticator sets the function used to verify the credentials of
+// SOCKS5 clients. When set, clients must authenticate with a username and
+// password. When nil, clients may connect without authentication, and any
+// credentials that are offered are accepted.
+func (p *Proxy) SetSOCKSAuthenticator(authenticate func(username, password string) bool) {
+	p.socksAuth = authenticate
+}
+
+// ServeSOCKS accepts SOCKS5 connections from the listener and handles the
+// requests sent through them. Only the CONNECT command is supported. Each
+// connection is handled as if it was tunneled through a CONNECT request: TLS
+// connections are MITM'd when MITM is configured, or tunneled to the target
+// otherwise, and all other connections are handled as HTTP.
+func (p *Proxy) ServeSOCKS(l net.Listener) error {
+	return p.serve(l, p.handleSOCKSLoop)
+}
+
+func (p *Proxy) handleSOCKSLoop(conn net.Conn) {
+	defer p.trackConn(conn)()
+	defer conn.Close()
+	if p.Closing() {
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(p.timeout))
+	brw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	s, err := newSession(conn, brw)
+	if err != nil {
+		log.Errorf("martian: failed to create session: %v", err)
+		return
+	}
+	p.hooks.accept(s, conn)
+
+	p.hooks.closed(s, p.handleSOCKS(s, conn, brw))
+}
+
+// handleSOCKS negotiates a SOCKS5 connection and handles the connection to the
+// requested destination, returning the error that caused it to be closed.
+func (p *Proxy) handleSOCKS(s *Session, conn net.Conn, brw *bufio.ReadWriter) error {
+	username, err := p.socksAuthenticate(brw)
+	if err != nil {
+		log.Errorf("martian: SOCKS authentication failed for %s: %v", conn.RemoteAddr(), err)
+		return err
+	}
+
+	dst, err := socksConnect(brw)
+	if err != nil {
+		log.Errorf("martian: failed to read SOCKS request from %s: %v", conn.RemoteAddr(), err)
+		return err
+	}
+	log.Debugf("martian: SOCKS connection from %s to %s", conn.RemoteAddr(), dst)
+
+	if username != "" {
+		s.Set(SOCKSUsernameKey, username)
+	}
+	p.hooks.connectEstablished(s, dst)
+
+	return p.handleDestination(s, conn, brw, dst)
+}
+
+// socksAuthenticate negotiates the authentication method with the client and
+// returns the username that the client authenticated with, if any.
+func (p *Proxy) socksAuthenticate(brw *bufio.ReadWriter) (string, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(brw, hdr[:]); err != nil {
+		return "", err
+	}
+	if hdr[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version: %d", hdr[0])
+	}
+
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(brw, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(socksAuthNoAcceptable)
+	for _, m := range methods {
+		switch {
+		case m == socksAuthPassword:
+			method = m
+		case m == socksAuthNone && p.socksAuth == nil && method != socksAuthPassword:
+			method = m
+		}
+	}
+
+	brw.Write([]byte{socksVersion, method})
+	if err := brw.Flush(); err != nil {
+		return "", err
+	}
+
+	switch method {
+	case socksAuthNone:
+		return "", nil
+	case socksAuthNoAcceptable:
+		return "", fmt.Errorf("no acceptable authentication methods in %v", methods)
+	}
+
+	// Username/password authentication.
+	// https://tools.ietf.org/html/rfc1929#section-2
+	ver, err := brw.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	if ver != socksPasswordVersion {
+		return "", fmt.Errorf("unsupported SOCKS username/password version: %d", ver)
+	}
+	username, err := readSOCKSString(brw.Reader)
+	if err != nil {
+		return "", err
+	}
+	password, err := readSOCKSString(brw.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	status := byte(0x00)
+	if p.socksAuth != nil && !p.socksAuth(username, password) {
+		status = 0x01
+	}
+
+	brw.Write([]byte{socksPasswordVersion, status})
+	if err := brw.Flush(); err != nil {
+		return "", err
+	}
+	if status != 0x00 {
+		return "", fmt.Errorf("invalid credentials for user %q", username)
+	}
+
+	return username, nil
+}
+
+// socksConnect reads the client's request and replies to it, returning the
+// host:port of the target on success.
+func socksConnect(brw *bufio.ReadWriter) (string, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(brw, hdr[:]); err != nil {
+		return "", err
+	}
+	if hdr[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version: %d", hdr[0])
+	}
+	if hdr[1] != socksCmdConnect {
+		writeSOCKSReply(brw, socksCmdNotSupported)
+		return "", fmt.Errorf("unsupported SOCKS command: %d", hdr[1])
+	}
+
+	var host string
+	switch hdr[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if hdr[3] == socksAddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(brw, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAddrDomain:
+		var err error
+		if host, err = readSOCKSString(brw.Reader); err != nil {
+			return "", err
+		}
+	default:
+		writeSOCKSReply(brw, socksAddrTypeUnsupported)
+		return "", fmt.Errorf("unsupported SOCKS address type: %d", hdr[3])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(brw, port[:]); err != nil {
+		return "", err
+	}
+	if host == "" {
+		writeSOCKSReply(brw, socksGeneralFailure)
+		return "", fmt.Errorf("empty SOCKS target host")
+	}
+
+	if err := writeSOCKSReply(brw, socksSucceeded); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// writeSOCKSReply writes a reply with the given status. The bound address is
+// always reported as 0.0.0.0:0 since the upstream connection, if any, is made
+// by the proxy on demand.
+func writeSOCKSReply(brw *bufio.ReadWriter, status byte) error {
+	brw.Write([]byte{socksVersion, status, 0x00, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return brw.Flush()
+}
+
+// readSOCKSString reads a string prefixed with its one byte length.
+func readSOCKSString(r *bufio.Reader) (string, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// socksClientConnect asks the SOCKS5 proxy at the other end of conn to connect
+// to the host:port addr, authenticating with the username and password of user
+// if set.
+func socksClientConnect(conn net.Conn, user *url.Userinfo, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid SOCKS target port: %q", portStr)
+	}
+
+	brw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	methods := []byte{socksAuthNone}
+	if user != nil {
+		methods = append(methods, socksAuthPassword)
+	}
+	brw.Write([]byte{socksVersion, byte(len(methods))})
+	brw.Write(methods)
+	if err := brw.Flush(); err != nil {
+		return err
+	}
+
+	var res [2]byte
+	if _, err := io.ReadFull(brw, res[:]); err != nil {
+		return err
+	}
+	if res[0] != socksVersion {
+		return fmt.Errorf("unsupported SOCKS version: %d", res[0])
+	}
+
+	switch res[1] {
+	case socksAuthNone:
+	case socksAuthPassword:
+		if user == nil {
+			return fmt.Errorf("SOCKS proxy requires authentication")
+		}
+		password, _ := user.Password()
+		if len(user.Username()) > 255 || len(password) > 255 {
+			return fmt.Errorf("SOCKS username or password too long")
+		}
+
+		msg := []byte{socksPasswordVersion, byte(len(user.Username()))}
+		msg = append(msg, user.Username()...)
+		msg = append(msg, byte(len(password)))
+		msg = append(msg, password...)
+		brw.Write(msg)
+		if err := brw.Flush(); err != nil {
+			return err
+		}
+
+		if _, err := io.ReadFull(brw, res[:]); err != nil {
+			return err
+		}
+		if res[1] != 0x00 {
+			return fmt.Errorf("SOCKS authentication failed for user %q", user.Username())
+		}
+	default:
+		return fmt.Errorf("no acceptable SOCKS authentication methods")
+	}
+
+	msg := []byte{socksVersion, socksCmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			msg = append(msg, socksAddrIPv4)
+			msg = append(msg, ip4...)
+		} else {
+			msg = append(msg, socksAddrIPv6)
+			msg = append(msg, ip...)
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("SOCKS target host too long: %q", host)
+		}
+		msg = append(msg, socksAddrDomain, byte(len(host)))
+		msg = append(msg, host...)
+	}
+	msg = append(msg, byte(port>>8), byte(port))
+	brw.Write(msg)
+	if err := brw.Flush(); err != nil {
+		return err
+	}
+
+	var hdr [4]byte
+	if _, err := io.ReadFull(brw, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[1] != socksSucceeded {
+		return fmt.Errorf("SOCKS proxy failed to connect to %s: status %d", addr, hdr[1])
+	}
+
+	// Discard the bound address.
+	var n int
+	switch hdr[3] {
+	case socksAddrIPv4:
+		n = net.IPv4len
+	case socksAddrIPv6:
+		n = net.IPv6len
+	case socksAddrDomain:
+		l, err := brw.ReadByte()
+		if err != nil {
+			return err
+		}
+		n = int(l)
+	default:
+		return fmt.Errorf("unsupported SOCKS address type: %d", hdr[3])
+	}
+	if _, err := io.ReadFull(brw, make([]byte, n+2)); err != nil {
+		return err
+	}
+	if brw.Reader.Buffered() > 0 {
+		return fmt.Errorf("unexpected data from SOCKS proxy after reply")
+	}
+
+	return nil
+}
@@ -0,0 +1,278 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/martian/v3/martiantest"
+	"github.com/google/martian/v3/mitm"
+	"github.com/google/martian/v3/proxyutil"
+)
+
+// socksHandshake performs a SOCKS5 handshake for a CONNECT to the domain name
+// host and port, authenticating with username and password if username is
+// non-empty. It returns the status of the last reply read from the proxy.
+func socksHandshake(t *testing.T, conn net.Conn, username, password, host string, port int) byte {
+	t.Helper()
+
+	br := bufio.NewReader(conn)
+	method := byte(socksAuthNone)
+	if username != "" {
+		method = socksAuthPassword
+	}
+	if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		t.Fatalf("conn.Write(methods): got %v, want no error", err)
+	}
+
+	var res [2]byte
+	if _, err := io.ReadFull(br, res[:]); err != nil {
+		t.Fatalf("io.ReadFull(method): got %v, want no error", err)
+	}
+	if got, want := res[1], method; got != want {
+		t.Fatalf("method: got %d, want %d", got, want)
+	}
+
+	if username != "" {
+		msg := []byte{socksPasswordVersion, byte(len(username))}
+		msg = append(msg, username...)
+		msg = append(msg, byte(len(password)))
+		msg = append(msg, password...)
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatalf("conn.Write(credentials): got %v, want no error", err)
+		}
+
+		if _, err := io.ReadFull(br, res[:]); err != nil {
+			t.Fatalf("io.ReadFull(auth status): got %v, want no error", err)
+		}
+		if res[1] != 0x00 {
+			return res[1]
+		}
+	}
+
+	msg := []byte{socksVersion, socksCmdConnect, 0x00, socksAddrDomain, byte(len(host))}
+	msg = append(msg, host...)
+	msg = append(msg, byte(port>>8), byte(port))
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatalf("conn.Write(request): got %v, want no error", err)
+	}
+
+	var reply [10]byte
+	if _, err := io.ReadFull(br, reply[:]); err != nil {
+		t.Fatalf("io.ReadFull(reply): got %v, want no error", err)
+	}
+
+	return reply[1]
+}
+
+func TestIntegrationSOCKSHTTP(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	tr := martiantest.NewTransport()
+	tr.Func(func(req *http.Request) (*http.Response, error) {
+		res := proxyutil.NewResponse(200, nil, req)
+		res.Header.Set("Request-URL", req.URL.String())
+
+		return res, nil
+	})
+	p.SetRoundTripper(tr)
+	p.SetTimeout(200 * time.Millisecond)
+
+	var username interface{}
+	tm := martiantest.NewModifier()
+	tm.RequestFunc(func(req *http.Request) {
+		username, _ = NewContext(req).Session().Get(SOCKSUsernameKey)
+	})
+	p.SetRequestModifier(tm)
+	p.SetResponseModifier(tm)
+
+	go p.ServeSOCKS(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	if got, want := socksHandshake(t, conn, "user", "secret", "example.com", 80), byte(socksSucceeded); got != want {
+		t.Fatalf("socksHandshake(): got status %d, want %d", got, want)
+	}
+
+	req, err := http.NewRequest("GET", "http://example.com/path", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("req.Write(): got %v, want no error", err)
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	defer res.Body.Close()
+
+	if got, want := res.StatusCode, 200; got != want {
+		t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+	}
+	if got, want := res.Header.Get("Request-URL"), "http://example.com/path"; got != want {
+		t.Errorf("res.Header.Get(%q): got %q, want %q", "Request-URL", got, want)
+	}
+	if got, want := username, "user"; got != want {
+		t.Errorf("session.Get(%q): got %v, want %q", SOCKSUsernameKey, got, want)
+	}
+	if !tm.ResponseModified() {
+		t.Error("tm.ResponseModified(): got false, want true")
+	}
+}
+
+func TestIntegrationSOCKSMITM(t *testing.T) {
+	t.Parallel()
+
+	ca, priv, err := mitm.NewAuthority("martian.proxy", "Martian Authority", 2*time.Hour)
+	if err != nil {
+		t.Fatalf("mitm.NewAuthority(): got %v, want no error", err)
+	}
+
+	mc, err := mitm.NewConfig(ca, priv)
+	if err != nil {
+		t.Fatalf("mitm.NewConfig(): got %v, want no error", err)
+	}
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	p.SetMITM(mc)
+	p.SetTimeout(200 * time.Millisecond)
+
+	tr := martiantest.NewTransport()
+	tr.Func(func(req *http.Request) (*http.Response, error) {
+		res := proxyutil.NewResponse(200, nil, req)
+		res.Header.Set("Request-URL", req.URL.String())
+
+		return res, nil
+	})
+	p.SetRoundTripper(tr)
+
+	go p.ServeSOCKS(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	if got, want := socksHandshake(t, conn, "", "", "example.com", 443), byte(socksSucceeded); got != want {
+		t.Fatalf("socksHandshake(): got status %d, want %d", got, want)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	tlsconn := tls.Client(conn, &tls.Config{
+		ServerName: "example.com",
+		RootCAs:    roots,
+	})
+	defer tlsconn.Close()
+
+	req, err := http.NewRequest("GET", "https://example.com/secure", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	if err := req.Write(tlsconn); err != nil {
+		t.Fatalf("req.Write(): got %v, want no error", err)
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(tlsconn), req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	defer res.Body.Close()
+
+	if got, want := res.Header.Get("Request-URL"), "https://example.com/secure"; got != want {
+		t.Errorf("res.Header.Get(%q): got %q, want %q", "Request-URL", got, want)
+	}
+}
+
+func TestIntegrationSOCKSAuthenticator(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	p.SetTimeout(200 * time.Millisecond)
+	p.SetSOCKSAuthenticator(func(username, password string) bool {
+		return username == "user" && password == "secret"
+	})
+
+	go p.ServeSOCKS(l)
+
+	// Clients that do not offer username/password authentication are rejected.
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte{socksVersion, 1, socksAuthNone}); err != nil {
+		t.Fatalf("conn.Write(methods): got %v, want no error", err)
+	}
+	var res [2]byte
+	if _, err := io.ReadFull(conn, res[:]); err != nil {
+		t.Fatalf("io.ReadFull(method): got %v, want no error", err)
+	}
+	if got, want := res[:], []byte{socksVersion, socksAuthNoAcceptable}; !bytes.Equal(got, want) {
+		t.Errorf("method: got %v, want %v", got, want)
+	}
+
+	// Invalid credentials are rejected.
+	conn, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	if got := socksHandshake(t, conn, "user", "wrong", "example.com", 80); got == 0x00 {
+		t.Errorf("socksHandshake(): got status %d, want failure", got)
+	}
+}
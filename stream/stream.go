@@ -0,0 +1,155 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package stream provides a modifier that transforms request and response
+// bodies as they are read by the proxy, without buffering them in memory.
+//
+// Transformers wrap the body in an io.Reader, so they work on bodies of any
+// size, including long-lived streaming responses. Since a transformer may
+// change the length of the body, the Content-Length of transformed messages
+// is removed and the body is sent chunked.
+package stream
+
+import (
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/google/martian/v3/log"
+)
+
+// RequestTransformer transforms request bodies.
+type RequestTransformer interface {
+	// TransformRequest returns a reader that reads the transformed body of req
+	// from body.
+	TransformRequest(req *http.Request, body io.Reader) io.Reader
+}
+
+// ResponseTransformer transforms response bodies.
+type ResponseTransformer interface {
+	// TransformResponse returns a reader that reads the transformed body of res
+	// from body.
+	TransformResponse(res *http.Response, body io.Reader) io.Reader
+}
+
+// RequestTransformerFunc is an adapter for using a function with the given
+// signature as a RequestTransformer.
+type RequestTransformerFunc func(req *http.Request, body io.Reader) io.Reader
+
+// TransformRequest transforms the request body using the given function.
+func (f RequestTransformerFunc) TransformRequest(req *http.Request, body io.Reader) io.Reader {
+	return f(req, body)
+}
+
+// ResponseTransformerFunc is an adapter for using a function with the given
+// signature as a ResponseTransformer.
+type ResponseTransformerFunc func(res *http.Response, body io.Reader) io.Reader
+
+// TransformResponse transforms the response body using the given function.
+func (f ResponseTransformerFunc) TransformResponse(res *http.Response, body io.Reader) io.Reader {
+	return f(res, body)
+}
+
+// Modifier is a martian.RequestResponseModifier that wraps message bodies in
+// a chain of transformers. Transformers are applied in the order they were
+// added: the first transformer reads the original body, and each following
+// transformer reads the output of the previous one.
+type Modifier struct {
+	reqmu sync.RWMutex
+	reqts []RequestTransformer
+
+	resmu sync.RWMutex
+	rests []ResponseTransformer
+}
+
+// NewModifier returns a modifier with no transformers.
+func NewModifier() *Modifier {
+	return &Modifier{}
+}
+
+// AddRequestTransformer adds a RequestTransformer to the end of the chain of
+// request transformers.
+func (m *Modifier) AddRequestTransformer(t RequestTransformer) {
+	m.reqmu.Lock()
+	defer m.reqmu.Unlock()
+
+	m.reqts = append(m.reqts, t)
+}
+
+// AddResponseTransformer adds a ResponseTransformer to the end of the chain of
+// response transformers.
+func (m *Modifier) AddResponseTransformer(t ResponseTransformer) {
+	m.resmu.Lock()
+	defer m.resmu.Unlock()
+
+	m.rests = append(m.rests, t)
+}
+
+// ModifyRequest wraps the request body in the request transformers.
+func (m *Modifier) ModifyRequest(req *http.Request) error {
+	m.reqmu.RLock()
+	defer m.reqmu.RUnlock()
+
+	if len(m.reqts) == 0 || req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	log.Debugf("stream.ModifyRequest: transforming request body: %s", req.URL)
+
+	var r io.Reader = req.Body
+	for _, t := range m.reqts {
+		r = t.TransformRequest(req, r)
+	}
+
+	req.Body = &body{Reader: r, Closer: req.Body}
+	req.ContentLength = -1
+	req.Header.Del("Content-Length")
+
+	return nil
+}
+
+// ModifyResponse wraps the response body in the response transformers.
+// Protocol upgrades are left untouched, since the body of a 101 Switching
+// Protocols response is the upgraded connection.
+func (m *Modifier) ModifyResponse(res *http.Response) error {
+	m.resmu.RLock()
+	defer m.resmu.RUnlock()
+
+	if len(m.rests) == 0 || res.Body == nil || res.Body == http.NoBody {
+		return nil
+	}
+	if res.StatusCode == http.StatusSwitchingProtocols || res.Header.Get("Upgrade") != "" {
+		return nil
+	}
+	log.Debugf("stream.ModifyResponse: transforming response body")
+
+	var r io.Reader = res.Body
+	for _, t := range m.rests {
+		r = t.TransformResponse(res, r)
+	}
+
+	res.Body = &body{Reader: r, Closer: res.Body}
+	res.ContentLength = -1
+	res.Header.Del("Content-Length")
+	if res.ProtoAtLeast(1, 1) {
+		res.TransferEncoding = []string{"chunked"}
+	}
+
+	return nil
+}
+
+// body reads the transformed body and closes the original one.
+type body struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,168 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stream
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/martian/v3/proxyutil"
+)
+
+// upperReader upper-cases the bytes read from r.
+type upperReader struct {
+	r io.Reader
+}
+
+func (u *upperReader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	copy(p, bytes.ToUpper(p[:n]))
+	return n, err
+}
+
+// closeRecorder records whether the body was closed.
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestModifyRequest(t *testing.T) {
+	m := NewModifier()
+	m.AddRequestTransformer(RequestTransformerFunc(func(req *http.Request, body io.Reader) io.Reader {
+		return &upperReader{r: body}
+	}))
+	m.AddRequestTransformer(RequestTransformerFunc(func(req *http.Request, body io.Reader) io.Reader {
+		return io.MultiReader(body, strings.NewReader(" suffix"))
+	}))
+
+	req, err := http.NewRequest("POST", "http://example.com", strings.NewReader("body"))
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	req.Header.Set("Content-Length", "4")
+
+	if err := m.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+
+	if got, want := req.ContentLength, int64(-1); got != want {
+		t.Errorf("req.ContentLength: got %d, want %d", got, want)
+	}
+	if got := req.Header.Get("Content-Length"); got != "" {
+		t.Errorf("req.Header.Get(%q): got %q, want no header", "Content-Length", got)
+	}
+
+	got, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	if want := "BODY suffix"; string(got) != want {
+		t.Errorf("req.Body: got %q, want %q", got, want)
+	}
+}
+
+func TestModifyResponse(t *testing.T) {
+	m := NewModifier()
+	m.AddResponseTransformer(ResponseTransformerFunc(func(res *http.Response, body io.Reader) io.Reader {
+		return &upperReader{r: body}
+	}))
+
+	cr := &closeRecorder{Reader: strings.NewReader("body")}
+	res := proxyutil.NewResponse(200, nil, nil)
+	res.Body = cr
+	res.ContentLength = 4
+
+	if err := m.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+
+	if got, want := res.ContentLength, int64(-1); got != want {
+		t.Errorf("res.ContentLength: got %d, want %d", got, want)
+	}
+	if got, want := res.TransferEncoding, []string{"chunked"}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("res.TransferEncoding: got %v, want %v", got, want)
+	}
+
+	got, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	if want := "BODY"; string(got) != want {
+		t.Errorf("res.Body: got %q, want %q", got, want)
+	}
+
+	res.Body.Close()
+	if !cr.closed {
+		t.Error("original body closed: got false, want true")
+	}
+}
+
+func TestModifyResponseNoBody(t *testing.T) {
+	m := NewModifier()
+	m.AddResponseTransformer(ResponseTransformerFunc(func(res *http.Response, body io.Reader) io.Reader {
+		t.Fatal("TransformResponse called for a response without a body")
+		return body
+	}))
+
+	res := proxyutil.NewResponse(204, nil, nil)
+	res.Body = http.NoBody
+	res.ContentLength = 0
+
+	if err := m.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse(): got %v, want no error", err)
+	}
+	if got, want := res.ContentLength, int64(0); got != want {
+		t.Errorf("res.ContentLength: got %d, want %d", got, want)
+	}
+}
+
+func TestModifyResponseUpgrade(t *testing.T) {
+	m := NewModifier()
+	m.AddResponseTransformer(ResponseTransformerFunc(func(res *http.Response, body io.Reader) io.Reader {
+		t.Fatal("TransformResponse called for a protocol upgrade")
+		return body
+	}))
+
+	tt := []struct {
+		code   int
+		header http.Header
+	}{
+		{101, http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}}},
+		{101, http.Header{}},
+		{200, http.Header{"Upgrade": {"h2c"}}},
+	}
+
+	for i, tc := range tt {
+		body := ioutil.NopCloser(strings.NewReader("frames"))
+		res := proxyutil.NewResponse(tc.code, body, nil)
+		res.Header = tc.header
+
+		if err := m.ModifyResponse(res); err != nil {
+			t.Fatalf("%d. ModifyResponse(): got %v, want no error", i, err)
+		}
+		if res.Body != body {
+			t.Errorf("%d. res.Body: got %T, want the original body", i, res.Body)
+		}
+	}
+}
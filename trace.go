@@ -0,0 +1,191 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+)
+
+// RoundTripTrace holds the times at which the phases of sending a request
+// upstream and receiving its response happened, so that loggers can report
+// timings. Phases that did not happen, such as the DNS lookup of a request
+// sent on a reused connection, are left zero.
+type RoundTripTrace struct {
+	// HandshakeStart and HandshakeDone bound the TLS handshake with the
+	// client. They are only set for the first request read from a MITM'd
+	// connection.
+	HandshakeStart time.Time
+	HandshakeDone  time.Time
+
+	// Start is when the proxy started sending the request upstream, or
+	// connecting to the target of a CONNECT request.
+	Start time.Time
+	// DNSStart and DNSDone bound the DNS lookup of the host.
+	DNSStart time.Time
+	DNSDone  time.Time
+	// ConnectStart and ConnectDone bound the dial of the upstream connection.
+	// They include the DNS lookup when the dial func of the proxy is set with
+	// SetDial.
+	ConnectStart time.Time
+	ConnectDone  time.Time
+	// TLSHandshakeStart and TLSHandshakeDone bound the TLS handshake with the
+	// upstream.
+	TLSHandshakeStart time.Time
+	TLSHandshakeDone  time.Time
+	// GotConn is when the connection to send the request on was obtained.
+	GotConn time.Time
+	// WroteRequest is when the request, including its body, was written.
+	WroteRequest time.Time
+	// GotFirstResponseByte is when the first byte of the response headers
+	// was read.
+	GotFirstResponseByte time.Time
+
+	// ServerIP is the IP address that the request was sent to, which is that
+	// of the downstream proxy when there is one.
+	ServerIP string
+	// Connection identifies the upstream connection by its local port.
+	Connection string
+	// Reused is whether the connection had been used for a previous request.
+	Reused bool
+}
+
+// RoundTripTrace returns the trace of the round trip of the current request,
+// or false if nothing has been traced for it, such as when the round trip is
+// skipped.
+func (ctx *Context) RoundTripTrace() (RoundTripTrace, bool) {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+
+	return ctx.trace, ctx.traced
+}
+
+// updateTrace calls f with the trace of the current request.
+func (ctx *Context) updateTrace(f func(t *RoundTripTrace)) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	f(&ctx.trace)
+	ctx.traced = true
+}
+
+// clientTrace returns the hooks of the *http.Transport that record the trace
+// of the current request. Dials may race, so the first start and the last
+// successful completion of each phase are kept.
+func (ctx *Context) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			now := time.Now()
+			ctx.updateTrace(func(t *RoundTripTrace) {
+				if t.DNSStart.IsZero() {
+					t.DNSStart = now
+				}
+			})
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			now := time.Now()
+			ctx.updateTrace(func(t *RoundTripTrace) {
+				t.DNSDone = now
+			})
+		},
+		ConnectStart: func(string, string) {
+			now := time.Now()
+			ctx.updateTrace(func(t *RoundTripTrace) {
+				if t.ConnectStart.IsZero() {
+					t.ConnectStart = now
+				}
+			})
+		},
+		ConnectDone: func(_, _ string, err error) {
+			if err != nil {
+				return
+			}
+			now := time.Now()
+			ctx.updateTrace(func(t *RoundTripTrace) {
+				t.ConnectDone = now
+			})
+		},
+		TLSHandshakeStart: func() {
+			now := time.Now()
+			ctx.updateTrace(func(t *RoundTripTrace) {
+				t.TLSHandshakeStart = now
+			})
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err != nil {
+				return
+			}
+			now := time.Now()
+			ctx.updateTrace(func(t *RoundTripTrace) {
+				t.TLSHandshakeDone = now
+			})
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			now := time.Now()
+			ctx.updateTrace(func(t *RoundTripTrace) {
+				t.GotConn = now
+				t.Reused = info.Reused
+				t.ServerIP, t.Connection = connAddrs(info.Conn)
+			})
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			now := time.Now()
+			ctx.updateTrace(func(t *RoundTripTrace) {
+				t.WroteRequest = now
+			})
+		},
+		GotFirstResponseByte: func() {
+			now := time.Now()
+			ctx.updateTrace(func(t *RoundTripTrace) {
+				t.GotFirstResponseByte = now
+			})
+		},
+	}
+}
+
+// connAddrs returns the IP address of the remote end of conn and the port of
+// its local end.
+func connAddrs(conn net.Conn) (ip, port string) {
+	if conn == nil {
+		return "", ""
+	}
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+		ip = host
+	}
+	if _, p, err := net.SplitHostPort(conn.LocalAddr().String()); err == nil {
+		port = p
+	}
+
+	return ip, port
+}
+
+// traceRequest calls f with the trace of req, if req has a context.
+func traceRequest(req *http.Request, f func(t *RoundTripTrace)) {
+	if ctx := NewContext(req); ctx != nil {
+		ctx.updateTrace(f)
+	}
+}
+
+// traceConn records in the trace of req that req is sent on conn.
+func traceConn(req *http.Request, conn net.Conn) {
+	now := time.Now()
+	traceRequest(req, func(t *RoundTripTrace) {
+		t.GotConn = now
+		t.ServerIP, t.Connection = connAddrs(conn)
+	})
+}
@@ -0,0 +1,347 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/martian/v3/martiantest"
+	"github.com/google/martian/v3/mitm"
+)
+
+// traceRecorder returns a response modifier that sends the trace of each
+// response to the returned channel.
+func traceRecorder() (ResponseModifier, <-chan RoundTripTrace) {
+	traces := make(chan RoundTripTrace, 10)
+
+	return ResponseModifierFunc(func(res *http.Response) error {
+		rt, _ := NewContext(res.Request).RoundTripTrace()
+		traces <- rt
+		return nil
+	}), traces
+}
+
+// ordered returns whether the times are not zero and in order.
+func ordered(ts ...time.Time) bool {
+	for i, t := range ts {
+		if t.IsZero() || (i > 0 && t.Before(ts[i-1])) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestIntegrationRoundTripTrace(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("body"))
+	}))
+	defer srv.Close()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	resmod, traces := traceRecorder()
+	p.SetResponseModifier(resmod)
+
+	go p.Serve(l)
+
+	c := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: l.Addr().String()})},
+		Timeout:   5 * time.Second,
+	}
+
+	for i := 0; i < 2; i++ {
+		res, err := c.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("%d. c.Get(): got %v, want no error", i, err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+
+	first, second := <-traces, <-traces
+
+	if !ordered(first.Start, first.ConnectStart, first.ConnectDone, first.GotConn, first.WroteRequest, first.GotFirstResponseByte) {
+		t.Errorf("first trace: got %+v, want ordered phases from start to first response byte", first)
+	}
+	if first.Reused {
+		t.Error("first.Reused: got true, want false")
+	}
+	if got, want := first.ServerIP, "127.0.0.1"; got != want {
+		t.Errorf("first.ServerIP: got %q, want %q", got, want)
+	}
+	if first.Connection == "" {
+		t.Error("first.Connection: got empty, want the local port")
+	}
+	if !first.HandshakeStart.IsZero() || !first.TLSHandshakeStart.IsZero() {
+		t.Errorf("first trace: got %+v, want no TLS handshakes", first)
+	}
+
+	if !ordered(second.Start, second.GotConn, second.WroteRequest, second.GotFirstResponseByte) {
+		t.Errorf("second trace: got %+v, want ordered phases from start to first response byte", second)
+	}
+	if !second.Reused {
+		t.Error("second.Reused: got false, want true")
+	}
+	if !second.ConnectStart.IsZero() {
+		t.Errorf("second.ConnectStart: got %v, want zero on a reused connection", second.ConnectStart)
+	}
+	if got, want := second.Connection, first.Connection; got != want {
+		t.Errorf("second.Connection: got %q, want %q", got, want)
+	}
+}
+
+func TestIntegrationRoundTripTraceSetDial(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("body"))
+	}))
+	defer srv.Close()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	// A dial func set after the round tripper, such as a traffic shaped one,
+	// is used by the transport and traced.
+	dialed := make(chan string, 1)
+	p.SetRoundTripper(&http.Transport{})
+	p.SetDial(func(network, addr string) (net.Conn, error) {
+		dialed <- addr
+		return net.Dial(network, addr)
+	})
+
+	resmod, traces := traceRecorder()
+	p.SetResponseModifier(resmod)
+
+	go p.Serve(l)
+
+	c := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: l.Addr().String()})},
+		Timeout:   5 * time.Second,
+	}
+
+	res, err := c.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("c.Get(): got %v, want no error", err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	select {
+	case got := <-dialed:
+		if want := srv.Listener.Addr().String(); got != want {
+			t.Errorf("dial: got addr %q, want %q", got, want)
+		}
+	default:
+		t.Fatal("dial: got not called, want the dial func set with SetDial")
+	}
+
+	trace := <-traces
+	if !ordered(trace.Start, trace.ConnectStart, trace.ConnectDone, trace.GotConn) {
+		t.Errorf("trace: got %+v, want ordered phases from start to connection", trace)
+	}
+}
+
+func TestIntegrationRoundTripTraceMITM(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	tr := martiantest.NewTransport()
+	p.SetRoundTripper(tr)
+
+	ca, priv, err := mitm.NewAuthority("martian.proxy", "Martian Authority", 2*time.Hour)
+	if err != nil {
+		t.Fatalf("mitm.NewAuthority(): got %v, want no error", err)
+	}
+	mc, err := mitm.NewConfig(ca, priv)
+	if err != nil {
+		t.Fatalf("mitm.NewConfig(): got %v, want no error", err)
+	}
+	p.SetMITM(mc)
+
+	resmod, traces := traceRecorder()
+	p.SetResponseModifier(resmod)
+
+	go p.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	req, err := http.NewRequest("CONNECT", "//example.com:443", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("req.Write(): got %v, want no error", err)
+	}
+	if _, err := http.ReadResponse(bufio.NewReader(conn), req); err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	<-traces
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	tlsconn := tls.Client(conn, &tls.Config{
+		ServerName: "example.com",
+		RootCAs:    roots,
+	})
+	defer tlsconn.Close()
+	brw := bufio.NewReader(tlsconn)
+
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("GET", "https://example.com", nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest(): got %v, want no error", err)
+		}
+		if err := req.Write(tlsconn); err != nil {
+			t.Fatalf("req.Write(): got %v, want no error", err)
+		}
+		res, err := http.ReadResponse(brw, req)
+		if err != nil {
+			t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+		}
+		res.Body.Close()
+	}
+
+	first, second := <-traces, <-traces
+	if !ordered(first.HandshakeStart, first.HandshakeDone, first.Start) {
+		t.Errorf("first trace: got %+v, want the MITM handshake before the start", first)
+	}
+	if !second.HandshakeStart.IsZero() {
+		t.Errorf("second.HandshakeStart: got %v, want zero after the first request", second.HandshakeStart)
+	}
+}
+
+func TestIntegrationRoundTripTraceConnect(t *testing.T) {
+	t.Parallel()
+
+	tl, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+	defer tl.Close()
+	go func() {
+		conn, err := tl.Accept()
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	resmod, traces := traceRecorder()
+	p.SetResponseModifier(resmod)
+
+	go p.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	req, err := http.NewRequest("CONNECT", "//"+tl.Addr().String(), nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("req.Write(): got %v, want no error", err)
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	if got, want := res.StatusCode, 200; got != want {
+		t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+	}
+
+	rt := <-traces
+	if !ordered(rt.Start, rt.ConnectStart, rt.ConnectDone, rt.GotConn, rt.WroteRequest, rt.GotFirstResponseByte) {
+		t.Errorf("trace: got %+v, want ordered phases from start to first response byte", rt)
+	}
+	if got, want := rt.ServerIP, "127.0.0.1"; got != want {
+		t.Errorf("rt.ServerIP: got %q, want %q", got, want)
+	}
+}
+
+func TestRoundTripTraceSkipped(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	ctx, remove, err := TestContext(req, nil, nil)
+	if err != nil {
+		t.Fatalf("TestContext(): got %v, want no error", err)
+	}
+	defer remove()
+
+	if _, ok := ctx.RoundTripTrace(); ok {
+		t.Error("ctx.RoundTripTrace(): got true, want false before the round trip")
+	}
+
+	ctx.SkipRoundTrip()
+	p := NewProxy()
+	defer p.Close()
+	res, err := p.roundTrip(ctx, req)
+	if err != nil {
+		t.Fatalf("p.roundTrip(): got %v, want no error", err)
+	}
+	res.Body.Close()
+
+	if _, ok := ctx.RoundTripTrace(); ok {
+		t.Error("ctx.RoundTripTrace(): got true, want false for a skipped round trip")
+	}
+}
@@ -233,7 +233,12 @@ func (l *Listener) Accept() (net.Conn, error) {
 		return nil, err
 	}
 
-	if tconn, ok := oc.(*net.TCPConn); ok {
+	// Connections wrapping a *net.TCPConn, such as those of a PROXY protocol
+	// listener, support keep-alives too.
+	if tconn, ok := oc.(interface {
+		SetKeepAlive(bool) error
+		SetKeepAlivePeriod(time.Duration) error
+	}); ok {
 		log.Debugf("trafficshape: setting keep-alive for TCP connection")
 		tconn.SetKeepAlive(true)
 		tconn.SetKeepAlivePeriod(3 * time.Minute)
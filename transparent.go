@@ -0,0 +1,202 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/martian/v3/log"
+)
+
+// originalDestination returns the host:port a redirected connection was
+// originally addressed to. It is a variable so that tests can replace it.
+var originalDestination = originalDst
+
+// ServeTransparent accepts connections that were redirected to the listener by
+// a packet filter, such as iptables REDIRECT, and handles their requests.
+//
+// The original destination of each connection is recovered with
+// SO_ORIGINAL_DST, which is only available on Linux. TLS connections are
+// MITM'd with the proxy's mitm.Config, using SNI to generate certificates, or
+// tunneled to the original destination when MITM is not configured. Plain
+// connections are handled as HTTP.
+func (p *Proxy) ServeTransparent(l net.Listener) error {
+	return p.serve(l, p.handleTransparentLoop)
+}
+
+func (p *Proxy) handleTransparentLoop(conn net.Conn) {
+	defer p.trackConn(conn)()
+	defer conn.Close()
+	if p.Closing() {
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(p.timeout))
+	brw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	s, err := newSession(conn, brw)
+	if err != nil {
+		log.Errorf("martian: failed to create session: %v", err)
+		return
+	}
+	p.hooks.accept(s, conn)
+
+	p.hooks.closed(s, p.handleTransparent(s, conn, brw))
+}
+
+// handleTransparent handles a transparently proxied connection and returns the
+// error that caused it to be closed.
+func (p *Proxy) handleTransparent(s *Session, conn net.Conn, brw *bufio.ReadWriter) error {
+	dst, err := originalDestination(conn)
+	if err != nil {
+		log.Errorf("martian: failed to get original destination for %s: %v", conn.RemoteAddr(), err)
+		return err
+	}
+	log.Debugf("martian: transparent connection from %s to %s", conn.RemoteAddr(), dst)
+
+	return p.handleDestination(s, conn, brw, dst)
+}
+
+// handleDestination handles a connection whose destination is known before any
+// data is read from it, and returns the error that caused it to be closed. TLS
+// connections are MITM'd, or tunneled to dst if MITM is not configured, and
+// all other connections are handled as HTTP.
+func (p *Proxy) handleDestination(s *Session, conn net.Conn, brw *bufio.ReadWriter, dst string) error {
+	s.setOriginalDestination(dst)
+
+	b, err := brw.Peek(1)
+	if err != nil {
+		if !isCloseable(err) {
+			log.Errorf("martian: error peeking connection to determine type: %v", err)
+		}
+		return err
+	}
+
+	// 22 is the TLS handshake.
+	// https://tools.ietf.org/html/rfc5246#section-6.2.1
+	if b[0] == 22 {
+		if p.mitm == nil {
+			return p.tunnel(s, conn, brw, dst)
+		}
+
+		tlsconn := tls.Server(&peekedConn{conn, brw.Reader}, p.mitm.TLSForHost(dst))
+		if err := tlsconn.Handshake(); err != nil {
+			p.mitm.HandshakeErrorCallback(connectRequest(dst), err)
+			p.metrics.HandshakeFailed()
+			log.Errorf("martian: failed TLS handshake for connection to %s: %v", dst, err)
+			return err
+		}
+
+		cs := tlsconn.ConnectionState()
+		p.hooks.mitmHandshakeDone(s, cs)
+		if cs.NegotiatedProtocol == "h2" {
+			host := dst
+			if _, port, err := net.SplitHostPort(dst); err == nil && cs.ServerName != "" {
+				host = net.JoinHostPort(cs.ServerName, port)
+			}
+			p.hooks.h2Negotiated(s, host)
+
+			if err := p.proxyH2(tlsconn, connectRequest(host)); err != nil {
+				log.Errorf("martian: failed to proxy h2 for %s: %v", host, err)
+				return err
+			}
+			return nil
+		}
+
+		conn = tlsconn
+		brw = bufio.NewReadWriter(bufio.NewReader(tlsconn), bufio.NewWriter(tlsconn))
+		s.setConn(conn, brw)
+	}
+
+	return p.handleSession(s, conn, brw)
+}
+
+// tunnel relays the connection to dst without inspecting it, through the
+// downstream proxy if one is set. It returns an error if the tunnel could not
+// be established.
+func (p *Proxy) tunnel(s *Session, conn net.Conn, brw *bufio.ReadWriter, dst string) error {
+	log.Debugf("martian: tunneling connection to %s", dst)
+
+	// The request stands in for the CONNECT request when choosing the
+	// downstream proxy, so it carries the session of the connection.
+	req := connectRequest(dst)
+	ctx, err := withSession(s)
+	if err != nil {
+		return err
+	}
+	link(req, ctx)
+	defer unlink(req)
+
+	res, cconn, err := p.connect(req)
+	if err != nil {
+		log.Errorf("martian: failed to tunnel connection to %s: %v", dst, err)
+		return err
+	}
+	defer res.Body.Close()
+	defer cconn.Close()
+
+	if res.StatusCode != 200 {
+		log.Errorf("martian: failed to tunnel connection to %s: %s", dst, res.Status)
+		return fmt.Errorf("downstream proxy responded to CONNECT with %q", res.Status)
+	}
+
+	p.metrics.TunnelOpened()
+	defer p.metrics.TunnelClosed()
+
+	copySync := func(w io.Writer, r io.Reader, n *int64, donec chan<- bool) {
+		var err error
+		if *n, err = io.Copy(w, r); err != nil && !isCloseable(err) {
+			log.Debugf("martian: tunnel finished copying: %v", err)
+		}
+
+		donec <- true
+	}
+
+	var sent, received int64
+	donec := make(chan bool, 2)
+	go copySync(cconn, brw.Reader, &sent, donec)
+	go copySync(conn, cconn, &received, donec)
+
+	<-donec
+	conn.Close()
+	cconn.Close()
+	<-donec
+
+	log.Debugf("martian: closed tunnel to %s", dst)
+	p.hooks.tunnelDone(s, dst, sent, received)
+
+	return nil
+}
+
+// connectRequest returns a CONNECT request for host, standing in for the
+// request that a client would send to a non-transparent proxy.
+func connectRequest(host string) *http.Request {
+	return &http.Request{
+		Method:     "CONNECT",
+		URL:        &url.URL{Host: host},
+		Host:       host,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+	}
+}
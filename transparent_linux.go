@@ -0,0 +1,85 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"github.com/google/martian/v3/trafficshape"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST from linux/netfilter_ipv4.h, which has the
+// same value as IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv6/ip6_tables.h.
+const soOriginalDst = 80
+
+// originalDst returns the destination of a connection before it was redirected
+// by netfilter.
+func originalDst(conn net.Conn) (string, error) {
+	if tsconn, ok := conn.(*trafficshape.Conn); ok {
+		conn = tsconn.GetWrappedConn()
+	}
+
+	tconn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", fmt.Errorf("martian: original destination requires a TCP connection, got %T", conn)
+	}
+	rc, err := tconn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	var ip net.IP
+	var port [2]byte
+	var serr error
+	ipv4 := true
+	if laddr, ok := tconn.LocalAddr().(*net.TCPAddr); ok && laddr.IP.To4() == nil {
+		ipv4 = false
+	}
+
+	if err := rc.Control(func(fd uintptr) {
+		if ipv4 {
+			// The struct sockaddr_in result fits in an IPv6Mreq.
+			var mreq *syscall.IPv6Mreq
+			mreq, serr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+			if serr != nil {
+				return
+			}
+			copy(port[:], mreq.Multiaddr[2:4])
+			ip = net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7])
+			return
+		}
+
+		// The struct sockaddr_in6 result fits in an IPv6MTUInfo.
+		var info *syscall.IPv6MTUInfo
+		info, serr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+		if serr != nil {
+			return
+		}
+		copy(port[:], (*[2]byte)(unsafe.Pointer(&info.Addr.Port))[:])
+		ip = make(net.IP, net.IPv6len)
+		copy(ip, info.Addr.Addr[:])
+	}); err != nil {
+		return "", err
+	}
+	if serr != nil {
+		return "", fmt.Errorf("martian: getsockopt(SO_ORIGINAL_DST): %v", serr)
+	}
+
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
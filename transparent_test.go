@@ -0,0 +1,242 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/martian/v3/martiantest"
+	"github.com/google/martian/v3/mitm"
+	"github.com/google/martian/v3/proxyutil"
+)
+
+// fakeOriginalDestination replaces the SO_ORIGINAL_DST lookup, which requires
+// netfilter rules, and returns a function that restores it.
+func fakeOriginalDestination(dst string) func() {
+	orig := originalDestination
+	originalDestination = func(net.Conn) (string, error) { return dst, nil }
+	return func() { originalDestination = orig }
+}
+
+func TestIntegrationServeTransparentHTTP(t *testing.T) {
+	defer fakeOriginalDestination("192.0.2.1:8080")()
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	tr := martiantest.NewTransport()
+	tr.Func(func(req *http.Request) (*http.Response, error) {
+		res := proxyutil.NewResponse(200, nil, req)
+		res.Header.Set("Request-URL", req.URL.String())
+
+		return res, nil
+	})
+	p.SetRoundTripper(tr)
+	p.SetTimeout(200 * time.Millisecond)
+
+	tm := martiantest.NewModifier()
+	p.SetRequestModifier(tm)
+	p.SetResponseModifier(tm)
+
+	go p.ServeTransparent(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	// HTTP/1.0 requests may omit the Host header, in which case the original
+	// destination is used.
+	if _, err := conn.Write([]byte("GET /path HTTP/1.0\r\n\r\n")); err != nil {
+		t.Fatalf("conn.Write(): got %v, want no error", err)
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	defer res.Body.Close()
+
+	if got, want := res.StatusCode, 200; got != want {
+		t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+	}
+	if got, want := res.Header.Get("Request-URL"), "http://192.0.2.1:8080/path"; got != want {
+		t.Errorf("res.Header.Get(%q): got %q, want %q", "Request-URL", got, want)
+	}
+
+	if !tm.RequestModified() {
+		t.Error("tm.RequestModified(): got false, want true")
+	}
+	if !tm.ResponseModified() {
+		t.Error("tm.ResponseModified(): got false, want true")
+	}
+}
+
+func TestIntegrationServeTransparentMITM(t *testing.T) {
+	defer fakeOriginalDestination("192.0.2.1:443")()
+
+	ca, priv, err := mitm.NewAuthority("martian.proxy", "Martian Authority", 2*time.Hour)
+	if err != nil {
+		t.Fatalf("mitm.NewAuthority(): got %v, want no error", err)
+	}
+
+	mc, err := mitm.NewConfig(ca, priv)
+	if err != nil {
+		t.Fatalf("mitm.NewConfig(): got %v, want no error", err)
+	}
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	p.SetMITM(mc)
+	p.SetTimeout(200 * time.Millisecond)
+
+	tr := martiantest.NewTransport()
+	tr.Func(func(req *http.Request) (*http.Response, error) {
+		res := proxyutil.NewResponse(200, nil, req)
+		res.Header.Set("Request-URL", req.URL.String())
+
+		return res, nil
+	})
+	p.SetRoundTripper(tr)
+
+	go p.ServeTransparent(l)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	tlsconn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		ServerName: "example.com",
+		RootCAs:    roots,
+	})
+	if err != nil {
+		t.Fatalf("tls.Dial(): got %v, want no error", err)
+	}
+	defer tlsconn.Close()
+
+	req, err := http.NewRequest("GET", "https://example.com/secure", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	if err := req.Write(tlsconn); err != nil {
+		t.Fatalf("req.Write(): got %v, want no error", err)
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(tlsconn), req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	defer res.Body.Close()
+
+	if got, want := res.StatusCode, 200; got != want {
+		t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+	}
+	if got, want := res.Header.Get("Request-URL"), "https://example.com/secure"; got != want {
+		t.Errorf("res.Header.Get(%q): got %q, want %q", "Request-URL", got, want)
+	}
+}
+
+func TestIntegrationServeTransparentTunnel(t *testing.T) {
+	ca, priv, err := mitm.NewAuthority("martian.proxy", "Martian Authority", 2*time.Hour)
+	if err != nil {
+		t.Fatalf("mitm.NewAuthority(): got %v, want no error", err)
+	}
+
+	mc, err := mitm.NewConfig(ca, priv)
+	if err != nil {
+		t.Fatalf("mitm.NewConfig(): got %v, want no error", err)
+	}
+
+	sl, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+	sl = tls.NewListener(sl, mc.TLS())
+	defer sl.Close()
+
+	go http.Serve(sl, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("origin"))
+	}))
+
+	defer fakeOriginalDestination(sl.Addr().String())()
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	// Without MITM, TLS connections are tunneled to the original destination.
+	p := NewProxy()
+	defer p.Close()
+
+	p.SetTimeout(time.Second)
+
+	go p.ServeTransparent(l)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	tlsconn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		ServerName: "example.com",
+		RootCAs:    roots,
+	})
+	if err != nil {
+		t.Fatalf("tls.Dial(): got %v, want no error", err)
+	}
+	defer tlsconn.Close()
+
+	req, err := http.NewRequest("GET", "https://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	req.Header.Set("Connection", "close")
+
+	if err := req.Write(tlsconn); err != nil {
+		t.Fatalf("req.Write(): got %v, want no error", err)
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(tlsconn), req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	defer res.Body.Close()
+
+	got, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll(): got %v, want no error", err)
+	}
+	if want := "origin"; string(got) != want {
+		t.Errorf("res.Body: got %q, want %q", got, want)
+	}
+}
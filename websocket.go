@@ -0,0 +1,336 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/google/martian/v3/log"
+)
+
+// WebSocket opcodes for data frames.
+//
+// https://tools.ietf.org/html/rfc6455#section-5.2
+const (
+	// WebSocketText is the opcode of a text message.
+	WebSocketText byte = 0x1
+	// WebSocketBinary is the opcode of a binary message.
+	WebSocketBinary byte = 0x2
+
+	wsContinuation byte = 0x0
+	wsClose        byte = 0x8
+
+	// wsMessageTooBig is the close status of a connection that sent a frame
+	// or message larger than the proxy accepts.
+	//
+	// https://tools.ietf.org/html/rfc6455#section-7.4.1
+	wsMessageTooBig = 1009
+)
+
+const (
+	// DefaultWebSocketMaxFrameSize is the default maximum payload size of a
+	// WebSocket frame relayed through a WebSocketModifier.
+	DefaultWebSocketMaxFrameSize = 16 << 20
+	// DefaultWebSocketMaxMessageSize is the default maximum size of a
+	// reassembled WebSocket message passed to a WebSocketModifier.
+	DefaultWebSocketMaxMessageSize = 32 << 20
+)
+
+// errWSTooBig is returned when a WebSocket frame or message exceeds the
+// limits of the proxy.
+var errWSTooBig = errors.New("martian: WebSocket message too big")
+
+// WebSocketMessage is a complete text or binary message relayed through a
+// WebSocket connection. Fragmented messages are reassembled before they are
+// passed to a WebSocketModifier.
+type WebSocketMessage struct {
+	// Request is the upgrade request that established the connection.
+	Request *http.Request
+	// FromClient is true for messages sent by the client to the server.
+	FromClient bool
+	// Opcode is either WebSocketText or WebSocketBinary.
+	Opcode byte
+	// Data is the unmasked payload of the message. Modifiers may replace it.
+	Data []byte
+
+	dropped bool
+}
+
+// Drop prevents the message from being forwarded.
+func (msg *WebSocketMessage) Drop() {
+	msg.dropped = true
+}
+
+// Dropped returns whether the message will be dropped.
+func (msg *WebSocketMessage) Dropped() bool {
+	return msg.dropped
+}
+
+// WebSocketModifier is an interface that defines a modifier for messages
+// relayed over a WebSocket connection that was upgraded through the proxy.
+type WebSocketModifier interface {
+	// ModifyWebSocketMessage modifies the message.
+	ModifyWebSocketMessage(msg *WebSocketMessage) error
+}
+
+// WebSocketModifierFunc is an adapter for using a function with the given
+// signature as a WebSocketModifier.
+type WebSocketModifierFunc func(msg *WebSocketMessage) error
+
+// ModifyWebSocketMessage modifies the message using the given function.
+func (f WebSocketModifierFunc) ModifyWebSocketMessage(msg *WebSocketMessage) error {
+	return f(msg)
+}
+
+// wsFrame is a single WebSocket frame with its payload unmasked.
+//
+// https://tools.ietf.org/html/rfc6455#section-5.2
+type wsFrame struct {
+	fin     bool
+	rsv     byte
+	opcode  byte
+	masked  bool
+	mask    [4]byte
+	payload []byte
+}
+
+// readWSFrame reads a single frame from r. If the payload is longer than max
+// bytes, errWSTooBig is returned before it is read.
+func readWSFrame(r *bufio.Reader, max int64) (*wsFrame, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	f := &wsFrame{
+		fin:    hdr[0]&0x80 != 0,
+		rsv:    hdr[0] & 0x70,
+		opcode: hdr[0] & 0x0f,
+		masked: hdr[1]&0x80 != 0,
+	}
+
+	n := uint64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+		if n > 1<<63-1 {
+			return nil, fmt.Errorf("martian: invalid WebSocket payload length: %d", n)
+		}
+	}
+
+	if f.masked {
+		if _, err := io.ReadFull(r, f.mask[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	if n > uint64(max) {
+		return nil, errWSTooBig
+	}
+
+	f.payload = make([]byte, n)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return nil, err
+	}
+	if f.masked {
+		maskWSPayload(f.mask, f.payload)
+	}
+
+	return f, nil
+}
+
+// write writes the frame to w, masking the payload if the frame is masked.
+func (f *wsFrame) write(w io.Writer) error {
+	hdr := make([]byte, 2, 14)
+	hdr[0] = f.rsv | f.opcode
+	if f.fin {
+		hdr[0] |= 0x80
+	}
+
+	switch n := len(f.payload); {
+	case n < 126:
+		hdr[1] = byte(n)
+	case n <= 0xffff:
+		hdr[1] = 126
+		hdr = append(hdr, 0, 0)
+		binary.BigEndian.PutUint16(hdr[2:], uint16(n))
+	default:
+		hdr[1] = 127
+		hdr = append(hdr, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(hdr[2:], uint64(n))
+	}
+
+	payload := f.payload
+	if f.masked {
+		hdr[1] |= 0x80
+		hdr = append(hdr, f.mask[:]...)
+
+		payload = make([]byte, len(f.payload))
+		copy(payload, f.payload)
+		maskWSPayload(f.mask, payload)
+	}
+
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// maskWSPayload masks or unmasks b in place.
+func maskWSPayload(mask [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= mask[i%4]
+	}
+}
+
+// wsWriter writes frames to one side of a WebSocket connection, which both
+// directions of the relay write to when closing it.
+type wsWriter struct {
+	mu sync.Mutex
+	w  *bufio.Writer
+	// masked is whether frames are masked, as those sent to the server must be.
+	masked bool
+}
+
+// writeFrame writes f to the connection and flushes it.
+func (w *wsWriter) writeFrame(f *wsFrame) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	f.masked = w.masked
+	if f.masked {
+		if _, err := rand.Read(f.mask[:]); err != nil {
+			return err
+		}
+	}
+	if err := f.write(w.w); err != nil {
+		return err
+	}
+
+	return w.w.Flush()
+}
+
+// closeTooBig sends a close frame with status 1009 (message too big).
+func (w *wsWriter) closeTooBig() {
+	payload := make([]byte, 2, 2+len("message too big"))
+	binary.BigEndian.PutUint16(payload, wsMessageTooBig)
+	payload = append(payload, "message too big"...)
+
+	if err := w.writeFrame(&wsFrame{fin: true, opcode: wsClose, payload: payload}); err != nil {
+		log.Debugf("martian: failed to send WebSocket close frame: %v", err)
+	}
+}
+
+// relayWebSocket copies frames from src to dst, reassembling fragmented data
+// messages and passing them through the proxy's WebSocketModifier. Control
+// frames and frames using extensions (RSV bits) are forwarded unchanged. A
+// frame or message larger than the limits of the proxy closes the connection
+// with status 1009 on both sides, through dst and back.
+func (p *Proxy) relayWebSocket(req *http.Request, fromClient bool, dst, back *wsWriter, src *bufio.Reader) error {
+	err := p.relayWebSocketFrames(req, fromClient, dst, src)
+	if err == errWSTooBig {
+		log.Errorf("martian: closing WebSocket connection for %s: %v", req.URL, err)
+		dst.closeTooBig()
+		back.closeTooBig()
+	}
+
+	return err
+}
+
+func (p *Proxy) relayWebSocketFrames(req *http.Request, fromClient bool, dst *wsWriter, src *bufio.Reader) error {
+	var msg *wsFrame
+	// raw is true while relaying the fragments of a message that uses an
+	// extension, such as permessage-deflate, that the proxy cannot decode.
+	var raw bool
+	for {
+		f, err := readWSFrame(src, p.wsMaxFrameSize)
+		if err != nil {
+			return err
+		}
+
+		var out *wsFrame
+		switch {
+		case f.opcode >= wsClose:
+			out = f
+		case f.opcode != wsContinuation && (msg != nil || raw):
+			return fmt.Errorf("martian: unexpected WebSocket data frame in fragmented message")
+		case f.opcode == wsContinuation && raw:
+			out = f
+			raw = !f.fin
+		case f.opcode != wsContinuation && f.rsv != 0:
+			out = f
+			raw = !f.fin
+		case f.opcode == wsContinuation && msg == nil:
+			return fmt.Errorf("martian: unexpected WebSocket continuation frame")
+		case f.opcode == wsContinuation:
+			if int64(len(msg.payload))+int64(len(f.payload)) > p.wsMaxMessageSize {
+				return errWSTooBig
+			}
+			msg.payload = append(msg.payload, f.payload...)
+		case int64(len(f.payload)) > p.wsMaxMessageSize:
+			return errWSTooBig
+		default:
+			msg = f
+		}
+
+		if out == nil && f.fin {
+			out = msg
+			msg = nil
+
+			wsmsg := &WebSocketMessage{
+				Request:    req,
+				FromClient: fromClient,
+				Opcode:     out.opcode,
+				Data:       out.payload,
+			}
+			if err := p.wsmod.ModifyWebSocketMessage(wsmsg); err != nil {
+				log.Errorf("martian: error modifying WebSocket message: %v", err)
+			}
+			if wsmsg.Dropped() {
+				log.Debugf("martian: dropped WebSocket message for %s", req.URL)
+				continue
+			}
+
+			out.fin = true
+			out.opcode = wsmsg.Opcode
+			out.payload = wsmsg.Data
+		}
+		if out == nil {
+			continue
+		}
+
+		if err := dst.writeFrame(out); err != nil {
+			return err
+		}
+	}
+}
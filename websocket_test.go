@@ -0,0 +1,424 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/martian/v3/log"
+)
+
+func TestWebSocketFrameRoundTrip(t *testing.T) {
+	tt := []struct {
+		masked bool
+		size   int
+	}{
+		{false, 0},
+		{true, 5},
+		{false, 125},
+		{true, 126},
+		{false, 70000},
+	}
+
+	for i, tc := range tt {
+		f := &wsFrame{
+			fin:     true,
+			opcode:  WebSocketBinary,
+			masked:  tc.masked,
+			mask:    [4]byte{1, 2, 3, 4},
+			payload: bytes.Repeat([]byte("a"), tc.size),
+		}
+
+		buf := &bytes.Buffer{}
+		if err := f.write(buf); err != nil {
+			t.Fatalf("%d. f.write(): got %v, want no error", i, err)
+		}
+
+		got, err := readWSFrame(bufio.NewReader(buf), DefaultWebSocketMaxFrameSize)
+		if err != nil {
+			t.Fatalf("%d. readWSFrame(): got %v, want no error", i, err)
+		}
+
+		if got.masked != tc.masked {
+			t.Errorf("%d. got.masked: got %t, want %t", i, got.masked, tc.masked)
+		}
+		if !bytes.Equal(got.payload, f.payload) {
+			t.Errorf("%d. got.payload: got %d bytes, want %d bytes", i, len(got.payload), tc.size)
+		}
+	}
+}
+
+func TestReadWebSocketFrameTooBig(t *testing.T) {
+	buf := new(bytes.Buffer)
+	f := &wsFrame{fin: true, opcode: WebSocketBinary, payload: make([]byte, 1<<10)}
+	if err := f.write(buf); err != nil {
+		t.Fatalf("f.write(): got %v, want no error", err)
+	}
+
+	if _, err := readWSFrame(bufio.NewReader(buf), 1<<10-1); err != errWSTooBig {
+		t.Errorf("readWSFrame(): got %v, want %v", err, errWSTooBig)
+	}
+}
+
+func TestRelayWebSocketInterleavedMessage(t *testing.T) {
+	tt := []struct {
+		name   string
+		frames []*wsFrame
+	}{
+		{
+			name: "message",
+			frames: []*wsFrame{
+				{opcode: WebSocketText, payload: []byte("a")},
+				{fin: true, opcode: WebSocketText, payload: []byte("b")},
+			},
+		},
+		{
+			name: "extension message",
+			frames: []*wsFrame{
+				{opcode: WebSocketBinary, rsv: 0x40, payload: []byte("a")},
+				{fin: true, opcode: WebSocketBinary, payload: []byte("b")},
+			},
+		},
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	for _, tc := range tt {
+		in := new(bytes.Buffer)
+		for _, f := range tc.frames {
+			if err := f.write(in); err != nil {
+				t.Fatalf("%s: f.write(): got %v, want no error", tc.name, err)
+			}
+		}
+
+		// The data frame that interrupts the fragmented message is an error
+		// rather than the end of the connection.
+		out := new(bytes.Buffer)
+		dst := &wsWriter{w: bufio.NewWriter(out)}
+		if err := p.relayWebSocketFrames(req, true, dst, bufio.NewReader(in)); err == nil || err == io.EOF {
+			t.Errorf("%s: relayWebSocketFrames(): got %v, want protocol error", tc.name, err)
+		}
+	}
+}
+
+// serveWebSocketEcho accepts a single WebSocket handshake on l and echoes
+// every frame it receives back to the client.
+func serveWebSocketEcho(l net.Listener, extc chan<- string) {
+	conn, err := l.Accept()
+	if err != nil {
+		log.Errorf("websocket_test: failed to accept connection: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	brw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	req, err := http.ReadRequest(brw.Reader)
+	if err != nil {
+		log.Errorf("websocket_test: failed to read request: %v", err)
+		return
+	}
+	extc <- req.Header.Get("Sec-WebSocket-Extensions")
+
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n\r\n")
+	brw.Flush()
+
+	for {
+		f, err := readWSFrame(brw.Reader, DefaultWebSocketMaxFrameSize)
+		if err != nil {
+			return
+		}
+		f.masked = false
+		f.write(brw)
+		brw.Flush()
+	}
+}
+
+func TestIntegrationWebSocket(t *testing.T) {
+	t.Parallel()
+
+	sl, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+	defer sl.Close()
+
+	extc := make(chan string, 1)
+	go serveWebSocketEcho(sl, extc)
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	p.SetTimeout(2 * time.Second)
+
+	var mu sync.Mutex
+	var seen []string
+	p.SetWebSocketModifier(WebSocketModifierFunc(func(msg *WebSocketMessage) error {
+		mu.Lock()
+		seen = append(seen, fmt.Sprintf("%t:%s", msg.FromClient, msg.Data))
+		mu.Unlock()
+
+		switch string(msg.Data) {
+		case "drop":
+			msg.Drop()
+		case "rewrite":
+			msg.Data = []byte("rewritten")
+		}
+
+		return nil
+	}))
+
+	go p.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	host := sl.Addr().String()
+	raw := fmt.Sprintf("GET http://%s/ HTTP/1.1\r\n"+
+		"Host: %s\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Sec-WebSocket-Extensions: permessage-deflate\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n", host, host)
+
+	if _, err := conn.Write([]byte(raw)); err != nil {
+		t.Fatalf("conn.Write(headers): got %v, want no error", err)
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+
+	if got, want := res.StatusCode, 101; got != want {
+		t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+	}
+	if got := <-extc; got != "" {
+		t.Errorf("req.Header.Get(%q): got %q, want no extensions", "Sec-WebSocket-Extensions", got)
+	}
+
+	// A fragmented message is reassembled before it is modified.
+	frames := []*wsFrame{
+		{fin: true, opcode: WebSocketText, masked: true, mask: [4]byte{1, 2, 3, 4}, payload: []byte("drop")},
+		{fin: false, opcode: WebSocketText, masked: true, mask: [4]byte{5, 6, 7, 8}, payload: []byte("rew")},
+		{fin: true, opcode: wsContinuation, masked: true, mask: [4]byte{5, 6, 7, 8}, payload: []byte("rite")},
+	}
+	for _, f := range frames {
+		if err := f.write(conn); err != nil {
+			t.Fatalf("f.write(): got %v, want no error", err)
+		}
+	}
+
+	f, err := readWSFrame(br, DefaultWebSocketMaxFrameSize)
+	if err != nil {
+		t.Fatalf("readWSFrame(): got %v, want no error", err)
+	}
+
+	if got, want := string(f.payload), "rewritten"; got != want {
+		t.Errorf("f.payload: got %q, want %q", got, want)
+	}
+	if !f.fin {
+		t.Error("f.fin: got false, want true")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	want := []string{"true:drop", "true:rewrite", "false:rewritten"}
+	if got := strings.Join(seen, ","); got != strings.Join(want, ",") {
+		t.Errorf("seen: got %q, want %q", got, want)
+	}
+}
+
+func TestIntegrationWebSocketMessageTooBig(t *testing.T) {
+	t.Parallel()
+
+	sl, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+	defer sl.Close()
+
+	extc := make(chan string, 1)
+	go serveWebSocketEcho(sl, extc)
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	p.SetTimeout(2 * time.Second)
+	p.SetWebSocketMaxMessageSize(4)
+	p.SetWebSocketModifier(WebSocketModifierFunc(func(*WebSocketMessage) error {
+		return nil
+	}))
+
+	go p.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	host := sl.Addr().String()
+	raw := fmt.Sprintf("GET http://%s/ HTTP/1.1\r\n"+
+		"Host: %s\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n", host, host)
+
+	if _, err := conn.Write([]byte(raw)); err != nil {
+		t.Fatalf("conn.Write(headers): got %v, want no error", err)
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	if got, want := res.StatusCode, 101; got != want {
+		t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+	}
+	<-extc
+
+	// Each fragment fits, but the reassembled message does not.
+	frames := []*wsFrame{
+		{fin: false, opcode: WebSocketText, masked: true, payload: []byte("rew")},
+		{fin: true, opcode: wsContinuation, masked: true, payload: []byte("rite")},
+	}
+	for _, f := range frames {
+		if err := f.write(conn); err != nil {
+			t.Fatalf("f.write(): got %v, want no error", err)
+		}
+	}
+
+	f, err := readWSFrame(br, DefaultWebSocketMaxFrameSize)
+	if err != nil {
+		t.Fatalf("readWSFrame(): got %v, want no error", err)
+	}
+	if got, want := f.opcode, wsClose; got != want {
+		t.Fatalf("f.opcode: got %#x, want %#x", got, want)
+	}
+	if len(f.payload) < 2 {
+		t.Fatalf("len(f.payload): got %d, want at least 2", len(f.payload))
+	}
+	if got, want := binary.BigEndian.Uint16(f.payload), uint16(wsMessageTooBig); got != want {
+		t.Errorf("close status: got %d, want %d", got, want)
+	}
+
+	// The connection is closed after the close frame.
+	if _, err := readWSFrame(br, DefaultWebSocketMaxFrameSize); err == nil {
+		t.Error("readWSFrame(): got no error, want connection closed")
+	}
+}
+
+func TestIntegrationUpgradeWithoutModifier(t *testing.T) {
+	t.Parallel()
+
+	sl, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+	defer sl.Close()
+
+	extc := make(chan string, 1)
+	go serveWebSocketEcho(sl, extc)
+
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	p := NewProxy()
+	defer p.Close()
+
+	p.SetTimeout(2 * time.Second)
+
+	go p.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	host := sl.Addr().String()
+	raw := fmt.Sprintf("GET http://%s/ HTTP/1.1\r\n"+
+		"Host: %s\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Sec-WebSocket-Extensions: permessage-deflate\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n", host, host)
+
+	if _, err := conn.Write([]byte(raw)); err != nil {
+		t.Fatalf("conn.Write(headers): got %v, want no error", err)
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+
+	if got, want := res.StatusCode, 101; got != want {
+		t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+	}
+	if got, want := <-extc, "permessage-deflate"; got != want {
+		t.Errorf("req.Header.Get(%q): got %q, want %q", "Sec-WebSocket-Extensions", got, want)
+	}
+
+	f := &wsFrame{fin: true, opcode: WebSocketText, masked: true, payload: []byte("hello")}
+	if err := f.write(conn); err != nil {
+		t.Fatalf("f.write(): got %v, want no error", err)
+	}
+
+	f, err = readWSFrame(br, DefaultWebSocketMaxFrameSize)
+	if err != nil {
+		t.Fatalf("readWSFrame(): got %v, want no error", err)
+	}
+	if got, want := string(f.payload), "hello"; got != want {
+		t.Errorf("f.payload: got %q, want %q", got, want)
+	}
+}